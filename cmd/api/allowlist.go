@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+// Refuse requests to the KAMAR listener endpoint from sources outside the kamar_allowed_cidrs config value. An empty list lets every source through, as does learn mode, which records KAMAR's IP instead.
+func (app *application) requireAllowedKAMARSource(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg, err := app.listenerConfig()
+		if err != nil {
+			return app.serverErrorResponse(c, err)
+		}
+
+		if cfg.GetBool("kamar_allowlist_learn") {
+			return next(c)
+		}
+
+		value, _ := cfg.GetString("kamar_allowed_cidrs")
+		allowed, err := data.ParseCIDRList(value)
+		if err != nil {
+			// Only valid lists can be saved, so this means app.db was edited directly - fail closed rather than open
+			app.logger.PrintError(err, map[string]any{
+				"message": "couldn't parse kamar_allowed_cidrs",
+			})
+			return app.kamarSourceNotAllowedResponse(c)
+		}
+		if len(allowed) == 0 {
+			return next(c)
+		}
+
+		ip := net.ParseIP(c.RealIP())
+		for _, n := range allowed {
+			if ip != nil && n.Contains(ip) {
+				return next(c)
+			}
+		}
+
+		app.logger.PrintInfo("listener: request from outside the KAMAR allow-list refused", map[string]any{
+			"ip": c.RealIP(),
+		})
+		return app.kamarSourceNotAllowedResponse(c)
+	}
+}
+
+// In learn mode, add the source of a successful check request to the allow-list, so the list can be built from KAMAR's own requests
+func (app *application) learnKAMARSource(c echo.Context) {
+	cfg, err := app.listenerConfig()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+	if !cfg.GetBool("kamar_allowlist_learn") {
+		return
+	}
+
+	ip := net.ParseIP(c.RealIP())
+	if ip == nil {
+		return
+	}
+	value, _ := cfg.GetString("kamar_allowed_cidrs")
+	allowed, err := data.ParseCIDRList(value)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+	for _, n := range allowed {
+		if n.Contains(ip) {
+			return
+		}
+	}
+
+	// Only a new source is written, so fetch the full entry to keep its description
+	entry, err := app.models.Config.GetByKey("kamar_allowed_cidrs")
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	list := ip.String()
+	if strings.TrimSpace(entry.Value) != "" {
+		list = entry.Value + ", " + list
+	}
+	entry.Value = list
+
+	if err := app.models.Config.Set(entry); err != nil {
+		app.logger.PrintError(err, map[string]any{
+			"message": "couldn't add KAMAR source to allow-list",
+		})
+		return
+	}
+
+	app.logger.PrintInfo("listener: KAMAR source added to allow-list", map[string]any{
+		"ip":                  ip.String(),
+		"kamar_allowed_cidrs": list,
+	})
+}
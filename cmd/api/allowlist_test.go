@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+)
+
+func TestParseCIDRList(t *testing.T) {
+	nets, err := data.ParseCIDRList(" 10.0.0.5, 192.168.1.0/24,,2001:db8::1 ")
+	assert.NilError(t, err)
+	assert.Equal(t, len(nets), 3)
+	assert.Equal(t, nets[0].String(), "10.0.0.5/32")
+	assert.Equal(t, nets[1].String(), "192.168.1.0/24")
+	assert.Equal(t, nets[2].String(), "2001:db8::1/128")
+
+	for _, bad := range []string{"10.0.0", "10.0.0.0/33", "kamar.school.nz"} {
+		v := validator.New()
+		data.ValidateConfigUpdate(v, data.ConfigEntry{Key: "kamar_allowed_cidrs", Value: bad, Type: "string"})
+		assert.Equal(t, v.Valid(), false)
+	}
+}
+
+func TestKAMARAllowList(t *testing.T) {
+	appDB, _, err := openAppDB(filepath.Join(t.TempDir(), "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+
+	app := newTestApplication(t, appDB, nil)
+	app.userExists = true
+
+	set := func(key, value, valueType string) {
+		assert.NilError(t, app.models.Config.Set(data.ConfigEntry{Key: key, Value: value, Type: valueType}))
+	}
+
+	e := echo.New()
+	request := func(ip string) int {
+		req := httptest.NewRequest(http.MethodPost, "/kamar-listener", nil)
+		req.RemoteAddr = ip + ":40000"
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		err := app.requireAllowedKAMARSource(func(c echo.Context) error {
+			app.learnKAMARSource(c)
+			return c.NoContent(http.StatusOK)
+		})(c)
+		assert.NilError(t, err)
+		return rec.Code
+	}
+
+	// An empty list lets every source through
+	assert.Equal(t, request("203.0.113.7"), http.StatusOK)
+
+	set("kamar_allowed_cidrs", "10.1.0.0/24", "string")
+	assert.Equal(t, request("10.1.0.20"), http.StatusOK)
+	assert.Equal(t, request("203.0.113.7"), http.StatusForbidden)
+
+	events, err := app.models.ListenerEvents.GetAll()
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 1)
+	assert.StringContains(t, events[0].Message, "203.0.113.7")
+
+	// Learn mode lets every source through, and adds new ones to the list
+	set("kamar_allowlist_learn", "true", "bool")
+	assert.Equal(t, request("203.0.113.7"), http.StatusOK)
+	assert.Equal(t, request("10.1.0.20"), http.StatusOK)
+
+	entry, err := app.models.Config.GetByKey("kamar_allowed_cidrs")
+	assert.NilError(t, err)
+	assert.Equal(t, entry.Value, "10.1.0.0/24, 203.0.113.7")
+
+	set("kamar_allowlist_learn", "false", "bool")
+	assert.Equal(t, request("203.0.113.7"), http.StatusOK)
+	assert.Equal(t, request("198.51.100.1"), http.StatusForbidden)
+}
@@ -9,12 +9,14 @@ import (
 
 // Mutex to prevent race conditions, in case two routines try to write to appMetrics at the same time
 type appMetrics struct {
-	lastCheckTime  time.Time
-	lastInsertTime time.Time
-	mu             sync.RWMutex
-	recordsToday   int
-	totalRecords   int
-	countByType    map[string]int
+	lastCheckTime   time.Time
+	lastExportError string
+	lastExportTime  time.Time
+	lastInsertTime  time.Time
+	mu              sync.RWMutex
+	recordsToday    int
+	totalRecords    int
+	countByType     map[string]int
 }
 
 // With mutex active read and return the values for the listener service's last check time, last insert time, records inserted today, and total number of records
@@ -37,6 +39,25 @@ func (a *appMetrics) SetLastInsertTime(t time.Time) {
 	a.lastInsertTime = t
 }
 
+// Record the outcome of the most recent export run - a nil err clears any previous export error
+func (a *appMetrics) SetLastExport(t time.Time, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastExportTime = t
+	if err != nil {
+		a.lastExportError = err.Error()
+	} else {
+		a.lastExportError = ""
+	}
+}
+
+func (a *appMetrics) ExportSnapshot() (time.Time, string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.lastExportTime, a.lastExportError
+}
+
 func (a *appMetrics) SetRecords(today, total int, countByType map[string]int) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
@@ -179,7 +200,10 @@ func (app *application) initiateRecordCountUpdateCycle() {
 		for {
 			select {
 			case <-ticker.C:
-				err := app.UpdateRecordCountsFromDB()
+				var err error
+				app.withDatabases(func() {
+					err = app.UpdateRecordCountsFromDB()
+				})
 				if err != nil {
 					app.logger.PrintError(err, nil)
 				}
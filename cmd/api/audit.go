@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+	views "github.com/michaelcjefferson/kamar-listener/ui/views"
+)
+
+// Append an event to the audit trail. A failure to record it is logged rather than failing the request, as the action it describes has already happened.
+func (app *application) audit(c echo.Context, userID int64, action, target string) {
+	app.auditFrom(c.RealIP(), userID, action, target)
+}
+
+// Append an event for work that finishes after its request has returned, once the echo.Context can no longer be used
+func (app *application) auditFrom(ip string, userID int64, action, target string) {
+	event := &data.AuditEvent{
+		UserID: userID,
+		Action: action,
+		Target: target,
+		IP:     ip,
+	}
+
+	if err := app.models.Audit.Insert(event); err != nil {
+		app.logger.PrintError(err, map[string]any{
+			"message": "error recording audit event",
+			"action":  action,
+			"target":  target,
+			"user_id": userID,
+		})
+	}
+}
+
+func (app *application) getAuditPageHandler(c echo.Context) error {
+	user := app.contextGetUser(c)
+
+	filters := data.Filters{
+		AuditFilters: data.AuditFilters{
+			Target: c.QueryParam("target"),
+		},
+		Page:         1,
+		PageSize:     25,
+		Sort:         "-id",
+		SortSafeList: []string{"id", "-id"},
+	}
+
+	// The filter form sends an empty value for "all"
+	for _, val := range c.QueryParams()["action"] {
+		if val != "" {
+			filters.AuditFilters.Action = append(filters.AuditFilters.Action, val)
+		}
+	}
+	if uids := c.QueryParams()["user_id"]; len(uids) != 0 {
+		for _, val := range uids {
+			if val == "" {
+				continue
+			}
+			u, err := strconv.Atoi(val)
+			if err != nil {
+				return app.badRequestResponse(c, err)
+			}
+			filters.AuditFilters.UserID = append(filters.AuditFilters.UserID, u)
+		}
+	}
+
+	if p := c.QueryParam("page"); p != "" {
+		p, err := strconv.Atoi(p)
+		if err != nil {
+			return app.badRequestResponse(c, err)
+		}
+		filters.Page = p
+	}
+
+	v := validator.New()
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	events, metadata, err := app.models.Audit.GetAll(filters)
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	verification, err := app.models.Audit.Verify()
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	users, err := app.models.Users.GetAll()
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	return app.Render(c, http.StatusOK, views.AuditPage(user, events, metadata, filters, verification, users))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+func TestAuditTrail(t *testing.T) {
+	appDB, _, err := openAppDB(filepath.Join(t.TempDir(), "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+
+	app := newTestApplication(t, appDB, nil)
+
+	e := echo.New()
+	newContext := func(u *data.User) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodGet, "/audit", nil)
+		req.Header.Set(echo.HeaderXRealIP, "10.0.0.5")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		app.contextSetUser(c, u)
+		return c, rec
+	}
+
+	admin := &data.User{ID: 1, Username: "admin", Role: data.RoleAdmin}
+	staff := &data.User{ID: 2, Username: "staff", Role: data.RoleOperator}
+
+	c, _ := newContext(admin)
+	app.audit(c, admin.ID, data.AuditConfigUpdate, "export_enabled=true")
+	app.audit(c, admin.ID, data.AuditLogsDelete, "log 12")
+
+	events, _, err := app.models.Audit.GetAll(data.Filters{
+		AuditFilters: data.AuditFilters{Action: []string{data.AuditLogsDelete}},
+		Page:         1,
+		PageSize:     10,
+		Sort:         "-id",
+		SortSafeList: []string{"-id"},
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].Target, "log 12")
+	assert.Equal(t, events[0].IP, "10.0.0.5")
+
+	verification, err := app.models.Audit.Verify()
+	assert.NilError(t, err)
+	assert.Equal(t, verification.Intact(), true)
+	assert.Equal(t, verification.Checked, 2)
+
+	// Events can't be changed or removed through SQL
+	_, err = appDB.Exec(`UPDATE audit_events SET target = 'log 13' WHERE id = 2;`)
+	assert.Equal(t, err != nil, true)
+	_, err = appDB.Exec(`DELETE FROM audit_events WHERE id = 1;`)
+	assert.Equal(t, err != nil, true)
+
+	// and doing so around the triggers is detected
+	_, err = appDB.Exec(`DROP TRIGGER audit_events_no_update;`)
+	assert.NilError(t, err)
+	_, err = appDB.Exec(`UPDATE audit_events SET user_id = 2 WHERE id = 1;`)
+	assert.NilError(t, err)
+
+	verification, err = app.models.Audit.Verify()
+	assert.NilError(t, err)
+	assert.Equal(t, verification.BrokenAt, int64(1))
+
+	// Only admins can see the audit page
+	next := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	requireAudit := app.requirePermission(data.PermissionAudit)
+
+	c, rec := newContext(staff)
+	assert.NilError(t, requireAudit(next)(c))
+	assert.Equal(t, rec.Code, http.StatusForbidden)
+
+	c, rec = newContext(admin)
+	assert.NilError(t, requireAudit(next)(c))
+	assert.Equal(t, rec.Code, http.StatusOK)
+}
+
+func TestAuditConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.db")
+
+	// Two handles on the same file share no memory, as if a second process were writing to app.db
+	var audits []data.AuditModel
+	for range 2 {
+		appDB, _, err := openAppDB(path)
+		assert.NilError(t, err)
+		defer appDB.Close()
+		audits = append(audits, data.AuditModel{DB: appDB})
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for i := range 200 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- audits[i%2].Insert(&data.AuditEvent{UserID: 1, Action: data.AuditConfigUpdate, Target: "concurrent"})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NilError(t, err)
+	}
+
+	v, err := audits[0].Verify()
+	assert.NilError(t, err)
+	assert.Equal(t, v.Checked, 200)
+	assert.Equal(t, v.Intact(), true)
+}
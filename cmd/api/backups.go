@@ -0,0 +1,541 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/ui/views"
+)
+
+const (
+	// Backups are folders in the backups directory named after the UTC time they were taken
+	backupNameLayout = "20060102T150405Z"
+	backupInterval   = 24 * time.Hour
+
+	defaultBackupKeepDaily   = 7
+	defaultBackupKeepWeekly  = 4
+	defaultBackupKeepMonthly = 6
+)
+
+var (
+	errBackupInProgress = errors.New("a backup or restore is already running - wait for it to finish and try again")
+	errBackupNotFound   = errors.New("backup not found")
+)
+
+// Hold app.dbMu for reading for the duration of every request, so that a restore waits for requests already using the databases to finish, and requests that arrive during a restore (including KAMAR's) wait until the databases have been reopened
+func (app *application) holdDatabases(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		app.dbMu.RLock()
+		defer app.dbMu.RUnlock()
+
+		return next(c)
+	}
+}
+
+// Run fn while holding app.dbMu for reading, for background jobs that use models outside of a request
+func (app *application) withDatabases(fn func()) {
+	app.dbMu.RLock()
+	defer app.dbMu.RUnlock()
+
+	fn()
+}
+
+func (app *application) closeDatabases() {
+	app.models.Users.DB.Close()
+	app.models.Exports.DB.Close()
+}
+
+// Create a consistent copy of the app database, and the listener database if it is stored in SQLite, in a new folder in the backups directory. VACUUM INTO reads from a single transaction, so unlike copying the files it is safe while KAMAR is writing, and includes anything still in the WAL. The caller must hold app.backupMu, and app.dbMu for reading.
+func (app *application) createBackup() (data.Backup, error) {
+	name := time.Now().UTC().Format(backupNameLayout)
+	dir := filepath.Join(app.config.backupDir, name)
+
+	// Write to a hidden folder first, so a backup that fails part way is never listed or restored
+	tmp := filepath.Join(app.config.backupDir, "."+name+".tmp")
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return data.Backup{}, err
+	}
+	defer os.RemoveAll(tmp)
+
+	_, err := app.models.Users.DB.Exec(`VACUUM INTO $1;`, filepath.Join(tmp, "app.db"))
+	if err != nil {
+		return data.Backup{}, fmt.Errorf("couldn't back up app database: %w", err)
+	}
+
+	if app.models.Exports.DB.Dialect == data.DialectSQLite {
+		_, err = app.models.Exports.DB.Exec(`VACUUM INTO $1;`, filepath.Join(tmp, "listener.db"))
+		if err != nil {
+			return data.Backup{}, fmt.Errorf("couldn't back up listener database: %w", err)
+		}
+	}
+
+	if err := os.Rename(tmp, dir); err != nil {
+		return data.Backup{}, err
+	}
+
+	return readBackup(app.config.backupDir, name)
+}
+
+// List the backups in dir, newest first
+func listBackups(dir string) ([]data.Backup, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []data.Backup
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(backupNameLayout, entry.Name()); err != nil {
+			continue
+		}
+
+		b, err := readBackup(dir, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, b)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].TakenAt.After(backups[j].TakenAt)
+	})
+
+	return backups, nil
+}
+
+func readBackup(dir, name string) (data.Backup, error) {
+	takenAt, err := time.Parse(backupNameLayout, name)
+	if err != nil {
+		return data.Backup{}, errBackupNotFound
+	}
+
+	b := data.Backup{Name: name, TakenAt: takenAt}
+	for _, file := range []string{"app.db", "listener.db"} {
+		info, err := os.Stat(filepath.Join(dir, name, file))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return data.Backup{}, err
+		}
+		b.Files = append(b.Files, file)
+		b.Size += info.Size()
+	}
+	if len(b.Files) == 0 {
+		return data.Backup{}, errBackupNotFound
+	}
+
+	return b, nil
+}
+
+// Choose which backups to keep: the newest backup from each of the last daily days, weekly ISO weeks and monthly months that have a backup. The newest backup is always kept. backups must be sorted newest first.
+func backupsToKeep(backups []data.Backup, daily, weekly, monthly int) map[string]bool {
+	keep := make(map[string]bool)
+	if len(backups) == 0 {
+		return keep
+	}
+	keep[backups[0].Name] = true
+
+	periods := []struct {
+		n   int
+		key func(t time.Time) string
+	}{
+		{daily, func(t time.Time) string { return t.Format(time.DateOnly) }},
+		{weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+
+	for _, period := range periods {
+		seen := make(map[string]bool)
+		for _, b := range backups {
+			if len(seen) >= period.n {
+				break
+			}
+			// Days, weeks and months start at midnight where the school is, not in UTC
+			key := period.key(b.TakenAt.Local())
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			keep[b.Name] = true
+		}
+	}
+
+	return keep
+}
+
+// Delete backups that are no longer needed under the configured daily, weekly and monthly retention
+func (app *application) pruneBackups(cfg *data.ListenerConfig) error {
+	daily, weekly, monthly := defaultBackupKeepDaily, defaultBackupKeepWeekly, defaultBackupKeepMonthly
+	if n, ok := cfg.GetInt("backup_keep_daily"); ok && n >= 0 {
+		daily = n
+	}
+	if n, ok := cfg.GetInt("backup_keep_weekly"); ok && n >= 0 {
+		weekly = n
+	}
+	if n, ok := cfg.GetInt("backup_keep_monthly"); ok && n >= 0 {
+		monthly = n
+	}
+
+	backups, err := listBackups(app.config.backupDir)
+	if err != nil {
+		return err
+	}
+
+	keep := backupsToKeep(backups, daily, weekly, monthly)
+
+	var errs []error
+	for _, b := range backups {
+		if keep[b.Name] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(app.config.backupDir, b.Name)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		app.logger.PrintInfo("old backup deleted", map[string]any{
+			"backup": b.Name,
+		})
+	}
+
+	return errors.Join(errs...)
+}
+
+// Take a backup if backups are enabled and a day has passed since the last one, then apply the retention rules
+func (app *application) runScheduledBackup() {
+	var cfg *data.ListenerConfig
+	var err error
+	app.withDatabases(func() {
+		cfg, err = app.listenerConfig()
+	})
+	if err != nil {
+		app.logger.PrintError(err, map[string]any{
+			"message": "couldn't load config for scheduled backup",
+		})
+		return
+	}
+
+	if !cfg.GetBool("backup_enabled") {
+		return
+	}
+
+	backups, err := listBackups(app.config.backupDir)
+	if err != nil {
+		app.logger.PrintError(err, map[string]any{
+			"message": "couldn't list backups",
+		})
+		return
+	}
+	if len(backups) > 0 && time.Since(backups[0].TakenAt) < backupInterval {
+		return
+	}
+
+	if !app.backupMu.TryLock() {
+		return
+	}
+	defer app.backupMu.Unlock()
+
+	var b data.Backup
+	app.withDatabases(func() {
+		b, err = app.createBackup()
+	})
+	if err != nil {
+		app.logger.PrintError(err, map[string]any{
+			"message": "scheduled backup failed",
+		})
+		return
+	}
+
+	app.logger.PrintInfo("scheduled backup complete", map[string]any{
+		"backup": b.Name,
+		"size":   b.Size,
+	})
+
+	if err := app.pruneBackups(cfg); err != nil {
+		app.logger.PrintError(err, map[string]any{
+			"message": "couldn't delete old backups",
+		})
+	}
+}
+
+// Once per minute, check whether a scheduled backup is due, so that a listener that is only running for part of each day still gets a daily backup
+func (app *application) initiateBackupCycle() {
+	app.background(func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				app.runScheduledBackup()
+			case <-app.isShuttingDown:
+				app.logger.PrintInfo("backup cycle ending - shut down signal received", nil)
+				return
+			}
+		}
+	})
+}
+
+// Replace the databases with the copies in backup. A backup of the current databases is taken first, so a restore can itself be undone. While the files are swapped, app.dbMu is held, so ingestion from KAMAR and every other request waits until the databases have been reopened. The restore is recorded in the audit trail as made by userID from ip. The caller must hold app.backupMu.
+func (app *application) restoreBackup(name string, userID int64, ip string) error {
+	b, err := readBackup(app.config.backupDir, name)
+	if err != nil {
+		return err
+	}
+
+	var undo data.Backup
+	app.withDatabases(func() {
+		undo, err = app.createBackup()
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't back up current databases before restoring: %w", err)
+	}
+	app.logger.PrintInfo("current databases backed up before restore", map[string]any{
+		"backup": undo.Name,
+	})
+
+	app.dbMu.Lock()
+	err = app.swapDatabases(b)
+	app.dbMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	app.withDatabases(func() {
+		app.auditFrom(ip, userID, data.AuditBackupRestore, fmt.Sprintf("backup %s (previous databases backed up to %s)", b.Name, undo.Name))
+		app.afterRestore()
+	})
+
+	return nil
+}
+
+// Close the databases, copy the backup's files over them and reopen them. The caller must hold app.dbMu for writing.
+func (app *application) swapDatabases(b data.Backup) error {
+	restoreListener := app.models.Exports.DB.Dialect == data.DialectSQLite && b.HasFile("listener.db")
+
+	// The audit trail isn't rolled back by a restore - whatever was recorded after the backup was taken is carried into the restored app.db
+	trail, err := app.models.Audit.Since(0)
+	if err != nil {
+		return fmt.Errorf("couldn't read audit trail: %w", err)
+	}
+	// Neither are erasures - the restored listener database is erased again in afterRestore
+	tombstones, err := app.models.Erasures.Tombstones()
+	if err != nil {
+		return fmt.Errorf("couldn't read erasures: %w", err)
+	}
+
+	app.models.Users.DB.Close()
+	if restoreListener {
+		app.models.Exports.DB.Close()
+	}
+
+	var errs []error
+	if err := replaceDBFile(filepath.Join(app.config.backupDir, b.Name, "app.db"), app.config.dbPaths.appDB); err != nil {
+		errs = append(errs, fmt.Errorf("couldn't restore app database: %w", err))
+	}
+	if restoreListener {
+		if err := replaceDBFile(filepath.Join(app.config.backupDir, b.Name, "listener.db"), app.config.dbPaths.listenerDB); err != nil {
+			errs = append(errs, fmt.Errorf("couldn't restore listener database: %w", err))
+		}
+	}
+
+	// Reopen the databases even if a file couldn't be replaced, so the listener keeps running on whatever is on disk
+	appDB, userExists, err := openAppDB(app.config.dbPaths.appDB)
+	if err != nil {
+		return errors.Join(append(errs, fmt.Errorf("couldn't reopen app database: %w", err))...)
+	}
+
+	listenerDB := app.models.Exports.DB
+	if restoreListener {
+		listenerDB, err = openListenerDB(app.config)
+		if err != nil {
+			appDB.Close()
+			return errors.Join(append(errs, fmt.Errorf("couldn't reopen listener database: %w", err))...)
+		}
+		listenerDB.Cipher = app.models.Exports.DB.Cipher
+	}
+
+	app.models = data.NewModels(appDB, listenerDB, app.background)
+	if _, err := app.models.Audit.Carry(trail); err != nil {
+		errs = append(errs, fmt.Errorf("couldn't carry audit trail into restored app database: %w", err))
+	}
+	if err := app.models.Erasures.Merge(tombstones); err != nil {
+		errs = append(errs, fmt.Errorf("couldn't merge erasures into restored app database: %w", err))
+	}
+	// The restored config wasn't changed through ConfigModel.Set, so the cached copy has to be dropped here
+	app.configs.invalidate()
+	app.userExists = userExists
+
+	if app.config.dblogs_on {
+		logs := app.models.Logs
+		app.logger.SetLogModel(&logs)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Copy src over dst by way of a temporary file, and remove dst's WAL and shared memory files, which belong to the database being replaced
+func replaceDBFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	err = writeFileAtomic(dst, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(dst + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Bring everything held in memory back in line with the restored databases
+func (app *application) afterRestore() {
+	var err error
+	app.config.kamar_auth_set, err = app.kamarAuthIsSet()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+
+	// The backup may hold students that have since been erased
+	if err := app.eraseRestoredStudents(); err != nil {
+		app.logger.PrintError(err, map[string]any{
+			"message": "couldn't erase students from restored listener database",
+		})
+	}
+
+	if err := app.UpdateRecordCountsFromDB(); err != nil {
+		app.logger.PrintError(err, nil)
+	}
+	if err := app.UpdateCheckInsertTimesFromDB(); err != nil {
+		app.logger.PrintError(err, nil)
+	}
+
+	// Sinks now hold data newer than the listener database, so restart replication from the restored sink list and copy everything to them again
+	app.replication.mu.Lock()
+	ids := make([]int, 0, len(app.replication.workers))
+	for id := range app.replication.workers {
+		ids = append(ids, id)
+	}
+	app.replication.mu.Unlock()
+	for _, id := range ids {
+		app.stopSinkWorker(id)
+	}
+
+	if err := app.startReplication(); err != nil {
+		app.logger.PrintError(err, map[string]any{
+			"message": "couldn't restart replication after restore",
+		})
+		return
+	}
+
+	app.resyncAllSinks()
+}
+
+func (app *application) getBackupsPageHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+
+	backups, err := listBackups(app.config.backupDir)
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	cfg, err := app.listenerConfig()
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	return app.Render(c, http.StatusOK, views.BackupsPage(u, backups, cfg.GetBool("backup_enabled"), app.config.backupDir, app.models.Exports.DB.Dialect == data.DialectPostgres))
+}
+
+// Take a backup now, independent of the backup schedule
+func (app *application) createBackupHandler(c echo.Context) error {
+	user := app.contextGetUser(c)
+
+	if !app.backupMu.TryLock() {
+		return app.errorResponse(c, http.StatusConflict, errBackupInProgress.Error())
+	}
+	defer app.backupMu.Unlock()
+
+	b, err := app.createBackup()
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	app.logger.PrintInfo("backup complete", map[string]any{
+		"backup":  b.Name,
+		"size":    b.Size,
+		"user_id": user.ID,
+	})
+	app.audit(c, user.ID, data.AuditBackupCreate, "backup "+b.Name)
+
+	return c.JSON(http.StatusCreated, envelope{"success": true, "backup": b})
+}
+
+// Restore a backup in the background - the restore waits for this request to finish before swapping the databases, and the page reloads once it is done
+func (app *application) restoreBackupHandler(c echo.Context) error {
+	user := app.contextGetUser(c)
+	// The echo.Context is reused once this handler returns, so the address is read before the restore starts
+	ip := c.RealIP()
+
+	name := c.Param("name")
+	if _, err := readBackup(app.config.backupDir, name); err != nil {
+		if errors.Is(err, errBackupNotFound) {
+			return app.notFoundResponse(c)
+		}
+		return app.serverErrorResponse(c, err)
+	}
+
+	if !app.backupMu.TryLock() {
+		return app.errorResponse(c, http.StatusConflict, errBackupInProgress.Error())
+	}
+
+	app.background(func() {
+		defer app.backupMu.Unlock()
+
+		app.logger.PrintInfo("restoring backup", map[string]any{
+			"backup":  name,
+			"user_id": user.ID,
+		})
+
+		if err := app.restoreBackup(name, user.ID, ip); err != nil {
+			app.logger.PrintError(err, map[string]any{
+				"message": "restore failed",
+				"backup":  name,
+				"user_id": user.ID,
+			})
+			return
+		}
+
+		app.logger.PrintInfo("backup restored", map[string]any{
+			"backup":  name,
+			"user_id": user.ID,
+		})
+	})
+
+	return c.JSON(http.StatusAccepted, envelope{"success": true, "message": "Restore started."})
+}
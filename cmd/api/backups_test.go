@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+func TestBackupsToKeep(t *testing.T) {
+	// One backup a day for 90 days, ending on a Wednesday
+	end := time.Date(2025, time.March, 12, 2, 0, 0, 0, time.Local)
+	var backups []data.Backup
+	for i := 0; i < 90; i++ {
+		taken := end.AddDate(0, 0, -i)
+		backups = append(backups, data.Backup{Name: taken.UTC().Format(backupNameLayout), TakenAt: taken.UTC()})
+	}
+
+	keep := backupsToKeep(backups, 7, 4, 3)
+
+	// The last 7 days (which include the newest of the previous week), plus the newest of the 2 weeks before that, plus the newest of the 2 months before this one
+	assert.Equal(t, len(keep), 11)
+	for i := 0; i < 7; i++ {
+		assert.Equal(t, keep[backups[i].Name], true)
+	}
+	// The Sunday ending the ISO week before last
+	assert.Equal(t, keep[end.AddDate(0, 0, -10).UTC().Format(backupNameLayout)], true)
+	// The last day of February and January
+	assert.Equal(t, keep[time.Date(2025, time.February, 28, 2, 0, 0, 0, time.Local).UTC().Format(backupNameLayout)], true)
+	assert.Equal(t, keep[time.Date(2025, time.January, 31, 2, 0, 0, 0, time.Local).UTC().Format(backupNameLayout)], true)
+	assert.Equal(t, keep[backups[89].Name], false)
+
+	// The newest backup is kept even when retention is turned all the way down
+	keep = backupsToKeep(backups, 0, 0, 0)
+	assert.Equal(t, len(keep), 1)
+	assert.Equal(t, keep[backups[0].Name], true)
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	dir := t.TempDir()
+
+	appDB, _, err := openAppDB(filepath.Join(dir, "app.db"))
+	assert.NilError(t, err)
+	listenerDB := newTestListenerDB(t, dir)
+
+	// Restoring reopens the databases from these paths
+	app := newTestApplication(t, appDB, listenerDB)
+	app.config.backupDir = filepath.Join(dir, "backups")
+	app.config.dbPaths.appDB = filepath.Join(dir, "app.db")
+	app.config.dbPaths.listenerDB = filepath.Join(dir, "listener.db")
+	app.config.listenerStore.driver = string(data.DialectSQLite)
+	assert.NilError(t, os.MkdirAll(app.config.backupDir, 0755))
+	defer app.closeDatabases()
+
+	id, name, level := "11MAT", "Mathematics", 1
+	assert.NilError(t, app.models.Subjects.InsertManySubjects([]data.Subject{{ID: &id, Name: &name, Level: &level}}))
+	app.auditFrom("192.0.2.1", 1, data.AuditConfigUpdate, "backup_enabled=true")
+
+	b, err := app.createBackup()
+	assert.NilError(t, err)
+	assert.Equal(t, len(b.Files), 2)
+
+	// Anything received after the backup must be gone once it is restored
+	id2, name2, level2 := "12ENG", "English", 2
+	assert.NilError(t, app.models.Subjects.InsertManySubjects([]data.Subject{{ID: &id2, Name: &name2, Level: &level2}}))
+	// ...but not anything recorded in the audit trail
+	app.auditFrom("192.0.2.1", 1, data.AuditStudentErase, "erasure 1 (REF-1)")
+
+	// Backups are named to the second, so make sure the backup taken before restoring doesn't replace this one
+	time.Sleep(time.Second)
+
+	assert.NilError(t, app.restoreBackup(b.Name, 1, "192.0.2.1"))
+	app.wg.Wait()
+
+	// The old connections are closed and models use the reopened databases
+	if err := listenerDB.Ping(); err == nil {
+		t.Errorf("expected the replaced listener database connection to be closed")
+	}
+	_, total, err := app.models.Subjects.GetSubjectsCount()
+	assert.NilError(t, err)
+	assert.Equal(t, total, 1)
+
+	// The event recorded after the backup is carried into the restored trail, followed by the restore itself
+	events, err := app.models.Audit.Since(0)
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 3)
+	assert.Equal(t, events[1].Action, data.AuditStudentErase)
+	assert.Equal(t, events[2].Action, data.AuditBackupRestore)
+	assert.Equal(t, events[2].IP, "192.0.2.1")
+	verification, err := app.models.Audit.Verify()
+	assert.NilError(t, err)
+	assert.Equal(t, verification.Intact(), true)
+	assert.Equal(t, verification.Checked, 3)
+
+	// The state before the restore was backed up too
+	backups, err := listBackups(app.config.backupDir)
+	assert.NilError(t, err)
+	assert.Equal(t, len(backups), 2)
+}
+
+func TestRestoreKeepsErasures(t *testing.T) {
+	dir := t.TempDir()
+
+	appDB, _, err := openAppDB(filepath.Join(dir, "app.db"))
+	assert.NilError(t, err)
+	listenerDB := newTestListenerDB(t, dir)
+
+	app := newTestApplication(t, appDB, listenerDB)
+	app.config.backupDir = filepath.Join(dir, "backups")
+	app.config.dbPaths.appDB = filepath.Join(dir, "app.db")
+	app.config.dbPaths.listenerDB = filepath.Join(dir, "listener.db")
+	app.config.listenerStore.driver = string(data.DialectSQLite)
+	assert.NilError(t, os.MkdirAll(app.config.backupDir, 0755))
+	defer app.closeDatabases()
+
+	id, otherID, uuid, otherUUID := 1234, 5678, "uuid-1", "uuid-2"
+	assert.NilError(t, app.models.Students.InsertManyStudents([]data.Student{{ID: &id, UUID: &uuid}, {ID: &otherID, UUID: &otherUUID}}))
+
+	b, err := app.createBackup()
+	assert.NilError(t, err)
+
+	// The student is erased after the backup was taken, so the backup still holds them
+	_, err = app.eraseStudent(id, &data.Erasure{ErasedBy: 1, Reference: "PA-2025-01"})
+	assert.NilError(t, err)
+
+	time.Sleep(time.Second)
+
+	assert.NilError(t, app.restoreBackup(b.Name, 1, "192.0.2.1"))
+	app.wg.Wait()
+
+	tables, err := app.models.Exports.GetExportableTables()
+	assert.NilError(t, err)
+	record, err := app.models.SubjectAccess.Collect(id, tables)
+	assert.NilError(t, err)
+	assert.Equal(t, len(record.Tables), 0)
+	record, err = app.models.SubjectAccess.Collect(otherID, tables)
+	assert.NilError(t, err)
+	assert.Equal(t, len(record.Tables), 1)
+
+	erasures, err := app.models.Erasures.GetAll()
+	assert.NilError(t, err)
+	assert.Equal(t, len(erasures), 1)
+	assert.Equal(t, erasures[0].Reference, "PA-2025-01")
+	assert.Equal(t, erasures[0].RowsDeleted, int64(1))
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/getip"
+	"github.com/michaelcjefferson/kamar-listener/internal/tlscerts"
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+)
+
+// Download the built-in CA's certificate, for IT to add to the trust store of machines that use the admin UI. It is the same PEM file the listener signs with, minus the key, and Windows accepts it as a .crt.
+func (app *application) downloadCAHandler(c echo.Context) error {
+	path := filepath.Join(app.config.tlsPaths.tlsDir, tlscerts.CAFile)
+
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return app.notFoundResponse(c)
+		}
+		return app.serverErrorResponse(c, err)
+	}
+
+	return c.Attachment(path, "kamar-listener-ca.crt")
+}
+
+// Certificates are replaced this long before they expire
+const certRenewBefore = 30 * 24 * time.Hour
+
+// The dashboard warns this long before the certificate being served expires - generated certificates are replaced before then, so this is for uploaded ones
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// certStore holds the certificate the listener's HTTPS servers present, through tls.Config.GetCertificate, so a new one can be swapped in without restarting them
+type certStore struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func (s *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.cert == nil {
+		return nil, errors.New("no TLS certificate loaded")
+	}
+	return s.cert, nil
+}
+
+func (s *certStore) set(cert *tls.Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cert = cert
+}
+
+// The certificate being served, or nil if none has been loaded
+func (s *certStore) leaf() *x509.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.cert == nil {
+		return nil
+	}
+	return s.cert.Leaf
+}
+
+func (app *application) localIP() string {
+	ip, _ := app.ip.Load().(string)
+	return ip
+}
+
+// Create a certificate for localhost and ip in the TLS directory, if there isn't one there already
+func (app *application) generateCertificate(ip string) error {
+	err := tlscerts.GenerateTLSCert(app.config.tlsPaths.tlsDir, ip, app.logger)
+	// mkcert has to be downloaded from GitHub, which offline and locked down machines can't do, so create the certificate with the built-in CA instead
+	if err != nil {
+		app.logger.PrintError(err, map[string]any{
+			"message": "couldn't generate TLS certificate with mkcert - using the built-in certificate authority instead",
+		})
+		return tlscerts.GenerateSelfSignedCert(app.config.tlsPaths.tlsDir, ip, app.logger)
+	}
+	return nil
+}
+
+// Read the certificate and key from the TLS directory, and start serving them
+func (app *application) loadCertificate() error {
+	cert, err := tls.LoadX509KeyPair(app.config.tlsPaths.cert, app.config.tlsPaths.key)
+	if err != nil {
+		return fmt.Errorf("couldn't load TLS certificate: %w", err)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("couldn't load TLS certificate: %w", err)
+		}
+	}
+
+	app.certs.set(&cert)
+	return nil
+}
+
+// Replace the certificate with a new one for ip, and start serving it. The old certificate is put back if a new one can't be made.
+func (app *application) regenerateCertificate(ip string) error {
+	paths := []string{app.config.tlsPaths.cert, app.config.tlsPaths.key}
+	for _, path := range paths {
+		if err := os.Rename(path, path+".old"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	err := app.generateCertificate(ip)
+	if err == nil {
+		err = app.loadCertificate()
+	}
+	if err != nil {
+		for _, path := range paths {
+			os.Rename(path+".old", path)
+		}
+		return err
+	}
+
+	for _, path := range paths {
+		os.Remove(path + ".old")
+	}
+	return nil
+}
+
+// Why the certificate needs replacing, or "" if it still suits the host: certIP is the IP recorded when the certificate was last checked, and ip is the host's IP now
+func certificateRenewalReason(leaf *x509.Certificate, certIP, ip string, now time.Time) string {
+	switch {
+	case leaf == nil:
+		return "no certificate loaded"
+	case ip != "" && certIP != "" && certIP != ip:
+		return fmt.Sprintf("ip address changed from %s", certIP)
+	case ip != "" && leaf.VerifyHostname(ip) != nil:
+		return "certificate doesn't include the ip address"
+	case now.Add(certRenewBefore).After(leaf.NotAfter):
+		return fmt.Sprintf("certificate expires %s", leaf.NotAfter.Format(time.DateOnly))
+	default:
+		return ""
+	}
+}
+
+// Compare the host's IP, and the date, with the certificate being served, and replace it if KAMAR would no longer accept it. The IP and the certificate's SANs are recorded in config, so a change is noticed across restarts.
+func (app *application) checkCertificate() {
+	ip, err := getip.GetLocalIP()
+	if err != nil {
+		app.logger.PrintError(err, map[string]any{
+			"message": "couldn't get ip address - keeping the current one",
+		})
+		ip = app.localIP()
+	}
+	if old := app.localIP(); ip != old {
+		app.logger.PrintInfo("ip address changed", map[string]any{
+			"old_ip_address": old,
+			"ip_address":     ip,
+		})
+		app.ip.Store(ip)
+	}
+
+	var certIP, source data.ConfigEntry
+	app.withDatabases(func() {
+		certIP, err = app.models.Config.GetByKey("tls_cert_ip")
+		if err == nil {
+			source, err = app.models.Config.GetByKey("tls_cert_source")
+		}
+	})
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	reason := certificateRenewalReason(app.certs.leaf(), certIP.Value, ip, time.Now())
+	// Uploaded certificates are the school's to replace - the listener only warns about them, on the dashboard and here
+	if reason != "" && source.Value == "uploaded" && app.certs.leaf() != nil {
+		app.logger.PrintInfo("uploaded TLS certificate needs replacing", map[string]any{
+			"reason":     reason,
+			"ip_address": ip,
+		})
+	} else if reason != "" {
+		app.logger.PrintInfo("regenerating TLS certificate", map[string]any{
+			"reason":     reason,
+			"ip_address": ip,
+		})
+		if err := app.regenerateCertificate(ip); err != nil {
+			app.logger.PrintError(err, map[string]any{
+				"message": "couldn't regenerate TLS certificate - still serving the old one",
+			})
+			return
+		}
+		app.logger.PrintInfo("new TLS certificate is being served", map[string]any{
+			"expiry": app.certs.leaf().NotAfter,
+		})
+	}
+
+	app.withDatabases(func() {
+		app.recordCertificate(ip)
+	})
+}
+
+// Record the IP and SANs of the certificate being served in config, so they can be seen on the config page and compared on the next check. The caller must hold app.dbMu for reading - requests already do, through holdDatabases, and RWMutex read locks can't be taken twice without risking deadlock with a restore waiting to write.
+func (app *application) recordCertificate(ip string) {
+	leaf := app.certs.leaf()
+	if leaf == nil {
+		return
+	}
+
+	sans := slices.Clone(leaf.DNSNames)
+	for _, san := range leaf.IPAddresses {
+		sans = append(sans, san.String())
+	}
+
+	values := map[string]string{
+		"tls_cert_ip":   ip,
+		"tls_cert_sans": strings.Join(sans, ", "),
+	}
+
+	for key, value := range values {
+		entry, err := app.models.Config.GetByKey(key)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			continue
+		}
+		if entry.Value == value {
+			continue
+		}
+		entry.Value = value
+		if err := app.models.Config.Set(entry); err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
+
+// Check the certificate every hour, so a new IP from DHCP or an approaching expiry doesn't stop KAMAR connecting
+func (app *application) initiateCertificateCheckCycle() {
+	app.background(func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				app.checkCertificate()
+			case <-app.isShuttingDown:
+				app.logger.PrintInfo("certificate check cycle ending - shut down signal received", nil)
+				return
+			}
+		}
+	})
+}
+
+// Replace the listener's certificate with one from the school's own PKI, uploaded as a PEM certificate chain and key. They are checked before anything is replaced, and the certificate is served straight away. Problems that won't stop it working, such as a SAN that doesn't match this machine, are returned as warnings.
+func (app *application) uploadCertificateHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+
+	v := validator.New()
+	certPEM := readUploadedFile(c, v, "cert")
+	keyPEM := readUploadedFile(c, v, "key")
+	if !v.Valid() {
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		v.AddError("key", fmt.Sprintf("must be the PEM private key for the certificate: %v", err))
+		return app.failedValidationResponse(c, v.Errors)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		v.AddError("cert", fmt.Sprintf("must be a PEM certificate: %v", err))
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	now := time.Now()
+	leaf := cert.Leaf
+	v.Check(now.Before(leaf.NotAfter), "cert", fmt.Sprintf("expired on %s", leaf.NotAfter.Format(time.DateOnly)))
+	v.Check(now.After(leaf.NotBefore), "cert", fmt.Sprintf("isn't valid until %s", leaf.NotBefore.Format(time.DateOnly)))
+	v.Check(len(leaf.ExtKeyUsage) == 0 || slices.Contains(leaf.ExtKeyUsage, x509.ExtKeyUsageServerAuth), "cert", "isn't for use by servers")
+	if !v.Valid() {
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	ip := app.localIP()
+	hostname, _ := os.Hostname()
+	warnings := certificateWarnings(leaf, ip, hostname, now)
+
+	if err := writeCertificate(app.config.tlsPaths.cert, app.config.tlsPaths.key, certPEM, keyPEM); err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+	app.certs.set(&cert)
+
+	if err := app.setCertificateSource("uploaded"); err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+	app.recordCertificate(ip)
+
+	app.logger.PrintInfo("uploaded TLS certificate is being served", map[string]any{
+		"subject":  leaf.Subject.String(),
+		"issuer":   leaf.Issuer.String(),
+		"expiry":   leaf.NotAfter,
+		"warnings": warnings,
+		"user_id":  u.ID,
+	})
+	app.audit(c, u.ID, data.AuditTLSCertUpload, fmt.Sprintf("%s, issued by %s, expires %s", leaf.Subject.CommonName, leaf.Issuer.CommonName, leaf.NotAfter.Format(time.DateOnly)))
+
+	return c.JSON(http.StatusOK, envelope{
+		"success":  true,
+		"expiry":   leaf.NotAfter,
+		"warnings": warnings,
+	})
+}
+
+// Stop serving an uploaded certificate, and go back to one the listener makes itself
+func (app *application) resetCertificateHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+
+	if err := app.regenerateCertificate(app.localIP()); err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	if err := app.setCertificateSource("generated"); err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+	app.recordCertificate(app.localIP())
+
+	app.logger.PrintInfo("generated TLS certificate is being served", map[string]any{
+		"expiry":  app.certs.leaf().NotAfter,
+		"user_id": u.ID,
+	})
+	app.audit(c, u.ID, data.AuditTLSCertReset, "generated certificate")
+
+	return c.JSON(http.StatusOK, envelope{"success": true})
+}
+
+// Set tls_cert_source, keeping its description
+func (app *application) setCertificateSource(source string) error {
+	entry, err := app.models.Config.GetByKey("tls_cert_source")
+	if err != nil {
+		return err
+	}
+	entry.Value = source
+	return app.models.Config.Set(entry)
+}
+
+// Read the uploaded file in the form field, adding an error to v if it is missing or can't be read
+func readUploadedFile(c echo.Context, v *validator.Validator, field string) []byte {
+	fh, err := c.FormFile(field)
+	if err != nil {
+		v.AddError(field, "must be provided")
+		return nil
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		v.AddError(field, "couldn't be read")
+		return nil
+	}
+	defer f.Close()
+
+	// Certificate chains and keys are a few KB at most
+	b, err := io.ReadAll(io.LimitReader(f, 1<<20))
+	if err != nil {
+		v.AddError(field, "couldn't be read")
+		return nil
+	}
+	return b
+}
+
+// Problems with a certificate that don't stop it being served
+func certificateWarnings(leaf *x509.Certificate, ip, hostname string, now time.Time) []string {
+	var warnings []string
+
+	matches := false
+	for _, name := range []string{ip, hostname} {
+		if name != "" && leaf.VerifyHostname(name) == nil {
+			matches = true
+		}
+	}
+	if !matches {
+		sans := slices.Clone(leaf.DNSNames)
+		for _, san := range leaf.IPAddresses {
+			sans = append(sans, san.String())
+		}
+		warnings = append(warnings, fmt.Sprintf("isn't valid for this machine's IP address (%s) or hostname (%s) - KAMAR must connect using one of: %s", ip, hostname, strings.Join(sans, ", ")))
+	}
+
+	if now.Add(certExpiryWarning).After(leaf.NotAfter) {
+		warnings = append(warnings, fmt.Sprintf("expires on %s", leaf.NotAfter.Format(time.DateOnly)))
+	}
+
+	return warnings
+}
+
+// Write the certificate and key beside their final paths first, so a failed write doesn't leave a half-written file in their place
+func writeCertificate(certPath, keyPath string, certPEM, keyPEM []byte) error {
+	if err := os.WriteFile(certPath+".new", certPEM, 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath+".new", keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(keyPath+".new", keyPath); err != nil {
+		return err
+	}
+	return os.Rename(certPath+".new", certPath)
+}
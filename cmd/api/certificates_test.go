@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/tlscerts"
+)
+
+func TestCertificateRenewalReason(t *testing.T) {
+	dir := t.TempDir()
+	app := newTestApplication(t, nil, nil)
+	assert.NilError(t, tlscerts.GenerateSelfSignedCert(dir, "10.0.0.5", app.logger))
+
+	app.config.tlsPaths.cert = filepath.Join(dir, "cert.pem")
+	app.config.tlsPaths.key = filepath.Join(dir, "key.pem")
+
+	cert, err := app.certs.getCertificate(nil)
+	assert.Equal(t, cert == nil, true)
+	assert.Equal(t, err != nil, true)
+
+	assert.NilError(t, app.loadCertificate())
+	leaf := app.certs.leaf()
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		leaf   *x509.Certificate
+		certIP string
+		ip     string
+		now    time.Time
+		renew  bool
+	}{
+		{"current", leaf, "10.0.0.5", "10.0.0.5", now, false},
+		{"first check", leaf, "", "10.0.0.5", now, false},
+		{"ip unknown", leaf, "10.0.0.5", "", now, false},
+		{"no certificate", nil, "10.0.0.5", "10.0.0.5", now, true},
+		{"new ip", leaf, "10.0.0.5", "10.0.0.9", now, true},
+		{"ip not in certificate", leaf, "", "10.0.0.9", now, true},
+		{"expiring", leaf, "10.0.0.5", "10.0.0.5", leaf.NotAfter.Add(-certRenewBefore / 2), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := certificateRenewalReason(tt.leaf, tt.certIP, tt.ip, tt.now)
+			assert.Equal(t, reason != "", tt.renew)
+		})
+	}
+
+	// A new certificate in the TLS directory is served as soon as it is loaded
+	for _, name := range []string{"cert.pem", "key.pem"} {
+		assert.NilError(t, os.Remove(filepath.Join(dir, name)))
+	}
+	assert.NilError(t, tlscerts.GenerateSelfSignedCert(dir, "10.0.0.9", app.logger))
+	assert.NilError(t, app.loadCertificate())
+
+	cert, err = app.certs.getCertificate(nil)
+	assert.NilError(t, err)
+	assert.NilError(t, cert.Leaf.VerifyHostname("10.0.0.9"))
+	assert.Equal(t, certificateRenewalReason(cert.Leaf, "10.0.0.9", "10.0.0.9", now), "")
+}
+
+func TestUploadCertificate(t *testing.T) {
+	appDB, _, err := openAppDB(filepath.Join(t.TempDir(), "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+
+	app := newTestApplication(t, appDB, nil)
+	app.userExists = true
+	app.ip.Store("10.0.0.9")
+
+	tlsDir := t.TempDir()
+	app.config.tlsPaths.cert = filepath.Join(tlsDir, "cert.pem")
+	app.config.tlsPaths.key = filepath.Join(tlsDir, "key.pem")
+	assert.NilError(t, tlscerts.GenerateSelfSignedCert(tlsDir, "10.0.0.9", app.logger))
+	assert.NilError(t, app.loadCertificate())
+
+	// Stand in for the school's PKI with a CA of its own, issuing a certificate for another IP
+	schoolDir, otherDir := t.TempDir(), t.TempDir()
+	assert.NilError(t, tlscerts.GenerateSelfSignedCert(schoolDir, "10.0.0.5", app.logger))
+	assert.NilError(t, tlscerts.GenerateSelfSignedCert(otherDir, "10.0.0.5", app.logger))
+	read := func(dir, name string) []byte {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		assert.NilError(t, err)
+		return b
+	}
+
+	admin := &data.User{ID: 1, Username: "admin", Role: data.RoleAdmin}
+	e := echo.New()
+	// Requests hold the databases for reading through holdDatabases, as they would in the router
+	upload := func(cert, key []byte, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for name, content := range map[string][]byte{"cert": cert, "key": key} {
+			if content == nil {
+				continue
+			}
+			fw, err := mw.CreateFormFile(name, name+".pem")
+			assert.NilError(t, err)
+			fw.Write(content)
+		}
+		mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/config/tls", &body)
+		req.Header.Set(echo.HeaderContentType, mw.FormDataContentType())
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		app.contextSetUser(c, admin)
+		assert.NilError(t, app.holdDatabases(handler)(c))
+		return rec
+	}
+
+	rec := upload(read(schoolDir, "cert.pem"), nil, app.uploadCertificateHandler)
+	assert.Equal(t, rec.Code, http.StatusUnprocessableEntity)
+
+	// The key must be the certificate's
+	rec = upload(read(schoolDir, "cert.pem"), read(otherDir, "key.pem"), app.uploadCertificateHandler)
+	assert.Equal(t, rec.Code, http.StatusUnprocessableEntity)
+	assert.Equal(t, app.certs.leaf().VerifyHostname("10.0.0.9"), nil)
+
+	// A certificate that doesn't cover this machine is served, with a warning. A restore is waiting to write while it is uploaded, which the upload must not deadlock with by taking the databases' read lock a second time.
+	restored := make(chan struct{})
+	rec = upload(read(schoolDir, "cert.pem"), read(schoolDir, "key.pem"), func(c echo.Context) error {
+		go func() {
+			app.dbMu.Lock()
+			app.dbMu.Unlock()
+			close(restored)
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		done := make(chan error, 1)
+		go func() { done <- app.uploadCertificateHandler(c) }()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("upload deadlocked with a waiting restore")
+			return nil
+		}
+	})
+	<-restored
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.StringContains(t, rec.Body.String(), "isn't valid for this machine's IP address (10.0.0.9)")
+	assert.NilError(t, app.certs.leaf().VerifyHostname("10.0.0.5"))
+	assert.Equal(t, string(read(tlsDir, "cert.pem")), string(read(schoolDir, "cert.pem")))
+
+	source, err := app.models.Config.GetByKey("tls_cert_source")
+	assert.NilError(t, err)
+	assert.Equal(t, source.Value, "uploaded")
+	assert.StringContains(t, source.Description, "Set by the listener")
+	sans, err := app.models.Config.GetByKey("tls_cert_sans")
+	assert.NilError(t, err)
+	assert.StringContains(t, sans.Value, "10.0.0.5")
+
+	now := time.Now()
+	leaf := &x509.Certificate{DNSNames: []string{"listener.school.nz"}, NotAfter: now.Add(10 * 24 * time.Hour)}
+	assert.Equal(t, len(certificateWarnings(leaf, "10.0.0.9", "listener.school.nz", now)), 1)
+	assert.Equal(t, len(certificateWarnings(leaf, "10.0.0.9", "listener.school.nz", now.Add(-certExpiryWarning))), 0)
+}
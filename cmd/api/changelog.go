@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+)
+
+const (
+	changesDefaultLimit = 500
+	changesMaxLimit     = 5000
+	// The most changed keys included in a single webhook payload - consumers needing more should page through /changes
+	webhookMaxChangedKeys = 1000
+)
+
+// Return the changes recorded after the seq given in the "after" query param, so downstream systems can sync incrementally rather than re-reading whole tables
+func (app *application) getChangesHandler(c echo.Context) error {
+	after := int64(0)
+	limit := changesDefaultLimit
+
+	if a := c.QueryParam("after"); a != "" {
+		a, err := strconv.ParseInt(a, 10, 64)
+		if err != nil {
+			return app.badRequestResponse(c, err)
+		}
+		after = a
+	}
+
+	if l := c.QueryParam("limit"); l != "" {
+		l, err := strconv.Atoi(l)
+		if err != nil {
+			return app.badRequestResponse(c, err)
+		}
+		limit = l
+	}
+
+	v := validator.New()
+	v.Check(after >= 0, "after", "must not be negative")
+	v.Check(limit > 0 && limit <= changesMaxLimit, "limit", "must be between 1 and "+strconv.Itoa(changesMaxLimit))
+	if !v.Valid() {
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	// Admins can see every change for internal use, which is recorded like any other consent override
+	var consent *data.Consent
+	if c.QueryParam("override_consent") == "true" {
+		user := app.contextGetUser(c)
+		if !user.Can(data.PermissionPrivacy) {
+			return app.notPermittedResponse(c)
+		}
+		app.logger.PrintInfo("datasharing consent overridden for changes", map[string]any{
+			"after":   after,
+			"user_id": user.ID,
+		})
+		app.audit(c, user.ID, data.AuditConsentOverride, "changes after "+strconv.FormatInt(after, 10))
+	} else {
+		var err error
+		consent, err = app.models.Consent.Load()
+		if err != nil {
+			return app.serverErrorResponse(c, err)
+		}
+	}
+
+	changes, err := app.models.ChangeLog.GetAfter(after, limit)
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	// If no changes are returned, the consumer should keep using the seq it sent
+	lastSeq := after
+	hasMore := len(changes) == limit
+	if len(changes) > 0 {
+		lastSeq = changes[len(changes)-1].Seq
+	}
+
+	// Worked out before filtering, so changes to withheld photos are skipped over rather than leaving the consumer stuck on them
+	changes = filterRecords(changes, func(ch data.Change) bool {
+		return ch.Entity != "photos" || !consent.PhotoWithheld(ch.Key)
+	})
+
+	env := envelope{
+		"changes":  changes,
+		"last_seq": lastSeq,
+		"has_more": hasMore,
+	}
+
+	return c.JSON(http.StatusOK, env)
+}
+
+// Collect "entity:key" for each change recorded after seq, for inclusion in sync webhook payloads. KAMAR sends syncs one at a time, so these are the changes made by the most recent sync.
+func (app *application) changedKeysSince(seq int64) []string {
+	changes, err := app.models.ChangeLog.GetAfter(seq, webhookMaxChangedKeys)
+	if err != nil {
+		app.logger.PrintError(err, map[string]any{
+			"message": "couldn't get changes for webhook payload",
+		})
+		return nil
+	}
+
+	keys := make([]string, len(changes))
+	for i, change := range changes {
+		keys[i] = change.Entity + ":" + change.Key
+	}
+
+	return keys
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+func TestChangeLogTriggers(t *testing.T) {
+	db, err := openKamarDB(filepath.Join(t.TempDir(), "listener.db"))
+	assert.NilError(t, err)
+	defer db.Close()
+
+	model := data.ChangeLogModel{DB: data.NewListenerDB(db, data.DialectSQLite)}
+
+	upsert := `INSERT INTO subjects (id, name, level) VALUES ($1, $2, $3)
+		ON CONFLICT(id) DO UPDATE SET name = excluded.name, level = excluded.level, listener_updated_at = datetime('now');`
+
+	_, err = db.Exec(upsert, "11MAT", "Mathematics", 1)
+	assert.NilError(t, err)
+
+	// Re-sending the same values should only touch listener_updated_at, which isn't recorded as a change
+	_, err = db.Exec(upsert, "11MAT", "Mathematics", 1)
+	assert.NilError(t, err)
+
+	_, err = db.Exec(upsert, "11MAT", "Maths", 1)
+	assert.NilError(t, err)
+
+	_, err = db.Exec(`DELETE FROM subjects WHERE id = $1;`, "11MAT")
+	assert.NilError(t, err)
+
+	changes, err := model.GetAfter(0, 100)
+	assert.NilError(t, err)
+	assert.Equal(t, len(changes), 3)
+
+	assert.Equal(t, changes[0].Operation, data.ChangeInsert)
+	assert.Equal(t, changes[0].Entity, "subjects")
+	assert.Equal(t, changes[0].Key, "11MAT")
+
+	assert.Equal(t, changes[1].Operation, data.ChangeUpdate)
+	assert.Equal(t, len(changes[1].ChangedColumns), 1)
+	assert.Equal(t, changes[1].ChangedColumns[0], "name")
+
+	assert.Equal(t, changes[2].Operation, data.ChangeRetire)
+
+	// Paging from the last seen seq should only return later changes
+	later, err := model.GetAfter(changes[1].Seq, 100)
+	assert.NilError(t, err)
+	assert.Equal(t, len(later), 1)
+	assert.Equal(t, later[0].Seq, changes[2].Seq)
+
+	latest, err := model.LatestSeq()
+	assert.NilError(t, err)
+	assert.Equal(t, latest, changes[2].Seq)
+}
+
+func TestChangeLogCompositeKey(t *testing.T) {
+	db, err := openKamarDB(filepath.Join(t.TempDir(), "listener.db"))
+	assert.NilError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec(`INSERT INTO student_caregivers (student_uuid, student_id, ref, name) VALUES ($1, $2, $3, $4);`, "abc-123", 1234, 2, "Hine")
+	assert.NilError(t, err)
+
+	changes, err := (&data.ChangeLogModel{DB: data.NewListenerDB(db, data.DialectSQLite)}).GetAfter(0, 10)
+	assert.NilError(t, err)
+	assert.Equal(t, len(changes), 1)
+	assert.Equal(t, changes[0].Key, "abc-123|2")
+}
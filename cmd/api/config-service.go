@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+// How long KAMAR's credentials are trusted after bcrypt has accepted them, before they are checked against the stored hash again
+const kamarCredentialCacheTTL = 5 * time.Minute
+
+// configService keeps the listener's config in memory, so KAMAR's requests - which arrive back to back during a full sync - don't each read the whole config table. It also remembers the last KAMAR credentials bcrypt accepted, so repeat requests can skip it. Both are only used while ConfigModel.Version is the one they were read at, so any change made by ConfigModel.Set drops them.
+type configService struct {
+	mu sync.Mutex
+	// Whether cfg and credDigest can be used - cleared when a backup is restored, which changes the config without Set
+	valid   bool
+	version uint64
+	cfg     *data.ListenerConfig
+	// An HMAC of the credentials that last matched, keyed with random bytes that never leave memory, so the password itself isn't kept
+	credKey      []byte
+	credDigest   []byte
+	credMatched  string
+	credVerified time.Time
+	// When KAMAR last used the secondary password - kept in memory, as writing it to config would drop the cache on every request
+	secondaryUsed time.Time
+}
+
+func (s *configService) invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.valid = false
+	s.cfg = nil
+	s.credDigest = nil
+}
+
+// Drop anything cached at an older version of the config. The caller must hold s.mu.
+func (s *configService) sync(version uint64) {
+	if !s.valid || s.version != version {
+		s.valid = true
+		s.version = version
+		s.cfg = nil
+		s.credDigest = nil
+	}
+}
+
+// The caller must hold s.mu
+func (s *configService) digest(username, password string) []byte {
+	if s.credKey == nil {
+		s.credKey = make([]byte, 32)
+		rand.Read(s.credKey)
+	}
+
+	mac := hmac.New(sha256.New, s.credKey)
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
+// The listener's config, from memory if it hasn't changed since it was last read. It is shared between requests, so must not be modified.
+func (app *application) listenerConfig() (*data.ListenerConfig, error) {
+	s := &app.configs
+	version := app.models.Config.Version()
+
+	s.mu.Lock()
+	s.sync(version)
+	if s.cfg != nil {
+		cfg := s.cfg
+		s.mu.Unlock()
+		return cfg, nil
+	}
+	s.mu.Unlock()
+
+	cfg, err := app.models.Config.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// Only cache what was read if nothing has changed the config in the meantime
+	s.mu.Lock()
+	if s.valid && s.version == version && app.models.Config.Version() == version {
+		s.cfg = cfg
+	}
+	s.mu.Unlock()
+
+	return cfg, nil
+}
+
+// Which of KAMAR's passwords a request used
+const (
+	kamarCredentialPrimary = "primary"
+	// The previous password, accepted for a while after it is changed so syncs keep working until KAMAR is updated
+	kamarCredentialSecondary = "secondary"
+)
+
+// Report which of KAMAR's passwords password is - kamarCredentialPrimary, kamarCredentialSecondary if it is the previous password and that hasn't expired, or "" if neither. bcrypt is skipped if username and password are the credentials that last matched, within kamarCredentialCacheTTL.
+func (app *application) matchKAMARPassword(cfg *data.ListenerConfig, username, password string, now time.Time) (string, error) {
+	s := &app.configs
+	version := app.models.Config.Version()
+
+	secondary, _ := cfg.GetPassword("listener_password_secondary")
+	secondaryValid := len(secondary.Hash()) > 0 && now.Before(kamarSecondaryExpiry(cfg))
+
+	s.mu.Lock()
+	s.sync(version)
+	digest := s.digest(username, password)
+	if s.credDigest != nil && hmac.Equal(s.credDigest, digest) && now.Sub(s.credVerified) < kamarCredentialCacheTTL {
+		matched := s.credMatched
+		if matched == kamarCredentialPrimary || secondaryValid {
+			s.noteUse(matched, now)
+			s.mu.Unlock()
+			return matched, nil
+		}
+	}
+	s.mu.Unlock()
+
+	matched := ""
+	primary, _ := cfg.GetPassword("listener_password")
+	ok, err := primary.Matches(password)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		matched = kamarCredentialPrimary
+	} else if secondaryValid {
+		ok, err = secondary.Matches(password)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			matched = kamarCredentialSecondary
+		}
+	}
+	if matched == "" {
+		return "", nil
+	}
+
+	s.mu.Lock()
+	if s.valid && s.version == version && app.models.Config.Version() == version {
+		s.credDigest = digest
+		s.credMatched = matched
+		s.credVerified = now
+	}
+	s.noteUse(matched, now)
+	s.mu.Unlock()
+
+	return matched, nil
+}
+
+// When the secondary password stops working, or the zero time if there isn't one
+func kamarSecondaryExpiry(cfg *data.ListenerConfig) time.Time {
+	value, _ := cfg.GetString("listener_password_secondary_expiry")
+	expiry, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return expiry
+}
+
+// Remember when the secondary password was last used, for the dashboard to warn that KAMAR hasn't been updated. The caller must hold s.mu.
+func (s *configService) noteUse(matched string, now time.Time) {
+	if matched == kamarCredentialSecondary {
+		s.secondaryUsed = now
+	}
+}
+
+// When KAMAR last used the secondary password, or the zero time if it hasn't since the password was changed
+func (app *application) kamarSecondaryLastUsed() time.Time {
+	app.configs.mu.Lock()
+	defer app.configs.mu.Unlock()
+
+	return app.configs.secondaryUsed
+}
+
+// Forget any use of the secondary password, when a new one replaces it
+func (app *application) resetKAMARSecondaryUse() {
+	app.configs.mu.Lock()
+	defer app.configs.mu.Unlock()
+
+	app.configs.secondaryUsed = time.Time{}
+}
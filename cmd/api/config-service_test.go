@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+func TestConfigService(t *testing.T) {
+	appDB, _, err := openAppDB(filepath.Join(t.TempDir(), "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+
+	app := newTestApplication(t, appDB, nil)
+	app.userExists = true
+
+	cfg, err := app.listenerConfig()
+	assert.NilError(t, err)
+	name, _ := cfg.GetString("service_name")
+	assert.Equal(t, name, "KAMAR Listener Service")
+
+	// Reads come from memory until the config is changed through ConfigModel.Set
+	_, err = appDB.Exec(`UPDATE config SET value = 'Changed behind its back' WHERE key = 'service_name';`)
+	assert.NilError(t, err)
+	cfg, err = app.listenerConfig()
+	assert.NilError(t, err)
+	name, _ = cfg.GetString("service_name")
+	assert.Equal(t, name, "KAMAR Listener Service")
+
+	assert.NilError(t, app.models.Config.Set(data.ConfigEntry{Key: "service_name", Value: "WHS KAMAR Listener Service", Type: "string"}))
+	cfg, err = app.listenerConfig()
+	assert.NilError(t, err)
+	name, _ = cfg.GetString("service_name")
+	assert.Equal(t, name, "WHS KAMAR Listener Service")
+
+	var stored, other data.Password
+	assert.NilError(t, stored.Set("kamar-password"))
+	assert.NilError(t, other.Set("new-password"))
+	storedCfg := data.NewConfig([]data.ConfigEntry{{Key: "listener_password", Value: string(stored.Hash()), Type: "password"}})
+	otherCfg := data.NewConfig([]data.ConfigEntry{{Key: "listener_password", Value: string(other.Hash()), Type: "password"}})
+	now := time.Now()
+
+	matched, err := app.matchKAMARPassword(storedCfg, "kamar", "wrong-password", now)
+	assert.NilError(t, err)
+	assert.Equal(t, matched, "")
+
+	matched, err = app.matchKAMARPassword(storedCfg, "kamar", "kamar-password", now)
+	assert.NilError(t, err)
+	assert.Equal(t, matched, kamarCredentialPrimary)
+
+	// Credentials that have just matched aren't checked against the hash again...
+	matched, err = app.matchKAMARPassword(otherCfg, "kamar", "kamar-password", now)
+	assert.NilError(t, err)
+	assert.Equal(t, matched, kamarCredentialPrimary)
+	matched, err = app.matchKAMARPassword(otherCfg, "someone-else", "kamar-password", now)
+	assert.NilError(t, err)
+	assert.Equal(t, matched, "")
+
+	// ...until the config changes, eg. because the password has been updated
+	assert.NilError(t, app.models.Config.Set(data.ConfigEntry{Key: "listener_password", Value: string(other.Hash()), Type: "password"}))
+	matched, err = app.matchKAMARPassword(otherCfg, "kamar", "kamar-password", now)
+	assert.NilError(t, err)
+	assert.Equal(t, matched, "")
+}
+
+func TestKAMARPasswordRotation(t *testing.T) {
+	appDB, _, err := openAppDB(filepath.Join(t.TempDir(), "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+
+	app := newTestApplication(t, appDB, nil)
+	app.userExists = true
+
+	e := echo.New()
+	update := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/config/update/password", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		app.contextSetUser(c, &data.User{ID: 1})
+		assert.NilError(t, app.updateConfigPasswordHandler(c))
+		return rec.Code
+	}
+	match := func(password string, now time.Time) string {
+		cfg, err := app.listenerConfig()
+		assert.NilError(t, err)
+		matched, err := app.matchKAMARPassword(cfg, "kamar", password, now)
+		assert.NilError(t, err)
+		return matched
+	}
+
+	assert.Equal(t, update(`{"new_password": "first-kamar-password"}`), http.StatusAccepted)
+	assert.Equal(t, update(`{"current_password": "first-kamar-password", "new_password": "second-kamar-password", "overlap_days": 31}`), http.StatusUnprocessableEntity)
+
+	// The first password was set without one before it, so there is nothing to overlap with
+	entry, err := app.models.Config.GetByKey("listener_password_secondary")
+	assert.NilError(t, err)
+	assert.Equal(t, entry.Value, "")
+
+	assert.Equal(t, update(`{"current_password": "first-kamar-password", "new_password": "second-kamar-password", "overlap_days": 2}`), http.StatusAccepted)
+	entry, err = app.models.Config.GetByKey("listener_password_secondary")
+	assert.NilError(t, err)
+	assert.StringContains(t, entry.Description, "previous listener password")
+
+	// KAMAR can use either password until the overlap ends, and the dashboard can tell it is still using the old one
+	now := time.Now()
+	assert.Equal(t, match("second-kamar-password", now), kamarCredentialPrimary)
+	assert.Equal(t, app.kamarSecondaryLastUsed().IsZero(), true)
+	assert.Equal(t, match("first-kamar-password", now), kamarCredentialSecondary)
+	assert.Equal(t, app.kamarSecondaryLastUsed().Equal(now), true)
+	assert.Equal(t, match("first-kamar-password", now.Add(47*time.Hour)), kamarCredentialSecondary)
+	assert.Equal(t, match("first-kamar-password", now.Add(49*time.Hour)), "")
+	assert.Equal(t, match("second-kamar-password", now.Add(49*time.Hour)), kamarCredentialPrimary)
+
+	// With no overlap, the old password stops working straight away
+	assert.Equal(t, update(`{"current_password": "second-kamar-password", "new_password": "third-kamar-password", "overlap_days": 0}`), http.StatusAccepted)
+	assert.Equal(t, app.kamarSecondaryLastUsed().IsZero(), true)
+	assert.Equal(t, match("second-kamar-password", now), "")
+	assert.Equal(t, match("third-kamar-password", now), kamarCredentialPrimary)
+}
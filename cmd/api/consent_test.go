@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+func TestConsentFiltering(t *testing.T) {
+	dir := t.TempDir()
+
+	appDB, _, err := openAppDB(filepath.Join(dir, "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+	listenerDB := newTestListenerDB(t, dir)
+
+	app := newTestApplication(t, appDB, listenerDB)
+
+	id, otherID, uuid, otherUUID := 1234, 5678, "uuid-1", "uuid-2"
+	email, otherEmail := "aroha@example.com", "tama@example.com"
+	no, yes := 0, 1
+	assert.NilError(t, app.models.Students.InsertManyStudents([]data.Student{
+		{ID: &id, UUID: &uuid, Email: &email, Datasharing: &data.Datasharing{Details: &no, Photo: &no, Other: &no}},
+		{ID: &otherID, UUID: &otherUUID, Email: &otherEmail, Datasharing: &data.Datasharing{Details: &yes, Photo: &yes, Other: &yes}},
+	}))
+
+	consent, err := app.models.Consent.Load()
+	assert.NilError(t, err)
+	assert.Equal(t, consent.Withheld(), 1)
+	assert.Equal(t, consent.PhotoWithheld("1234"), true)
+	assert.Equal(t, consent.PhotoWithheld("5678"), false)
+
+	// Contact details are withheld from exports, but the student is still included
+	var csv bytes.Buffer
+	count, err := app.models.Exports.WriteCSV("students", consent, &csv)
+	assert.NilError(t, err)
+	assert.Equal(t, count, 2)
+	assert.Equal(t, bytes.Contains(csv.Bytes(), []byte(email)), false)
+	assert.StringContains(t, csv.String(), otherEmail)
+
+	// An admin override includes everything
+	csv.Reset()
+	_, err = app.models.Exports.WriteCSV("students", nil, &csv)
+	assert.NilError(t, err)
+	assert.StringContains(t, csv.String(), email)
+
+	// Students who haven't consented to other uses are left out of research exports altogether
+	key, err := app.models.ResearchKey.Get()
+	assert.NilError(t, err)
+	csv.Reset()
+	count, err = app.models.Exports.WriteResearchCSV("students", key, consent, &csv)
+	assert.NilError(t, err)
+	assert.Equal(t, count, 1)
+}
@@ -10,6 +10,9 @@ import (
 
 const userContextKey = "user"
 
+// The token a signed in user's request was made with, so their current session can be told apart from their others
+const sessionTokenContextKey = "session_token"
+
 // Add the provdied user struct to the request's context, using "user" as the key (with the type of userContextKey)
 func (app *application) contextSetUser(c echo.Context, user *data.User) {
 	c.Set(string(userContextKey), user)
@@ -24,3 +27,13 @@ func (app *application) contextGetUser(c echo.Context) *data.User {
 
 	return user
 }
+
+func (app *application) contextSetSessionToken(c echo.Context, token string) {
+	c.Set(sessionTokenContextKey, token)
+}
+
+// The token the request was made with, or "" if it wasn't made by a signed in user
+func (app *application) contextGetSessionToken(c echo.Context) string {
+	token, _ := c.Get(sessionTokenContextKey).(string)
+	return token
+}
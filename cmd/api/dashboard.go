@@ -2,13 +2,17 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	"os/exec"
 	"runtime"
+	"sort"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/tlscerts"
 	views "github.com/michaelcjefferson/kamar-listener/ui/views"
 )
 
@@ -19,21 +23,52 @@ func (app *application) getDashboardPageHandler(c echo.Context) error {
 
 	w.LastCheckTime, w.LastInsertTime, w.RecordsToday, w.TotalRecords, w.CountByType = app.appMetrics.Snapshot()
 
-	w.IP = app.config.ip
+	w.IP = app.localIP()
 
-	aDBStat, err := os.Stat(app.config.dbPaths.appDB)
+	fingerprint, _, err := tlscerts.CAFingerprint(app.config.tlsPaths.tlsDir)
 	if err != nil {
-		app.serverErrorResponse(c, err)
-		panic(err)
+		app.logger.PrintError(err, map[string]any{
+			"message": "couldn't read built-in certificate authority",
+		})
+	}
+	w.CAFingerprint = fingerprint
+
+	if leaf := app.certs.leaf(); leaf != nil && time.Until(leaf.NotAfter) < certExpiryWarning {
+		w.CertExpiry = leaf.NotAfter
+	}
+
+	if cfg, err := app.listenerConfig(); err == nil {
+		expiry := kamarSecondaryExpiry(cfg)
+		if used := app.kamarSecondaryLastUsed(); !used.IsZero() && time.Now().Before(expiry) {
+			w.KAMARSecondaryUsed, w.KAMARSecondaryExpiry = used, expiry
+		}
+	}
+
+	w.Lockouts = app.lockouts.locked(time.Now())
+	w.CanUnlock = u.Can(data.PermissionConfigure)
+
+	for _, status := range app.replicationStatuses() {
+		w.Sinks = append(w.Sinks, status)
 	}
-	lDBStat, err := os.Stat(app.config.dbPaths.listenerDB)
+	sort.Slice(w.Sinks, func(i, j int) bool { return w.Sinks[i].ID < w.Sinks[j].ID })
+
+	aDBStat, err := os.Stat(app.config.dbPaths.appDB)
 	if err != nil {
 		app.serverErrorResponse(c, err)
 		panic(err)
 	}
 	appDBSize := float64(aDBStat.Size()) / 1024.0 / 1024.0
-	listenerDBSize := float64(lDBStat.Size()) / 1024.0 / 1024.0
-	w.DBSize = appDBSize + listenerDBSize
+	w.DBSize = appDBSize
+	// When KAMAR data is stored in Postgres, there's no local file to measure
+	if data.Dialect(app.config.listenerStore.driver) != data.DialectPostgres {
+		lDBStat, err := os.Stat(app.config.dbPaths.listenerDB)
+		if err != nil {
+			app.serverErrorResponse(c, err)
+			panic(err)
+		}
+		listenerDBSize := float64(lDBStat.Size()) / 1024.0 / 1024.0
+		w.DBSize += listenerDBSize
+	}
 
 	logFilters := data.Filters{
 		LogFilters:   data.LogFilters{},
@@ -77,6 +112,15 @@ func (app *application) getDashboardPageHandler(c echo.Context) error {
 
 	w.JSONEnabled = app.config.kamar_write_to_json
 
+	w.LastExportTime, w.LastExportError = app.appMetrics.ExportSnapshot()
+	w.CanOverrideConsent = u.Can(data.PermissionPrivacy)
+	if consent, err := app.models.Consent.Load(); err == nil {
+		w.ConsentWithheld = consent.Withheld()
+	}
+	if cfg, err := app.listenerConfig(); err == nil {
+		w.ExportEnabled = cfg.GetBool("export_enabled")
+	}
+
 	return app.Render(c, http.StatusOK, views.DashboardPage(u, w))
 }
 
@@ -104,6 +148,8 @@ func (app *application) openDataFolderHandler(c echo.Context) error {
 		return app.serverErrorResponse(c, err)
 	}
 
+	app.audit(c, app.contextGetUser(c).ID, data.AuditDataFolderOpen, app.config.dbPaths.dbDir)
+
 	return c.NoContent(http.StatusOK)
 }
 
@@ -119,5 +165,7 @@ func (app *application) jsonSwitchHandler(c echo.Context) error {
 	}
 
 	app.config.kamar_write_to_json = req.Enabled
+	app.audit(c, app.contextGetUser(c).ID, data.AuditJSONSwitch, fmt.Sprintf("enabled=%t", req.Enabled))
+
 	return c.NoContent(http.StatusOK)
 }
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+// Open the listener database in PostgreSQL rather than SQLite, for schools that want KAMAR data alongside their other systems. app.db (users, config, logs) always stays in SQLite.
+func openPostgresListenerDB(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unlike SQLite, Postgres handles concurrent writers itself, so a small pool is enough to keep syncs from queueing behind one another without holding too many server connections
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(5)
+	db.SetConnMaxIdleTime(15 * time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = createPostgresSMSTables(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = createPostgresChangeLogTable(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// The same tables as createSMSTables, in Postgres' dialect. Differences from the SQLite schema:
+//   - INTEGER columns are BIGINT, as SQLite integers are 64 bit
+//   - columns holding Go bools are BOOLEAN, as Postgres won't store true/false in an integer column
+//   - "user", "group" and "values" are reserved words, so are quoted
+//   - foreign keys are left out, as SQLite doesn't enforce them (foreign_keys is off) and the InsertMany functions don't always write parent rows first
+//
+// listener_updated_at stays TEXT in the same format as SQLite's datetime('now'), so values compare the same way in both dialects.
+const postgresSMSTablesStmt = `
+CREATE TABLE IF NOT EXISTS results (
+	code TEXT,
+	comment TEXT,
+	course TEXT,
+	curriculumlevel TEXT,
+	date TEXT,
+	enrolled BOOLEAN,
+	id BIGINT,
+	nsn TEXT,
+	number TEXT,
+	published BOOLEAN,
+	result TEXT,
+	resultData TEXT,
+	results TEXT,
+	subject TEXT NULL,
+	tnv TEXT,
+	type TEXT,
+	version BIGINT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `),
+	year BIGINT,
+	yearlevel BIGINT,
+	UNIQUE(id, tnv, subject)
+);
+
+CREATE TABLE IF NOT EXISTS assessments (
+	credits BIGINT,
+	description TEXT,
+	internalexternal TEXT,
+	level BIGINT,
+	number TEXT,
+	points TEXT,
+	purpose TEXT,
+	schoolref TEXT,
+	subfield TEXT,
+	title TEXT,
+	tnv TEXT PRIMARY KEY,
+	type TEXT,
+	version BIGINT,
+	weighting TEXT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `)
+);
+
+CREATE TABLE IF NOT EXISTS attendance (
+	student_id BIGINT PRIMARY KEY,
+	nsn TEXT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `)
+);
+
+CREATE TABLE IF NOT EXISTS attendance_values (
+	att_student_id BIGINT NOT NULL,
+	date TEXT,
+	codes TEXT,
+	alt TEXT,
+	hdu BIGINT,
+	hdj BIGINT,
+	hdp BIGINT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `),
+	UNIQUE(att_student_id, date)
+);
+
+CREATE TABLE IF NOT EXISTS bookings (
+	room TEXT NOT NULL,
+	date TEXT NOT NULL,
+	slot BIGINT NOT NULL,
+	"group" TEXT,
+	notes TEXT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `),
+	UNIQUE(room, date, slot)
+);
+
+CREATE TABLE IF NOT EXISTS calendar (
+	timestructure TEXT,
+	days TEXT,
+	events TEXT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `)
+);
+
+CREATE TABLE IF NOT EXISTS class_efforts (
+	count BIGINT,
+	student_id BIGINT NOT NULL,
+	nsn TEXT,
+	date TEXT NOT NULL,
+	slot BIGINT NOT NULL,
+	term BIGINT,
+	week BIGINT,
+	subject TEXT,
+	"user" TEXT,
+	efforts TEXT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `),
+	UNIQUE(student_id, date, slot)
+);
+
+CREATE TABLE IF NOT EXISTS notices (
+	uuid TEXT PRIMARY KEY,
+	datestart TEXT,
+	datefinish TEXT,
+	publishweb BOOLEAN,
+	level TEXT,
+	subject TEXT,
+	body TEXT,
+	teacher TEXT,
+	meetingdate TEXT,
+	meetingtime TEXT,
+	meetingplace TEXT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `)
+);
+
+CREATE TABLE IF NOT EXISTS pastoral (
+	student_id BIGINT NOT NULL,
+	nsn TEXT,
+	type TEXT,
+	ref BIGINT,
+	reason TEXT,
+	reason_pb TEXT,
+	motivation TEXT,
+	motivation_pb TEXT,
+	location TEXT,
+	location_pb TEXT,
+	others_involved TEXT,
+	action1 TEXT,
+	action2 TEXT,
+	action3 TEXT,
+	action_pb1 TEXT,
+	action_pb2 TEXT,
+	action_pb3 TEXT,
+	teacher TEXT,
+	points BIGINT,
+	demerits BIGINT,
+	dateevent TEXT,
+	timeevent TEXT,
+	datedue TEXT,
+	duestatus TEXT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `),
+	UNIQUE(student_id, type, ref)
+);
+
+CREATE TABLE IF NOT EXISTS photos (
+	id TEXT PRIMARY KEY,
+	schoolindex TEXT,
+	type TEXT,
+	filename TEXT,
+	photo TEXT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `)
+);
+
+CREATE TABLE IF NOT EXISTS recognitions (
+	count BIGINT,
+	student_id BIGINT NOT NULL,
+	nsn TEXT,
+	uuid TEXT,
+	date TEXT NOT NULL,
+	slot BIGINT NOT NULL,
+	term BIGINT,
+	week BIGINT,
+	subject TEXT,
+	"user" TEXT,
+	points BIGINT,
+	comment TEXT,
+	"values" TEXT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `),
+	UNIQUE(student_id, date, slot)
+);
+
+CREATE TABLE IF NOT EXISTS staff (
+	id TEXT,
+	uuid TEXT PRIMARY KEY,
+	role TEXT,
+	created BIGINT,
+	uniqueid BIGINT,
+	username TEXT,
+	firstname TEXT,
+	lastname TEXT,
+	gender TEXT,
+	schoolindex BIGINT,
+	title TEXT,
+	email TEXT,
+	mobile TEXT,
+	extension TEXT,
+	classification TEXT,
+	position TEXT,
+	house TEXT,
+	tutor TEXT,
+	datebirth TEXT,
+	leavingdate TEXT,
+	startingdate TEXT,
+	eslguid TEXT,
+	moenumber TEXT,
+	photocopierid TEXT,
+	registrationnumber TEXT,
+	custom TEXT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `)
+);
+
+CREATE TABLE IF NOT EXISTS staff_groups (
+	staff_uuid TEXT NOT NULL,
+	staff_id TEXT NOT NULL,
+	type TEXT,
+	subject TEXT,
+	coreoption TEXT,
+	ref BIGINT,
+	year BIGINT,
+	name TEXT,
+	description TEXT,
+	teacher TEXT,
+	showreport BIGINT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `)
+);
+
+CREATE TABLE IF NOT EXISTS students (
+	id BIGINT NOT NULL,
+	uuid TEXT PRIMARY KEY,
+	role TEXT,
+	created BIGINT,
+	uniqueid BIGINT,
+	nsn TEXT,
+	username TEXT,
+	firstname TEXT,
+	firstnamelegal TEXT,
+	lastname TEXT,
+	lastnamelegal TEXT,
+	forenames TEXT,
+	forenameslegal TEXT,
+	gender TEXT,
+	genderpreferred TEXT,
+	gendercode BIGINT,
+	schoolindex BIGINT,
+	email TEXT,
+	mobile TEXT,
+	house TEXT,
+	whanau TEXT,
+	boarder TEXT,
+	byodinfo TEXT,
+	ece TEXT,
+	esol TEXT,
+	ors TEXT,
+	languagespoken TEXT,
+	datebirth BIGINT,
+	startingdate BIGINT,
+	startschooldate TEXT,
+	leavingdate BIGINT,
+	leavingreason TEXT,
+	leavingschool TEXT,
+	leavingactivity TEXT,
+	moetype TEXT,
+	ethnicityL1 TEXT,
+	ethnicityL2 TEXT,
+	ethnicity TEXT,
+	iwi TEXT,
+	yearlevel TEXT,
+	fundinglevel TEXT,
+	tutor TEXT,
+	timetablebottom1 TEXT,
+	timetablebottom2 TEXT,
+	timetablebottom3 TEXT,
+	timetablebottom4 TEXT,
+	timetabletop1 TEXT,
+	timetabletop2 TEXT,
+	timetabletop3 TEXT,
+	timetabletop4 TEXT,
+	maorilevel TEXT,
+	pacificlanguage TEXT,
+	pacificlevel TEXT,
+	siblinglink TEXT,
+	photocopierid TEXT,
+	signedagreement TEXT,
+	accountdisabled TEXT,
+	networkaccess TEXT,
+	altdescription TEXT,
+	althomedrive TEXT,
+	custom TEXT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `)
+);
+
+CREATE TABLE IF NOT EXISTS student_awards (
+	student_uuid TEXT NOT NULL,
+	student_id BIGINT NOT NULL,
+	type TEXT,
+	name TEXT,
+	year BIGINT,
+	date TEXT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `),
+	UNIQUE(student_uuid, name, year, date)
+);
+
+CREATE TABLE IF NOT EXISTS student_caregivers (
+	student_uuid TEXT NOT NULL,
+	student_id BIGINT NOT NULL,
+	ref BIGINT,
+	role TEXT,
+	name TEXT,
+	email TEXT,
+	mobile TEXT,
+	relationship TEXT,
+	status TEXT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `),
+	UNIQUE(student_uuid, ref)
+);
+
+CREATE TABLE IF NOT EXISTS student_datasharing (
+	student_uuid TEXT NOT NULL,
+	student_id BIGINT NOT NULL,
+	details BIGINT,
+	photo BIGINT,
+	other BIGINT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `),
+	UNIQUE(student_uuid)
+);
+
+CREATE TABLE IF NOT EXISTS student_emergency (
+	student_uuid TEXT NOT NULL,
+	student_id BIGINT NOT NULL,
+	name TEXT,
+	relationship TEXT,
+	mobile TEXT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `)
+);
+
+CREATE TABLE IF NOT EXISTS student_flags (
+	student_uuid TEXT NOT NULL,
+	student_id BIGINT NOT NULL,
+	general TEXT,
+	notes TEXT,
+	alert TEXT,
+	conditions TEXT,
+	dietary TEXT,
+	ibuprofen TEXT,
+	medical TEXT,
+	paracetamol TEXT,
+	pastoral TEXT,
+	reactions TEXT,
+	specialneeds TEXT,
+	vaccinations TEXT,
+	eotcconsent TEXT,
+	eotcform TEXT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `),
+	UNIQUE(student_uuid)
+);
+
+CREATE TABLE IF NOT EXISTS student_groups (
+	student_uuid TEXT NOT NULL,
+	student_id BIGINT NOT NULL,
+	type TEXT,
+	subject TEXT,
+	coreoption TEXT,
+	ref BIGINT,
+	year BIGINT,
+	name TEXT,
+	description TEXT,
+	teacher TEXT,
+	showreport BIGINT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `)
+);
+
+CREATE TABLE IF NOT EXISTS student_residences (
+	student_uuid TEXT NOT NULL,
+	student_id BIGINT NOT NULL,
+	title TEXT,
+	salutation TEXT,
+	email TEXT,
+	numFlatUnit TEXT,
+	numStreet TEXT,
+	ref BIGINT NOT NULL,
+	ruralDelivery TEXT,
+	suburb TEXT,
+	town TEXT,
+	postcode TEXT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `),
+	UNIQUE(student_uuid, ref)
+);
+
+CREATE TABLE IF NOT EXISTS subjects (
+	id TEXT PRIMARY KEY,
+	created BIGINT,
+	name TEXT,
+	department TEXT,
+	subdepartment TEXT,
+	qualification TEXT,
+	level BIGINT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `)
+);
+
+CREATE TABLE IF NOT EXISTS timetables (
+	student BIGINT,
+	uuid TEXT PRIMARY KEY,
+	grid TEXT,
+	timetable TEXT,
+	listener_updated_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `)
+);
+`
+
+func createPostgresSMSTables(db *sql.DB) error {
+	_, err := db.Exec(postgresSMSTablesStmt)
+	if err != nil {
+		return fmt.Errorf("couldn't set up listener tables in postgres: %w", err)
+	}
+
+	return nil
+}
+
+// The Postgres version of change_log. Rather than generating a trigger body per table as createChangeLogTable does for SQLite, a single function compares the old and new rows as jsonb, and is passed each table's key columns as trigger arguments.
+func createPostgresChangeLogTable(db *sql.DB) error {
+	changeLogStmt := `
+	CREATE TABLE IF NOT EXISTS change_log (
+		seq BIGSERIAL PRIMARY KEY,
+		entity TEXT NOT NULL,
+		entity_key TEXT NOT NULL,
+		operation TEXT NOT NULL,
+		changed_columns TEXT NOT NULL DEFAULT '[]',
+		changed_at TEXT NOT NULL DEFAULT (` + data.PostgresNow + `)
+	);
+
+	CREATE OR REPLACE FUNCTION listener_change_log() RETURNS trigger AS $$
+	DECLARE
+		old_row jsonb;
+		new_row jsonb;
+		changed jsonb;
+		row_key text;
+	BEGIN
+		IF TG_OP <> 'INSERT' THEN
+			old_row := to_jsonb(OLD) - 'listener_updated_at';
+		END IF;
+		IF TG_OP <> 'DELETE' THEN
+			new_row := to_jsonb(NEW) - 'listener_updated_at';
+		END IF;
+
+		SELECT COALESCE(string_agg(COALESCE(COALESCE(new_row, old_row) ->> k, ''), '|' ORDER BY i), '')
+		INTO row_key
+		FROM unnest(TG_ARGV) WITH ORDINALITY AS a(k, i);
+
+		IF TG_OP = 'INSERT' THEN
+			SELECT COALESCE(jsonb_agg(key ORDER BY key), '[]') INTO changed
+			FROM jsonb_each(new_row) WHERE value <> 'null'::jsonb;
+
+			INSERT INTO change_log (entity, entity_key, operation, changed_columns)
+			VALUES (TG_TABLE_NAME, row_key, 'insert', changed::text);
+		ELSIF TG_OP = 'UPDATE' THEN
+			SELECT COALESCE(jsonb_agg(key ORDER BY key), '[]') INTO changed
+			FROM jsonb_each(new_row) WHERE value IS DISTINCT FROM old_row -> key;
+
+			IF changed <> '[]'::jsonb THEN
+				INSERT INTO change_log (entity, entity_key, operation, changed_columns)
+				VALUES (TG_TABLE_NAME, row_key, 'update', changed::text);
+			END IF;
+		ELSE
+			INSERT INTO change_log (entity, entity_key, operation)
+			VALUES (TG_TABLE_NAME, row_key, 'retire');
+		END IF;
+
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;`
+
+	_, err := db.Exec(changeLogStmt)
+	if err != nil {
+		return fmt.Errorf("couldn't set up change_log in postgres: %w", err)
+	}
+
+	for table, keyColumns := range changeLogKeyColumns {
+		args := make([]string, len(keyColumns))
+		for i, col := range keyColumns {
+			args[i] = "'" + strings.ToLower(col) + "'"
+		}
+
+		triggerStmt := fmt.Sprintf(`
+		DROP TRIGGER IF EXISTS change_log_%[1]s ON %[1]s;
+		CREATE TRIGGER change_log_%[1]s AFTER INSERT OR UPDATE OR DELETE ON %[1]s
+		FOR EACH ROW EXECUTE FUNCTION listener_change_log(%[2]s);`, table, strings.Join(args, ", "))
+
+		_, err := db.Exec(triggerStmt)
+		if err != nil {
+			return fmt.Errorf("couldn't create change_log trigger for %s: %w", table, err)
+		}
+	}
+
+	return nil
+}
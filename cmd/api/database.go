@@ -3,9 +3,13 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"strings"
 	"time"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
 )
 
 // SQLite config for reads and writes (avoid SQLITE BUSY error): https://kerkour.com/sqlite-for-servers
@@ -49,6 +53,12 @@ func openAppDB(dbpath string) (*sql.DB, bool, error) {
 		return nil, false, err
 	}
 
+	err = createTwoFactorTables(db)
+	if err != nil {
+		db.Close()
+		return nil, false, err
+	}
+
 	// Set up config table
 	err = createConfigTable(db)
 	if err != nil {
@@ -63,6 +73,56 @@ func openAppDB(dbpath string) (*sql.DB, bool, error) {
 		return nil, false, err
 	}
 
+	// Set up export_watermarks table
+	err = createExportWatermarksTable(db)
+	if err != nil {
+		db.Close()
+		return nil, false, err
+	}
+
+	// Set up webhooks and webhook_deliveries tables
+	err = createWebhookTables(db)
+	if err != nil {
+		db.Close()
+		return nil, false, err
+	}
+
+	err = createReplicationSinksTable(db)
+	if err != nil {
+		db.Close()
+		return nil, false, err
+	}
+
+	err = createFieldEncryptionTable(db)
+	if err != nil {
+		db.Close()
+		return nil, false, err
+	}
+
+	err = createPIIPolicyTables(db)
+	if err != nil {
+		db.Close()
+		return nil, false, err
+	}
+
+	err = createResearchKeyTable(db)
+	if err != nil {
+		db.Close()
+		return nil, false, err
+	}
+
+	err = createErasuresTable(db)
+	if err != nil {
+		db.Close()
+		return nil, false, err
+	}
+
+	err = createAuditEventsTable(db)
+	if err != nil {
+		db.Close()
+		return nil, false, err
+	}
+
 	// Check to see whether a user already exists in the database - if not, a user must be created before the admin dashboard can be used
 	exists, err := userExists(db)
 	if err != nil {
@@ -73,6 +133,29 @@ func openAppDB(dbpath string) (*sql.DB, bool, error) {
 }
 
 // SQLite config for reads and writes (avoid SQLITE BUSY error): https://kerkour.com/sqlite-for-servers
+// Open the database holding data received from KAMAR with the driver chosen in cfg, wrapped so the models' queries are rewritten for its dialect
+func openListenerDB(cfg config) (*data.ListenerDB, error) {
+	switch data.Dialect(cfg.listenerStore.driver) {
+	case data.DialectSQLite:
+		db, err := openKamarDB(cfg.dbPaths.listenerDB)
+		if err != nil {
+			return nil, err
+		}
+		return data.NewListenerDB(db, data.DialectSQLite), nil
+	case data.DialectPostgres:
+		if cfg.listenerStore.dsn == "" {
+			return nil, errors.New("listener-db-dsn (or LISTENER_DB_DSN) must be set when listener-db-driver is postgres")
+		}
+		db, err := openPostgresListenerDB(cfg.listenerStore.dsn)
+		if err != nil {
+			return nil, err
+		}
+		return data.NewListenerDB(db, data.DialectPostgres), nil
+	default:
+		return nil, fmt.Errorf("unsupported listener-db-driver %q, must be one of %v", cfg.listenerStore.driver, data.Dialects)
+	}
+}
+
 func openKamarDB(dbpath string) (*sql.DB, error) {
 	// Create string of connection params to prevent "SQLITE_BUSY" errors - to be further improved based on the above article
 	dbParams := "?_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL"
@@ -99,6 +182,13 @@ func openKamarDB(dbpath string) (*sql.DB, error) {
 		return nil, err
 	}
 
+	// Set up change_log table, and the triggers that write to it whenever an SMS table changes
+	err = createChangeLogTable(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return db, nil
 }
 
@@ -177,10 +267,48 @@ func createUserTable(db *sql.DB) error {
 	);`
 
 	_, err := db.Exec(userTableStmt)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'viewer';`)
+	switch {
+	case err == nil:
+		if err := migrateUserRoles(db); err != nil {
+			return err
+		}
+	// Alter table doesn't support IF NOT EXISTS, so ignore the error thrown if this column already exists
+	case !strings.Contains(err.Error(), "duplicate column name"):
+		return err
+	}
+
+	// There must always be someone able to manage users, so if there isn't, make the first user an admin
+	_, err = db.Exec(`UPDATE users SET role = 'admin' WHERE id = (SELECT MIN(id) FROM users) AND NOT EXISTS (SELECT 1 FROM users WHERE role = 'admin');`)
 
 	return err
 }
 
+// Users registered before roles existed could change everything other than the audit trail, so they become operators - those flagged as admins stay admins, and the flag is dropped
+func migrateUserRoles(db *sql.DB) error {
+	_, err := db.Exec(`UPDATE users SET role = 'operator';`)
+	if err != nil {
+		return err
+	}
+
+	// Databases created before the admin flag was added don't have the column
+	_, err = db.Exec(`UPDATE users SET role = 'admin' WHERE is_admin = 1;`)
+	if err != nil && !strings.Contains(err.Error(), "no such column") {
+		return err
+	}
+
+	_, err = db.Exec(`ALTER TABLE users DROP COLUMN is_admin;`)
+	if err != nil && !strings.Contains(err.Error(), "no such column") {
+		return err
+	}
+
+	return nil
+}
+
 func createTokenTable(db *sql.DB) error {
 	tokenTableStmt := `CREATE TABLE IF NOT EXISTS tokens (
 		hash BLOB PRIMARY KEY, 
@@ -189,6 +317,50 @@ func createTokenTable(db *sql.DB) error {
 	);`
 
 	_, err := db.Exec(tokenTableStmt)
+	if err != nil {
+		return err
+	}
+
+	// Tokens created before scopes were added were all for signing in. Sessions from before the columns after that were added show as unknown on the sessions page.
+	for _, stmt := range []string{
+		`ALTER TABLE tokens ADD COLUMN scope TEXT NOT NULL DEFAULT 'authentication';`,
+		`ALTER TABLE tokens ADD COLUMN role TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE tokens ADD COLUMN created_at TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE tokens ADD COLUMN last_used_at TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE tokens ADD COLUMN ip TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE tokens ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';`,
+	} {
+		_, err = db.Exec(stmt)
+		// Alter table doesn't support IF NOT EXISTS, so ignore the error thrown if this column already exists
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func createTwoFactorTables(db *sql.DB) error {
+	twoFactorTableStmt := `CREATE TABLE IF NOT EXISTS user_two_factor (
+		user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		secret TEXT NOT NULL,
+		enabled INTEGER NOT NULL DEFAULT 0,
+		last_step INTEGER NOT NULL DEFAULT 0
+	);`
+
+	_, err := db.Exec(twoFactorTableStmt)
+	if err != nil {
+		return err
+	}
+
+	recoveryCodesTableStmt := `CREATE TABLE IF NOT EXISTS user_recovery_codes (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		code_hash BLOB NOT NULL,
+		used_at TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_user_recovery_codes_user_id ON user_recovery_codes(user_id);`
+
+	_, err = db.Exec(recoveryCodesTableStmt)
 
 	return err
 }
@@ -229,7 +401,25 @@ func createConfigTable(db *sql.DB) error {
 		('photos', 'false', 'bool', 'Enable/disable photos'),
 		('notices', 'false', 'bool', 'Enable/disable notices'),
 		('calendar', 'false', 'bool', 'Enable/disable calendar'),
-		('bookings', 'false', 'bool', 'Enable/disable bookings');
+		('bookings', 'false', 'bool', 'Enable/disable bookings'),
+		('export_enabled', 'false', 'bool', 'Enable/disable scheduled exports of every listener table'),
+		('export_format', 'csv', 'string', 'Format of scheduled exports - "csv" or "parquet"'),
+		('export_incremental', 'false', 'bool', 'Parquet only: when on, scheduled exports only include rows updated since the previous export'),
+		('export_dir', '', 'string', 'Folder that scheduled exports are written to - leave blank to use the exports folder in the application directory'),
+		('export_interval_minutes', '60', 'int', 'How often, in minutes, scheduled exports run'),
+		('backup_enabled', 'true', 'bool', 'Enable/disable daily backups of the listener and app databases'),
+		('backup_keep_daily', '7', 'int', 'Number of daily backups to keep'),
+		('backup_keep_weekly', '4', 'int', 'Number of weekly backups to keep'),
+		('backup_keep_monthly', '6', 'int', 'Number of monthly backups to keep'),
+		('encrypted_columns', 'students.nsn, students.email, students.mobile, student_caregivers.name, student_caregivers.email, student_caregivers.mobile, student_emergency.name, student_emergency.mobile, student_flags.general, student_flags.notes, student_flags.alert, student_flags.conditions, student_flags.dietary, student_flags.medical, student_flags.pastoral, student_flags.reactions, student_flags.specialneeds, student_flags.vaccinations, student_residences.email, student_residences.numflatunit, student_residences.numstreet, student_residences.ruraldelivery, student_residences.suburb, student_residences.town, student_residences.postcode', 'string', 'Comma separated table.column list of listener columns to encrypt - only used when the listener is started with an encryption key or passphrase'),
+		('lockout_exempt_ips', '', 'string', 'Comma separated IP addresses, such as your KAMAR server''s, that are never locked out after failed sign in or KAMAR auth attempts'),
+		('kamar_allowed_cidrs', '', 'string', 'Comma separated IP addresses or CIDR ranges allowed to send data to the listener - leave blank to allow any'),
+		('kamar_allowlist_learn', 'false', 'bool', 'When on, any source can send data to the listener, and the IP of each successful check request is added to kamar_allowed_cidrs - turn off once KAMAR has checked in'),
+		('tls_cert_ip', '', 'string', 'Set by the listener: the IP address the TLS certificate was last checked against - a new certificate is made when this changes'),
+		('tls_cert_sans', '', 'string', 'Set by the listener: the hostnames and IP addresses the TLS certificate is valid for'),
+		('tls_cert_source', 'generated', 'string', 'Set by the listener: "generated" if the listener makes its own TLS certificate, or "uploaded" if it serves one uploaded from the config page'),
+		('listener_password_secondary', '', 'password', 'Set by the listener: the previous listener password, which KAMAR can still use until listener_password_secondary_expiry'),
+		('listener_password_secondary_expiry', '', 'string', 'Set by the listener: when the previous listener password stops working');
 	`
 
 	_, err = db.Exec(configTableStmt)
@@ -260,6 +450,197 @@ func createListenerEventsTable(db *sql.DB) error {
 	return err
 }
 
+func createExportWatermarksTable(db *sql.DB) error {
+	exportWatermarksTableStmt := `CREATE TABLE IF NOT EXISTS export_watermarks (
+		table_name TEXT NOT NULL,
+		format TEXT NOT NULL,
+		watermark TEXT NOT NULL,
+		updated_at TEXT NOT NULL DEFAULT (datetime('now')),
+		PRIMARY KEY (table_name, format)
+	);`
+
+	_, err := db.Exec(exportWatermarksTableStmt)
+	if err != nil {
+		return err
+	}
+
+	// The rows exported in the watermark's second, as a JSON array of hashes - watermarks from before it was added re-export that second once
+	_, err = db.Exec(`ALTER TABLE export_watermarks ADD COLUMN exported TEXT NOT NULL DEFAULT '[]';`)
+	// Alter table doesn't support IF NOT EXISTS, so ignore the error thrown if this column already exists
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		return err
+	}
+
+	return nil
+}
+
+func createWebhookTables(db *sql.DB) error {
+	webhooksTableStmt := `CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		enabled INTEGER NOT NULL DEFAULT 1,
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+
+	_, err := db.Exec(webhooksTableStmt)
+	if err != nil {
+		return err
+	}
+
+	// url is copied onto each delivery so the delivery history still makes sense after a webhook is deleted
+	webhookDeliveriesTableStmt := `CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		response_code INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now')),
+		updated_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+
+	_, err = db.Exec(webhookDeliveriesTableStmt)
+
+	return err
+}
+
+// Sinks start with needs_resync set, so the whole listener database is copied to them before batches are replicated
+func createReplicationSinksTable(db *sql.DB) error {
+	replicationSinksTableStmt := `CREATE TABLE IF NOT EXISTS replication_sinks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		driver TEXT NOT NULL,
+		dsn TEXT NOT NULL,
+		enabled INTEGER NOT NULL DEFAULT 1,
+		needs_resync INTEGER NOT NULL DEFAULT 1,
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+
+	_, err := db.Exec(replicationSinksTableStmt)
+
+	return err
+}
+
+// Only ever holds one row - the salt and key check for the key that listener data is encrypted with. The key itself is never stored.
+func createFieldEncryptionTable(db *sql.DB) error {
+	fieldEncryptionTableStmt := `CREATE TABLE IF NOT EXISTS field_encryption (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		kdf TEXT NOT NULL,
+		salt TEXT NOT NULL,
+		key_check TEXT NOT NULL,
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+
+	_, err := db.Exec(fieldEncryptionTableStmt)
+
+	return err
+}
+
+func createPIIPolicyTables(db *sql.DB) error {
+	piiPolicyTableStmt := `CREATE TABLE IF NOT EXISTS pii_policy (
+		entity TEXT NOT NULL,
+		field TEXT NOT NULL,
+		action TEXT NOT NULL,
+		updated_at TEXT NOT NULL DEFAULT (datetime('now')),
+		PRIMARY KEY (entity, field)
+	);`
+
+	_, err := db.Exec(piiPolicyTableStmt)
+	if err != nil {
+		return err
+	}
+
+	piiHashKeyTableStmt := `CREATE TABLE IF NOT EXISTS pii_hash_key (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		key TEXT NOT NULL
+	);`
+
+	_, err = db.Exec(piiHashKeyTableStmt)
+	if err != nil {
+		return err
+	}
+
+	// The key must never change once values have been hashed with it, or the same value sent again would be stored differently
+	key, err := data.NewHashKey()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT OR IGNORE INTO pii_hash_key (id, key) VALUES (1, $1);`, key)
+
+	return err
+}
+
+func createResearchKeyTable(db *sql.DB) error {
+	researchKeyTableStmt := `CREATE TABLE IF NOT EXISTS research_key (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		key TEXT NOT NULL
+	);`
+
+	_, err := db.Exec(researchKeyTableStmt)
+	if err != nil {
+		return err
+	}
+
+	// Pseudonyms in research exports are only consistent across exports while this key stays the same
+	key, err := data.NewHashKey()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT OR IGNORE INTO research_key (id, key) VALUES (1, $1);`, key)
+
+	return err
+}
+
+// audit_events is append-only - the triggers refuse any update or delete, and each event is chained to the one before it by hash, so changes made around the triggers can still be detected
+func createAuditEventsTable(db *sql.DB) error {
+	auditEventsTableStmt := `CREATE TABLE IF NOT EXISTS audit_events (
+		id INTEGER PRIMARY KEY,
+		time TEXT NOT NULL,
+		user_id INTEGER NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		prev_hash TEXT NOT NULL,
+		hash TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_audit_events_user_id ON audit_events(user_id);
+	CREATE INDEX IF NOT EXISTS idx_audit_events_action ON audit_events(action);
+
+	CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_events is append-only');
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_events is append-only');
+	END;`
+
+	_, err := db.Exec(auditEventsTableStmt)
+
+	return err
+}
+
+func createErasuresTable(db *sql.DB) error {
+	erasuresTableStmt := `CREATE TABLE IF NOT EXISTS erasures (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		student_key TEXT NOT NULL UNIQUE,
+		erased_by INTEGER NOT NULL,
+		reference TEXT NOT NULL,
+		rows_deleted INTEGER NOT NULL DEFAULT 0,
+		erased_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+
+	_, err := db.Exec(erasuresTableStmt)
+
+	return err
+}
+
 func createSMSTables(db *sql.DB) error {
 	// Includes resultData and results fields
 	resultTableStmt := `CREATE TABLE IF NOT EXISTS results (
@@ -716,6 +1097,160 @@ func createSMSTables(db *sql.DB) error {
 	return err
 }
 
+// The columns that identify a row in each SMS table, used as the entity key in change_log. Tables without a unique constraint use the columns that the InsertMany functions match existing rows on.
+var changeLogKeyColumns = map[string][]string{
+	"assessments":         {"tnv"},
+	"attendance":          {"student_id"},
+	"attendance_values":   {"att_student_id", "date"},
+	"bookings":            {"room", "date", "slot"},
+	"class_efforts":       {"student_id", "date", "slot"},
+	"notices":             {"uuid"},
+	"pastoral":            {"student_id", "type", "ref"},
+	"photos":              {"id"},
+	"recognitions":        {"student_id", "date", "slot"},
+	"results":             {"id", "tnv", "subject"},
+	"staff":               {"uuid"},
+	"staff_groups":        {"staff_uuid", "coreoption", "ref", "name"},
+	"student_awards":      {"student_uuid", "name", "year", "date"},
+	"student_caregivers":  {"student_uuid", "ref"},
+	"student_datasharing": {"student_uuid"},
+	"student_emergency":   {"student_uuid", "name"},
+	"student_flags":       {"student_uuid"},
+	"student_groups":      {"student_uuid", "coreoption", "ref", "name"},
+	"student_residences":  {"student_uuid", "ref"},
+	"students":            {"uuid"},
+	"subjects":            {"id"},
+	"timetables":          {"uuid"},
+}
+
+// change_log is an outbox for downstream consumers: every insert, real update (ignoring upserts that change nothing but listener_updated_at) and delete of an SMS table row is recorded by a trigger with a monotonically increasing seq. Triggers are used rather than Go code in each InsertMany function, as ON CONFLICT DO UPDATE can't report whether a row was inserted, changed or left as it was.
+func createChangeLogTable(db *sql.DB) error {
+	changeLogTableStmt := `CREATE TABLE IF NOT EXISTS change_log (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		entity TEXT NOT NULL,
+		entity_key TEXT NOT NULL,
+		operation TEXT NOT NULL,
+		changed_columns TEXT NOT NULL DEFAULT '[]',
+		changed_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+
+	_, err := db.Exec(changeLogTableStmt)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for table, keyColumns := range changeLogKeyColumns {
+		columns, err := tableColumns(tx, table)
+		if err != nil {
+			return err
+		}
+		if len(columns) == 0 {
+			continue
+		}
+
+		// Triggers are recreated on every start up, so they always reflect the table's current columns
+		for _, stmt := range changeLogTriggerStmts(table, keyColumns, columns) {
+			if _, err := tx.Exec(stmt); err != nil {
+				return fmt.Errorf("couldn't create change_log trigger for %s: %w", table, err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func tableColumns(tx *sql.Tx, table string) ([]string, error) {
+	rows, err := tx.Query(`SELECT name FROM pragma_table_info($1);`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+
+	return columns, rows.Err()
+}
+
+func changeLogTriggerStmts(table string, keyColumns, columns []string) []string {
+	exists := make(map[string]bool)
+	var tracked []string
+	for _, col := range columns {
+		exists[col] = true
+		if col != "listener_updated_at" {
+			tracked = append(tracked, col)
+		}
+	}
+
+	// Join the key columns with "|" to form the entity key, falling back on rowid if none of them exist in the table
+	keyExpr := func(row string) string {
+		var parts []string
+		for _, col := range keyColumns {
+			if exists[col] {
+				parts = append(parts, fmt.Sprintf(`COALESCE(CAST(%s."%s" AS TEXT), '')`, row, col))
+			}
+		}
+		if len(parts) == 0 {
+			return fmt.Sprintf(`CAST(%s.rowid AS TEXT)`, row)
+		}
+		return strings.Join(parts, ` || '|' || `)
+	}
+
+	// Build a JSON array of the names of the columns for which cond is true
+	columnList := func(cond string) string {
+		cases := make([]string, len(tracked))
+		for i, col := range tracked {
+			cases[i] = fmt.Sprintf(`CASE WHEN %s THEN '%s' END`, strings.ReplaceAll(cond, "$col", `"`+col+`"`), col)
+		}
+		return fmt.Sprintf(`(SELECT json_group_array(value) FROM json_each(json_array(%s)) WHERE value IS NOT NULL)`, strings.Join(cases, ", "))
+	}
+
+	changed := make([]string, len(tracked))
+	for i, col := range tracked {
+		changed[i] = fmt.Sprintf(`OLD."%s" IS NOT NEW."%s"`, col, col)
+	}
+
+	insertTrigger := fmt.Sprintf(`CREATE TRIGGER change_log_%[1]s_insert AFTER INSERT ON %[1]s
+	BEGIN
+		INSERT INTO change_log (entity, entity_key, operation, changed_columns)
+		VALUES ('%[1]s', %[2]s, 'insert', %[3]s);
+	END;`, table, keyExpr("NEW"), columnList(`NEW.$col IS NOT NULL`))
+
+	updateTrigger := fmt.Sprintf(`CREATE TRIGGER change_log_%[1]s_update AFTER UPDATE ON %[1]s
+	WHEN %[2]s
+	BEGIN
+		INSERT INTO change_log (entity, entity_key, operation, changed_columns)
+		VALUES ('%[1]s', %[3]s, 'update', %[4]s);
+	END;`, table, strings.Join(changed, " OR "), keyExpr("NEW"), columnList(`OLD.$col IS NOT NEW.$col`))
+
+	deleteTrigger := fmt.Sprintf(`CREATE TRIGGER change_log_%[1]s_retire AFTER DELETE ON %[1]s
+	BEGIN
+		INSERT INTO change_log (entity, entity_key, operation)
+		VALUES ('%[1]s', %[2]s, 'retire');
+	END;`, table, keyExpr("OLD"))
+
+	return []string{
+		fmt.Sprintf(`DROP TRIGGER IF EXISTS change_log_%s_insert;`, table),
+		fmt.Sprintf(`DROP TRIGGER IF EXISTS change_log_%s_update;`, table),
+		fmt.Sprintf(`DROP TRIGGER IF EXISTS change_log_%s_retire;`, table),
+		insertTrigger,
+		updateTrigger,
+		deleteTrigger,
+	}
+}
+
 func userExists(db *sql.DB) (bool, error) {
 	var count int
 	err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+// Create the cipher for the sensitive listener columns from the key file or passphrase the listener was started with. The key is checked against the key check recorded when encryption was first turned on, so a mistyped passphrase can't mix data encrypted with two different keys. Returns nil if encryption has never been turned on and no key was given.
+func (app *application) loadFieldCipher() (*data.FieldCipher, error) {
+	keyFile, passphrase := app.config.encryption.keyFile, app.config.encryption.passphrase
+	if keyFile != "" && passphrase != "" {
+		return nil, errors.New("set either an encryption key file or passphrase, not both")
+	}
+
+	existing, err := app.models.FieldEncryption.Get()
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	if keyFile == "" && passphrase == "" {
+		if existing != nil {
+			return nil, fmt.Errorf("listener data is encrypted - start the listener with the same encryption %s it was encrypted with", existing.KDF)
+		}
+		return nil, nil
+	}
+
+	fe := &data.FieldEncryption{KDF: "keyfile"}
+	if passphrase != "" {
+		fe.KDF = "passphrase"
+	}
+	if existing != nil {
+		if existing.KDF != fe.KDF {
+			return nil, fmt.Errorf("listener data was encrypted using a %s - start the listener with that instead", existing.KDF)
+		}
+		fe.Salt = existing.Salt
+	}
+
+	var key []byte
+	switch fe.KDF {
+	case "keyfile":
+		key, err = readKeyFile(keyFile)
+	case "passphrase":
+		if len(passphrase) < 12 {
+			return nil, errors.New("encryption passphrase must be at least 12 characters long")
+		}
+		if fe.Salt == nil {
+			fe.Salt, err = data.NewSalt()
+			if err != nil {
+				return nil, err
+			}
+		}
+		key, err = data.DeriveFieldKey(passphrase, fe.Salt)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fc, err := data.NewFieldCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	fe.KeyCheck = fc.KeyCheck()
+	if existing == nil {
+		if err := app.models.FieldEncryption.Insert(fe); err != nil {
+			return nil, err
+		}
+	} else if existing.KeyCheck != fe.KeyCheck {
+		return nil, data.ErrWrongEncryptionKey
+	}
+
+	return fc, nil
+}
+
+// A key file holds 32 random bytes, either raw or hex encoded, eg. as created by `openssl rand -hex 32`
+func readKeyFile(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read encryption key file: %w", err)
+	}
+
+	if key, err := hex.DecodeString(strings.TrimSpace(string(contents))); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if len(contents) == 32 {
+		return contents, nil
+	}
+
+	return nil, errors.New("encryption key file must hold 32 bytes, or 64 hex characters")
+}
+
+// Encrypt the columns listed in the encrypted_columns config value from now on, and in the background encrypt any values already stored in them. Columns that don't exist or aren't declared as TEXT are skipped, as encrypted values are text.
+func (app *application) applyEncryptedColumns() {
+	listenerDB := app.models.Exports.DB
+	if listenerDB.Cipher == nil {
+		return
+	}
+
+	columns := data.DefaultEncryptedColumns
+	if entry, err := app.models.Config.GetByKey("encrypted_columns"); err == nil {
+		columns = data.ParseEncryptedColumns(entry.Value)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Columns of each listed table, keyed by lower cased name
+	declared := make(map[string]map[string]data.Column)
+	var valid []string
+	for _, col := range columns {
+		table, column, _ := strings.Cut(col, ".")
+
+		if _, ok := declared[table]; !ok {
+			tableColumns, err := listenerDB.Columns(ctx, table)
+			if err != nil {
+				app.logger.PrintError(err, map[string]any{
+					"message": "couldn't read columns of table to encrypt",
+					"table":   table,
+				})
+				return
+			}
+			declared[table] = make(map[string]data.Column, len(tableColumns))
+			for _, tc := range tableColumns {
+				declared[table][strings.ToLower(tc.Name)] = tc
+			}
+		}
+
+		tc, ok := declared[table][column]
+		if !ok || !strings.EqualFold(tc.Type, "TEXT") {
+			app.logger.PrintError(errors.New("encrypted_columns lists a column that doesn't exist or isn't TEXT, so it won't be encrypted"), map[string]any{
+				"column": col,
+			})
+			continue
+		}
+		valid = append(valid, table+"."+tc.Name)
+	}
+
+	listenerDB.Cipher.SetColumns(valid)
+
+	app.background(func() {
+		app.withDatabases(func() {
+			for _, col := range valid {
+				table, column, _ := strings.Cut(col, ".")
+				n, err := app.models.Exports.DB.EncryptColumn(table, column)
+				if err != nil {
+					app.logger.PrintError(err, map[string]any{
+						"message": "couldn't encrypt existing values",
+						"column":  col,
+					})
+					continue
+				}
+				if n > 0 {
+					app.logger.PrintInfo("existing values encrypted", map[string]any{
+						"column": col,
+						"values": n,
+					})
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+func TestFieldEncryption(t *testing.T) {
+	dir := t.TempDir()
+
+	appDB, _, err := openAppDB(filepath.Join(dir, "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+	listenerDB := newTestListenerDB(t, dir)
+
+	app := newTestApplication(t, appDB, listenerDB)
+	app.config.encryption.passphrase = "correct horse battery staple"
+
+	// A caregiver written before encryption was turned on must be encrypted once it is
+	id, uuid, nsn, email := 1, "uuid-1", "123456789", "student@example.school.nz"
+	careName := "Aroha Smith"
+	student := data.Student{ID: &id, UUID: &uuid, Nsn: &nsn, Email: &email, Caregivers: []data.Caregiver{{Ref: &id, Name: &careName}}}
+	assert.NilError(t, app.models.Students.InsertManyStudents([]data.Student{{ID: &id, UUID: &uuid, Caregivers: student.Caregivers}}))
+
+	listenerDB.Cipher, err = app.loadFieldCipher()
+	assert.NilError(t, err)
+	app.applyEncryptedColumns()
+	app.wg.Wait()
+
+	assert.NilError(t, app.models.Students.InsertManyStudents([]data.Student{student}))
+
+	var rawNsn, rawCareName string
+	assert.NilError(t, listenerDB.QueryRow(`SELECT nsn FROM students WHERE id = 1;`).Scan(&rawNsn))
+	assert.NilError(t, listenerDB.QueryRow(`SELECT name FROM student_caregivers WHERE student_id = 1;`).Scan(&rawCareName))
+	assert.StringContains(t, rawNsn, data.EncryptedPrefix)
+	assert.StringContains(t, rawCareName, data.EncryptedPrefix)
+
+	// Sending the same student again mustn't be recorded as a change, as encryption is deterministic
+	before, err := app.models.ChangeLog.LatestSeq()
+	assert.NilError(t, err)
+	assert.NilError(t, app.models.Students.InsertManyStudents([]data.Student{student}))
+	after, err := app.models.ChangeLog.LatestSeq()
+	assert.NilError(t, err)
+	assert.Equal(t, after, before)
+
+	// Exports are decrypted
+	var csv strings.Builder
+	_, err = app.models.Exports.WriteCSV("students", nil, &csv)
+	assert.NilError(t, err)
+	assert.StringContains(t, csv.String(), "123456789")
+	assert.StringContains(t, csv.String(), "student@example.school.nz")
+
+	// Starting again with a different passphrase must be refused
+	app.config.encryption.passphrase = "incorrect horse battery staple"
+	_, err = app.loadFieldCipher()
+	assert.Equal(t, err, data.ErrWrongEncryptionKey)
+
+	// As must starting without one
+	app.config.encryption.passphrase = ""
+	_, err = app.loadFieldCipher()
+	if err == nil {
+		t.Errorf("expected an error starting without the passphrase")
+	}
+}
@@ -105,6 +105,20 @@ func (app *application) signOutRequiredResponse(c echo.Context) error {
 	return app.redirectErrorResponse(c, "/", http.StatusForbidden, message)
 }
 
+// Sent when a user with 2FA turned on signs in without a code, so the sign in form can ask for one
+func (app *application) twoFactorRequiredResponse(c echo.Context) error {
+	env := envelope{
+		"error":               "enter the code from your authenticator app, or one of your recovery codes",
+		"two_factor_required": true,
+	}
+	return c.JSON(http.StatusUnauthorized, env)
+}
+
+func (app *application) notPermittedResponse(c echo.Context) error {
+	message := "your user account doesn't have the necessary permissions to access this resource"
+	return app.errorResponse(c, http.StatusForbidden, message)
+}
+
 func (app *application) badRequestResponse(c echo.Context, err error) error {
 	return app.errorResponse(c, http.StatusBadRequest, err.Error())
 }
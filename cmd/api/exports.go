@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+)
+
+const defaultExportInterval = 60 * time.Minute
+
+// Returns the directory that exports should be written to - the export_dir config value if one has been set, otherwise the exports folder in the application directory
+func (app *application) exportDir(cfg *data.ListenerConfig) (string, error) {
+	dir, _ := cfg.GetString("export_dir")
+	if dir == "" {
+		dir = app.config.exportDir
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("couldn't create export directory %s: %w", dir, err)
+	}
+
+	return dir, nil
+}
+
+var errExportInProgress = errors.New("an export is already running - wait for it to finish and try again")
+
+type exportOptions struct {
+	format string
+	// Only applies to parquet exports - when true, only rows updated since the previous parquet export are written
+	incremental bool
+	// When true, what students haven't consented to share is exported anyway - only admins can set this, for internal use
+	overrideConsent bool
+}
+
+// Export every table in listener.db to dir in the requested format. Only one export may run at a time - the caller must hold app.exportMu.
+func (app *application) runExport(dir string, opts exportOptions) error {
+	var consent *data.Consent
+	if !opts.overrideConsent {
+		var err error
+		consent, err = app.models.Consent.Load()
+		if err != nil {
+			return err
+		}
+	}
+
+	switch opts.format {
+	case "parquet":
+		return app.exportAllTablesParquet(dir, opts.incremental, consent)
+	default:
+		return app.exportAllTablesCSV(dir, consent)
+	}
+}
+
+// Write a CSV file for every table and view in listener.db to dir. Every table is attempted even if an earlier one fails, and the errors are joined and returned together.
+func (app *application) exportAllTablesCSV(dir string, consent *data.Consent) error {
+	tables, err := app.models.Exports.GetExportableTables()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, table := range tables {
+		var count int
+		err := writeFileAtomic(filepath.Join(dir, table+".csv"), func(w io.Writer) error {
+			var err error
+			count, err = app.models.Exports.WriteCSV(table, consent, w)
+			return err
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", table, err))
+			continue
+		}
+
+		app.logger.PrintInfo("table exported to csv", map[string]any{
+			"table":   table,
+			"records": count,
+		})
+	}
+
+	return errors.Join(errs...)
+}
+
+// Write a Parquet file for every table and view in listener.db to dir. A full export overwrites <table>.parquet, whereas an incremental export writes only the rows updated since the last parquet export to a new timestamped file, so a warehouse can load each file once. Tables and views without listener_updated_at can't be exported incrementally, so are always written in full to <table>.parquet, for the warehouse to replace rather than append. Both record how far they got, so incremental exports can follow a full one.
+func (app *application) exportAllTablesParquet(dir string, incremental bool, consent *data.Consent) error {
+	tables, err := app.models.Exports.GetExportableTables()
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().UTC().Format("20060102T150405Z")
+
+	var errs []error
+	for _, table := range tables {
+		var since data.ExportWatermark
+		path := filepath.Join(dir, table+".parquet")
+		tracked := false
+		if incremental {
+			tracked, err = app.models.Exports.TracksUpdates(table)
+			if err == nil && tracked {
+				since, err = app.models.ExportMarks.Get(table, "parquet")
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", table, err))
+				continue
+			}
+			if tracked {
+				path = filepath.Join(dir, fmt.Sprintf("%s_%s.parquet", table, timestamp))
+			}
+		}
+
+		var count int
+		var watermark data.ExportWatermark
+		err := writeFileAtomic(path, func(w io.Writer) error {
+			var err error
+			count, watermark, err = app.models.Exports.WriteParquet(table, since, consent, w)
+			return err
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", table, err))
+			continue
+		}
+
+		// Don't leave empty files behind for tables that haven't changed since the last incremental export
+		if tracked && count == 0 {
+			os.Remove(path)
+			if watermark.UpdatedAt != since.UpdatedAt || len(watermark.Exported) != len(since.Exported) {
+				// Withheld rows still move the watermark on
+				if err := app.models.ExportMarks.Set(table, "parquet", watermark); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", table, err))
+				}
+			}
+			continue
+		}
+
+		if watermark.UpdatedAt != "" {
+			if err := app.models.ExportMarks.Set(table, "parquet", watermark); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", table, err))
+			}
+		}
+
+		app.logger.PrintInfo("table exported to parquet", map[string]any{
+			"table":       table,
+			"records":     count,
+			"incremental": incremental,
+		})
+	}
+
+	return errors.Join(errs...)
+}
+
+// Write a file by first writing to a temporary file in the same directory, then renaming it over the destination once it is complete. Rename is atomic on the same filesystem, so anything watching the export directory (eg. Power Query or Excel) never picks up a half-written file.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	dir, name := filepath.Split(path)
+
+	tmp, err := os.CreateTemp(dir, "."+name+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	// Clean up the temporary file if anything below fails - after a successful rename this is a no-op
+	defer os.Remove(tmp.Name())
+
+	bw := bufio.NewWriter(tmp)
+	if err := write(bw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Run an export if exports are enabled in config and the configured interval has passed since the last one
+func (app *application) runScheduledExport() {
+	cfg, err := app.listenerConfig()
+	if err != nil {
+		app.logger.PrintError(err, map[string]any{
+			"message": "couldn't load config for scheduled export",
+		})
+		return
+	}
+
+	if !cfg.GetBool("export_enabled") {
+		return
+	}
+
+	interval := defaultExportInterval
+	if minutes, ok := cfg.GetInt("export_interval_minutes"); ok && minutes > 0 {
+		interval = time.Duration(minutes) * time.Minute
+	}
+
+	lastExport, _ := app.appMetrics.ExportSnapshot()
+	if time.Since(lastExport) < interval {
+		return
+	}
+
+	if !app.exportMu.TryLock() {
+		return
+	}
+	defer app.exportMu.Unlock()
+
+	format, _ := cfg.GetString("export_format")
+	opts := exportOptions{
+		format:      format,
+		incremental: cfg.GetBool("export_incremental"),
+	}
+
+	dir, err := app.exportDir(cfg)
+	if err == nil {
+		err = app.runExport(dir, opts)
+	}
+	app.appMetrics.SetLastExport(time.Now(), err)
+
+	if err != nil {
+		app.logger.PrintError(err, map[string]any{
+			"message": "scheduled export failed",
+		})
+		return
+	}
+
+	app.logger.PrintInfo("scheduled export complete", map[string]any{
+		"export_dir": dir,
+		"format":     opts.format,
+	})
+}
+
+type exportRunRequest struct {
+	Format          string `json:"format"`
+	Incremental     bool   `json:"incremental"`
+	OverrideConsent bool   `json:"override_consent"`
+}
+
+// Start a one-off export in the background, independent of the export schedule
+func (app *application) runExportHandler(c echo.Context) error {
+	user := app.contextGetUser(c)
+
+	var req exportRunRequest
+	if err := c.Bind(&req); err != nil {
+		return app.badRequestResponse(c, err)
+	}
+
+	v := validator.New()
+	v.Check(validator.In(req.Format, data.ExportFormats...), "format", "must be one of csv or parquet")
+	if !v.Valid() {
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	if req.OverrideConsent && !user.Can(data.PermissionPrivacy) {
+		return app.notPermittedResponse(c)
+	}
+
+	cfg, err := app.listenerConfig()
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	dir, err := app.exportDir(cfg)
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	if !app.exportMu.TryLock() {
+		return app.errorResponse(c, http.StatusConflict, errExportInProgress.Error())
+	}
+
+	opts := exportOptions{format: req.Format, incremental: req.Incremental, overrideConsent: req.OverrideConsent}
+	app.audit(c, user.ID, data.AuditDataExport, fmt.Sprintf("%s export to %s (incremental=%t)", opts.format, dir, opts.incremental))
+	if opts.overrideConsent {
+		app.logger.PrintInfo("datasharing consent overridden for export", map[string]any{
+			"export_dir": dir,
+			"format":     opts.format,
+			"user_id":    user.ID,
+		})
+		app.audit(c, user.ID, data.AuditConsentOverride, dir)
+	}
+
+	app.background(func() {
+		defer app.exportMu.Unlock()
+
+		var err error
+		app.withDatabases(func() {
+			err = app.runExport(dir, opts)
+		})
+		app.appMetrics.SetLastExport(time.Now(), err)
+		if err != nil {
+			app.logger.PrintError(err, map[string]any{
+				"message": "export failed",
+				"user_id": user.ID,
+			})
+			return
+		}
+
+		app.logger.PrintInfo("export complete", map[string]any{
+			"export_dir":  dir,
+			"format":      opts.format,
+			"incremental": opts.incremental,
+			"user_id":     user.ID,
+		})
+	})
+
+	env := envelope{
+		"success": true,
+		"message": "export started - files will be written to " + dir,
+	}
+
+	return c.JSON(http.StatusAccepted, env)
+}
+
+// Once per minute, check whether a scheduled export is due, so that changes to the export interval on the config page take effect without a restart
+func (app *application) initiateExportCycle() {
+	app.background(func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				app.withDatabases(app.runScheduledExport)
+			case <-app.isShuttingDown:
+				app.logger.PrintInfo("export cycle ending - shut down signal received", nil)
+				return
+			}
+		}
+	})
+}
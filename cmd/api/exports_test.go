@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+func TestCSVExport(t *testing.T) {
+	dir := t.TempDir()
+
+	appDB, _, err := openAppDB(filepath.Join(dir, "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+
+	app := newTestApplication(t, appDB, newTestListenerDB(t, dir))
+
+	id, name, level := "11MAT", "Māthematics", 1
+	otherID, otherName := "12ENG", "English"
+	assert.NilError(t, app.models.Subjects.InsertManySubjects([]data.Subject{{ID: &id, Name: &name, Level: &level}, {ID: &otherID, Name: &otherName}}))
+
+	out := filepath.Join(dir, "exports")
+	assert.NilError(t, os.MkdirAll(out, 0755))
+	assert.NilError(t, app.exportAllTablesCSV(out, nil))
+
+	b, err := os.ReadFile(filepath.Join(out, "subjects.csv"))
+	assert.NilError(t, err)
+	// Starts with a byte order mark, so Excel shows the macron
+	body, ok := strings.CutPrefix(string(b), "\ufeff")
+	assert.Equal(t, ok, true)
+
+	records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	assert.NilError(t, err)
+	assert.Equal(t, len(records), 3)
+
+	header := records[0]
+	idCol, nameCol, levelCol := slices.Index(header, "id"), slices.Index(header, "name"), slices.Index(header, "level")
+	assert.Equal(t, idCol >= 0 && nameCol >= 0 && levelCol >= 0, true)
+	assert.Equal(t, slices.Contains(header, "listener_updated_at"), true)
+
+	slices.SortFunc(records[1:], func(a, b []string) int { return strings.Compare(a[idCol], b[idCol]) })
+	assert.Equal(t, records[1][idCol], "11MAT")
+	assert.Equal(t, records[1][nameCol], "Māthematics")
+	assert.Equal(t, records[1][levelCol], "1")
+	assert.Equal(t, records[2][idCol], "12ENG")
+	assert.Equal(t, records[2][levelCol], "")
+
+	// Every table gets a file, even if it's empty
+	b, err = os.ReadFile(filepath.Join(out, "students.csv"))
+	assert.NilError(t, err)
+	records, err = csv.NewReader(strings.NewReader(strings.TrimPrefix(string(b), "\ufeff"))).ReadAll()
+	assert.NilError(t, err)
+	assert.Equal(t, len(records), 1)
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "subjects.csv")
+	assert.NilError(t, os.WriteFile(path, []byte("previous export"), 0644))
+
+	tmpFiles := func() []string {
+		matches, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+		assert.NilError(t, err)
+		return matches
+	}
+
+	t.Run("A failed write leaves the previous file in place", func(t *testing.T) {
+		errWrite := errors.New("database went away")
+		err := writeFileAtomic(path, func(w io.Writer) error {
+			io.WriteString(w, "half an exp")
+			return errWrite
+		})
+		assert.Equal(t, errors.Is(err, errWrite), true)
+
+		b, err := os.ReadFile(path)
+		assert.NilError(t, err)
+		assert.Equal(t, string(b), "previous export")
+		assert.Equal(t, len(tmpFiles()), 0)
+	})
+
+	t.Run("A successful write replaces it", func(t *testing.T) {
+		assert.NilError(t, writeFileAtomic(path, func(w io.Writer) error {
+			_, err := io.WriteString(w, "new export")
+			return err
+		}))
+
+		b, err := os.ReadFile(path)
+		assert.NilError(t, err)
+		assert.Equal(t, string(b), "new export")
+		assert.Equal(t, len(tmpFiles()), 0)
+	})
+}
+
+func TestIncrementalParquetExport(t *testing.T) {
+	dir := t.TempDir()
+
+	appDB, _, err := openAppDB(filepath.Join(dir, "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+	listenerDB := newTestListenerDB(t, dir)
+
+	app := newTestApplication(t, appDB, listenerDB)
+
+	// Every row is updated in the same second, as they are when KAMAR sends a batch
+	insertStudent := func(id int, uuid string) {
+		t.Helper()
+		assert.NilError(t, app.models.Students.InsertManyStudents([]data.Student{{ID: &id, UUID: &uuid}}))
+		_, err := listenerDB.Exec(`UPDATE students SET listener_updated_at = '2026-03-02 09:15:00';`)
+		assert.NilError(t, err)
+	}
+	export := func(since data.ExportWatermark) (int, data.ExportWatermark) {
+		t.Helper()
+		count, watermark, err := app.models.Exports.WriteParquet("students", since, nil, io.Discard)
+		assert.NilError(t, err)
+		return count, watermark
+	}
+
+	insertStudent(1, "uuid-1")
+	count, watermark := export(data.ExportWatermark{})
+	assert.Equal(t, count, 1)
+	assert.Equal(t, watermark.UpdatedAt, "2026-03-02 09:15:00")
+
+	t.Run("Rows written later in the watermark's second are exported", func(t *testing.T) {
+		insertStudent(2, "uuid-2")
+
+		count, next := export(watermark)
+		assert.Equal(t, count, 1)
+		assert.Equal(t, len(next.Exported), 2)
+
+		count, _ = export(next)
+		assert.Equal(t, count, 0)
+	})
+
+	t.Run("Watermarks are stored", func(t *testing.T) {
+		assert.NilError(t, app.models.ExportMarks.Set("students", "parquet", watermark))
+
+		got, err := app.models.ExportMarks.Get("students", "parquet")
+		assert.NilError(t, err)
+		assert.Equal(t, got.UpdatedAt, watermark.UpdatedAt)
+		assert.Equal(t, len(got.Exported), len(watermark.Exported))
+		assert.Equal(t, got.Exported[0], watermark.Exported[0])
+	})
+
+	t.Run("Tables without listener_updated_at are written in full to a stable file", func(t *testing.T) {
+		_, err := listenerDB.Exec(`CREATE VIEW student_uuids AS SELECT uuid FROM students;`)
+		assert.NilError(t, err)
+
+		out := filepath.Join(dir, "exports")
+		assert.NilError(t, os.MkdirAll(out, 0755))
+		for range 2 {
+			assert.NilError(t, app.exportAllTablesParquet(out, true, nil))
+		}
+
+		matches, err := filepath.Glob(filepath.Join(out, "student_uuids*.parquet"))
+		assert.NilError(t, err)
+		assert.Equal(t, len(matches), 1)
+		assert.Equal(t, filepath.Base(matches[0]), "student_uuids.parquet")
+
+		marks, err := app.models.ExportMarks.Get("student_uuids", "parquet")
+		assert.NilError(t, err)
+		assert.Equal(t, marks.UpdatedAt, "")
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+	views "github.com/michaelcjefferson/kamar-listener/ui/views"
+)
+
+// How long an invited user has to activate their account
+const activationTokenTTL = 24 * time.Hour
+
+type inviteInput struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type activateInput struct {
+	Token    string `json:"token"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Create an activation link for the admin to send to a new user, who follows it to set their own username and password. The email address is only recorded against the invitation in the logs and audit trail - nothing is sent from the listener.
+func (app *application) inviteUserHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+
+	var input inviteInput
+	if err := c.Bind(&input); err != nil {
+		return app.badRequestResponse(c, err)
+	}
+
+	v := validator.New()
+	v.Check(validator.Matches(input.Email, validator.EmailRX), "email", "must be a valid email address")
+	data.ValidateRole(v, input.Role)
+	if !v.Valid() {
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	token, err := app.models.Tokens.NewActivation(u.ID, input.Role, activationTokenTTL)
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	// The link uses the address the admin reached the listener on, which the new user will be able to reach it on too
+	link := fmt.Sprintf("%s://%s/activate?token=%s", c.Scheme(), c.Request().Host, url.QueryEscape(token.Plaintext))
+
+	app.logger.PrintInfo("user invited", map[string]any{
+		"email":      input.Email,
+		"role":       input.Role,
+		"invited_by": u.ID,
+		"expiry":     token.Expiry,
+	})
+	app.audit(c, u.ID, data.AuditUserInvite, fmt.Sprintf("%s (%s)", input.Email, input.Role))
+
+	return c.JSON(http.StatusCreated, envelope{
+		"activation_link": link,
+		"expiry":          token.Expiry,
+	})
+}
+
+func (app *application) activatePageHandler(c echo.Context) error {
+	if !app.contextGetUser(c).IsAnonymous() {
+		return app.signOutRequiredResponse(c)
+	}
+
+	plaintext := c.QueryParam("token")
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, plaintext); !v.Valid() {
+		return app.Render(c, http.StatusNotFound, views.ActivatePage("", nil))
+	}
+
+	token, err := app.models.Tokens.GetActivation(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return app.Render(c, http.StatusNotFound, views.ActivatePage("", nil))
+		default:
+			return app.serverErrorResponse(c, err)
+		}
+	}
+
+	return app.Render(c, http.StatusOK, views.ActivatePage(plaintext, token))
+}
+
+// Create the invited user's account with the username and password they chose, and sign them in. The token can only be used once.
+func (app *application) activateUserHandler(c echo.Context) error {
+	if !app.contextGetUser(c).IsAnonymous() {
+		return app.signOutRequiredResponse(c)
+	}
+
+	var input activateInput
+	if err := c.Bind(&input); err != nil {
+		return app.badRequestResponse(c, err)
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.Token); !v.Valid() {
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	token, err := app.models.Tokens.GetActivation(input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired activation link - ask an admin for a new one")
+			return app.failedValidationResponse(c, v.Errors)
+		default:
+			return app.serverErrorResponse(c, err)
+		}
+	}
+
+	user := &data.User{
+		Username: input.Username,
+		Role:     token.Role,
+	}
+
+	if err := user.Password.Set(input.Password); err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	// Remove the token before creating the account, so the same link can't be used twice at once
+	if err := app.models.Tokens.Delete(token); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "this activation link has already been used")
+			return app.failedValidationResponse(c, v.Errors)
+		default:
+			return app.serverErrorResponse(c, err)
+		}
+	}
+
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		// Give the token back, so the user can try another username
+		if insertErr := app.models.Tokens.Insert(token); insertErr != nil {
+			app.logger.PrintError(insertErr, map[string]any{
+				"message": "error restoring activation token",
+			})
+		}
+
+		switch {
+		case errors.Is(err, data.ErrUserAlreadyExists):
+			v.AddError("username", "a user with this username already exists")
+			return app.failedValidationResponse(c, v.Errors)
+		default:
+			return app.serverErrorResponse(c, err)
+		}
+	}
+
+	app.logger.PrintInfo("invited user activated", map[string]any{
+		"user_id":    user.ID,
+		"username":   user.Username,
+		"role":       user.Role,
+		"invited_by": token.UserID,
+	})
+	app.audit(c, user.ID, data.AuditUserActivate, fmt.Sprintf("user %s (%s, invited by user %d)", user.Username, user.Role, token.UserID))
+
+	if err := app.createAndSetAdminTokenCookie(c, user.ID, app.config.tokens.expiry); err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	return app.redirectResponse(c, "/", http.StatusCreated, envelope{"user": user, "authenticated": true})
+}
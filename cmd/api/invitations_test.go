@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+func TestInvitations(t *testing.T) {
+	appDB, _, err := openAppDB(filepath.Join(t.TempDir(), "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+
+	app := newTestApplication(t, appDB, nil)
+	app.userExists = true
+
+	admin := &data.User{Username: "admin", Role: data.RoleAdmin}
+	assert.NilError(t, admin.Password.Set("correct horse"))
+	assert.NilError(t, app.models.Users.Insert(admin))
+
+	e := echo.New()
+	newContext := func(u *data.User, body string) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		app.contextSetUser(c, u)
+		return c, rec
+	}
+
+	c, rec := newContext(admin, `{"email": "analyst@school.nz", "role": "viewer"}`)
+	assert.NilError(t, app.inviteUserHandler(c))
+	assert.Equal(t, rec.Code, http.StatusCreated)
+
+	var invite struct {
+		ActivationLink string `json:"activation_link"`
+	}
+	assert.NilError(t, json.Unmarshal(rec.Body.Bytes(), &invite))
+	link, err := url.Parse(invite.ActivationLink)
+	assert.NilError(t, err)
+	token := link.Query().Get("token")
+
+	// An activation token can't be used to sign in as the admin who sent it
+	_, _, err = app.models.Users.GetForToken(token)
+	assert.Equal(t, err, data.ErrRecordNotFound)
+
+	activate := `{"token": "` + token + `", "username": "analyst", "password": "analyst password"}`
+	c, rec = newContext(data.AnonymousUser, activate)
+	assert.NilError(t, app.activateUserHandler(c))
+	assert.Equal(t, rec.Code, http.StatusCreated)
+
+	user, err := app.models.Users.GetByUsername("analyst")
+	assert.NilError(t, err)
+	assert.Equal(t, user.Role, data.RoleViewer)
+
+	// and can only be used once
+	c, rec = newContext(data.AnonymousUser, strings.Replace(activate, "analyst", "analyst2", 1))
+	assert.NilError(t, app.activateUserHandler(c))
+	assert.Equal(t, rec.Code, http.StatusUnprocessableEntity)
+
+	events, _, err := app.models.Audit.GetAll(data.Filters{
+		AuditFilters: data.AuditFilters{Action: []string{data.AuditUserInvite, data.AuditUserActivate}},
+		Page:         1,
+		PageSize:     10,
+		Sort:         "id",
+		SortSafeList: []string{"id"},
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, events[0].Target, "analyst@school.nz (viewer)")
+	assert.Equal(t, events[1].UserID, user.ID)
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/michaelcjefferson/kamar-listener/internal/data"
@@ -19,7 +21,12 @@ func (app *application) configPageHandler(c echo.Context) error {
 		return app.serverErrorResponse(c, err)
 	}
 
-	return app.Render(c, http.StatusOK, views.ConfigPage(config, app.config.kamar_write_to_json, u))
+	piiFields, err := app.piiPolicyFields()
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	return app.Render(c, http.StatusOK, views.ConfigPage(config, app.config.kamar_write_to_json, u, piiFields))
 }
 
 func (app *application) updateConfigHandler(c echo.Context) error {
@@ -73,6 +80,11 @@ func (app *application) updateConfigHandler(c echo.Context) error {
 		"value":   req.Value,
 		"user_id": user.ID,
 	})
+	app.audit(c, user.ID, data.AuditConfigUpdate, req.Key+"="+req.Value)
+
+	if req.Key == "encrypted_columns" {
+		app.applyEncryptedColumns()
+	}
 
 	// TODO: Add "success" field to all responses?
 	updatedConfig, err := app.models.Config.GetByKey(req.Key)
@@ -95,9 +107,22 @@ func (app *application) updateConfigPasswordPageHandler(c echo.Context) error {
 	return app.Render(c, http.StatusAccepted, views.UpdatePasswordPage(u, true))
 }
 
+// How long the previous listener password keeps working after it is changed, when no overlap is given
+const defaultKAMARPasswordOverlapDays = 7
+
+// The longest the previous listener password can keep working for
+const maxKAMARPasswordOverlapDays = 30
+
+type kamarPasswordUpdateInput struct {
+	PasswordUpdateInput
+	// Days the previous password is still accepted for, so syncs keep working until KAMAR is given the new one. 0 stops it working straight away.
+	OverlapDays *int `json:"overlap_days"`
+}
+
+// Change the listener password. The previous one becomes the secondary password, which KAMAR can keep using for the overlap.
 func (app *application) updateConfigPasswordHandler(c echo.Context) error {
 	user := app.contextGetUser(c)
-	input := PasswordUpdateInput{}
+	input := kamarPasswordUpdateInput{}
 
 	err := c.Bind(&input)
 	if err != nil {
@@ -132,7 +157,13 @@ func (app *application) updateConfigPasswordHandler(c echo.Context) error {
 		}
 	}
 
+	overlapDays := defaultKAMARPasswordOverlapDays
+	if input.OverlapDays != nil {
+		overlapDays = *input.OverlapDays
+	}
+
 	v := validator.New()
+	v.Check(overlapDays >= 0 && overlapDays <= maxKAMARPasswordOverlapDays, "overlap_days", fmt.Sprintf("must be between 0 and %d", maxKAMARPasswordOverlapDays))
 
 	if data.ValidatePasswordPlaintext(v, input.NewPassword); !v.Valid() {
 		app.logger.PrintError(errors.New("updating listener password - failed validation"), map[string]any{
@@ -153,32 +184,55 @@ func (app *application) updateConfigPasswordHandler(c echo.Context) error {
 		return app.serverErrorResponse(c, err)
 	}
 
-	configEntry := data.ConfigEntry{
-		Key:         "listener_password",
-		Value:       string(p.Hash()),
-		Type:        "password",
-		Description: currPassConf.Description,
+	// Without a current password, or an overlap, there is nothing for KAMAR to keep using
+	secondary, expiry := "", ""
+	var secondaryExpiry time.Time
+	if currPassConf.Value != "" && overlapDays > 0 {
+		secondaryExpiry = time.Now().Add(time.Duration(overlapDays) * 24 * time.Hour).UTC()
+		secondary, expiry = currPassConf.Value, secondaryExpiry.Format(time.RFC3339)
 	}
 
-	err = app.models.Config.Set(configEntry)
-	if err != nil {
-		app.logger.PrintError(err, map[string]any{
-			"message": "error updating listener password",
-			"key":     "listener_password",
-			"user_id": user.ID,
-		})
-		return app.serverErrorResponse(c, err)
+	// The secondary password is set first, so there is no moment where KAMAR's password is accepted as neither
+	updates := []struct{ key, value string }{
+		{"listener_password_secondary", secondary},
+		{"listener_password_secondary_expiry", expiry},
+		{"listener_password", string(p.Hash())},
+	}
+	for _, update := range updates {
+		entry, err := app.models.Config.GetByKey(update.key)
+		if err == nil {
+			entry.Value = update.value
+			err = app.models.Config.Set(entry)
+		}
+		if err != nil {
+			app.logger.PrintError(err, map[string]any{
+				"message": "error updating listener password",
+				"key":     update.key,
+				"user_id": user.ID,
+			})
+			return app.serverErrorResponse(c, err)
+		}
 	}
+	app.resetKAMARSecondaryUse()
 
 	app.logger.PrintInfo("config updated", map[string]any{
-		"message": "successfully updated listener password",
-		"key":     "listener_password",
-		"user_id": user.ID,
+		"message":               "successfully updated listener password",
+		"key":                   "listener_password",
+		"user_id":               user.ID,
+		"secondary_valid_until": expiry,
 	})
+	target := "listener_password"
+	if expiry != "" {
+		target += fmt.Sprintf(" (previous password accepted until %s)", secondaryExpiry.Local().Format(time.DateTime))
+	}
+	app.audit(c, user.ID, data.AuditConfigKAMARAuth, target)
 
 	env := envelope{
 		"success": true,
 	}
+	if expiry != "" {
+		env["secondary_expiry"] = secondaryExpiry
+	}
 
 	return c.JSON(http.StatusAccepted, env)
 }
@@ -268,6 +322,7 @@ func (app *application) setKamarAuthHandler(c echo.Context) error {
 		"key":     "listener_username, listener_password",
 		"user_id": user.ID,
 	})
+	app.audit(c, user.ID, data.AuditConfigKAMARAuth, "listener_username="+kamarAuth.Username)
 
 	env := envelope{
 		"success": true,
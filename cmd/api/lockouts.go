@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+)
+
+const (
+	// Failed attempts allowed before a lockout starts
+	lockoutFreeAttempts = 5
+	// The first lockout lasts this long, and each failure after it doubles it, up to lockoutMaxDelay
+	lockoutBaseDelay = 30 * time.Second
+	lockoutMaxDelay  = time.Hour
+	// Failures are forgotten once there hasn't been one for this long
+	lockoutWindow = 24 * time.Hour
+)
+
+// What failed attempts are counted against - the source IP, an admin username, or the username sent in KAMAR's basic auth
+const (
+	lockoutIP        = "ip"
+	lockoutUser      = "user"
+	lockoutKAMARUser = "kamar_user"
+)
+
+type lockoutKey struct {
+	kind  string
+	value string
+}
+
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// Counts failed attempts in memory, so lockouts end if the listener is restarted
+type lockoutTracker struct {
+	mu      sync.Mutex
+	entries map[lockoutKey]*lockoutEntry
+}
+
+// Returns when the latest lockout of any of keys ends, or the zero time if none of them are locked out
+func (t *lockoutTracker) lockedUntil(now time.Time, keys ...lockoutKey) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var until time.Time
+	for _, k := range keys {
+		if e, ok := t.entries[k]; ok && e.lockedUntil.After(now) && e.lockedUntil.After(until) {
+			until = e.lockedUntil
+		}
+	}
+	return until
+}
+
+// Record a failed attempt against each of keys, returning any that it locks out
+func (t *lockoutTracker) fail(now time.Time, keys ...lockoutKey) []data.Lockout {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.entries == nil {
+		t.entries = make(map[lockoutKey]*lockoutEntry)
+	}
+	t.forgetStale(now)
+
+	var locked []data.Lockout
+	for _, k := range keys {
+		e, ok := t.entries[k]
+		if !ok {
+			e = &lockoutEntry{}
+			t.entries[k] = e
+		}
+		e.failures++
+		e.lastFailure = now
+
+		if e.failures > lockoutFreeAttempts {
+			delay := lockoutBaseDelay << min(e.failures-lockoutFreeAttempts-1, 16)
+			e.lockedUntil = now.Add(min(delay, lockoutMaxDelay))
+			locked = append(locked, data.Lockout{Kind: k.kind, Value: k.value, Failures: e.failures, LockedUntil: e.lockedUntil})
+		}
+	}
+	return locked
+}
+
+// A successful attempt clears the failures counted against each of keys
+func (t *lockoutTracker) succeed(keys ...lockoutKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, k := range keys {
+		delete(t.entries, k)
+	}
+}
+
+func (t *lockoutTracker) unlock(k lockoutKey) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := t.entries[k]
+	delete(t.entries, k)
+	return ok
+}
+
+// Every key currently locked out, with the longest lockouts first
+func (t *lockoutTracker) locked(now time.Time) []data.Lockout {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.forgetStale(now)
+
+	var locked []data.Lockout
+	for k, e := range t.entries {
+		if e.lockedUntil.After(now) {
+			locked = append(locked, data.Lockout{Kind: k.kind, Value: k.value, Failures: e.failures, LockedUntil: e.lockedUntil})
+		}
+	}
+	sort.Slice(locked, func(i, j int) bool { return locked[i].LockedUntil.After(locked[j].LockedUntil) })
+	return locked
+}
+
+// Must be called with t.mu held
+func (t *lockoutTracker) forgetStale(now time.Time) {
+	for k, e := range t.entries {
+		if now.Sub(e.lastFailure) > lockoutWindow && !e.lockedUntil.After(now) {
+			delete(t.entries, k)
+		}
+	}
+}
+
+// Attempts from the IPs in the lockout_exempt_ips config value, such as the KAMAR server's, are never locked out, so a mistyped password doesn't stop syncs
+func (app *application) lockoutExempt(ip string) bool {
+	cfg, err := app.listenerConfig()
+	if err != nil {
+		return false
+	}
+
+	value, _ := cfg.GetString("lockout_exempt_ips")
+	for _, exempt := range strings.Split(value, ",") {
+		if strings.TrimSpace(exempt) == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether any of keys is locked out, unless the request comes from an exempt IP. Returns the time the lockout ends, or the zero time if the attempt can go ahead.
+func (app *application) checkLockout(c echo.Context, keys ...lockoutKey) time.Time {
+	if app.lockoutExempt(c.RealIP()) {
+		return time.Time{}
+	}
+	return app.lockouts.lockedUntil(time.Now(), keys...)
+}
+
+// Count a failed attempt against each of keys, unless the request comes from an exempt IP, and log any lockouts it starts
+func (app *application) recordFailedAttempt(c echo.Context, keys ...lockoutKey) {
+	if app.lockoutExempt(c.RealIP()) {
+		return
+	}
+
+	for _, l := range app.lockouts.fail(time.Now(), keys...) {
+		app.logger.PrintInfo("locked out after repeated failed attempts", map[string]any{
+			"kind":         l.Kind,
+			"value":        l.Value,
+			"failures":     l.Failures,
+			"locked_until": l.LockedUntil.Format(time.RFC3339),
+			"ip":           c.RealIP(),
+		})
+	}
+}
+
+func (app *application) lockedOutResponse(c echo.Context, until time.Time) error {
+	retryAfter := int(time.Until(until).Seconds()) + 1
+	c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+	message := fmt.Sprintf("too many failed attempts - try again in %v", time.Duration(retryAfter)*time.Second)
+	app.logRequest(c, "locked out attempt refused")
+	return app.errorResponse(c, http.StatusTooManyRequests, message)
+}
+
+type unlockInput struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+func (app *application) unlockHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+
+	var input unlockInput
+	if err := c.Bind(&input); err != nil {
+		return app.badRequestResponse(c, err)
+	}
+
+	v := validator.New()
+	v.Check(validator.In(input.Kind, lockoutIP, lockoutUser, lockoutKAMARUser), "kind", "must be one of ip, user or kamar_user")
+	v.Check(input.Value != "", "value", "must be provided")
+	if !v.Valid() {
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	if !app.lockouts.unlock(lockoutKey{input.Kind, input.Value}) {
+		return app.notFoundResponse(c)
+	}
+
+	app.logger.PrintInfo("lockout cleared", map[string]any{
+		"kind":    input.Kind,
+		"value":   input.Value,
+		"user_id": u.ID,
+	})
+	app.audit(c, u.ID, data.AuditLockoutClear, input.Kind+" "+input.Value)
+
+	return c.JSON(http.StatusOK, envelope{"success": true})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+func TestLockoutBackoff(t *testing.T) {
+	var tracker lockoutTracker
+	now := time.Now()
+	key := lockoutKey{lockoutIP, "10.0.0.9"}
+
+	for range lockoutFreeAttempts {
+		assert.Equal(t, len(tracker.fail(now, key)), 0)
+	}
+	assert.Equal(t, tracker.lockedUntil(now, key).IsZero(), true)
+
+	// Each failure after the free attempts doubles the lockout
+	locked := tracker.fail(now, key)
+	assert.Equal(t, len(locked), 1)
+	assert.Equal(t, locked[0].LockedUntil, now.Add(lockoutBaseDelay))
+	locked = tracker.fail(now, key)
+	assert.Equal(t, locked[0].LockedUntil, now.Add(2*lockoutBaseDelay))
+
+	for range 20 {
+		locked = tracker.fail(now, key)
+	}
+	assert.Equal(t, locked[0].LockedUntil, now.Add(lockoutMaxDelay))
+	assert.Equal(t, len(tracker.locked(now)), 1)
+
+	// Lockouts end on their own, and failures are eventually forgotten
+	assert.Equal(t, tracker.lockedUntil(now.Add(lockoutMaxDelay+time.Second), key).IsZero(), true)
+	assert.Equal(t, len(tracker.locked(now.Add(lockoutWindow+time.Hour))), 0)
+	assert.Equal(t, len(tracker.entries), 0)
+
+	tracker.fail(now, key)
+	tracker.succeed(key)
+	assert.Equal(t, len(tracker.entries), 0)
+}
+
+func TestSignInLockout(t *testing.T) {
+	appDB, _, err := openAppDB(filepath.Join(t.TempDir(), "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+
+	app := newTestApplication(t, appDB, nil)
+	app.userExists = true
+	app.config.tokens.expiry = time.Hour
+
+	user := &data.User{Username: "admin", Role: data.RoleAdmin}
+	assert.NilError(t, user.Password.Set("correct horse"))
+	assert.NilError(t, app.models.Users.Insert(user))
+
+	e := echo.New()
+	signIn := func(ip, password string) *httptest.ResponseRecorder {
+		body := `{"username": "admin", "password": "` + password + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/sign-in", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderXRealIP, ip)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		app.contextSetUser(c, data.AnonymousUser)
+		assert.NilError(t, app.signInUserHandler(c))
+		return rec
+	}
+
+	for range lockoutFreeAttempts + 1 {
+		assert.Equal(t, signIn("10.0.0.9", "wrong password").Code, http.StatusUnauthorized)
+	}
+
+	// Once locked out, even the right password is refused - from any IP, as the username is locked out too
+	rec := signIn("10.0.0.9", "correct horse")
+	assert.Equal(t, rec.Code, http.StatusTooManyRequests)
+	assert.Equal(t, rec.Header().Get("Retry-After") != "", true)
+	assert.Equal(t, signIn("10.0.0.10", "correct horse").Code, http.StatusTooManyRequests)
+
+	// Exempt IPs are never locked out
+	assert.NilError(t, app.models.Config.Set(data.ConfigEntry{Key: "lockout_exempt_ips", Value: "10.0.0.50, 10.0.0.51", Type: "string"}))
+	assert.Equal(t, signIn("10.0.0.51", "correct horse").Code, http.StatusAccepted)
+
+	// Unlocking the username and IP lets the user back in
+	app.lockouts.fail(time.Now(), lockoutKey{lockoutUser, "admin"})
+	assert.Equal(t, app.lockouts.unlock(lockoutKey{lockoutUser, "admin"}), true)
+	assert.Equal(t, app.lockouts.unlock(lockoutKey{lockoutIP, "10.0.0.9"}), true)
+	assert.Equal(t, signIn("10.0.0.9", "correct horse").Code, http.StatusAccepted)
+}
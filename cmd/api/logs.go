@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
@@ -90,6 +91,7 @@ func (app *application) getIndividualLogPageHandler(c echo.Context) error {
 }
 
 func (app *application) deleteIndividualLogHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
 	id, err := app.readIDParam(c)
 	if err != nil {
 		app.notFoundResponse(c)
@@ -107,6 +109,8 @@ func (app *application) deleteIndividualLogHandler(c echo.Context) error {
 		return err
 	}
 
+	app.audit(c, u.ID, data.AuditLogsDelete, fmt.Sprintf("log %d", id))
+
 	return app.redirectResponse(c, "/logs", http.StatusAccepted, "log successfully deleted")
 }
 
@@ -128,6 +132,7 @@ func (app *application) deleteLogsWithinTimeframeHandler(c echo.Context) error {
 		"end_time":   p.EndTime,
 		"user_id":    u.ID,
 	})
+	app.audit(c, u.ID, data.AuditLogsDelete, logTimeRange(*p))
 
 	return app.redirectResponse(c, "/", http.StatusAccepted, nil)
 }
@@ -149,6 +154,7 @@ func (app *application) pruneLogsWidgetHandler(c echo.Context) error {
 		"end_time":   p.EndTime,
 		"user_id":    u.ID,
 	})
+	app.audit(c, u.ID, data.AuditLogsDelete, logTimeRange(*p))
 
 	logFilters := data.Filters{
 		LogFilters:   data.LogFilters{},
@@ -212,3 +218,15 @@ func (app *application) getFilteredLogsHandler(c echo.Context) error {
 
 	return app.Render(c, http.StatusAccepted, components.LogsContainer(logs, metadata))
 }
+
+// Describe the logs a deletion covers, eg. "logs from the first log to 2025-05-19 09:27:59", for the audit trail
+func logTimeRange(p data.LogDeletionParams) string {
+	start, end := "the first log", "now"
+	if p.StartTime != nil {
+		start = p.StartTime.UTC().Format("2006-01-02 15:04:05")
+	}
+	if p.EndTime != nil {
+		end = p.EndTime.UTC().Format("2006-01-02 15:04:05")
+	}
+	return "logs from " + start + " to " + end
+}
@@ -8,33 +8,49 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/michaelcjefferson/kamar-listener/internal/data"
 	"github.com/michaelcjefferson/kamar-listener/internal/getip"
 	"github.com/michaelcjefferson/kamar-listener/internal/jsonlog"
 	"github.com/michaelcjefferson/kamar-listener/internal/setfiledirs"
-	"github.com/michaelcjefferson/kamar-listener/internal/tlscerts"
 
 	// _ "modernc.org/sqlite"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type config struct {
-	ip                   string
+	backupDir            string
 	port                 int
 	env                  string
+	exportDir            string
 	dblogs_on            bool
 	kamar_auth_set       bool
 	kamar_write_to_json  bool
 	kamar_db_table_names []string
-	https_on             bool
 	basePath             string
 	dbPaths              struct {
 		appDB      string
 		dbDir      string
 		listenerDB string
 	}
+	// The database holding data received from KAMAR - SQLite at dbPaths.listenerDB by default, or PostgreSQL at dsn
+	listenerStore struct {
+		driver string
+		dsn    string
+	}
+	// Key material for the sensitive listener columns - never stored, so it must be given every time the listener starts
+	encryption struct {
+		keyFile    string
+		passphrase string
+	}
+	// When dir is set, the listener writes a pseudonymised research export there and exits, rather than starting
+	research struct {
+		dir     string
+		format  string
+		minCell int
+	}
 	// rps (requests per second) must be float, burst must be int for limiter. enabled allows turning off the rate limiter for, for example load testing.
 	limiter struct {
 		rps     float64
@@ -50,18 +66,47 @@ type config struct {
 		expiry  time.Duration
 		refresh time.Duration
 	}
+	// Where KAMAR's requests are received - on every interface at port, unless an addr is given
+	kamar listenerConfig
+	// Where the admin UI is served. Without an addr it shares the KAMAR listener, as it did before they could be separated.
+	admin listenerConfig
+}
+
+// Where and how one of the listener's servers accepts connections
+type listenerConfig struct {
+	addr         string
+	https_on     bool
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
 }
 
 type application struct {
 	appMetrics   appMetrics
 	assetHandler http.Handler
-	config       config
+	// The config, and KAMAR's last verified credentials, cached in memory
+	configs configService
+	// The certificate served to HTTPS clients, which can be replaced while the listener runs
+	certs  certStore
+	config config
+	// Held for reading by every request and background job that uses models, and for writing while a backup is restored and the databases are reopened
+	dbMu sync.RWMutex
+	// Held while a backup is being taken or restored
+	backupMu sync.Mutex
+	// Held while an export is running, so scheduled and one-off exports never write to the same files at once
+	exportMu sync.Mutex
 	// Allows processes, eg. token deletion cycle, to respond to this channel closing (and eg. perform tidy up operations)
 	isShuttingDown chan struct{}
-	logger         *jsonlog.Logger
-	models         data.Models
-	userExists     bool
-	wg             sync.WaitGroup
+	// The host's IP address, as a string - it can change while the listener runs, eg. when DHCP gives the machine a new one
+	ip atomic.Value
+	// Failed sign in and KAMAR auth attempts, for locking out sources of repeated failures
+	lockouts lockoutTracker
+	logger   *jsonlog.Logger
+	models   data.Models
+	// Workers copying each committed batch to the replication sinks
+	replication replicator
+	userExists  bool
+	wg          sync.WaitGroup
 }
 
 func main() {
@@ -74,6 +119,17 @@ func main() {
 
 	flag.StringVar(&cfg.dbPaths.appDB, "app-db-path", "./db/app.db", "Path to SQLite .db file holding user data, config, logs etc.")
 	flag.StringVar(&cfg.dbPaths.listenerDB, "listener-db-path", "./db/listener.db", "Path to SQLite .db file holding data received from KAMAR directory service.")
+	flag.StringVar(&cfg.listenerStore.driver, "listener-db-driver", "sqlite", "Database to store data received from KAMAR directory service in (sqlite|postgres).")
+	// Read from the environment by default so the password isn't visible in the process list
+	flag.StringVar(&cfg.listenerStore.dsn, "listener-db-dsn", os.Getenv("LISTENER_DB_DSN"), "PostgreSQL connection string, used when listener-db-driver is postgres.")
+
+	flag.StringVar(&cfg.encryption.keyFile, "encryption-key-file", "", "Path to a file holding the key (32 bytes, or 64 hex characters) used to encrypt sensitive listener columns.")
+	// Read from the environment by default so the passphrase isn't visible in the process list
+	flag.StringVar(&cfg.encryption.passphrase, "encryption-passphrase", os.Getenv("LISTENER_ENCRYPTION_PASSPHRASE"), "Passphrase used to derive the key that encrypts sensitive listener columns.")
+
+	flag.StringVar(&cfg.research.dir, "research-export", "", "Write a pseudonymised research export to this directory, then exit.")
+	flag.StringVar(&cfg.research.format, "research-format", "csv", "Format of the research export (csv|sqlite).")
+	flag.IntVar(&cfg.research.minCell, "research-min-cell", 5, "Counts below this in research export summaries are suppressed. Set to 0 to turn suppression off.")
 
 	flag.StringVar(&cfg.tlsPaths.tlsDir, "tls-dir-path", "./tls", "Path to directory holding tls files")
 
@@ -84,17 +140,33 @@ func main() {
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 8, "Rate limiter maximum burst.")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", false, "Enable rate limiter.")
 
-	flag.BoolVar(&cfg.https_on, "https_on", true, "Turn server-side HTTPS on or off.")
+	flag.StringVar(&cfg.kamar.addr, "kamar-addr", "", "Address to receive KAMAR's requests on, eg. 10.0.0.2:8085. Defaults to every interface on -port.")
+	flag.BoolVar(&cfg.kamar.https_on, "https_on", true, "Turn server-side HTTPS on or off for the KAMAR listener, and the admin UI when it shares it.")
+	// KAMAR can take minutes to upload a large sync, so it has no read or write timeout by default
+	flag.DurationVar(&cfg.kamar.readTimeout, "kamar-read-timeout", 0, "Maximum time to read a request from KAMAR, including its body. 0 means no limit.")
+	flag.DurationVar(&cfg.kamar.writeTimeout, "kamar-write-timeout", 0, "Maximum time to write a response to KAMAR. 0 means no limit.")
+	flag.DurationVar(&cfg.kamar.idleTimeout, "kamar-idle-timeout", time.Minute, "Maximum time to keep KAMAR's idle connections open.")
+
+	flag.StringVar(&cfg.admin.addr, "admin-addr", "", "Address to serve the admin UI on, eg. 127.0.0.1:8086. When empty, the admin UI is served on the KAMAR listener.")
+	flag.BoolVar(&cfg.admin.https_on, "admin-https_on", true, "Turn server-side HTTPS on or off for the admin UI, when it has its own listener.")
+	flag.DurationVar(&cfg.admin.readTimeout, "admin-read-timeout", 30*time.Second, "Maximum time to read a request to the admin UI.")
+	// Exports and backups are run while the request waits, so writes aren't limited by default
+	flag.DurationVar(&cfg.admin.writeTimeout, "admin-write-timeout", 0, "Maximum time to write a response from the admin UI. 0 means no limit.")
+	flag.DurationVar(&cfg.admin.idleTimeout, "admin-idle-timeout", time.Minute, "Maximum time to keep idle admin UI connections open.")
 	flag.BoolVar(&cfg.dblogs_on, "dblogs_on", true, "Turn writing logs to database on or off.")
 
 	flag.Parse()
 
+	if cfg.kamar.addr == "" {
+		cfg.kamar.addr = fmt.Sprintf(":%d", cfg.port)
+	}
+
 	// TODO: Likely unnecessary, as TLS and DB paths are already set in writable static folders
 	// if cfg.env == "production" {
 	// 	checkrundir.EnforceRunLocation()
 	// }
 
-	dirs, err := setfiledirs.SetFileDirs("kamar-listener", []string{"db", "tls"})
+	dirs, err := setfiledirs.SetFileDirs("kamar-listener", []string{"backups", "db", "exports", "tls"})
 	if err != nil {
 		log.Fatalf("couldn't set up app data directories: %v", err)
 	}
@@ -106,6 +178,9 @@ func main() {
 	cfg.dbPaths.appDB = filepath.Join(cfg.dbPaths.dbDir, "app.db")
 	cfg.dbPaths.listenerDB = filepath.Join(cfg.dbPaths.dbDir, "listener.db")
 
+	cfg.exportDir = dirs.FileDirs["exports"]
+	cfg.backupDir = dirs.FileDirs["backups"]
+
 	cfg.tlsPaths.tlsDir = dirs.FileDirs["tls"]
 	cfg.tlsPaths.cert = filepath.Join(cfg.tlsPaths.tlsDir, "cert.pem")
 	cfg.tlsPaths.key = filepath.Join(cfg.tlsPaths.tlsDir, "key.pem")
@@ -128,19 +203,18 @@ func main() {
 		time.Sleep(20 * time.Second)
 	}
 
-	defer appDB.Close()
 	app.userExists = userExists
 
-	listenerDB, err := openKamarDB(cfg.dbPaths.listenerDB)
+	listenerDB, err := openListenerDB(cfg)
 	if err != nil {
 		fmt.Printf("error setting up listener database: %v\n", err)
 		time.Sleep(20 * time.Second)
 	}
 
-	defer listenerDB.Close()
-
 	models := data.NewModels(appDB, listenerDB, app.background)
 	app.models = models
+	// Close whichever connections are open at exit, as restoring a backup replaces them
+	defer app.closeDatabases()
 
 	// Instantiate logger that will log anything at or above info level. To write from a different level, change this parameter.
 	var logger *jsonlog.Logger
@@ -153,6 +227,30 @@ func main() {
 	app.logger = logger
 	app.logger.PrintInfo("database connection established", nil)
 
+	// Listener data must never be written unencrypted, or with a different key, once encryption has been turned on - so rather than run without it, stop
+	listenerDB.Cipher, err = app.loadFieldCipher()
+	if err != nil {
+		app.logger.PrintFatal(err, map[string]any{
+			"message": "couldn't set up encryption of sensitive listener columns",
+		})
+	}
+	app.applyEncryptedColumns()
+
+	if cfg.research.dir != "" {
+		path, err := app.runResearchExport(cfg.research.dir, cfg.research.format, cfg.research.minCell)
+		if err != nil {
+			app.logger.PrintFatal(err, map[string]any{
+				"message": "research export failed",
+			})
+		}
+		app.logger.PrintInfo("research export complete", map[string]any{
+			"path":     path,
+			"format":   cfg.research.format,
+			"min_cell": cfg.research.minCell,
+		})
+		return
+	}
+
 	app.config.kamar_auth_set, err = app.kamarAuthIsSet()
 	if err != nil {
 		app.logger.PrintFatal(err, nil)
@@ -176,11 +274,10 @@ func main() {
 	if err != nil {
 		app.logger.PrintError(err, nil)
 	}
-	// TODO: Add local IP field in config db. Check if previous local IP exists, and if it does and it's different to the one returned by GetLocalIP, generate new SSL certs
 
-	app.config.ip = ip
+	app.ip.Store(ip)
 	app.logger.PrintInfo("ip address set", map[string]any{
-		"ip_address": app.config.ip,
+		"ip_address": ip,
 	})
 
 	// if cfg.env == "production" {
@@ -190,11 +287,14 @@ func main() {
 	// 	}
 	// }
 
-	err = tlscerts.GenerateTLSCert(app.config.tlsPaths.tlsDir, ip, app.logger)
-	// If SSL certs couldn't be found or generated, serve over HTTP; otherwise, serve over HTTPS
-	if err != nil {
+	// Only creates a certificate if there isn't one - checkCertificate replaces it if it doesn't suit the host any more
+	if err := app.generateCertificate(ip); err != nil {
+		app.logger.PrintError(err, nil)
+	}
+	if err := app.loadCertificate(); err != nil {
 		app.logger.PrintError(err, nil)
 	}
+	app.checkCertificate()
 
 	err = app.serve()
 	if err != nil {
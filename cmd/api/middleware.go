@@ -51,6 +51,11 @@ func (app *application) authenticateKAMAR(next echo.HandlerFunc) echo.HandlerFun
 	return func(c echo.Context) error {
 		// app.logRequest(c, "hit authenticateKAMAR middleware")
 
+		ipKey := lockoutKey{lockoutIP, c.RealIP()}
+		if until := app.checkLockout(c, ipKey); !until.IsZero() {
+			return app.kamarLockedOutResponse(c, until)
+		}
+
 		authHeader := c.Request().Header.Get("Authorization")
 		if authHeader == "" {
 			app.logger.PrintInfo("listener: failed at authHeader", nil)
@@ -60,40 +65,30 @@ func (app *application) authenticateKAMAR(next echo.HandlerFunc) echo.HandlerFun
 		headerParts := strings.Split(authHeader, " ")
 		if len(headerParts) != 2 || headerParts[0] != "Basic" {
 			app.logger.PrintInfo("listener: failed at headerParts", nil)
+			app.recordFailedAttempt(c, ipKey)
 			return app.kamarAuthFailedResponse(c)
 		}
 
 		decodedAuth, err := base64.StdEncoding.DecodeString(headerParts[1])
 		if err != nil {
 			app.logger.PrintInfo("listener: failed at decodedAuth", nil)
+			app.recordFailedAttempt(c, ipKey)
 			return app.kamarAuthFailedResponse(c)
 		}
 
-		cfg, err := app.models.Config.LoadConfig()
+		cfg, err := app.listenerConfig()
 		if err != nil {
 			app.logger.PrintFatal(err, map[string]any{
 				"message": "error loading KAMAR config from database",
 			})
 		}
 
-		// TODO: Consider using this rather than loading full config for middleware checking. Even better, store values in cfg (memory) to reduce db calls?
-		_, err = app.models.Config.GetAuth()
-		if err != nil {
-			app.logger.PrintFatal(err, map[string]any{
-				"message": "error loading KAMAR auth from database",
-			})
-		}
-		// app.logger.PrintInfo("kamar auth loaded from database", map[string]any{
-		// 	"username":      kamarUser.Username,
-		// 	"password_hash": kamarUser.Password.Hash(),
-		// })
-
 		kUsername, ok := cfg.GetString("listener_username")
 		if !ok {
 			return app.serverErrorResponse(c, errors.New("couldn't get username for kamar directory service from the database"))
 		}
-		kPassword, ok := cfg.GetPassword("listener_password")
-		if !ok {
+		// The password itself is checked by matchKAMARPassword, along with the secondary password
+		if _, ok := cfg.GetPassword("listener_password"); !ok {
 			return app.serverErrorResponse(c, errors.New("couldn't get password for kamar directory service from the database"))
 		}
 
@@ -104,30 +99,41 @@ func (app *application) authenticateKAMAR(next echo.HandlerFunc) echo.HandlerFun
 				"auth_credentials_from_header": authCredentials,
 				"number_of_auth_elements":      len(authCredentials),
 			})
+			app.recordFailedAttempt(c, ipKey)
 			return app.kamarAuthFailedResponse(c)
 		}
 
+		lockoutKeys := []lockoutKey{ipKey, {lockoutKAMARUser, authCredentials[0]}}
+		if until := app.checkLockout(c, lockoutKeys...); !until.IsZero() {
+			return app.kamarLockedOutResponse(c, until)
+		}
+
 		// Check username
 		if authCredentials[0] != kUsername {
 			app.logger.PrintInfo("listener: username doesn't match", map[string]any{
 				"expected_user": kUsername,
 				"got_user":      authCredentials[0],
 			})
+			app.recordFailedAttempt(c, lockoutKeys...)
 			return app.kamarAuthFailedResponse(c)
 		}
 
 		// Check password
-		matches, err := kPassword.Matches(authCredentials[1])
+		credential, err := app.matchKAMARPassword(cfg, authCredentials[0], authCredentials[1], time.Now())
 		if err != nil {
 			app.logger.PrintError(err, nil)
 			return app.serverErrorResponse(c, err)
 		}
-		if !matches {
+		if credential == "" {
 			app.logger.PrintInfo("listener: passwords don't match", nil)
+			app.recordFailedAttempt(c, lockoutKeys...)
 			return app.kamarAuthFailedResponse(c)
 		}
 
-		app.logger.PrintInfo("listener: successfully authenticated request from KAMAR", nil)
+		app.lockouts.succeed(lockoutKeys...)
+		app.logger.PrintInfo("listener: successfully authenticated request from KAMAR", map[string]any{
+			"credential": credential,
+		})
 		return next(c)
 	}
 }
@@ -174,26 +180,36 @@ func (app *application) authenticateUser(next echo.HandlerFunc) echo.HandlerFunc
 
 		expiryTimeFrame := time.Now().Add(app.config.tokens.refresh)
 
-		// Check if the token expiry is within the timeframe, and if so, generate a new token and return it
+		// Check if the token expiry is within the timeframe, and if so, extend it and send the cookie again with the new expiry - the session carries on, rather than being replaced by a new one
 		if expiryTime.Before(expiryTimeFrame) {
-			app.logger.PrintInfo("token near expiry - creating new token and sending to user", map[string]any{
+			app.logger.PrintInfo("token near expiry - extending token and sending to user", map[string]any{
 				"user id":           user.ID,
 				"expiry time":       tokenExpiry,
 				"expiry time frame": expiryTimeFrame,
 			})
-			app.createAndSetAdminTokenCookie(c, user.ID, app.config.tokens.expiry)
+			if err := app.models.Tokens.Extend(token, app.config.tokens.expiry); err != nil {
+				return app.serverErrorResponse(c, err)
+			}
+			app.setAdminTokenCookie(c, token, app.config.tokens.expiry)
+		}
+
+		// Keep the sessions page's last used time, IP and user agent up to date. Failing to is no reason to refuse the request.
+		if err := app.models.Tokens.Touch(token, c.RealIP(), c.Request().UserAgent()); err != nil {
+			app.logger.PrintError(err, map[string]any{
+				"message": "couldn't record session use",
+				"user_id": user.ID,
+			})
 		}
 
 		// Attach user data to context
 		app.contextSetUser(c, user)
+		app.contextSetSessionToken(c, token)
 
 		// Call next handler in the chain.
 		return next(c)
 	}
 }
 
-// TODO: Add activation and requireActivatedUser for new user registrations after initial set-up - admins can go to an add user page, and enter an email address to send an activation code to. This creates an activation token in the database, and provides it as part of a link for the admin to copy and paste into an email to the new user. The new user can follow that link to be brought to an activation page, where they create a username and password, and a new account is created. Activation tokens valid for 24 (?) hours
-
 // Runs after authenticate, only needed on protected routes - checks the context for the value of the user set by authenticate, and at this point only ensures that one exists, as it means that someone is logged in and can access protected routes
 func (app *application) requireAuthenticatedUser(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -211,6 +227,19 @@ func (app *application) requireAuthenticatedUser(next echo.HandlerFunc) echo.Han
 	}
 }
 
+// Runs after requireAuthenticatedUser, set on each route to the permission the user's role must grant to reach it
+func (app *application) requirePermission(permission data.Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !app.contextGetUser(c).Can(permission) {
+				return app.notPermittedResponse(c)
+			}
+
+			return next(c)
+		}
+	}
+}
+
 // // TODO: Add to config for app, including instructions to find IP address of KAMAR instance
 // func (app *application) processCORS(next http.Handler) http.Handler {
 // 	c := cors.New(cors.Options{
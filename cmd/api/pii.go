@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+)
+
+// List every field on the PII policy editor. Dropped fields show how many values the listener database still holds for them, which should always be 0 - this is how it can be shown that a dropped field is never stored.
+func (app *application) piiPolicyFields() ([]data.PIIField, error) {
+	rules, err := app.models.PIIPolicy.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := data.PIIPolicyFields(rules)
+	for i, f := range fields {
+		if f.Action != data.PIIDrop {
+			continue
+		}
+		table, column, ok := app.piiColumn(f.Entity, f.Field)
+		if !ok {
+			continue
+		}
+		n, err := app.models.Exports.DB.CountStored(table, column)
+		if err != nil {
+			return nil, err
+		}
+		fields[i].Stored = n
+	}
+
+	return fields, nil
+}
+
+// Find where a field is stored, checking the column really exists, as not every field KAMAR can send has a column of its own
+func (app *application) piiColumn(entity, field string) (string, string, bool) {
+	table, column, ok := data.PIIColumn(entity, field)
+	if !ok || column == "" {
+		return table, column, ok
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	columns, err := app.models.Exports.DB.Columns(ctx, table)
+	if err != nil {
+		return "", "", false
+	}
+	for _, c := range columns {
+		if strings.EqualFold(c.Name, column) {
+			return table, c.Name, true
+		}
+	}
+	return "", "", false
+}
+
+// Remove the values already stored for a field that has just been dropped, so that it is held nowhere from now on, not just left out of new data
+func (app *application) clearDroppedPII(rule *data.PIIRule) (int64, error) {
+	table, column, ok := app.piiColumn(rule.Entity, rule.Field)
+	if !ok {
+		return 0, nil
+	}
+	return app.models.Exports.DB.ClearStored(table, column)
+}
+
+func (app *application) updatePIIPolicyHandler(c echo.Context) error {
+	user := app.contextGetUser(c)
+
+	var rule data.PIIRule
+	if err := c.Bind(&rule); err != nil {
+		return app.badRequestResponse(c, err)
+	}
+
+	v := validator.New()
+	if data.ValidatePIIRule(v, &rule); !v.Valid() {
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	if err := app.models.PIIPolicy.Set(&rule); err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	app.logger.PrintInfo("pii policy updated", map[string]any{
+		"entity":  rule.Entity,
+		"field":   rule.Field,
+		"action":  rule.Action,
+		"user_id": user.ID,
+	})
+	app.audit(c, user.ID, data.AuditConfigPIIPolicy, rule.Entity+"."+rule.Field+"="+rule.Action)
+
+	env := envelope{
+		"success":   true,
+		"updatedAt": rule.UpdatedAt,
+	}
+
+	if rule.Action == data.PIIDrop {
+		cleared, err := app.clearDroppedPII(&rule)
+		if err != nil {
+			return app.serverErrorResponse(c, err)
+		}
+		if cleared > 0 {
+			app.logger.PrintInfo("stored values of dropped field removed", map[string]any{
+				"entity": rule.Entity,
+				"field":  rule.Field,
+				"values": cleared,
+			})
+		}
+		env["cleared"] = cleared
+	}
+
+	return c.JSON(http.StatusAccepted, env)
+}
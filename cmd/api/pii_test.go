@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+)
+
+func TestPIIPolicy(t *testing.T) {
+	dir := t.TempDir()
+
+	appDB, _, err := openAppDB(filepath.Join(dir, "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+	listenerDB := newTestListenerDB(t, dir)
+
+	app := newTestApplication(t, appDB, listenerDB)
+
+	newStudent := func() data.Student {
+		id, uuid, nsn, datebirth := 1, "uuid-1", "123456789", 20070512
+		careName, careMobile, careEmail := "Aroha Smith", "021 555 1234", "aroha@example.co.nz"
+		street, postcode := "12A Example Street", "9300"
+		return data.Student{
+			ID: &id, UUID: &uuid, Nsn: &nsn, Datebirth: &datebirth,
+			Caregivers: []data.Caregiver{{Ref: &id, Name: &careName, Mobile: &careMobile, Email: &careEmail}},
+			Residences: []data.Residence{{Ref: &id, NumStreet: &street, Postcode: &postcode}},
+		}
+	}
+	setRule := func(entity, field, action string) {
+		t.Helper()
+		rule := &data.PIIRule{Entity: entity, Field: field, Action: action}
+		v := validator.New()
+		data.ValidatePIIRule(v, rule)
+		assert.Equal(t, v.Valid(), true)
+		assert.NilError(t, app.models.PIIPolicy.Set(rule))
+		if action == data.PIIDrop {
+			_, err := app.clearDroppedPII(rule)
+			assert.NilError(t, err)
+		}
+	}
+
+	// Without a policy, everything is stored
+	assert.NilError(t, app.models.Students.InsertManyStudents([]data.Student{newStudent()}))
+	var mobile sql.NullString
+	assert.NilError(t, listenerDB.QueryRow(`SELECT mobile FROM student_caregivers WHERE student_id = 1;`).Scan(&mobile))
+	assert.Equal(t, mobile.String, "021 555 1234")
+
+	// Dropping caregiver mobiles removes the ones already stored, stops them being stored, and stops them being asked for
+	setRule("students", "caregiver.mobile", data.PIIDrop)
+	setRule("students", "nsn", data.PIIHash)
+	setRule("students", "datebirth", data.PIITruncate)
+	setRule("students", "res", data.PIITruncate)
+	setRule("students", "caregiver.email", data.PIITruncate)
+
+	assert.NilError(t, listenerDB.QueryRow(`SELECT mobile FROM student_caregivers WHERE student_id = 1;`).Scan(&mobile))
+	assert.Equal(t, mobile.Valid, false)
+
+	assert.NilError(t, app.models.Students.InsertManyStudents([]data.Student{newStudent()}))
+
+	var nsn, careEmail, postcode string
+	var numStreet sql.NullString
+	var datebirth int
+	assert.NilError(t, listenerDB.QueryRow(`SELECT nsn, datebirth FROM students WHERE id = 1;`).Scan(&nsn, &datebirth))
+	assert.NilError(t, listenerDB.QueryRow(`SELECT mobile, email FROM student_caregivers WHERE student_id = 1;`).Scan(&mobile, &careEmail))
+	assert.NilError(t, listenerDB.QueryRow(`SELECT numStreet, postcode FROM student_residences WHERE student_id = 1;`).Scan(&numStreet, &postcode))
+	assert.Equal(t, mobile.Valid, false)
+	assert.StringContains(t, nsn, data.PIIHashPrefix)
+	assert.Equal(t, datebirth, 2007)
+	assert.Equal(t, careEmail, "@example.co.nz")
+	assert.Equal(t, numStreet.Valid, false)
+	assert.Equal(t, postcode, "9300")
+
+	fields, err := app.piiPolicyFields()
+	assert.NilError(t, err)
+	for _, f := range fields {
+		if f.Entity == "students" && f.Field == "caregiver.mobile" {
+			assert.Equal(t, f.Stored, 0)
+		}
+	}
+
+	// Hashing is repeatable, so sending the same student again changes nothing
+	before, err := app.models.ChangeLog.LatestSeq()
+	assert.NilError(t, err)
+	assert.NilError(t, app.models.Students.InsertManyStudents([]data.Student{newStudent()}))
+	after, err := app.models.ChangeLog.LatestSeq()
+	assert.NilError(t, err)
+	assert.Equal(t, after, before)
+
+	policy, err := app.models.PIIPolicy.Load()
+	assert.NilError(t, err)
+	optional := ";" + strings.Join(policy.Advertised("students", data.StudentOptionalFields), ";") + ";"
+	assert.Equal(t, strings.Contains(optional, ";caregiver.mobile;"), false)
+	assert.StringContains(t, optional, ";caregiver.email;")
+
+	// Dropping a group stops every field in it being asked for
+	setRule("students", "caregivers", data.PIIDrop)
+	policy, err = app.models.PIIPolicy.Load()
+	assert.NilError(t, err)
+	optional = ";" + strings.Join(policy.Advertised("students", data.StudentOptionalFields), ";") + ";"
+	assert.Equal(t, strings.Contains(optional, ";caregiver"), false)
+	assert.StringContains(t, optional, ";emergency.mobile;")
+
+	var caregivers int
+	assert.NilError(t, listenerDB.QueryRow(`SELECT COUNT(*) FROM student_caregivers;`).Scan(&caregivers))
+	assert.Equal(t, caregivers, 0)
+
+	// Only text fields can be hashed, and only some fields truncated
+	for _, rule := range []data.PIIRule{
+		{Entity: "students", Field: "datebirth", Action: data.PIIHash},
+		{Entity: "students", Field: "house", Action: data.PIITruncate},
+		{Entity: "staff", Field: "caregiver.mobile", Action: data.PIIDrop},
+	} {
+		v := validator.New()
+		data.ValidatePIIRule(v, &rule)
+		assert.Equal(t, v.Valid(), false)
+	}
+}
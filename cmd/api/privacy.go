@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+	views "github.com/michaelcjefferson/kamar-listener/ui/views"
+)
+
+// Look students up by NSN, id or name, so everything held about one of them can be provided or erased in response to a Privacy Act request
+func (app *application) getPrivacyPageHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+	query := c.QueryParam("q")
+
+	policy, err := app.models.PIIPolicy.Load()
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	matches, err := app.models.SubjectAccess.FindStudents(query, policy)
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	erasures, err := app.models.Erasures.GetAll()
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	return app.Render(c, http.StatusOK, views.PrivacyPage(u, query, matches, erasures))
+}
+
+// Provide everything held about a student, as a page or (with ?format=json) as a JSON file to send to the family
+func (app *application) getSubjectAccessHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+
+	id, err := app.readIDParam(c)
+	if err != nil {
+		return app.notFoundResponse(c)
+	}
+
+	tables, err := app.models.Exports.GetExportableTables()
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	record, err := app.models.SubjectAccess.Collect(id, tables)
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+	if len(record.Tables) == 0 {
+		return app.notFoundResponse(c)
+	}
+
+	app.logger.PrintInfo("subject access record provided", map[string]any{
+		"student_id": id,
+		"format":     c.QueryParam("format"),
+		"user_id":    u.ID,
+	})
+	app.audit(c, u.ID, data.AuditStudentView, fmt.Sprintf("student %d", id))
+
+	if c.QueryParam("format") == "json" {
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="student-%d.json"`, id))
+		return c.JSONPretty(http.StatusOK, record.JSON(), "  ")
+	}
+
+	return app.Render(c, http.StatusOK, views.SubjectAccessPage(u, record))
+}
+
+type eraseStudentInput struct {
+	Reference string `json:"reference"`
+}
+
+// Erase everything held about a student, and record a tombstone so later syncs from KAMAR don't store their data again
+func (app *application) eraseStudentHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+
+	id, err := app.readIDParam(c)
+	if err != nil {
+		return app.notFoundResponse(c)
+	}
+
+	var input eraseStudentInput
+	if err := c.Bind(&input); err != nil {
+		return app.badRequestResponse(c, err)
+	}
+
+	erasure := &data.Erasure{ErasedBy: u.ID, Reference: input.Reference}
+
+	v := validator.New()
+	if data.ValidateErasure(v, erasure); !v.Valid() {
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	if _, err := app.eraseStudent(id, erasure); err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	app.audit(c, u.ID, data.AuditStudentErase, fmt.Sprintf("erasure %d (%s)", erasure.ID, erasure.Reference))
+
+	return c.JSON(http.StatusOK, envelope{
+		"success":      true,
+		"rows_deleted": erasure.RowsDeleted,
+	})
+}
+
+// Record the tombstone first, so that a sync arriving while the rows are being deleted can't store the student again
+func (app *application) eraseStudent(id int, erasure *data.Erasure) (int64, error) {
+	if err := app.models.Erasures.Insert(id, erasure); err != nil {
+		return 0, err
+	}
+
+	tables, err := app.models.Exports.GetExportableTables()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, err := app.models.SubjectAccess.Erase(id, tables)
+	if err != nil {
+		return 0, err
+	}
+
+	// Insert adds to the rows already recorded against the tombstone
+	erasure.RowsDeleted = deleted
+	if err := app.models.Erasures.Insert(id, erasure); err != nil {
+		return deleted, err
+	}
+
+	app.logger.PrintInfo("student data erased", map[string]any{
+		"erasure_id":   erasure.ID,
+		"reference":    erasure.Reference,
+		"rows_deleted": deleted,
+		"user_id":      erasure.ErasedBy,
+	})
+
+	// Replicated batches only ever add or update rows, so copy everything to the sinks again to remove the student from them too
+	app.resyncAllSinks()
+
+	if err := app.UpdateRecordCountsFromDB(); err != nil {
+		app.logger.PrintError(err, nil)
+	}
+
+	return deleted, nil
+}
+
+// Delete every student with a tombstone from the listener database again, after a restore has brought back data that was erased after the backup was taken. The tombstones themselves are left as they are, so the rows deleted here aren't added to them.
+func (app *application) eraseRestoredStudents() error {
+	erased, err := app.models.Erasures.Load()
+	if err != nil || erased.Empty() {
+		return err
+	}
+
+	tables, err := app.models.Exports.GetExportableTables()
+	if err != nil {
+		return err
+	}
+
+	ids, err := app.models.SubjectAccess.StudentIDs(tables)
+	if err != nil {
+		return err
+	}
+
+	var students int
+	var deleted int64
+	for _, id := range ids {
+		if !erased.Has(&id) {
+			continue
+		}
+		n, err := app.models.SubjectAccess.Erase(id, tables)
+		if err != nil {
+			return err
+		}
+		students++
+		deleted += n
+	}
+
+	if students > 0 {
+		app.logger.PrintInfo("erased students removed from restored data", map[string]any{
+			"students":     students,
+			"rows_deleted": deleted,
+		})
+	}
+
+	return nil
+}
+
+// Leave out records about erased students from a sync before it is written, returning how many were left out
+func (app *application) skipErasedStudents(d *SMSDirectoryData) (int, error) {
+	erased, err := app.models.Erasures.Load()
+	if err != nil || erased.Empty() {
+		return 0, err
+	}
+
+	skipped := 0
+	keep := func(id *int) bool {
+		if erased.Has(id) {
+			skipped++
+			return false
+		}
+		return true
+	}
+
+	if d.Students != nil {
+		d.Students.Data = filterRecords(d.Students.Data, func(s data.Student) bool { return keep(s.ID) })
+	}
+	d.Attendance.Data = filterRecords(d.Attendance.Data, func(a data.Attendance) bool { return keep(a.ID) })
+	d.ClassEfforts.Data = filterRecords(d.ClassEfforts.Data, func(e data.ClassEffort) bool { return keep(e.ID) })
+	d.Pastoral.Data = filterRecords(d.Pastoral.Data, func(p data.Pastoral) bool { return keep(p.ID) })
+	d.Recognitions.Data = filterRecords(d.Recognitions.Data, func(r data.Recognition) bool { return keep(r.ID) })
+	d.Results.Data = filterRecords(d.Results.Data, func(r data.Result) bool { return keep(r.ID) })
+	d.Timetables.Data = filterRecords(d.Timetables.Data, func(t data.Timetable) bool { return keep(t.Student) })
+
+	return skipped, nil
+}
+
+func filterRecords[T any](records []T, keep func(T) bool) []T {
+	if records == nil {
+		return nil
+	}
+	kept := records[:0]
+	for _, r := range records {
+		if keep(r) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+func TestSubjectAccess(t *testing.T) {
+	dir := t.TempDir()
+
+	appDB, _, err := openAppDB(filepath.Join(dir, "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+	listenerDB := newTestListenerDB(t, dir)
+
+	app := newTestApplication(t, appDB, listenerDB)
+
+	id, otherID, uuid, otherUUID, nsn, otherNSN, firstname, otherFirstname := 1234, 5678, "uuid-1", "uuid-2", "123456789", "987654321", "Aroha", "Tama"
+	students := func() []data.Student {
+		return []data.Student{{ID: &id, UUID: &uuid, Nsn: &nsn, Firstname: &firstname}, {ID: &otherID, UUID: &otherUUID, Nsn: &otherNSN, Firstname: &otherFirstname}}
+	}
+	assert.NilError(t, app.models.Students.InsertManyStudents(students()))
+	resultType, number, version, year, result := "NCEA", "91027", 1, 2025, "A"
+	assert.NilError(t, app.models.Results.InsertManyResults([]data.Result{{ID: &id, NSN: &nsn, Type: &resultType, Number: &number, Version: &version, Year: &year, Result: &result}}))
+
+	matches, err := app.models.SubjectAccess.FindStudents(nsn, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(matches), 1)
+	assert.Equal(t, matches[0].ID, id)
+
+	matches, err = app.models.SubjectAccess.FindStudents("aroha", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(matches), 1)
+
+	tables, err := app.models.Exports.GetExportableTables()
+	assert.NilError(t, err)
+
+	record, err := app.models.SubjectAccess.Collect(id, tables)
+	assert.NilError(t, err)
+	assert.Equal(t, len(record.Tables), 2)
+	assert.Equal(t, record.Tables[0].Name, "students")
+
+	erasure := &data.Erasure{ErasedBy: 1, Reference: "PA-2025-01"}
+	deleted, err := app.eraseStudent(id, erasure)
+	assert.NilError(t, err)
+	assert.Equal(t, deleted, int64(2))
+
+	record, err = app.models.SubjectAccess.Collect(id, tables)
+	assert.NilError(t, err)
+	assert.Equal(t, len(record.Tables), 0)
+
+	// The tombstone doesn't hold the student's id, but still stops KAMAR sending them again
+	erasures, err := app.models.Erasures.GetAll()
+	assert.NilError(t, err)
+	assert.Equal(t, len(erasures), 1)
+	assert.Equal(t, erasures[0].RowsDeleted, int64(2))
+
+	sync := &SMSDirectoryData{Students: &StudentsField{Data: students()}}
+	skipped, err := app.skipErasedStudents(sync)
+	assert.NilError(t, err)
+	assert.Equal(t, skipped, 1)
+	assert.NilError(t, writeSyncData(&app.models, "part", sync))
+
+	matches, err = app.models.SubjectAccess.FindStudents(nsn, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(matches), 0)
+	matches, err = app.models.SubjectAccess.FindStudents(otherNSN, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(matches), 1)
+}
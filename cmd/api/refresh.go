@@ -94,11 +94,51 @@ type TimetablesField struct {
 	Data  []data.Timetable `json:"data,omitempty"`
 }
 
+// Write the records in a sync from KAMAR to the listener tables of models. This is used for the primary listener database and for each replication sink, so every copy is written by the same code.
+func writeSyncData(models *data.Models, syncType string, d *SMSDirectoryData) error {
+	switch syncType {
+	case "assessments":
+		return models.Assessments.InsertManyAssessments(d.Assessments.Data)
+	case "attendance":
+		return models.Attendance.InsertManyAttendance(d.Attendance.Data)
+	case "classefforts":
+		return models.ClassEfforts.InsertManyClassEfforts(d.ClassEfforts.Data)
+	case "full", "part":
+		// Write every data type that was sent, even if an earlier one fails, and report all of the errors together
+		var errs []error
+		if d.Staff != nil {
+			errs = append(errs, models.Staff.InsertManyStaff(d.Staff.Data))
+		}
+		if d.Students != nil {
+			errs = append(errs, models.Students.InsertManyStudents(d.Students.Data))
+		}
+		if d.Subjects != nil {
+			errs = append(errs, models.Subjects.InsertManySubjects(d.Subjects.Data))
+		}
+		return errors.Join(errs...)
+	case "notices":
+		return models.Notices.InsertManyNotices(d.Notices.Data)
+	case "pastoral":
+		return models.Pastoral.InsertManyPastoral(d.Pastoral.Data)
+	case "recognitions":
+		return models.Recognitions.InsertManyRecognitions(d.Recognitions.Data)
+	case "results":
+		return models.Results.InsertManyResults(d.Results.Data)
+	case "studenttimetables", "stafftimetables":
+		return models.Timetables.InsertManyTimetables(d.Timetables.Data)
+	}
+
+	return fmt.Errorf("unsupported sync type %q", syncType)
+}
+
 func (app *application) kamarRefreshHandler(c echo.Context) error {
 	// If write_to_json is on, send context to json writing handler instead
 	if app.config.kamar_write_to_json {
 		return app.kamarRefreshJSONHandler(c)
 	} else {
+		start := time.Now()
+		// Record where change_log is up to, so the keys changed by this sync can be included in webhook payloads
+		seqBefore, seqErr := app.models.ChangeLog.LatestSeq()
 		var kamarData KAMARData
 
 		body, err := io.ReadAll(c.Request().Body)
@@ -135,6 +175,8 @@ func (app *application) kamarRefreshHandler(c echo.Context) error {
 		}
 
 		count := 0
+		// Number of records received per data type, for webhook payloads - for most sync types there is only one
+		counts := make(map[string]int)
 
 		// Check sync type, and respond accordingly
 		switch syncType {
@@ -143,6 +185,7 @@ func (app *application) kamarRefreshHandler(c echo.Context) error {
 			app.logger.PrintInfo("listener: received and processed check request", map[string]any{
 				"data": kamarData.Data,
 			})
+			app.learnKAMARSource(c)
 			return app.kamarCheckResponse(c)
 		case "assessments":
 			count = kamarData.Data.Assessments.Count
@@ -150,46 +193,42 @@ func (app *application) kamarRefreshHandler(c echo.Context) error {
 				"count": count,
 				"sync":  syncType,
 			})
-			err = app.models.Assessments.InsertManyAssessments(kamarData.Data.Assessments.Data)
 		case "attendance":
 			count = kamarData.Data.Attendance.Count
 			app.logger.PrintInfo("listener: attempting to write attendance to database...", map[string]any{
 				"count": count,
 				"sync":  syncType,
 			})
-			err = app.models.Attendance.InsertManyAttendance(kamarData.Data.Attendance.Data)
 		case "classefforts":
 			count = kamarData.Data.ClassEfforts.Count
 			app.logger.PrintInfo("listener: attempting to write classefforts to database...", map[string]any{
 				"count": count,
 				"sync":  syncType,
 			})
-			err = app.models.ClassEfforts.InsertManyClassEfforts(kamarData.Data.ClassEfforts.Data)
 		case "full", "part":
-			// TODO: Issue here where there may be multiple errors but only the last one will be returned/recorded
 			if kamarData.Data.Staff != nil {
 				count += kamarData.Data.Staff.Count
+				counts["staff"] = kamarData.Data.Staff.Count
 				app.logger.PrintInfo("listener: attempting to write staff to database...", map[string]any{
 					"count": kamarData.Data.Staff.Count,
 					"sync":  syncType,
 				})
-				err = app.models.Staff.InsertManyStaff(kamarData.Data.Staff.Data)
 			}
 			if kamarData.Data.Students != nil {
 				count += kamarData.Data.Students.Count
+				counts["students"] = kamarData.Data.Students.Count
 				app.logger.PrintInfo("listener: attempting to write students to database...", map[string]any{
 					"count": kamarData.Data.Students.Count,
 					"sync":  syncType,
 				})
-				err = app.models.Students.InsertManyStudents(kamarData.Data.Students.Data)
 			}
 			if kamarData.Data.Subjects != nil {
 				count += kamarData.Data.Subjects.Count
+				counts["subjects"] = kamarData.Data.Subjects.Count
 				app.logger.PrintInfo("listener: attempting to write subjects to database...", map[string]any{
 					"count": kamarData.Data.Subjects.Count,
 					"sync":  syncType,
 				})
-				err = app.models.Subjects.InsertManySubjects(kamarData.Data.Subjects.Data)
 			}
 		case "notices":
 			count += kamarData.Data.Notices.Count
@@ -197,21 +236,18 @@ func (app *application) kamarRefreshHandler(c echo.Context) error {
 				"count": count,
 				"sync":  syncType,
 			})
-			err = app.models.Notices.InsertManyNotices(kamarData.Data.Notices.Data)
 		case "pastoral":
 			count = kamarData.Data.Pastoral.Count
 			app.logger.PrintInfo("listener: attempting to write pastoral records to database...", map[string]any{
 				"count": count,
 				"sync":  syncType,
 			})
-			err = app.models.Pastoral.InsertManyPastoral(kamarData.Data.Pastoral.Data)
 		case "recognitions":
 			count = kamarData.Data.Recognitions.Count
 			app.logger.PrintInfo("listener: attempting to write recognitions to database...", map[string]any{
 				"count": count,
 				"sync":  syncType,
 			})
-			err = app.models.Recognitions.InsertManyRecognitions(kamarData.Data.Recognitions.Data)
 		case "results":
 			count = kamarData.Data.Results.Count
 			app.logger.PrintInfo("listener: attempting to write results to database...", map[string]any{
@@ -220,7 +256,6 @@ func (app *application) kamarRefreshHandler(c echo.Context) error {
 				"sync": syncType,
 				// "schools": kamarData.Data.Schools,
 			})
-			err = app.models.Results.InsertManyResults(kamarData.Data.Results.Data)
 		case "studenttimetables", "stafftimetables":
 			count = kamarData.Data.Timetables.Count
 			app.logger.PrintInfo("listener: attempting to write timetables to database...", map[string]any{
@@ -229,7 +264,6 @@ func (app *application) kamarRefreshHandler(c echo.Context) error {
 				"sync": syncType,
 				// "schools": kamarData.Data.Schools,
 			})
-			err = app.models.Timetables.InsertManyTimetables(kamarData.Data.Timetables.Data)
 		// If synctype doesn't match any of these cases, return an unprocessable entity error
 		default:
 			app.logger.PrintError(errors.New("listener: synctype not available"), map[string]any{
@@ -257,6 +291,38 @@ func (app *application) kamarRefreshHandler(c echo.Context) error {
 		- studenttimetables/stafftimetables (json key="timetables")
 		*/
 
+		// KAMAR will keep sending records about students whose data was erased in response to a Privacy Act request, so leave them out
+		if skipped, skipErr := app.skipErasedStudents(&kamarData.Data); skipErr != nil {
+			app.logger.PrintError(skipErr, map[string]any{"sync_type": syncType})
+		} else if skipped > 0 {
+			app.logger.PrintInfo("records about erased students left out of sync", map[string]any{
+				"sync_type": syncType,
+				"records":   skipped,
+			})
+		}
+
+		err = writeSyncData(&app.models, syncType, &kamarData.Data)
+
+		if len(counts) == 0 {
+			counts[syncType] = count
+		}
+
+		payload := syncWebhookPayload{
+			Event:      "sync.completed",
+			SyncType:   syncType,
+			Counts:     counts,
+			Success:    err == nil,
+			DurationMS: time.Since(start).Milliseconds(),
+			Time:       time.Now(),
+		}
+		if err != nil {
+			payload.Event = "sync.failed"
+			payload.Error = err.Error()
+		} else if seqErr == nil {
+			payload.ChangedKeys = app.changedKeysSince(seqBefore)
+		}
+		app.notifyWebhooks(payload)
+
 		if err != nil {
 			app.logError(c, err)
 			return app.kamarUnprocessableEntityResponse(c)
@@ -264,6 +330,8 @@ func (app *application) kamarRefreshHandler(c echo.Context) error {
 
 		app.logger.PrintInfo("listener: data successfully received from KAMAR and written to the SQLite database", nil)
 
+		app.replicate(syncType, &kamarData.Data)
+
 		e := data.ListenerEvent{
 			ReqType:       "insert",
 			WasSuccessful: true,
@@ -371,6 +439,7 @@ func (app *application) kamarRefreshJSONHandler(c echo.Context) error {
 
 	if syncType == "check" {
 		app.logger.PrintInfo("listener: received and processed check", nil)
+		app.learnKAMARSource(c)
 		return app.kamarCheckResponse(c)
 	}
 
@@ -0,0 +1,343 @@
+//go:build kamarfixtures
+
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+)
+
+// Run with go test -tags kamarfixtures once refresh-test.json and the actual-requests directory are in ../../test
+func init() {
+	capturedRefreshTests = append(capturedRefreshTests, []refreshTestCase{
+		{
+			name:           "Valid Results Data",
+			jsonFile:       "refresh-test.json",
+			username:       "username",
+			password:       "password",
+			includeAuth:    true,
+			expectedStatus: http.StatusOK,
+			expectedBody: map[string]any{
+				"SMSDirectoryData": map[string]any{
+					"error":   0,
+					"result":  "OK",
+					"service": "WHS KAMAR Refresh",
+					"version": "1.0",
+				},
+			},
+			expectedCount: 5,
+			checkDB: func(t *testing.T, expectedCount int, db *sql.DB, app *application) {
+				var actualCount int
+
+				err := db.QueryRow("SELECT COUNT(*) FROM results;").Scan(&actualCount)
+				if err != nil {
+					t.Fatalf("error getting count of results from db: %v", err)
+				}
+
+				if actualCount != expectedCount {
+					t.Errorf("unexpected number of results inserted into database: want %d got %d", expectedCount, actualCount)
+				}
+			},
+		},
+		{
+			name:           "Valid Results Data, Invalid Credentials",
+			jsonFile:       "refresh-test.json",
+			username:       "",
+			password:       "password",
+			includeAuth:    true,
+			expectedStatus: http.StatusForbidden,
+			expectedBody: map[string]any{
+				"SMSDirectoryData": map[string]any{
+					"error":   403,
+					"result":  "Authentication Failed",
+					"service": "WHS KAMAR Refresh",
+					"version": "1.0",
+				},
+			},
+		},
+		// {
+		// 	name:     "Results Data with Incorrect (attendance) Sync Label",
+		// 	jsonFile: "refresh-test.json",
+		// },
+		{
+			name:           "Valid Assessments Data",
+			jsonFile:       "actual-requests/assessments_18122024_161942.json",
+			username:       "username",
+			password:       "password",
+			includeAuth:    true,
+			expectedStatus: http.StatusOK,
+			expectedBody: map[string]any{
+				"SMSDirectoryData": map[string]any{
+					"error":   0,
+					"result":  "OK",
+					"service": "WHS KAMAR Refresh",
+					"version": "1.0",
+				},
+			},
+			// TODO: Actual count is 2365. Assessment titles T_TP and T_UE, with _ replaced with numbers 1 through 4, have duplicate entries, so any write after the first is skipped
+			expectedCount: 1969,
+			checkDB: func(t *testing.T, expectedCount int, db *sql.DB, app *application) {
+				var actualCount int
+
+				err := db.QueryRow("SELECT COUNT(*) FROM assessments;").Scan(&actualCount)
+				if err != nil {
+					t.Fatalf("error getting count of assessments from db: %v", err)
+				}
+
+				if actualCount != expectedCount {
+					t.Errorf("unexpected number of assessments inserted into database: want %d got %d", expectedCount, actualCount)
+				}
+
+				ass, err := app.models.Assessments.GetByAssessmentNumber("91402")
+				if err != nil {
+					t.Fatalf("error getting assessment from db: %v", err)
+				}
+
+				// TODO: Move to test table - optional data verification check, with two test table parameters - key (eg. assmnt number for select query) and expected returned struct values
+				if *ass.Type != "A" {
+					t.Errorf("unexpected value in db for assessment.type: want %v got %v", "A", ass.Type)
+				}
+				if *ass.Number != "91402" {
+					t.Errorf("unexpected value in db for assessment.number: want %v got %v", "91402", ass.Number)
+				}
+				if *ass.Version != 3 {
+					t.Errorf("unexpected value in db for assessment.version: want %v got %v", 3, ass.Version)
+				}
+				if *ass.Level != 3 {
+					t.Errorf("unexpected value in db for assessment.level: want %v got %v", 3, ass.Level)
+				}
+				if *ass.Credits != 5 {
+					t.Errorf("unexpected value in db for assessment.credits: want %v got %v", 5, ass.Credits)
+				}
+				if ass.Weighting != nil {
+					t.Errorf("unexpected value in db for assessment.weighting: want %v got %v", nil, ass.Weighting)
+				}
+				if ass.Points != nil {
+					t.Errorf("unexpected value in db for assessment.points: want %v got %v", nil, ass.Points)
+				}
+				if *ass.Title != "Economics 3.4 - Demonstrate understanding of government interventions where the market fails to deliver efficient or equitable outcomes" {
+					t.Errorf("unexpected value in db for assessment.title: want %v got %v", "Economics 3.4 - Demonstrate understanding of government interventions where the market fails to deliver efficient or equitable outcomes", ass.Title)
+				}
+				if ass.Description != nil {
+					t.Errorf("unexpected value in db for assessment.description: want %v got %v", "", ass.Description)
+				}
+				if ass.Purpose != nil {
+					t.Errorf("unexpected value in db for assessment.purpose: want %v got %v", "", ass.Purpose)
+				}
+				if *ass.Subfield != "Economic Theory and Practice" {
+					t.Errorf("unexpected value in db for assessment.subfield: want %v got %v", "Economic Theory and Practice", ass.Subfield)
+				}
+				if *ass.Internalexternal != "I" {
+					t.Errorf("unexpected value in db for assessment.internalexternal: want %v got %v", "I", ass.Internalexternal)
+				}
+
+				// "type": "A",
+				// "number": "91402",
+				// "version": 3,
+				// "level": 3,
+				// "credits": 5,
+				// "weighting": null,
+				// "points": null,
+				// "title": "Economics 3.4 - Demonstrate understanding of government interventions where the market fails to deliver efficient or equitable outcomes",
+				// "description": null,
+				// "purpose": null,
+				// "subfield": "Economic Theory and Practice",
+				// "internalexternal": "I"
+			},
+		},
+		{
+			name:           "Valid Attendance Data",
+			jsonFile:       "actual-requests/attendance_18122024_152843.json",
+			username:       "username",
+			password:       "password",
+			includeAuth:    true,
+			expectedStatus: http.StatusOK,
+			expectedBody: map[string]any{
+				"SMSDirectoryData": map[string]any{
+					"error":   0,
+					"result":  "OK",
+					"service": "WHS KAMAR Refresh",
+					"version": "1.0",
+				},
+			},
+			// TODO: This only represents the total number of unique student IDs added from this attendance request, and doesn't match the "count" value from the request - "count" is 3982 (total number of attendance records), and attendance_values will have a total count much higher than this, as each record contains up to 5 values
+			expectedCount: 1471,
+			checkDB: func(t *testing.T, expectedCount int, db *sql.DB, app *application) {
+				var actualCount int
+
+				err := db.QueryRow("SELECT COUNT(*) FROM attendance;").Scan(&actualCount)
+				if err != nil {
+					t.Fatalf("error getting count of attendance from db: %v", err)
+				}
+
+				if actualCount != expectedCount {
+					t.Errorf("unexpected number of attendance records inserted into database: want %d got %d", expectedCount, actualCount)
+				}
+			},
+		},
+		{
+			name:           "Valid Pastoral Data",
+			jsonFile:       "actual-requests/pastoral_19122024_154553.json",
+			username:       "username",
+			password:       "password",
+			includeAuth:    true,
+			expectedStatus: http.StatusOK,
+			expectedBody: map[string]any{
+				"SMSDirectoryData": map[string]any{
+					"error":   0,
+					"result":  "OK",
+					"service": "WHS KAMAR Refresh",
+					"version": "1.0",
+				},
+			},
+			expectedCount: 3262,
+			checkDB: func(t *testing.T, expectedCount int, db *sql.DB, app *application) {
+				var actualCount int
+
+				err := db.QueryRow("SELECT COUNT(*) FROM pastoral;").Scan(&actualCount)
+				if err != nil {
+					t.Fatalf("error getting count of pastoral from db: %v", err)
+				}
+
+				if actualCount != expectedCount {
+					t.Errorf("unexpected number of pastoral records inserted into database: want %d got %d", expectedCount, actualCount)
+				}
+			},
+		},
+		{
+			name:           "Valid Student Details (Full) Data",
+			jsonFile:       "actual-requests/full_18122024_151311.json",
+			username:       "username",
+			password:       "password",
+			includeAuth:    true,
+			expectedStatus: http.StatusOK,
+			expectedBody: map[string]any{
+				"SMSDirectoryData": map[string]any{
+					"error":   0,
+					"result":  "OK",
+					"service": "WHS KAMAR Refresh",
+					"version": "1.0",
+				},
+			},
+			expectedCount: 1777,
+			checkDB: func(t *testing.T, expectedCount int, db *sql.DB, app *application) {
+				var actualCount int
+
+				err := db.QueryRow("SELECT COUNT(*) FROM students;").Scan(&actualCount)
+				if err != nil {
+					t.Fatalf("error getting count of students from db: %v", err)
+				}
+
+				if actualCount != expectedCount {
+					t.Errorf("unexpected number of students records inserted into database: want %d got %d", expectedCount, actualCount)
+				}
+			},
+		},
+		{
+			name:           "Valid Student Details (Part) Data",
+			jsonFile:       "actual-requests/part_18122024_201702.json",
+			username:       "username",
+			password:       "password",
+			includeAuth:    true,
+			expectedStatus: http.StatusOK,
+			expectedBody: map[string]any{
+				"SMSDirectoryData": map[string]any{
+					"error":   0,
+					"result":  "OK",
+					"service": "WHS KAMAR Refresh",
+					"version": "1.0",
+				},
+			},
+			expectedCount: 1,
+			checkDB: func(t *testing.T, expectedCount int, db *sql.DB, app *application) {
+				var actualCount int
+
+				err := db.QueryRow("SELECT COUNT(*) FROM students;").Scan(&actualCount)
+				if err != nil {
+					t.Fatalf("error getting count of students from db: %v", err)
+				}
+
+				if actualCount != expectedCount {
+					t.Errorf("unexpected number of students records inserted into database: want %d got %d", expectedCount, actualCount)
+				}
+			},
+		},
+		{
+			name:           "Valid Staff, Student, and Subject Details (Full) Data",
+			jsonFile:       "actual-requests/full_19122024_154006.json",
+			username:       "username",
+			password:       "password",
+			includeAuth:    true,
+			expectedStatus: http.StatusOK,
+			expectedBody: map[string]any{
+				"SMSDirectoryData": map[string]any{
+					"error":   0,
+					"result":  "OK",
+					"service": "WHS KAMAR Refresh",
+					"version": "1.0",
+				},
+			},
+			expectedCount: 1,
+			checkDB: func(t *testing.T, expectedCount int, db *sql.DB, app *application) {
+				var actualStaffCount, actualStudentCount, actualSubjectCount int
+
+				err := db.QueryRow("SELECT COUNT(*) FROM staff;").Scan(&actualStaffCount)
+				if err != nil {
+					t.Fatalf("error getting count of staff from db: %v", err)
+				}
+
+				if actualStaffCount != 227 {
+					t.Errorf("unexpected number of staff records inserted into database: want %d got %d", 227, actualStaffCount)
+				}
+
+				err = db.QueryRow("SELECT COUNT(*) FROM students;").Scan(&actualStudentCount)
+				if err != nil {
+					t.Fatalf("error getting count of students from db: %v", err)
+				}
+
+				if actualStudentCount != 1777 {
+					t.Errorf("unexpected number of students records inserted into database: want %d got %d", 1777, actualStudentCount)
+				}
+
+				err = db.QueryRow("SELECT COUNT(*) FROM subjects;").Scan(&actualSubjectCount)
+				if err != nil {
+					t.Fatalf("error getting count of subjects from db: %v", err)
+				}
+
+				if actualSubjectCount != 255 {
+					t.Errorf("unexpected number of subject records inserted into database: want %d got %d", 255, actualSubjectCount)
+				}
+			},
+		},
+		{
+			name:           "Valid Student Timetables Data",
+			jsonFile:       "actual-requests/studenttimetables_18122024_152357.json",
+			username:       "username",
+			password:       "password",
+			includeAuth:    true,
+			expectedStatus: http.StatusOK,
+			expectedBody: map[string]any{
+				"SMSDirectoryData": map[string]any{
+					"error":   0,
+					"result":  "OK",
+					"service": "WHS KAMAR Refresh",
+					"version": "1.0",
+				},
+			},
+			expectedCount: 8,
+			checkDB: func(t *testing.T, expectedCount int, db *sql.DB, app *application) {
+				var actualCount int
+
+				err := db.QueryRow("SELECT COUNT(*) FROM timetables;").Scan(&actualCount)
+				if err != nil {
+					t.Fatalf("error getting count of timetables from db: %v", err)
+				}
+
+				if actualCount != expectedCount {
+					t.Errorf("unexpected number of timetables inserted into database: want %d got %d", expectedCount, actualCount)
+				}
+			},
+		},
+	}...)
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+	views "github.com/michaelcjefferson/kamar-listener/ui/views"
+)
+
+const (
+	// The number of batches that can wait for a sink before it is marked as needing a resync instead
+	replicationQueueSize = 64
+	// How many times a batch is written to a sink before giving up and marking it as needing a resync
+	replicationAttempts = 3
+	// How often a sink that needs a resync is retried
+	replicationResyncInterval = time.Minute
+)
+
+// The delay between attempts to write a batch to a sink, doubled after every attempt
+var replicationRetryDelay = 2 * time.Second
+
+// A sync from KAMAR that has been committed to the listener database, waiting to be written to a sink
+type replicationBatch struct {
+	syncType    string
+	data        *SMSDirectoryData
+	committedAt time.Time
+}
+
+// sinkWorker writes batches to a single sink in the background. KAMAR's request never waits on a sink: batches are queued without blocking, and if a sink falls too far behind or can't be written to, the batches it missed are dropped and the sink is resynced by copying the whole listener database to it.
+type sinkWorker struct {
+	sink      data.ReplicationSink
+	queue     chan replicationBatch
+	stop      chan struct{}
+	resyncNow chan struct{}
+
+	mu          sync.Mutex
+	behindSince time.Time
+	lastApplied time.Time
+	lastError   string
+	lastErrorAt time.Time
+	needsResync bool
+	resyncing   bool
+}
+
+type replicator struct {
+	mu      sync.Mutex
+	workers map[int]*sinkWorker
+}
+
+// Start a worker for every enabled sink
+func (app *application) startReplication() error {
+	sinks, err := app.models.Replication.GetAll()
+	if err != nil {
+		return err
+	}
+
+	for _, sink := range sinks {
+		if sink.Enabled {
+			app.startSinkWorker(sink)
+		}
+	}
+
+	return nil
+}
+
+func (app *application) startSinkWorker(sink data.ReplicationSink) {
+	w := &sinkWorker{
+		sink:        sink,
+		queue:       make(chan replicationBatch, replicationQueueSize),
+		stop:        make(chan struct{}),
+		resyncNow:   make(chan struct{}, 1),
+		needsResync: sink.NeedsResync,
+	}
+	if sink.NeedsResync {
+		w.behindSince = time.Now()
+	}
+
+	app.replication.mu.Lock()
+	if app.replication.workers == nil {
+		app.replication.workers = make(map[int]*sinkWorker)
+	}
+	app.replication.workers[sink.ID] = w
+	app.replication.mu.Unlock()
+
+	app.background(func() {
+		app.runSinkWorker(w)
+	})
+}
+
+func (app *application) stopSinkWorker(id int) {
+	app.replication.mu.Lock()
+	defer app.replication.mu.Unlock()
+
+	if w, ok := app.replication.workers[id]; ok {
+		close(w.stop)
+		delete(app.replication.workers, id)
+	}
+}
+
+// Queue a committed sync to be written to every sink. This never blocks - if a sink's queue is full, the sink is marked as needing a resync instead.
+func (app *application) replicate(syncType string, d *SMSDirectoryData) {
+	app.replication.mu.Lock()
+	defer app.replication.mu.Unlock()
+
+	batch := replicationBatch{syncType: syncType, data: d, committedAt: time.Now()}
+
+	for _, w := range app.replication.workers {
+		w.mu.Lock()
+		if w.behindSince.IsZero() {
+			w.behindSince = batch.committedAt
+		}
+		w.mu.Unlock()
+
+		select {
+		case w.queue <- batch:
+		default:
+			app.markSinkForResync(w, errors.New("sink fell too far behind, so it will be resynced"))
+		}
+	}
+}
+
+func (app *application) markSinkForResync(w *sinkWorker, err error) {
+	w.recordError(err)
+
+	if app.flagSinkResync(w) {
+		app.logger.PrintError(fmt.Errorf("replication sink %s needs resync: %w", w.sink.Name, err), map[string]any{
+			"sink_id": w.sink.ID,
+		})
+	}
+}
+
+// Mark w as needing a resync, returning false if it already did
+func (app *application) flagSinkResync(w *sinkWorker) bool {
+	w.mu.Lock()
+	alreadyMarked := w.needsResync
+	w.needsResync = true
+	if w.behindSince.IsZero() {
+		w.behindSince = time.Now()
+	}
+	w.mu.Unlock()
+
+	if alreadyMarked {
+		return false
+	}
+
+	// Persist the flag, so the sink is still resynced if the listener restarts before it catches up
+	if err := app.models.Replication.SetNeedsResync(w.sink.ID, true); err != nil {
+		app.logger.PrintError(err, map[string]any{
+			"message": "couldn't mark replication sink as needing resync",
+			"sink_id": w.sink.ID,
+		})
+	}
+
+	return true
+}
+
+// Mark every running sink as needing a resync, eg. after rows have been deleted from the listener database outside of a sync, which replicated batches can't carry
+func (app *application) resyncAllSinks() {
+	app.replication.mu.Lock()
+	workers := make([]*sinkWorker, 0, len(app.replication.workers))
+	for _, w := range app.replication.workers {
+		workers = append(workers, w)
+	}
+	app.replication.mu.Unlock()
+
+	for _, w := range workers {
+		app.flagSinkResync(w)
+	}
+}
+
+func (app *application) runSinkWorker(w *sinkWorker) {
+	var db *data.ListenerDB
+	var models data.Models
+	defer func() {
+		if db != nil {
+			db.Close()
+		}
+	}()
+
+	// Open the sink on first use, and again after any failure, as the failure may have been caused by the connection (eg. a network share that was unmounted)
+	open := func() error {
+		if db != nil {
+			return nil
+		}
+		// A restore replaces app.models, so it can only be read under app.dbMu
+		var cipher *data.FieldCipher
+		app.withDatabases(func() {
+			cipher = app.models.Exports.DB.Cipher
+		})
+
+		var err error
+		db, err = openSinkDB(w.sink, cipher)
+		if err != nil {
+			return err
+		}
+		models = data.NewModels(nil, db, nil)
+		return nil
+	}
+	reset := func() {
+		if db != nil {
+			db.Close()
+			db = nil
+		}
+	}
+
+	ticker := time.NewTicker(replicationResyncInterval)
+	defer ticker.Stop()
+
+	var nextResync time.Time
+
+	for {
+		w.mu.Lock()
+		needsResync := w.needsResync
+		w.mu.Unlock()
+
+		if needsResync && !time.Now().Before(nextResync) {
+			// Batches already queued will be included in the copy
+			w.drain()
+
+			err := open()
+			if err == nil {
+				app.withDatabases(func() {
+					err = app.resyncSink(w, db)
+				})
+			}
+			if err != nil {
+				reset()
+				w.recordError(err)
+				nextResync = time.Now().Add(replicationResyncInterval)
+			}
+		}
+
+		select {
+		case batch := <-w.queue:
+			w.mu.Lock()
+			needsResync := w.needsResync
+			w.mu.Unlock()
+			if needsResync {
+				continue
+			}
+
+			err := app.applyBatch(w, batch, open, reset, &models)
+			if err != nil {
+				app.withDatabases(func() {
+					app.markSinkForResync(w, err)
+				})
+				continue
+			}
+
+			w.mu.Lock()
+			w.lastApplied = time.Now()
+			if len(w.queue) == 0 {
+				w.behindSince = time.Time{}
+			}
+			w.mu.Unlock()
+		case <-w.resyncNow:
+			nextResync = time.Time{}
+		case <-ticker.C:
+		case <-w.stop:
+			return
+		case <-app.isShuttingDown:
+			// Don't hold up shutdown writing to a sink - any batches it hasn't received yet will be copied by a resync when the listener next starts
+			if len(w.queue) > 0 {
+				app.withDatabases(func() {
+					app.markSinkForResync(w, errors.New("listener shut down before queued batches were replicated"))
+				})
+			}
+			return
+		}
+	}
+}
+
+// Write batch to the sink, retrying with backoff
+func (app *application) applyBatch(w *sinkWorker, batch replicationBatch, open func() error, reset func(), models *data.Models) error {
+	delay := replicationRetryDelay
+
+	var err error
+	for attempt := 1; attempt <= replicationAttempts; attempt++ {
+		err = open()
+		if err == nil {
+			err = writeSyncData(models, batch.syncType, batch.data)
+			if err == nil {
+				return nil
+			}
+		}
+
+		reset()
+		w.recordError(err)
+
+		if attempt == replicationAttempts {
+			break
+		}
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-app.isShuttingDown:
+			return err
+		case <-w.stop:
+			return err
+		}
+	}
+
+	return err
+}
+
+// Copy every table in the listener database to the sink
+func (app *application) resyncSink(w *sinkWorker, dst *data.ListenerDB) error {
+	w.mu.Lock()
+	w.resyncing = true
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		w.resyncing = false
+		w.mu.Unlock()
+	}()
+
+	start := time.Now()
+
+	tables, err := app.models.Exports.GetExportableTables()
+	if err != nil {
+		return err
+	}
+
+	total := 0
+	for _, table := range tables {
+		n, err := data.CopyTable(app.models.Exports.DB, dst, table)
+		if err != nil {
+			return fmt.Errorf("couldn't copy %s: %w", table, err)
+		}
+		total += n
+	}
+
+	if err := app.models.Replication.SetNeedsResync(w.sink.ID, false); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.needsResync = false
+	w.lastApplied = time.Now()
+	w.lastError = ""
+	if len(w.queue) == 0 {
+		w.behindSince = time.Time{}
+	}
+	w.mu.Unlock()
+
+	app.logger.PrintInfo("replication sink resynced", map[string]any{
+		"sink_id":     w.sink.ID,
+		"rows":        total,
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+
+	return nil
+}
+
+func (w *sinkWorker) drain() {
+	for {
+		select {
+		case <-w.queue:
+		default:
+			return
+		}
+	}
+}
+
+func (w *sinkWorker) recordError(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastError = err.Error()
+	w.lastErrorAt = time.Now()
+}
+
+func (w *sinkWorker) status() data.SinkStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s := data.SinkStatus{
+		ID:          w.sink.ID,
+		Name:        w.sink.Name,
+		Target:      w.sink.Target(),
+		Pending:     len(w.queue),
+		LastApplied: w.lastApplied,
+		LastError:   w.lastError,
+		LastErrorAt: w.lastErrorAt,
+		NeedsResync: w.needsResync,
+		Resyncing:   w.resyncing,
+	}
+	if !w.behindSince.IsZero() {
+		s.Lag = time.Since(w.behindSince)
+	}
+
+	return s
+}
+
+func (app *application) replicationStatuses() map[int]data.SinkStatus {
+	app.replication.mu.Lock()
+	defer app.replication.mu.Unlock()
+
+	statuses := make(map[int]data.SinkStatus, len(app.replication.workers))
+	for id, w := range app.replication.workers {
+		statuses[id] = w.status()
+	}
+
+	return statuses
+}
+
+// Open a sink and create the listener tables in it. Sinks don't get change_log triggers - they are copies of the listener database, not a source of changes - but they do get the listener database's cipher, so sensitive columns are encrypted in them too.
+func openSinkDB(sink data.ReplicationSink, cipher *data.FieldCipher) (*data.ListenerDB, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	switch data.Dialect(sink.Driver) {
+	case data.DialectSQLite:
+		// WAL mode relies on shared memory, which doesn't work on network shares, so sinks use a rollback journal and full syncs instead
+		db, err := sql.Open("sqlite3", sink.DSN+"?_journal_mode=DELETE&_busy_timeout=5000&_synchronous=FULL")
+		if err != nil {
+			return nil, err
+		}
+		if err := db.PingContext(ctx); err != nil {
+			db.Close()
+			return nil, err
+		}
+		if err := createSMSTables(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+		listenerDB := data.NewListenerDB(db, data.DialectSQLite)
+		listenerDB.Cipher = cipher
+		return listenerDB, nil
+	case data.DialectPostgres:
+		db, err := sql.Open("postgres", sink.DSN)
+		if err != nil {
+			return nil, err
+		}
+		if err := db.PingContext(ctx); err != nil {
+			db.Close()
+			return nil, err
+		}
+		if err := createPostgresSMSTables(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+		listenerDB := data.NewListenerDB(db, data.DialectPostgres)
+		listenerDB.Cipher = cipher
+		return listenerDB, nil
+	}
+
+	return nil, fmt.Errorf("unsupported sink driver %q", sink.Driver)
+}
+
+func (app *application) getReplicationPageHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+
+	sinks, err := app.models.Replication.GetAll()
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	return app.Render(c, http.StatusOK, views.ReplicationPage(u, sinks, app.replicationStatuses()))
+}
+
+type replicationSinkInput struct {
+	Name   string `json:"name"`
+	Driver string `json:"driver"`
+	DSN    string `json:"dsn"`
+}
+
+func (app *application) createReplicationSinkHandler(c echo.Context) error {
+	user := app.contextGetUser(c)
+
+	var input replicationSinkInput
+	if err := c.Bind(&input); err != nil {
+		return app.badRequestResponse(c, err)
+	}
+
+	sink := &data.ReplicationSink{
+		Name:        input.Name,
+		Driver:      input.Driver,
+		DSN:         input.DSN,
+		Enabled:     true,
+		NeedsResync: true,
+	}
+
+	v := validator.New()
+	data.ValidateReplicationSink(v, sink)
+	if sink.Driver == string(data.DialectSQLite) && sink.DSN != "" {
+		v.Check(filepath.IsAbs(sink.DSN), "dsn", "must be an absolute path to a .db file")
+		v.Check(!sameFile(sink.DSN, app.config.dbPaths.listenerDB), "dsn", "must not be the listener database itself")
+	}
+	if !v.Valid() {
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	// Check the sink can be reached before saving it, so a mistyped path or connection string is caught straight away
+	db, err := openSinkDB(*sink, nil)
+	if err != nil {
+		v.AddError("dsn", "couldn't connect: "+err.Error())
+		return app.failedValidationResponse(c, v.Errors)
+	}
+	db.Close()
+
+	err = app.models.Replication.Insert(sink)
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	app.startSinkWorker(*sink)
+
+	app.logger.PrintInfo("replication sink created", map[string]any{
+		"sink_id": sink.ID,
+		"name":    sink.Name,
+		"driver":  sink.Driver,
+		"user_id": user.ID,
+	})
+	// The DSN is left out, as it can hold the sink's password
+	app.audit(c, user.ID, data.AuditSinkCreate, fmt.Sprintf("sink %d: %s (%s)", sink.ID, sink.Name, sink.Driver))
+
+	return c.JSON(http.StatusCreated, envelope{"success": true, "sink": sink})
+}
+
+func (app *application) deleteReplicationSinkHandler(c echo.Context) error {
+	user := app.contextGetUser(c)
+
+	id, err := app.readIDParam(c)
+	if err != nil {
+		return app.notFoundResponse(c)
+	}
+
+	err = app.models.Replication.Delete(id)
+	if err != nil {
+		switch err {
+		case data.ErrRecordNotFound:
+			return app.notFoundResponse(c)
+		default:
+			return app.serverErrorResponse(c, err)
+		}
+	}
+
+	app.stopSinkWorker(id)
+
+	app.logger.PrintInfo("replication sink deleted", map[string]any{
+		"sink_id": id,
+		"user_id": user.ID,
+	})
+	app.audit(c, user.ID, data.AuditSinkDelete, fmt.Sprintf("sink %d", id))
+
+	return c.JSON(http.StatusOK, envelope{"success": true})
+}
+
+// Copy the whole listener database to a sink now, eg. after restoring its disk
+func (app *application) resyncReplicationSinkHandler(c echo.Context) error {
+	user := app.contextGetUser(c)
+
+	id, err := app.readIDParam(c)
+	if err != nil {
+		return app.notFoundResponse(c)
+	}
+
+	app.replication.mu.Lock()
+	w, ok := app.replication.workers[id]
+	app.replication.mu.Unlock()
+	if !ok {
+		return app.notFoundResponse(c)
+	}
+
+	app.flagSinkResync(w)
+	select {
+	case w.resyncNow <- struct{}{}:
+	default:
+	}
+
+	app.logger.PrintInfo("replication sink resync requested", map[string]any{
+		"sink_id": id,
+		"user_id": user.ID,
+	})
+
+	return c.JSON(http.StatusAccepted, envelope{"success": true, "message": "Resync started."})
+}
+
+func sameFile(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && filepath.Clean(absA) == filepath.Clean(absB)
+}
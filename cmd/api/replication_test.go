@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+func TestReplicationToSQLiteSink(t *testing.T) {
+	dir := t.TempDir()
+
+	appDB, err := sql.Open("sqlite3", filepath.Join(dir, "app.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer appDB.Close()
+	assert.NilError(t, createReplicationSinksTable(appDB))
+
+	listenerDB, err := openKamarDB(filepath.Join(dir, "listener.db"))
+	assert.NilError(t, err)
+	defer listenerDB.Close()
+
+	app := newTestApplication(t, appDB, data.NewListenerDB(listenerDB, data.DialectSQLite))
+
+	// A subject that is already in the listener database when the sink is added must arrive through the initial resync
+	id, name, level := "11MAT", "Mathematics", 1
+	assert.NilError(t, app.models.Subjects.InsertManySubjects([]data.Subject{{ID: &id, Name: &name, Level: &level}}))
+
+	sinkPath := filepath.Join(dir, "mirror.db")
+	sink := &data.ReplicationSink{Name: "mirror", Driver: string(data.DialectSQLite), DSN: sinkPath, Enabled: true, NeedsResync: true}
+	assert.NilError(t, app.models.Replication.Insert(sink))
+	assert.NilError(t, app.startReplication())
+
+	// A batch committed after the sink was added must arrive through replication
+	id2, name2, level2 := "12ENG", "English", 2
+	batch := &SMSDirectoryData{Subjects: &SubjectsField{Data: []data.Subject{{ID: &id2, Name: &name2, Level: &level2}}}}
+	assert.NilError(t, writeSyncData(&app.models, "part", batch))
+	app.replicate("part", batch)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s := app.replicationStatuses()[sink.ID]
+		if !s.NeedsResync && s.Pending == 0 && s.Lag == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sink didn't catch up: %+v", s)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	close(app.isShuttingDown)
+	app.wg.Wait()
+
+	mirror, err := sql.Open("sqlite3", sinkPath)
+	assert.NilError(t, err)
+	defer mirror.Close()
+
+	var count int
+	assert.NilError(t, mirror.QueryRow(`SELECT COUNT(*) FROM subjects;`).Scan(&count))
+	assert.Equal(t, count, 2)
+
+	// Sinks are copies, so must not record their own changes
+	var triggers int
+	assert.NilError(t, mirror.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger';`).Scan(&triggers))
+	assert.Equal(t, triggers, 0)
+
+	sinks, err := app.models.Replication.GetAll()
+	assert.NilError(t, err)
+	assert.Equal(t, sinks[0].NeedsResync, false)
+}
+
+// A restore replaces app.models while sink workers are running, so they must only read it under app.dbMu - run with -race to check
+func TestReplicationDuringModelSwap(t *testing.T) {
+	dir := t.TempDir()
+
+	appDB, _, err := openAppDB(filepath.Join(dir, "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+	listenerDB := newTestListenerDB(t, dir)
+
+	app := newTestApplication(t, appDB, listenerDB)
+
+	sink := &data.ReplicationSink{Name: "mirror", Driver: string(data.DialectSQLite), DSN: filepath.Join(dir, "mirror.db"), Enabled: true, NeedsResync: true}
+	assert.NilError(t, app.models.Replication.Insert(sink))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 50 {
+			// As swapDatabases does
+			app.dbMu.Lock()
+			app.models = data.NewModels(appDB, listenerDB, app.background)
+			app.dbMu.Unlock()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	app.withDatabases(func() {
+		err = app.startReplication()
+	})
+	assert.NilError(t, err)
+	<-done
+
+	deadline := time.Now().Add(5 * time.Second)
+	for app.replicationStatuses()[sink.ID].NeedsResync {
+		if time.Now().After(deadline) {
+			t.Fatalf("sink wasn't resynced: %+v", app.replicationStatuses()[sink.ID])
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	close(app.isShuttingDown)
+	app.wg.Wait()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+)
+
+// Write a research export to a new folder (csv) or .db file (sqlite) in dir, and return its path. Identifiers are replaced with pseudonyms that are the same in every export, direct identifiers are left out, and counts below minCell in the summaries are suppressed.
+func (app *application) runResearchExport(dir, format string, minCell int) (string, error) {
+	v := validator.New()
+	v.Check(validator.In(format, data.ResearchFormats...), "format", "must be one of csv or sqlite")
+	v.Check(minCell >= 0, "min_cell", "must not be negative")
+	if !v.Valid() {
+		return "", fmt.Errorf("invalid research export options: %v", v.Errors)
+	}
+
+	key, err := app.models.ResearchKey.Get()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("couldn't create research export directory %s: %w", dir, err)
+	}
+
+	// Only export the tables this listener database actually has
+	existing, err := app.models.Exports.GetExportableTables()
+	if err != nil {
+		return "", err
+	}
+	var tables []string
+	for _, table := range data.ResearchTables {
+		if validator.In(table, existing...) {
+			tables = append(tables, table)
+		}
+	}
+
+	// Research exports leave the school, so there is no override for students who haven't consented
+	consent, err := app.models.Consent.Load()
+	if err != nil {
+		return "", err
+	}
+
+	name := "research-" + time.Now().UTC().Format("20060102T150405Z")
+	if format == "sqlite" {
+		return app.writeResearchSQLite(filepath.Join(dir, name+".db"), tables, key, consent, minCell)
+	}
+	return app.writeResearchCSV(filepath.Join(dir, name), tables, key, consent, minCell)
+}
+
+func (app *application) writeResearchCSV(path string, tables []string, key []byte, consent *data.Consent, minCell int) (string, error) {
+	if err := os.Mkdir(path, 0755); err != nil {
+		return "", err
+	}
+
+	for _, table := range tables {
+		var count int
+		err := writeFileAtomic(filepath.Join(path, table+".csv"), func(w io.Writer) error {
+			var err error
+			count, err = app.models.Exports.WriteResearchCSV(table, key, consent, w)
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", table, err)
+		}
+
+		app.logger.PrintInfo("table written to research export", map[string]any{
+			"table":   table,
+			"records": count,
+		})
+	}
+
+	for _, a := range data.ResearchAggregates {
+		err := writeFileAtomic(filepath.Join(path, a.Name+".csv"), func(w io.Writer) error {
+			_, err := app.models.Exports.WriteResearchAggregateCSV(a, minCell, w)
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", a.Name, err)
+		}
+	}
+
+	return path, nil
+}
+
+// The export is written to a temporary file and renamed once it is complete, so a partial export is never left looking like a finished one
+func (app *application) writeResearchSQLite(path string, tables []string, key []byte, consent *data.Consent, minCell int) (string, error) {
+	tmp := path + ".tmp"
+	defer os.Remove(tmp)
+
+	db, err := sql.Open("sqlite3", tmp)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	for _, table := range tables {
+		count, err := app.models.Exports.WriteResearchSQLite(table, key, consent, db)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", table, err)
+		}
+
+		app.logger.PrintInfo("table written to research export", map[string]any{
+			"table":   table,
+			"records": count,
+		})
+	}
+
+	for _, a := range data.ResearchAggregates {
+		if _, err := app.models.Exports.WriteResearchAggregateSQLite(a, minCell, db); err != nil {
+			return "", fmt.Errorf("%s: %w", a.Name, err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
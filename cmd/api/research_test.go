@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+func TestResearchExport(t *testing.T) {
+	dir := t.TempDir()
+
+	appDB, _, err := openAppDB(filepath.Join(dir, "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+	listenerDB := newTestListenerDB(t, dir)
+
+	app := newTestApplication(t, appDB, listenerDB)
+
+	id, uuid, nsn, firstname, datebirth := 1234, "uuid-1", "123456789", "Aroha", 20070512
+	assert.NilError(t, app.models.Students.InsertManyStudents([]data.Student{{ID: &id, UUID: &uuid, Nsn: &nsn, Firstname: &firstname, Datebirth: &datebirth}}))
+	resultType, number, version, year, result, comment := "NCEA", "91027", 1, 2025, "A", "Aroha worked hard"
+	assert.NilError(t, app.models.Results.InsertManyResults([]data.Result{{ID: &id, NSN: &nsn, Type: &resultType, Number: &number, Version: &version, Year: &year, Result: &result, Comment: &comment}}))
+
+	path, err := app.runResearchExport(filepath.Join(dir, "research"), "sqlite", 5)
+	assert.NilError(t, err)
+
+	db, err := sql.Open("sqlite3", path)
+	assert.NilError(t, err)
+	defer db.Close()
+
+	// Identifiers are pseudonymised the same way in every table, so they can still be joined
+	var studentID, studentNSN, resultID, resultNSN string
+	var birthYear int
+	assert.NilError(t, db.QueryRow(`SELECT id, nsn, datebirth FROM students;`).Scan(&studentID, &studentNSN, &birthYear))
+	assert.NilError(t, db.QueryRow(`SELECT id, nsn FROM results;`).Scan(&resultID, &resultNSN))
+	assert.Equal(t, studentID, resultID)
+	assert.Equal(t, studentNSN, resultNSN)
+	assert.Equal(t, studentNSN == nsn, false)
+	assert.Equal(t, birthYear, 2007)
+
+	// Names and free text are left out
+	for _, q := range []string{`SELECT firstname FROM students;`, `SELECT comment FROM results;`} {
+		var v any
+		if err := db.QueryRow(q).Scan(&v); err == nil {
+			t.Errorf("expected %q to fail, as the column shouldn't be exported", q)
+		}
+	}
+
+	// A single student is too small a group to report
+	var students string
+	assert.NilError(t, db.QueryRow(`SELECT students FROM results_by_standard;`).Scan(&students))
+	assert.Equal(t, students, "<5")
+
+	// Pseudonyms stay the same in later exports
+	path, err = app.runResearchExport(filepath.Join(dir, "research"), "csv", 0)
+	assert.NilError(t, err)
+	csv, err := os.ReadFile(filepath.Join(path, "students.csv"))
+	assert.NilError(t, err)
+	assert.StringContains(t, string(csv), studentNSN)
+	assert.Equal(t, strings.Contains(string(csv), "Aroha"), false)
+
+	summary, err := os.ReadFile(filepath.Join(path, "results_by_standard.csv"))
+	assert.NilError(t, err)
+	assert.StringContains(t, string(summary), "2025,91027,A,1")
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -75,6 +77,39 @@ func (app *application) kamarAuthFailedResponse(c echo.Context) error {
 	return app.kamarResponse(c, http.StatusForbidden, j)
 }
 
+// Sent without checking KAMAR's credentials at all while the request's source is locked out - add KAMAR's IP to lockout_exempt_ips to stop this happening to syncs
+func (app *application) kamarLockedOutResponse(c echo.Context, until time.Time) error {
+	j := map[string]any{
+		"error":   429,
+		"result":  "Too Many Failed Attempts",
+		"service": "WHS KAMAR Refresh",
+		"version": "1.0",
+	}
+
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+
+	return app.kamarResponse(c, http.StatusTooManyRequests, j)
+}
+
+// Sent before KAMAR's credentials are checked when the request's source isn't in kamar_allowed_cidrs
+func (app *application) kamarSourceNotAllowedResponse(c echo.Context) error {
+	j := map[string]any{
+		"error":   403,
+		"result":  "Source Not Allowed",
+		"service": "WHS KAMAR Refresh",
+		"version": "1.0",
+	}
+
+	e := data.ListenerEvent{
+		ReqType:       "unknown",
+		WasSuccessful: false,
+		Message:       fmt.Sprintf("request from %s isn't in the KAMAR allow-list", c.RealIP()),
+	}
+	app.models.ListenerEvents.Insert(&e)
+
+	return app.kamarResponse(c, http.StatusForbidden, j)
+}
+
 func (app *application) kamarNoCredentialsResponse(c echo.Context) error {
 	j := map[string]any{
 		"error":   401,
@@ -114,11 +149,17 @@ func (app *application) kamarUnprocessableEntityResponse(c echo.Context) error {
 
 // TODO: Get check options etc. from DB
 func (app *application) kamarCheckResponse(c echo.Context) error {
-	cfg, err := app.models.Config.LoadConfig()
+	cfg, err := app.listenerConfig()
 	if err != nil {
 		app.serverErrorResponse(c, err)
 	}
 
+	// Fields dropped by the PII policy aren't asked for, so KAMAR never sends them
+	policy, err := app.models.PIIPolicy.Load()
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
 	j := map[string]any{
 		"error":            0,
 		"result":           "OK",
@@ -147,8 +188,8 @@ func (app *application) kamarCheckResponse(c echo.Context) error {
 				"classefforts":    cfg.GetBool("classefforts"),
 				"learningsupport": cfg.GetBool("learningsupport"),
 				"fields": map[string]string{
-					"required": "firstname;lastname;gender;gendercode;nsn;uniqueid",
-					"optional": "schoolindex;firstnamelegal;lastnamelegal;forenames;forenameslegal;genderpreferred;username;mobile;email;house;whanau;boarder;byodinfo;ece;esol;ors;languagespoken;datebirth;startingdate;startschooldate;created;leavingdate;leavingreason;leavingschool;leavingactivity;res;resa;resb;res.title;res.salutation;res.email;res.numFlatUnit;res.numStreet;res.ruralDelivery;res.suburb;res.town;res.postcode;caregivers;caregivers1;caregivers2;caregivers3;caregivers4;caregiver.name;caregiver.relationship;caregiver.status;caregiver.address,caregiver.mobile;caregiver.email;emergency;emergency1;emergency2;emergency.name;emergency.relationship;emergency.mobile;moetype;ethnicityL1;ethnicityL2;ethnicity;iwi;yearlevel;fundinglevel;tutor;timetablebottom1;timetablebottom2;timetablebottom3;timetablebottom4;timetabletop1;timetabletop2;timetabletop3;timetabletop4;maorilevel;pacificlanguage;pacificlevel;flags;flag.alert;flag.conditions;flag.dietary;flag.general;flag.ibuprofen;flag.medical;flag.notes;flag.paracetamol;flag.pastoral;flag.reactions;flag.specialneeds;flag.vaccinations;flag.eotcconsent;flag.eotcform;custom;custom.custom1;custom.custom2;custom.custom3;custom.custom4;custom.custom5;siblinglink;photocopierid;signedagreement;accountdisabled;networkaccess;altdescription;althomedrive",
+					"required": strings.Join(data.StudentRequiredFields, ";"),
+					"optional": strings.Join(policy.Advertised("students", data.StudentOptionalFields), ";"),
 				},
 			},
 			"staff": map[string]any{
@@ -156,8 +197,8 @@ func (app *application) kamarCheckResponse(c echo.Context) error {
 				"photos":     false,
 				"timetables": cfg.GetBool("details"),
 				"fields": map[string]string{
-					"required": "uniqueid;firstname;lastname;username;gender;email",
-					"optional": "schoolindex;title;mobile;extension;classification;position;house;tutor;groups;groups.departments;datebirth;created;leavingdate;startingdate;eslguid;moenumber;photocopierid;registrationnumber;custom;custom.custom1;custom.custom2;custom.custom3;custom.custom4;custom.custom5",
+					"required": strings.Join(data.StaffRequiredFields, ";"),
+					"optional": strings.Join(policy.Advertised("staff", data.StaffOptionalFields), ";"),
 				},
 			},
 			"common": map[string]bool{
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+func TestUserRoles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.db")
+
+	// A database from before roles, with one admin and one other user
+	db, err := sql.Open("sqlite3", path)
+	assert.NilError(t, err)
+	_, err = db.Exec(`CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at TEXT NOT NULL DEFAULT (datetime('now')),
+		last_authenticated_at TEXT NOT NULL DEFAULT (datetime('now')),
+		username TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		is_admin INTEGER NOT NULL DEFAULT 0
+	);
+	INSERT INTO users (username, password_hash, is_admin) VALUES ('staff', 'x', 0), ('admin', 'x', 1);`)
+	assert.NilError(t, err)
+	db.Close()
+
+	appDB, _, err := openAppDB(path)
+	assert.NilError(t, err)
+	defer appDB.Close()
+
+	app := newTestApplication(t, appDB, nil)
+
+	users, err := app.models.Users.GetAll()
+	assert.NilError(t, err)
+	assert.Equal(t, len(users), 2)
+	assert.Equal(t, users[0].Role, data.RoleOperator)
+	assert.Equal(t, users[1].Role, data.RoleAdmin)
+
+	admin, operator := users[1], users[0]
+	viewer := &data.User{ID: 3, Username: "analyst", Role: data.RoleViewer}
+
+	e := echo.New()
+	newContext := func(u *data.User, body string) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		app.contextSetUser(c, u)
+		return c, rec
+	}
+
+	next := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	tests := []struct {
+		user       *data.User
+		permission data.Permission
+		want       int
+	}{
+		{viewer, data.PermissionView, http.StatusOK},
+		{viewer, data.PermissionOperate, http.StatusForbidden},
+		{operator, data.PermissionOperate, http.StatusOK},
+		{operator, data.PermissionConfigure, http.StatusForbidden},
+		{operator, data.PermissionManageUsers, http.StatusForbidden},
+		{admin, data.PermissionConfigure, http.StatusOK},
+		{admin, data.PermissionManageUsers, http.StatusOK},
+		{data.AnonymousUser, data.PermissionView, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		c, rec := newContext(tt.user, "")
+		assert.NilError(t, app.requirePermission(tt.permission)(next)(c))
+		assert.Equal(t, rec.Code, tt.want)
+	}
+
+	// Admins can assign roles, but not take the role away from the only admin
+	c, rec := newContext(admin, `{"role": "viewer"}`)
+	c.SetParamNames("id")
+	c.SetParamValues("2")
+	assert.NilError(t, app.updateUserRoleHandler(c))
+	assert.Equal(t, rec.Code, http.StatusUnprocessableEntity)
+
+	c, rec = newContext(admin, `{"role": "admin"}`)
+	c.SetParamNames("id")
+	c.SetParamValues("1")
+	assert.NilError(t, app.updateUserRoleHandler(c))
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	c, rec = newContext(admin, `{"role": "viewer"}`)
+	c.SetParamNames("id")
+	c.SetParamValues("2")
+	assert.NilError(t, app.updateUserRoleHandler(c))
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	user, err := app.models.Users.GetByID(2)
+	assert.NilError(t, err)
+	assert.Equal(t, user.Role, data.RoleViewer)
+
+	// The only admin can't delete their account either, but anyone else can
+	onlyAdmin, err := app.models.Users.GetByID(1)
+	assert.NilError(t, err)
+	c, rec = newContext(onlyAdmin, "")
+	assert.NilError(t, app.deleteUserHandler(c))
+	assert.Equal(t, rec.Code, http.StatusUnprocessableEntity)
+	_, err = app.models.Users.GetByID(1)
+	assert.NilError(t, err)
+
+	c, rec = newContext(user, "")
+	assert.NilError(t, app.deleteUserHandler(c))
+	assert.Equal(t, rec.Code, http.StatusSeeOther)
+	_, err = app.models.Users.GetByID(2)
+	assert.Equal(t, err, data.ErrRecordNotFound)
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
 )
 
 //go:embed assets/*
@@ -16,10 +17,36 @@ var embeddedAssets embed.FS
 //go:embed comment-checker-ui/*
 var commentCheckerFiles embed.FS
 
+// Both the KAMAR listener endpoint and the admin UI, for when they share a server
 func (app *application) routes() http.Handler {
+	router := app.newRouter()
+	app.addAdminRoutes(router)
+	app.addKAMARRoutes(router)
+	return router
+}
+
+// Just the KAMAR listener endpoint, for a server separate from the admin UI
+func (app *application) kamarRoutes() http.Handler {
+	router := app.newRouter()
+	app.addKAMARRoutes(router)
+	return router
+}
+
+// Just the admin UI, for a server that KAMAR doesn't need to reach
+func (app *application) adminRoutes() http.Handler {
+	router := app.newRouter()
+	app.addAdminRoutes(router)
+	return router
+}
+
+// A router with the middleware and routes that every server needs
+func (app *application) newRouter() *echo.Echo {
 	router := echo.New()
+	// The listener is reached directly rather than through a proxy, so X-Forwarded-For and X-Real-IP headers are ignored - otherwise anyone could claim to be KAMAR's IP to get past the allow-list and lockouts
+	router.IPExtractor = echo.ExtractIPDirect()
 
 	router.Use(app.recoverPanicMiddleware)
+	router.Use(app.holdDatabases)
 	// Only use rate limiter if enabled, and use custom values in config
 	if app.config.limiter.enabled {
 		router.Use(middleware.RateLimiter(middleware.NewRateLimiterMemoryStoreWithConfig(
@@ -33,6 +60,12 @@ func (app *application) routes() http.Handler {
 
 	router.Pre(middleware.RemoveTrailingSlash())
 
+	router.GET("/healthcheck", app.healthcheckHandler)
+
+	return router
+}
+
+func (app *application) addAdminRoutes(router *echo.Echo) {
 	// TO SET UP EMBEDDED ASSETS OR FILES WITH ECHO,
 	// 1) the assets must be in the same directory as main.go, so the go:embed can find them (as far as I can tell)
 	// 2) use echo.MustSubFS() to clean route-file matching, eg. the html is searching for url.com/style.css - seeing as that file is in the /assets folder, MustSubFS navigates the file system inside of /assets
@@ -41,14 +74,16 @@ func (app *application) routes() http.Handler {
 
 	commentCheckerFS := echo.MustSubFS(commentCheckerFiles, "comment-checker-ui")
 
-	router.GET("/healthcheck", app.healthcheckHandler)
-
 	// Routes that require authentication - clients accessing these routes will pass through authentication, being set as either the user associated with their cookie or an anonymous user
 	// To set middleware on any route branching off of "/", including the "/" route itself, echo requires the route group to be set on "" rather than "/" as it appends a trailing slash.
 	authGroup := router.Group("", app.authenticateUser)
 	authGroup.GET("/register", app.registerPageHandler)
 	authGroup.POST("/register", app.registerUserHandler)
 
+	// Invited users activate their account themselves, so must be able to reach these without being signed in
+	authGroup.GET("/activate", app.activatePageHandler)
+	authGroup.POST("/activate", app.activateUserHandler)
+
 	authGroup.GET("/sign-in", app.signInPageHandler)
 	authGroup.POST("/sign-in", app.signInUserHandler)
 
@@ -65,38 +100,90 @@ func (app *application) routes() http.Handler {
 	// The user must be authenticated in order to be logged out successfully, and to reach the dashboard
 	isAuthenticatedGroup.POST("/log-out", app.logoutUserHandler)
 
-	isAuthenticatedGroup.POST("/config/set/auth", app.setKamarAuthHandler)
+	// Each route below requires a permission, which the user's role must grant - see data.Roles
+	view := app.requirePermission(data.PermissionView)
+	operate := app.requirePermission(data.PermissionOperate)
+	configure := app.requirePermission(data.PermissionConfigure)
+	manageUsers := app.requirePermission(data.PermissionManageUsers)
+	privacy := app.requirePermission(data.PermissionPrivacy)
+	audit := app.requirePermission(data.PermissionAudit)
+
+	isAuthenticatedGroup.POST("/config/set/auth", app.setKamarAuthHandler, configure)
 
 	// Routes in this group will be redirected to a KAMAR auth set up page if a username and password for KAMAR directory service haven't been set in the database
 	kamarAuthSetGroup := isAuthenticatedGroup.Group("", app.requireKAMARAuthSetUp)
-	kamarAuthSetGroup.GET("/config/update/password", app.updateConfigPasswordPageHandler)
-	kamarAuthSetGroup.POST("/config/update/password", app.updateConfigPasswordHandler)
-	kamarAuthSetGroup.POST("/config/update/json-switch", app.jsonSwitchHandler)
-	kamarAuthSetGroup.POST("/config/update", app.updateConfigHandler)
-	kamarAuthSetGroup.GET("/config", app.configPageHandler)
-
-	isAuthenticatedGroup.GET("/logs/partial", app.getFilteredLogsHandler)
-	isAuthenticatedGroup.GET("/logs/:id", app.getIndividualLogPageHandler)
-	isAuthenticatedGroup.DELETE("/logs/:id", app.deleteIndividualLogHandler)
-	isAuthenticatedGroup.GET("/logs/prune", app.pruneLogsWidgetHandler)
-	isAuthenticatedGroup.GET("/logs", app.getFilteredLogsPageHandler)
-
+	kamarAuthSetGroup.GET("/config/update/password", app.updateConfigPasswordPageHandler, configure)
+	kamarAuthSetGroup.POST("/config/update/password", app.updateConfigPasswordHandler, configure)
+	kamarAuthSetGroup.POST("/config/update/json-switch", app.jsonSwitchHandler, configure)
+	kamarAuthSetGroup.POST("/config/update", app.updateConfigHandler, configure)
+	kamarAuthSetGroup.POST("/config/pii-policy", app.updatePIIPolicyHandler, configure)
+	kamarAuthSetGroup.POST("/config/tls", app.uploadCertificateHandler, configure)
+	kamarAuthSetGroup.POST("/config/tls/reset", app.resetCertificateHandler, configure)
+	kamarAuthSetGroup.GET("/config", app.configPageHandler, configure)
+
+	isAuthenticatedGroup.GET("/logs/partial", app.getFilteredLogsHandler, view)
+	isAuthenticatedGroup.GET("/logs/:id", app.getIndividualLogPageHandler, view)
+	isAuthenticatedGroup.DELETE("/logs/:id", app.deleteIndividualLogHandler, operate)
+	isAuthenticatedGroup.GET("/logs/prune", app.pruneLogsWidgetHandler, operate)
+	isAuthenticatedGroup.GET("/logs", app.getFilteredLogsPageHandler, view)
+
+	// Every user can change their own password, set up their own 2FA and delete their own account
 	isAuthenticatedGroup.GET("/users/update/password", app.updateUserPasswordPageHandler)
 	isAuthenticatedGroup.POST("/users/update/password", app.updateUserPasswordHandler)
 	isAuthenticatedGroup.GET("/users/delete", app.deleteUserHandler)
-	isAuthenticatedGroup.GET("/users", app.getUsersPageHandler)
+	isAuthenticatedGroup.GET("/users/2fa", app.getTwoFactorPageHandler)
+	isAuthenticatedGroup.POST("/users/2fa/enable", app.enableTwoFactorHandler)
+	isAuthenticatedGroup.POST("/users/2fa/disable", app.disableTwoFactorHandler)
+	isAuthenticatedGroup.POST("/users/:id/2fa/reset", app.resetTwoFactorHandler, manageUsers)
+	isAuthenticatedGroup.POST("/users/:id/sessions/revoke", app.revokeUserSessionsHandler, manageUsers)
+	isAuthenticatedGroup.POST("/users/invite", app.inviteUserHandler, manageUsers)
+	isAuthenticatedGroup.POST("/users/:id/role", app.updateUserRoleHandler, manageUsers)
+	isAuthenticatedGroup.GET("/users", app.getUsersPageHandler, view)
+
+	// Every user can see and sign out their own sessions - revokeSessionHandler checks the permission to sign out anyone else's
+	isAuthenticatedGroup.GET("/sessions", app.getSessionsPageHandler)
+	isAuthenticatedGroup.DELETE("/sessions/:id", app.revokeSessionHandler)
+	isAuthenticatedGroup.POST("/sessions/revoke-all", app.revokeAllSessionsHandler)
+
+	isAuthenticatedGroup.POST("/lockouts/unlock", app.unlockHandler, configure)
+
+	isAuthenticatedGroup.GET("/help", app.getHelpPageHandler, view)
+
+	isAuthenticatedGroup.GET("/opendatafolder", app.openDataFolderHandler, operate)
+
+	isAuthenticatedGroup.GET("/tls/ca.crt", app.downloadCAHandler, view)
 
-	isAuthenticatedGroup.GET("/help", app.getHelpPageHandler)
+	isAuthenticatedGroup.POST("/exports/run", app.runExportHandler, operate)
 
-	isAuthenticatedGroup.GET("/opendatafolder", app.openDataFolderHandler)
+	isAuthenticatedGroup.GET("/changes", app.getChangesHandler, view)
 
-	kamarAuthSetGroup.GET("/", app.getDashboardPageHandler)
+	isAuthenticatedGroup.GET("/webhooks", app.getWebhooksPageHandler, operate)
+	isAuthenticatedGroup.POST("/webhooks", app.createWebhookHandler, operate)
+	isAuthenticatedGroup.DELETE("/webhooks/:id", app.deleteWebhookHandler, operate)
 
+	isAuthenticatedGroup.GET("/replication", app.getReplicationPageHandler, operate)
+	isAuthenticatedGroup.POST("/replication", app.createReplicationSinkHandler, operate)
+	isAuthenticatedGroup.DELETE("/replication/:id", app.deleteReplicationSinkHandler, operate)
+	isAuthenticatedGroup.POST("/replication/:id/resync", app.resyncReplicationSinkHandler, operate)
+
+	isAuthenticatedGroup.GET("/backups", app.getBackupsPageHandler, operate)
+	isAuthenticatedGroup.POST("/backups", app.createBackupHandler, operate)
+	isAuthenticatedGroup.POST("/backups/:name/restore", app.restoreBackupHandler, configure)
+
+	isAuthenticatedGroup.GET("/privacy", app.getPrivacyPageHandler, privacy)
+	isAuthenticatedGroup.GET("/privacy/students/:id", app.getSubjectAccessHandler, privacy)
+	isAuthenticatedGroup.POST("/privacy/students/:id/erase", app.eraseStudentHandler, privacy)
+
+	isAuthenticatedGroup.GET("/audit", app.getAuditPageHandler, audit)
+
+	kamarAuthSetGroup.GET("/", app.getDashboardPageHandler, view)
+}
+
+func (app *application) addKAMARRoutes(router *echo.Echo) {
 	// Wrap the /kamar-refresh handler in the authenticate middleware, to force an auth check on any request to this endpoint.
-	kamarAuthGroup := router.Group("/kamar-listener", app.authenticateKAMAR)
+	// Requests from outside the KAMAR source allow-list are refused before their credentials are checked
+	kamarAuthGroup := router.Group("/kamar-listener", app.requireAllowedKAMARSource, app.authenticateKAMAR)
 	kamarAuthGroup.POST("", app.kamarRefreshHandler)
 
 	// router.HandlerFunc(http.MethodPost, "/tokens/authentication", app.authenticateUser(app.createAuthenticationTokenHandler))
-
-	return router
 }
@@ -9,36 +9,82 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
 
-// Create and serve an httpserver based on app parameters. Before starting the server, run a goroutine that listens for Interrupt and Terminate signals, and attempts to shut down the server and any background goroutines gracefully.
+// One of the listener's servers, and whether it serves HTTPS
+type server struct {
+	*http.Server
+	name     string
+	https_on bool
+}
+
+// The admin UI's listener settings, which are the KAMAR listener's when the admin UI shares it
+func (cfg config) adminListener() listenerConfig {
+	if cfg.admin.addr == "" {
+		return cfg.kamar
+	}
+	return cfg.admin
+}
+
+// The servers to run - one serving both KAMAR and the admin UI by default, or one for each when the admin UI has an address of its own
+func (app *application) servers() []*server {
+	if app.config.admin.addr == "" {
+		return []*server{app.newServer("listener", app.config.kamar, app.routes())}
+	}
+
+	return []*server{
+		app.newServer("kamar", app.config.kamar, app.kamarRoutes()),
+		app.newServer("admin", app.config.admin, app.adminRoutes()),
+	}
+}
+
 // InsecureSkipVerify prevents errors caused by using self-signed certificates (as is the case for this application)
 // TODO: Implement VerifyConnection to improve security
+func (app *application) newServer(name string, lc listenerConfig, handler http.Handler) *server {
+	tlsConfig := &tls.Config{
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		// Read for every connection, so a regenerated certificate is served straight away
+		GetCertificate: app.certs.getCertificate,
+	}
+
+	return &server{
+		Server: &http.Server{
+			Addr:    lc.addr,
+			Handler: handler,
+			// Create a logger to be used as standard error, so that error logs coming from http.server, which is configured to print to stderror rather than stdout, will be caught and sent to the custom jsonlog logger instead.
+			ErrorLog:     log.New(app.logger, "", 0),
+			TLSConfig:    tlsConfig,
+			IdleTimeout:  lc.idleTimeout,
+			ReadTimeout:  lc.readTimeout,
+			WriteTimeout: lc.writeTimeout,
+		},
+		name:     name,
+		https_on: lc.https_on,
+	}
+}
+
+// Create and serve the listener's servers based on app parameters. Before starting them, run a goroutine that listens for Interrupt and Terminate signals, and attempts to shut down every server and any background goroutines gracefully.
 func (app *application) serve() error {
 	// if err := sslcerts.GenerateSSLCert(app.logger); err != nil {
 	// 	app.logger.PrintFatal(err, nil)
 	// }
 
-	tlsConfig := &tls.Config{
-		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
-	}
-
-	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", app.config.port),
-		Handler: app.routes(),
-		// Create a logger to be used as standard error, so that error logs coming from http.server, which is configured to print to stderror rather than stdout, will be caught and sent to the custom jsonlog logger instead.
-		ErrorLog:     log.New(app.logger, "", 0),
-		TLSConfig:    tlsConfig,
-		IdleTimeout:  time.Minute,
-		ReadTimeout:  0,
-		WriteTimeout: 0,
+	servers := app.servers()
+	for _, srv := range servers {
+		if srv.https_on && app.certs.leaf() == nil {
+			return errors.New("no TLS certificate could be loaded or generated - check the tls folder, or start the listener with -https_on=false")
+		}
 	}
 
 	shutdownError := make(chan error)
+	// Closed when a server stops by itself, eg. because its address is in use, so the others are shut down too rather than left running without it
+	serverStopped := make(chan struct{})
+	var stopOnce sync.Once
 
-	// Create a goroutine that listens for program-ending signals in the background, and instead of just causing the server to stop without completing requests, writes etc., allows the server to gracefully shut down.
+	// Create a goroutine that listens for program-ending signals in the background, and instead of just causing the servers to stop without completing requests, writes etc., allows them to gracefully shut down.
 	go func() {
 		// Set up a channel that receives an os.Signal, with a buffer of 1 - the buffer of 1 means that s := <-quit will wait (buffer) until the quit channel has received a value to send to s.
 		quit := make(chan os.Signal, 1)
@@ -46,12 +92,17 @@ func (app *application) serve() error {
 		// Listen for SIGINT (ctrl+c) and SIGTERM signals, and on either event, send the signal to the quit channel, triggering the buffer s below.
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
-		// This will block until a signal is received
-		s := <-quit
-
-		app.logger.PrintInfo("shutting down server", map[string]any{
-			"signal": s.String(),
-		})
+		// This will block until a signal is received, or a server has stopped
+		select {
+		case s := <-quit:
+			app.logger.PrintInfo("shutting down server", map[string]any{
+				"signal": s.String(),
+			})
+		case <-serverStopped:
+			app.logger.PrintInfo("shutting down server", map[string]any{
+				"reason": "a listener stopped unexpectedly",
+			})
+		}
 
 		close(app.isShuttingDown)
 
@@ -59,51 +110,86 @@ func (app *application) serve() error {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		// If Shutdown() returns an error, send it to shutdownError.
-		err := srv.Shutdown(ctx)
-		if err != nil {
-			shutdownError <- err
+		// Shut every server down at once, so they share the 5 seconds rather than each getting their own
+		errs := make([]error, len(servers))
+		var wg sync.WaitGroup
+		for i, srv := range servers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = srv.Shutdown(ctx)
+			}()
 		}
+		wg.Wait()
 
-		app.logger.PrintInfo("completing background tasks", map[string]any{
-			"addr": srv.Addr,
-		})
+		app.logger.PrintInfo("completing background tasks", nil)
 
-		// Wait for all goroutines in WaitGroup to complete before sending nil to shutdownError
+		// Wait for all goroutines in WaitGroup to complete before sending any errors from Shutdown() to shutdownError
 		app.wg.Wait()
-		shutdownError <- nil
+		shutdownError <- errors.Join(errs...)
 	}()
 
 	app.initiateTokenDeletionCycle()
 	app.initiateRecordCountUpdateCycle()
+	app.initiateExportCycle()
+	app.initiateBackupCycle()
+	app.initiateCertificateCheckCycle()
 
-	app.logger.PrintInfo("starting server", map[string]any{
-		"addr":     srv.Addr,
-		"env":      app.config.env,
-		"https_on": app.config.https_on,
-	})
+	if err := app.startReplication(); err != nil {
+		app.logger.PrintError(err, map[string]any{
+			"message": "couldn't start replication to sinks",
+		})
+	}
 
-	// Shutdown causes an ErrServerClosed to be thrown, which is the desired outcome - only return an error that is not of this type.
-	var err error
-	if app.config.https_on {
-		err = srv.ListenAndServeTLS(app.config.tlsPaths.cert, app.config.tlsPaths.key)
-	} else {
-		err = srv.ListenAndServe()
+	listenErrors := make(chan error, len(servers))
+	for _, srv := range servers {
+		app.logger.PrintInfo("starting server", map[string]any{
+			"name":     srv.name,
+			"addr":     srv.Addr,
+			"env":      app.config.env,
+			"https_on": srv.https_on,
+		})
+
+		go func() {
+			var err error
+			if srv.https_on {
+				// The certificate comes from GetCertificate rather than files
+				err = srv.ListenAndServeTLS("", "")
+			} else {
+				err = srv.ListenAndServe()
+			}
+			// Shutdown causes an ErrServerClosed to be returned, which is the desired outcome - anything else means the server stopped by itself
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.PrintError(err, map[string]any{
+					"name": srv.name,
+					"addr": srv.Addr,
+				})
+				stopOnce.Do(func() { close(serverStopped) })
+				listenErrors <- fmt.Errorf("%s server: %w", srv.name, err)
+				return
+			}
+			listenErrors <- nil
+		}()
 	}
-	if !errors.Is(err, http.ErrServerClosed) {
-		return err
+
+	var err error
+	for range servers {
+		err = errors.Join(err, <-listenErrors)
 	}
 
-	// Successful Shutdown returns nil, so if shutdownError is not nil, return the error that occurred.
-	err = <-shutdownError
+	// Successful Shutdown returns nil, so if shutdownError is not nil, return the error that occurred along with any from the servers themselves.
+	err = errors.Join(err, <-shutdownError)
 	if err != nil {
 		return err
 	}
 
 	// Otherwise, Shutdown completed successfully - log that fact, and return nil.
-	app.logger.PrintInfo("stopped server", map[string]any{
-		"addr": srv.Addr,
-	})
+	for _, srv := range servers {
+		app.logger.PrintInfo("stopped server", map[string]any{
+			"name": srv.name,
+			"addr": srv.Addr,
+		})
+	}
 
 	return nil
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+)
+
+func TestServers(t *testing.T) {
+	app := newTestApplication(t, nil, nil)
+
+	hasRoute := func(h http.Handler, method, path string) bool {
+		for _, r := range h.(*echo.Echo).Routes() {
+			if r.Method == method && r.Path == path {
+				return true
+			}
+		}
+		return false
+	}
+
+	// By default one server handles everything, as it always has
+	servers := app.servers()
+	assert.Equal(t, len(servers), 1)
+	assert.Equal(t, servers[0].Addr, ":8085")
+	assert.Equal(t, hasRoute(servers[0].Handler, http.MethodPost, "/kamar-listener"), true)
+	assert.Equal(t, hasRoute(servers[0].Handler, http.MethodGet, "/sign-in"), true)
+	assert.Equal(t, app.config.adminListener().https_on, true)
+
+	// With an admin address, KAMAR can't reach the admin UI and the admin listener doesn't accept KAMAR's data
+	app.config.admin = listenerConfig{addr: "127.0.0.1:8086", https_on: false}
+	servers = app.servers()
+	assert.Equal(t, len(servers), 2)
+	kamar, admin := servers[0], servers[1]
+	assert.Equal(t, kamar.Addr, ":8085")
+	assert.Equal(t, kamar.https_on, true)
+	assert.Equal(t, hasRoute(kamar.Handler, http.MethodPost, "/kamar-listener"), true)
+	assert.Equal(t, hasRoute(kamar.Handler, http.MethodGet, "/sign-in"), false)
+	assert.Equal(t, hasRoute(kamar.Handler, http.MethodGet, "/healthcheck"), true)
+
+	assert.Equal(t, admin.Addr, "127.0.0.1:8086")
+	assert.Equal(t, admin.https_on, false)
+	assert.Equal(t, hasRoute(admin.Handler, http.MethodPost, "/kamar-listener"), false)
+	assert.Equal(t, hasRoute(admin.Handler, http.MethodGet, "/sign-in"), true)
+	assert.Equal(t, app.config.adminListener().https_on, false)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	views "github.com/michaelcjefferson/kamar-listener/ui/views"
+)
+
+// Users see their own sessions. Those who can manage users see everyone's, so they can sign out a stolen or forgotten session.
+func (app *application) getSessionsPageHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+	token := app.contextGetSessionToken(c)
+
+	var sessions []data.Session
+	var err error
+	if u.Can(data.PermissionManageUsers) {
+		sessions, err = app.models.Tokens.GetAllSessions(token)
+	} else {
+		sessions, err = app.models.Tokens.GetSessionsForUser(u.ID, token)
+	}
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	return app.Render(c, http.StatusOK, views.SessionsPage(u, sessions))
+}
+
+func (app *application) revokeSessionHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+
+	id, err := app.readIDParam(c)
+	if err != nil {
+		return app.notFoundResponse(c)
+	}
+
+	session, err := app.models.Tokens.GetSession(int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return app.notFoundResponse(c)
+		default:
+			return app.serverErrorResponse(c, err)
+		}
+	}
+
+	// Other users' sessions are treated as not existing, unless the user can manage users
+	if session.UserID != u.ID && !u.Can(data.PermissionManageUsers) {
+		return app.notFoundResponse(c)
+	}
+
+	err = app.models.Tokens.DeleteSession(session.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return app.notFoundResponse(c)
+		default:
+			return app.serverErrorResponse(c, err)
+		}
+	}
+
+	app.logger.PrintInfo("session revoked", map[string]any{
+		"session_id": session.ID,
+		"user_id":    session.UserID,
+		"revoked_by": u.ID,
+	})
+	app.audit(c, u.ID, data.AuditSessionRevoke, fmt.Sprintf("user %s: session %d (%s)", session.Username, session.ID, session.IP))
+
+	return c.JSON(http.StatusOK, envelope{"success": true})
+}
+
+// Sign the user out everywhere, including the session the request was made with
+func (app *application) revokeAllSessionsHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+
+	deleted, err := app.models.Tokens.DeleteAllForUser(data.ScopeAuthentication, u.ID)
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	app.logger.PrintInfo("sessions revoked", map[string]any{
+		"user_id":          u.ID,
+		"sessions_revoked": deleted,
+	})
+	app.audit(c, u.ID, data.AuditSessionRevoke, fmt.Sprintf("user %s: all %d sessions", u.Username, deleted))
+
+	app.signOutRequest(c)
+
+	return app.redirectResponse(c, "/sign-in", http.StatusAccepted, "signed out everywhere")
+}
+
+// Sign another user out everywhere, eg. if their account may have been used by someone else
+func (app *application) revokeUserSessionsHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+
+	id, err := app.readIDParam(c)
+	if err != nil {
+		return app.notFoundResponse(c)
+	}
+
+	user, err := app.models.Users.GetByID(int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return app.notFoundResponse(c)
+		default:
+			return app.serverErrorResponse(c, err)
+		}
+	}
+
+	deleted, err := app.models.Tokens.DeleteAllForUser(data.ScopeAuthentication, user.ID)
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	app.logger.PrintInfo("sessions revoked", map[string]any{
+		"user_id":          user.ID,
+		"sessions_revoked": deleted,
+		"revoked_by":       u.ID,
+	})
+	app.audit(c, u.ID, data.AuditSessionRevoke, fmt.Sprintf("user %s: all %d sessions", user.Username, deleted))
+
+	if user.ID == u.ID {
+		app.signOutRequest(c)
+		return app.redirectResponse(c, "/sign-in", http.StatusAccepted, "signed out everywhere")
+	}
+
+	return c.JSON(http.StatusOK, envelope{"success": true, "sessions_revoked": deleted})
+}
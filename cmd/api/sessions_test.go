@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+func TestSessions(t *testing.T) {
+	appDB, _, err := openAppDB(filepath.Join(t.TempDir(), "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+
+	app := newTestApplication(t, appDB, nil)
+	app.userExists = true
+	app.config.tokens.expiry = 24 * time.Hour
+	app.config.tokens.refresh = 6 * time.Hour
+
+	staff := &data.User{Username: "staff", Role: data.RoleViewer}
+	assert.NilError(t, staff.Password.Set("staff-password"))
+	assert.NilError(t, app.models.Users.Insert(staff))
+	admin := &data.User{Username: "admin", Role: data.RoleAdmin}
+	assert.NilError(t, admin.Password.Set("admin-password"))
+	assert.NilError(t, app.models.Users.Insert(admin))
+
+	newSession := func(u *data.User, ip string) string {
+		token, err := app.models.Tokens.NewSession(u.ID, app.config.tokens.expiry, ip, "Firefox")
+		assert.NilError(t, err)
+		return token.Plaintext
+	}
+	laptop := newSession(staff, "10.0.0.1")
+	phone := newSession(staff, "10.0.0.2")
+	adminDesk := newSession(admin, "10.0.0.9")
+
+	// Requests go through authenticateUser, so each is made as the user the token belongs to
+	e := echo.New()
+	request := func(token, method, target, body string, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+		req.Header.Set("User-Agent", "Edge")
+		req.RemoteAddr = "10.0.0.3:40000"
+		req.AddCookie(&http.Cookie{Name: "listener_admin_auth_token", Value: token})
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if i := strings.LastIndex(target, "/sessions/"); i >= 0 && method == http.MethodDelete {
+			c.SetParamNames("id")
+			c.SetParamValues(target[i+len("/sessions/"):])
+		}
+		assert.NilError(t, app.authenticateUser(handler)(c))
+		return rec
+	}
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(staff.ID, laptop)
+	assert.NilError(t, err)
+	assert.Equal(t, len(sessions), 2)
+	for _, s := range sessions {
+		assert.Equal(t, s.Username, "staff")
+		assert.Equal(t, s.UserAgent, "Firefox")
+		assert.Equal(t, s.Current, s.IP == "10.0.0.1")
+	}
+	all, err := app.models.Tokens.GetAllSessions(adminDesk)
+	assert.NilError(t, err)
+	assert.Equal(t, len(all), 3)
+
+	// Using a session records where it was last used from
+	assert.Equal(t, request(phone, http.MethodGet, "/sessions", "", app.getSessionsPageHandler).Code, http.StatusOK)
+	sessions, err = app.models.Tokens.GetSessionsForUser(staff.ID, phone)
+	assert.NilError(t, err)
+	assert.Equal(t, sessions[0].Current, true)
+	assert.Equal(t, sessions[0].IP, "10.0.0.3")
+	assert.Equal(t, sessions[0].UserAgent, "Edge")
+
+	var phoneID, adminDeskID int64
+	for _, s := range all {
+		switch s.IP {
+		case "10.0.0.2":
+			phoneID = s.ID
+		case "10.0.0.9":
+			adminDeskID = s.ID
+		}
+	}
+	sessionPath := func(id int64) string { return "/sessions/" + strconv.FormatInt(id, 10) }
+
+	// Users can't sign out other users' sessions, unless they can manage users
+	assert.Equal(t, request(laptop, http.MethodDelete, sessionPath(adminDeskID), "", app.revokeSessionHandler).Code, http.StatusNotFound)
+	assert.Equal(t, request(laptop, http.MethodDelete, sessionPath(phoneID), "", app.revokeSessionHandler).Code, http.StatusOK)
+	assert.Equal(t, request(phone, http.MethodGet, "/sessions", "", app.getSessionsPageHandler).Code, http.StatusUnauthorized)
+
+	// Changing password signs out every other session, but not the one it was changed from
+	tablet := newSession(staff, "10.0.0.4")
+	rec := request(laptop, http.MethodPost, "/users/update/password", `{"current_password": "staff-password", "new_password": "new-staff-password"}`, app.updateUserPasswordHandler)
+	assert.Equal(t, rec.Code, http.StatusAccepted)
+	assert.Equal(t, request(tablet, http.MethodGet, "/sessions", "", app.getSessionsPageHandler).Code, http.StatusUnauthorized)
+	assert.Equal(t, request(laptop, http.MethodGet, "/sessions", "", app.getSessionsPageHandler).Code, http.StatusOK)
+
+	// Signing out everywhere includes the session it was done from
+	newSession(staff, "10.0.0.5")
+	rec = request(laptop, http.MethodPost, "/sessions/revoke-all", "", app.revokeAllSessionsHandler)
+	assert.StringContains(t, rec.Body.String(), "/sign-in")
+	sessions, err = app.models.Tokens.GetSessionsForUser(staff.ID, "")
+	assert.NilError(t, err)
+	assert.Equal(t, len(sessions), 0)
+
+	// The admin's session is untouched throughout
+	sessions, err = app.models.Tokens.GetSessionsForUser(admin.ID, adminDesk)
+	assert.NilError(t, err)
+	assert.Equal(t, len(sessions), 1)
+	assert.Equal(t, sessions[0].Current, true)
+}
@@ -1,8 +1,17 @@
 package main
 
-import "testing"
+import (
+	"database/sql"
+	"io"
+	"path/filepath"
+	"testing"
 
-func newTestApplication(t *testing.T) *application {
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/jsonlog"
+)
+
+// Create an application for testing, with models for the provided databases - either can be nil if the test doesn't need it. Logs are discarded.
+func newTestApplication(t *testing.T, appDB *sql.DB, listenerDB *data.ListenerDB) *application {
 	cfg := config{
 		port:      8085,
 		env:       "development",
@@ -14,7 +23,10 @@ func newTestApplication(t *testing.T) *application {
 		}{
 			appDB: "../../test/test-full.db",
 		},
-		https_on: true,
+		kamar: listenerConfig{
+			addr:     ":8085",
+			https_on: true,
+		},
 		limiter: struct {
 			rps     float64
 			burst   int
@@ -26,8 +38,24 @@ func newTestApplication(t *testing.T) *application {
 		},
 	}
 
-	return &application{
-		assetHandler: nil,
-		config:       cfg,
+	app := &application{
+		assetHandler:   nil,
+		config:         cfg,
+		isShuttingDown: make(chan struct{}),
+		logger:         jsonlog.New(io.Discard, jsonlog.LevelInfo, nil),
 	}
+	app.models = data.NewModels(appDB, listenerDB, app.background)
+
+	return app
+}
+
+// Open a SQLite listener.db in dir with every table created, closed once the test has run
+func newTestListenerDB(t *testing.T, dir string) *data.ListenerDB {
+	db, err := openKamarDB(filepath.Join(dir, "listener.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return data.NewListenerDB(db, data.DialectSQLite)
 }
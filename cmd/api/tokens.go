@@ -81,7 +81,11 @@ func (app *application) initiateTokenDeletionCycle() {
 		for {
 			select {
 			case <-ticker.C:
-				deleted, err := app.models.Tokens.DeleteExpiredTokens()
+				var deleted int64
+				var err error
+				app.withDatabases(func() {
+					deleted, err = app.models.Tokens.DeleteExpiredTokens()
+				})
 				if err != nil {
 					app.logger.PrintError(err, nil)
 				}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/totp"
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+	views "github.com/michaelcjefferson/kamar-listener/ui/views"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Shown as the account's name in authenticator apps
+const totpIssuer = "KAMAR Listener"
+
+// Width and height of the enrolment QR code, in pixels
+const totpQRSize = 256
+
+type twoFactorCodeInput struct {
+	Code string `json:"code"`
+}
+
+// Show the user's 2FA status, or a new secret for them to add to their authenticator app if they haven't turned it on yet
+func (app *application) getTwoFactorPageHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+
+	tf, err := app.models.TwoFactor.Get(u.ID)
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	if !tf.Enabled && tf.Secret == "" {
+		tf.Secret, err = totp.NewSecret()
+		if err != nil {
+			return app.serverErrorResponse(c, err)
+		}
+		if err := app.models.TwoFactor.SetSecret(u.ID, tf.Secret); err != nil {
+			return app.serverErrorResponse(c, err)
+		}
+	}
+
+	uri := totp.URI(totpIssuer, u.Username, tf.Secret)
+
+	// The QR code is inlined as a data URL, so the secret is never served from a URL of its own
+	var qr string
+	if !tf.Enabled {
+		png, err := qrcode.Encode(uri, qrcode.Medium, totpQRSize)
+		if err != nil {
+			return app.serverErrorResponse(c, err)
+		}
+		qr = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+	}
+
+	return app.Render(c, http.StatusOK, views.TwoFactorPage(u, tf, uri, qr))
+}
+
+// Turn 2FA on once the user has proven their authenticator app has the secret, and give them their recovery codes
+func (app *application) enableTwoFactorHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+
+	var input twoFactorCodeInput
+	if err := c.Bind(&input); err != nil {
+		return app.badRequestResponse(c, err)
+	}
+
+	tf, err := app.models.TwoFactor.Get(u.ID)
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	v := validator.New()
+	v.Check(!tf.Enabled, "code", "2FA is already turned on")
+	v.Check(tf.Secret != "", "code", "reload the page to get a secret to add to your authenticator app")
+	if !v.Valid() {
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	step, ok := totp.Validate(tf.Secret, input.Code, time.Now())
+	if !ok {
+		v.AddError("code", "doesn't match - check the time on your phone is correct and try the next code")
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	codes, err := app.models.TwoFactor.Enable(u.ID, step)
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	app.logger.PrintInfo("two-factor authentication enabled", map[string]any{
+		"user_id": u.ID,
+	})
+	app.audit(c, u.ID, data.AuditUser2FAEnable, "user "+u.Username)
+
+	return c.JSON(http.StatusOK, envelope{"recovery_codes": codes})
+}
+
+// Users turning off their own 2FA must provide a current code, so someone using a session left signed in can't do it for them
+func (app *application) disableTwoFactorHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+
+	var input twoFactorCodeInput
+	if err := c.Bind(&input); err != nil {
+		return app.badRequestResponse(c, err)
+	}
+
+	tf, err := app.models.TwoFactor.Get(u.ID)
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+	if !tf.Enabled {
+		return app.notFoundResponse(c)
+	}
+
+	_, ok, err := app.models.TwoFactor.Verify(tf, input.Code, time.Now())
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+	if !ok {
+		v := validator.New()
+		v.AddError("code", "doesn't match a current code or an unused recovery code")
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	if err := app.models.TwoFactor.Reset(u.ID); err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	app.logger.PrintInfo("two-factor authentication disabled", map[string]any{
+		"user_id": u.ID,
+	})
+	app.audit(c, u.ID, data.AuditUser2FADisable, "user "+u.Username)
+
+	return c.JSON(http.StatusOK, envelope{"success": true})
+}
+
+// For users who have lost their phone and their recovery codes - they can sign in with just their password afterwards, and set 2FA up again
+func (app *application) resetTwoFactorHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+
+	id, err := app.readIDParam(c)
+	if err != nil {
+		return app.notFoundResponse(c)
+	}
+
+	user, err := app.models.Users.GetByID(int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return app.notFoundResponse(c)
+		default:
+			return app.serverErrorResponse(c, err)
+		}
+	}
+
+	if err := app.models.TwoFactor.Reset(user.ID); err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	app.logger.PrintInfo("two-factor authentication reset", map[string]any{
+		"user_id":  user.ID,
+		"reset_by": u.ID,
+	})
+	app.audit(c, u.ID, data.AuditUser2FAReset, fmt.Sprintf("user %s", user.Username))
+
+	return c.JSON(http.StatusOK, envelope{"success": true})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/totp"
+)
+
+func TestTwoFactorSignIn(t *testing.T) {
+	appDB, _, err := openAppDB(filepath.Join(t.TempDir(), "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+
+	app := newTestApplication(t, appDB, nil)
+	app.userExists = true
+	app.config.tokens.expiry = time.Hour
+
+	user := &data.User{Username: "admin", Role: data.RoleAdmin}
+	assert.NilError(t, user.Password.Set("correct horse"))
+	assert.NilError(t, app.models.Users.Insert(user))
+
+	secret, err := totp.NewSecret()
+	assert.NilError(t, err)
+	assert.NilError(t, app.models.TwoFactor.SetSecret(user.ID, secret))
+
+	// Codes from a step that has already been used are refused, so enrol with an older one
+	now := time.Now()
+	codes, err := app.models.TwoFactor.Enable(user.ID, totp.Step(now)-2)
+	assert.NilError(t, err)
+	assert.Equal(t, len(codes), 10)
+
+	e := echo.New()
+	signIn := func(code string) *httptest.ResponseRecorder {
+		body := `{"username": "admin", "password": "correct horse", "code": "` + code + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/sign-in", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		app.contextSetUser(c, data.AnonymousUser)
+		assert.NilError(t, app.signInUserHandler(c))
+		return rec
+	}
+
+	// The password alone isn't enough, and no cookie is issued
+	rec := signIn("")
+	assert.Equal(t, rec.Code, http.StatusUnauthorized)
+	assert.StringContains(t, rec.Body.String(), "two_factor_required")
+	assert.Equal(t, rec.Header().Get("Set-Cookie"), "")
+
+	code, err := totp.Code(secret, totp.Step(now))
+	assert.NilError(t, err)
+
+	rec = signIn(code)
+	assert.Equal(t, rec.Code, http.StatusAccepted)
+	assert.StringContains(t, rec.Header().Get("Set-Cookie"), "listener_admin_auth_token")
+
+	// The same code can't be used twice
+	rec = signIn(code)
+	assert.Equal(t, rec.Code, http.StatusUnauthorized)
+
+	// and neither can a recovery code
+	rec = signIn(strings.ToUpper(codes[0]))
+	assert.Equal(t, rec.Code, http.StatusAccepted)
+	rec = signIn(codes[0])
+	assert.Equal(t, rec.Code, http.StatusUnauthorized)
+
+	tf, err := app.models.TwoFactor.Get(user.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, tf.RecoveryCodesLeft, 9)
+
+	// After an admin reset, the password is enough again
+	assert.NilError(t, app.models.TwoFactor.Reset(user.ID))
+	rec = signIn("")
+	assert.Equal(t, rec.Code, http.StatusAccepted)
+}
+
+func TestTwoFactorPage(t *testing.T) {
+	appDB, _, err := openAppDB(filepath.Join(t.TempDir(), "app.db"))
+	assert.NilError(t, err)
+	defer appDB.Close()
+
+	app := newTestApplication(t, appDB, nil)
+	app.userExists = true
+
+	user := &data.User{Username: "admin", Role: data.RoleAdmin}
+	assert.NilError(t, user.Password.Set("correct horse"))
+	assert.NilError(t, app.models.Users.Insert(user))
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/users/2fa", nil), rec)
+	app.contextSetUser(c, user)
+	assert.NilError(t, app.getTwoFactorPageHandler(c))
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	// Enrolment shows a QR code of the otpauth:// URI, with the secret to type in if it can't be scanned
+	tf, err := app.models.TwoFactor.Get(user.ID)
+	assert.NilError(t, err)
+	body := rec.Body.String()
+	assert.StringContains(t, body, tf.Secret)
+
+	_, qr, ok := strings.Cut(body, `src="data:image/png;base64,`)
+	assert.Equal(t, ok, true)
+	qr, _, _ = strings.Cut(qr, `"`)
+	b, err := base64.StdEncoding.DecodeString(qr)
+	assert.NilError(t, err)
+	img, err := png.Decode(bytes.NewReader(b))
+	assert.NilError(t, err)
+	assert.Equal(t, img.Bounds().Dx(), totpQRSize)
+}
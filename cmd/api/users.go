@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -14,6 +15,8 @@ import (
 type userInput struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// A code from the user's authenticator app or one of their recovery codes, only needed if they have 2FA turned on
+	Code string `json:"code"`
 }
 
 type PasswordUpdateInput struct {
@@ -21,28 +24,22 @@ type PasswordUpdateInput struct {
 	NewPassword     string `json:"new_password"`
 }
 
+type roleInput struct {
+	Role string `json:"role"`
+}
+
+// Only the first user registers themselves - everyone after them is invited from the users page, and sets their own username and password
 func (app *application) registerPageHandler(c echo.Context) error {
 	if app.userExists {
-		user := app.contextGetUser(c)
-
-		if user.IsAnonymous() {
-			app.authenticationRequiredResponse(c)
-			return nil
-		}
+		return app.redirectResponse(c, "/users", http.StatusOK, "new users are invited from the users page")
 	}
 
 	return app.Render(c, http.StatusAccepted, views.RegisterPage())
 }
 
 func (app *application) registerUserHandler(c echo.Context) error {
-	// If app.userExists, ensure user is authenticated
 	if app.userExists {
-		user := app.contextGetUser(c)
-
-		if user.IsAnonymous() {
-			app.authenticationRequiredResponse(c)
-			return nil
-		}
+		return app.notPermittedResponse(c)
 	}
 
 	input := userInput{}
@@ -53,8 +50,10 @@ func (app *application) registerUserHandler(c echo.Context) error {
 		return nil
 	}
 
+	// The first user to register administers the listener
 	user := &data.User{
 		Username: input.Username,
+		Role:     data.RoleAdmin,
 	}
 
 	err = user.Password.Set(input.Password)
@@ -82,6 +81,8 @@ func (app *application) registerUserHandler(c echo.Context) error {
 		return nil
 	}
 
+	app.audit(c, user.ID, data.AuditUserRegister, "user "+user.Username)
+
 	err = app.createAndSetAdminTokenCookie(c, user.ID, app.config.tokens.expiry)
 	if err != nil {
 		app.serverErrorResponse(c, err)
@@ -134,11 +135,18 @@ func (app *application) signInUserHandler(c echo.Context) error {
 		return app.failedValidationResponse(c, v.Errors)
 	}
 
+	// Failures are counted against both where they come from and the account they're for, so neither guessing many passwords for one user nor one password for many users gets far
+	lockoutKeys := []lockoutKey{{lockoutIP, c.RealIP()}, {lockoutUser, input.Username}}
+	if until := app.checkLockout(c, lockoutKeys...); !until.IsZero() {
+		return app.lockedOutResponse(c, until)
+	}
+
 	// Retrieve row from users table that matches the provided username
 	user, err := app.models.Users.GetByUsername(input.Username)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			app.recordFailedAttempt(c, lockoutKeys...)
 			return app.invalidCredentialsResponse(c)
 		default:
 			return app.serverErrorResponse(c, err)
@@ -152,9 +160,37 @@ func (app *application) signInUserHandler(c echo.Context) error {
 	}
 
 	if !match {
+		app.recordFailedAttempt(c, lockoutKeys...)
 		return app.invalidCredentialsResponse(c)
 	}
 
+	// The cookie is only issued once the second factor has been checked too
+	tf, err := app.models.TwoFactor.Get(user.ID)
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	target := "user " + user.Username
+	if tf.Enabled {
+		if input.Code == "" {
+			return app.twoFactorRequiredResponse(c)
+		}
+
+		recovery, ok, err := app.models.TwoFactor.Verify(tf, input.Code, time.Now())
+		if err != nil {
+			return app.serverErrorResponse(c, err)
+		}
+		if !ok {
+			app.recordFailedAttempt(c, lockoutKeys...)
+			return app.invalidCredentialsResponse(c)
+		}
+		if recovery {
+			target += " (recovery code)"
+		}
+	}
+
+	app.lockouts.succeed(lockoutKeys...)
+
 	err = app.createAndSetAdminTokenCookie(c, user.ID, app.config.tokens.expiry)
 	if err != nil {
 		return app.serverErrorResponse(c, err)
@@ -163,6 +199,7 @@ func (app *application) signInUserHandler(c echo.Context) error {
 	app.logger.PrintInfo("user logged in", map[string]any{
 		"user_id": user.ID,
 	})
+	app.audit(c, user.ID, data.AuditUserSignIn, target)
 
 	return app.redirectResponse(c, "/", http.StatusAccepted, envelope{"user": user})
 }
@@ -174,25 +211,27 @@ func (app *application) logoutUserHandler(c echo.Context) error {
 		return app.invalidAuthenticationTokenResponse(c)
 	}
 
-	deleted, err := app.models.Tokens.DeleteAllForUser(user.ID)
+	// Only this session is signed out - the user's others can be signed out from the sessions page
+	deleted, err := app.models.Tokens.DeleteForToken(app.contextGetSessionToken(c))
 	if err != nil {
-		switch {
-		// TODO: This case currently cannot be triggered as DeleteAllForUser doesn't return this type of error
-		case errors.Is(err, data.ErrRecordNotFound):
-			return app.invalidCredentialsResponse(c)
-		default:
-			return app.serverErrorResponse(c, err)
-		}
+		return app.serverErrorResponse(c, err)
 	}
 
 	app.logger.PrintInfo("user logged out", map[string]any{
 		"user_id":        user.ID,
 		"tokens deleted": deleted,
 	})
+	app.audit(c, user.ID, data.AuditUserSignOut, "user "+user.Username)
 
-	// Set the user for this request session to an anonymous user, and expire previously set cookies
-	// TODO: Refactor into function
+	app.signOutRequest(c)
+
+	return app.redirectResponse(c, "/sign-in", http.StatusAccepted, "successfully logged out")
+}
+
+// Set the user for this request session to an anonymous user, and expire previously set cookies
+func (app *application) signOutRequest(c echo.Context) {
 	app.contextSetUser(c, data.AnonymousUser)
+	app.contextSetSessionToken(c, "")
 	c.SetCookie(&http.Cookie{
 		Name:     "listener_admin_auth_token",
 		Value:    "",
@@ -200,8 +239,6 @@ func (app *application) logoutUserHandler(c echo.Context) error {
 		HttpOnly: true,
 		MaxAge:   -1,
 	})
-
-	return app.redirectResponse(c, "/sign-in", http.StatusAccepted, "successfully logged out")
 }
 
 func (app *application) updateUserPasswordPageHandler(c echo.Context) error {
@@ -248,10 +285,18 @@ func (app *application) updateUserPasswordHandler(c echo.Context) error {
 		return app.serverErrorResponse(c, err)
 	}
 
+	// Anyone who was signed in as the user with the old password is signed out
+	revoked, err := app.models.Tokens.DeleteOtherSessions(user.ID, app.contextGetSessionToken(c))
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
 	app.logger.PrintInfo("user config updated", map[string]any{
-		"message": "user password successfully updated",
-		"user_id": user.ID,
+		"message":          "user password successfully updated",
+		"user_id":          user.ID,
+		"sessions_revoked": revoked,
 	})
+	app.audit(c, user.ID, data.AuditUserPasswordUpdate, fmt.Sprintf("user %s (%d other sessions signed out)", user.Username, revoked))
 
 	env := envelope{
 		"success": true,
@@ -263,6 +308,26 @@ func (app *application) updateUserPasswordHandler(c echo.Context) error {
 func (app *application) deleteUserHandler(c echo.Context) error {
 	u := app.contextGetUser(c)
 
+	// Otherwise nobody would be left who could manage users, and registering a new admin isn't possible once a user exists
+	if u.Role == data.RoleAdmin {
+		users, err := app.models.Users.GetAll()
+		if err != nil {
+			return app.serverErrorResponse(c, err)
+		}
+
+		admins := 0
+		for _, user := range users {
+			if user.Role == data.RoleAdmin {
+				admins++
+			}
+		}
+		if admins == 1 {
+			v := validator.New()
+			v.AddError("user", "the only admin can't delete their account - make someone else an admin first")
+			return app.failedValidationResponse(c, v.Errors)
+		}
+	}
+
 	err := app.models.Users.Delete(u.ID)
 	if err != nil {
 		app.logger.PrintError(err, map[string]any{
@@ -280,6 +345,7 @@ func (app *application) deleteUserHandler(c echo.Context) error {
 		"message": "user successfully deleted",
 		"user_id": u.ID,
 	})
+	app.audit(c, u.ID, data.AuditUserDelete, "user "+u.Username)
 
 	return app.redirectResponse(c, "/sign-in", http.StatusOK, "user successfully deleted")
 }
@@ -292,7 +358,74 @@ func (app *application) getUsersPageHandler(c echo.Context) error {
 		return app.serverErrorResponse(c, err)
 	}
 
-	return app.Render(c, http.StatusAccepted, views.UsersPage(users, u))
+	twoFactor, err := app.models.TwoFactor.GetEnabledUserIDs()
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	return app.Render(c, http.StatusAccepted, views.UsersPage(users, u, twoFactor))
+}
+
+func (app *application) updateUserRoleHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+
+	id, err := app.readIDParam(c)
+	if err != nil {
+		return app.notFoundResponse(c)
+	}
+
+	var input roleInput
+	if err := c.Bind(&input); err != nil {
+		return app.badRequestResponse(c, err)
+	}
+
+	v := validator.New()
+	if data.ValidateRole(v, input.Role); !v.Valid() {
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	users, err := app.models.Users.GetAll()
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	var target *data.User
+	admins := 0
+	for _, user := range users {
+		if user.ID == int64(id) {
+			target = user
+		}
+		if user.Role == data.RoleAdmin {
+			admins++
+		}
+	}
+	if target == nil {
+		return app.notFoundResponse(c)
+	}
+
+	// Otherwise nobody would be left who could manage users
+	if target.Role == data.RoleAdmin && input.Role != data.RoleAdmin && admins == 1 {
+		v.AddError("role", "the only admin can't be given another role")
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	if err := app.models.Users.UpdateRole(target.ID, input.Role); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return app.notFoundResponse(c)
+		default:
+			return app.serverErrorResponse(c, err)
+		}
+	}
+
+	app.logger.PrintInfo("user role updated", map[string]any{
+		"user_id":    target.ID,
+		"role":       input.Role,
+		"updated_by": u.ID,
+	})
+	app.audit(c, u.ID, data.AuditUserRoleUpdate, fmt.Sprintf("user %s: %s -> %s", target.Username, target.Role, input.Role))
+
+	return c.JSON(http.StatusOK, envelope{"success": true})
 }
 
 func (app *application) getUserCount() (int, error) {
@@ -308,20 +441,24 @@ func (app *application) getUserCount() (int, error) {
 
 // TODO: https://www.alexedwards.net/blog/working-with-cookies-in-go - add features
 func (app *application) createAndSetAdminTokenCookie(c echo.Context, id int64, ttl time.Duration) error {
-	token, err := app.models.Tokens.New(id, ttl)
+	token, err := app.models.Tokens.NewSession(id, ttl, c.RealIP(), c.Request().UserAgent())
 	if err != nil {
 		return err
 	}
 
+	app.setAdminTokenCookie(c, token.Plaintext, ttl)
+
+	return nil
+}
+
+func (app *application) setAdminTokenCookie(c echo.Context, token string, ttl time.Duration) {
 	c.SetCookie(&http.Cookie{
 		Name:     "listener_admin_auth_token",
-		Value:    token.Plaintext,
+		Value:    token,
 		Path:     "/",
 		HttpOnly: true,
-		Secure:   app.config.https_on,
+		Secure:   app.config.adminListener().https_on,
 		SameSite: http.SameSiteStrictMode,
 		Expires:  time.Now().Add(ttl),
 	})
-
-	return nil
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+	views "github.com/michaelcjefferson/kamar-listener/ui/views"
+)
+
+const (
+	webhookMaxAttempts = 5
+	webhookTimeout     = 10 * time.Second
+)
+
+// The delay before the first retry of a failed delivery, doubled after every attempt
+var webhookInitialDelay = 2 * time.Second
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// The JSON body POSTed to every enabled webhook target after a KAMAR sync has been processed
+type syncWebhookPayload struct {
+	Event       string         `json:"event"`
+	SyncType    string         `json:"sync_type"`
+	Counts      map[string]int `json:"counts"`
+	Success     bool           `json:"success"`
+	Error       string         `json:"error,omitempty"`
+	DurationMS  int64          `json:"duration_ms"`
+	ChangedKeys []string       `json:"changed_keys,omitempty"`
+	Time        time.Time      `json:"time"`
+}
+
+// Sign the timestamp and body with the webhook's secret, so receivers can verify the request came from this listener and reject replays of old requests. Receivers should compute HMAC-SHA256(secret, timestamp + "." + body) and compare it with the X-Listener-Signature header.
+func signWebhookPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Record a delivery for every enabled webhook target and send them in the background, so KAMAR's response is never held up by a slow or unreachable receiver
+func (app *application) notifyWebhooks(payload syncWebhookPayload) {
+	webhooks, err := app.models.Webhooks.GetEnabled()
+	if err != nil {
+		app.logger.PrintError(err, map[string]any{
+			"message": "couldn't get webhooks from database",
+		})
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	for _, hook := range webhooks {
+		delivery := &data.WebhookDelivery{
+			WebhookID: hook.ID,
+			URL:       hook.URL,
+			Event:     payload.Event,
+			Payload:   string(body),
+			Status:    data.DeliveryPending,
+		}
+
+		err := app.models.Webhooks.InsertDelivery(delivery)
+		if err != nil {
+			app.logger.PrintError(err, map[string]any{
+				"message":    "couldn't record webhook delivery",
+				"webhook_id": hook.ID,
+			})
+			continue
+		}
+
+		app.background(func() {
+			app.deliverWebhook(hook, delivery, body)
+		})
+	}
+}
+
+// Attempt to deliver body to hook, retrying with exponential backoff until it succeeds, webhookMaxAttempts is reached, or the application starts shutting down. The outcome of each attempt is written to the delivery's row.
+func (app *application) deliverWebhook(hook data.Webhook, delivery *data.WebhookDelivery, body []byte) {
+	delay := webhookInitialDelay
+
+	for {
+		delivery.Attempts++
+		delivery.ResponseCode, delivery.Error = postWebhook(hook, delivery, body)
+
+		switch {
+		case delivery.Error == "":
+			delivery.Status = data.DeliveryDelivered
+		case delivery.Attempts >= webhookMaxAttempts:
+			delivery.Status = data.DeliveryFailed
+		}
+
+		var err error
+		app.withDatabases(func() {
+			err = app.models.Webhooks.UpdateDelivery(delivery)
+		})
+		if err != nil {
+			app.logger.PrintError(err, map[string]any{
+				"message":     "couldn't update webhook delivery",
+				"delivery_id": delivery.ID,
+			})
+		}
+
+		if delivery.Status != data.DeliveryPending {
+			if delivery.Status == data.DeliveryFailed {
+				app.logger.PrintError(fmt.Errorf("webhook delivery failed: %s", delivery.Error), map[string]any{
+					"webhook_id":  hook.ID,
+					"delivery_id": delivery.ID,
+					"attempts":    delivery.Attempts,
+				})
+			}
+			return
+		}
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-app.isShuttingDown:
+			delivery.Status = data.DeliveryFailed
+			delivery.Error = "listener shut down before delivery succeeded: " + delivery.Error
+			app.withDatabases(func() {
+				app.models.Webhooks.UpdateDelivery(delivery)
+			})
+			return
+		}
+	}
+}
+
+// Make a single delivery attempt, returning the response status code and, if the attempt failed, a description of the error
+func postWebhook(hook data.Webhook, delivery *data.WebhookDelivery, body []byte) (int, string) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err.Error()
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "kamar-listener")
+	req.Header.Set("X-Listener-Event", delivery.Event)
+	req.Header.Set("X-Listener-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-Listener-Timestamp", timestamp)
+	req.Header.Set("X-Listener-Signature", signWebhookPayload(hook.Secret, timestamp, body))
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer res.Body.Close()
+	// Drain the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Sprintf("receiver responded with status %d", res.StatusCode)
+	}
+
+	return res.StatusCode, ""
+}
+
+func (app *application) getWebhooksPageHandler(c echo.Context) error {
+	u := app.contextGetUser(c)
+
+	webhooks, err := app.models.Webhooks.GetAll()
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	deliveries, err := app.models.Webhooks.GetRecentDeliveries(100)
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	return app.Render(c, http.StatusOK, views.WebhooksPage(u, webhooks, deliveries))
+}
+
+type webhookInput struct {
+	URL string `json:"url"`
+}
+
+func (app *application) createWebhookHandler(c echo.Context) error {
+	user := app.contextGetUser(c)
+
+	var input webhookInput
+	if err := c.Bind(&input); err != nil {
+		return app.badRequestResponse(c, err)
+	}
+
+	secret, err := data.NewWebhookSecret()
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	hook := &data.Webhook{
+		URL:     input.URL,
+		Secret:  secret,
+		Enabled: true,
+	}
+
+	v := validator.New()
+	if data.ValidateWebhook(v, hook); !v.Valid() {
+		return app.failedValidationResponse(c, v.Errors)
+	}
+
+	err = app.models.Webhooks.Insert(hook)
+	if err != nil {
+		return app.serverErrorResponse(c, err)
+	}
+
+	app.logger.PrintInfo("webhook created", map[string]any{
+		"webhook_id": hook.ID,
+		"url":        hook.URL,
+		"user_id":    user.ID,
+	})
+
+	// The secret is only ever shown here, when the webhook is created
+	env := envelope{
+		"success": true,
+		"webhook": hook,
+		"secret":  hook.Secret,
+	}
+
+	return c.JSON(http.StatusCreated, env)
+}
+
+func (app *application) deleteWebhookHandler(c echo.Context) error {
+	user := app.contextGetUser(c)
+
+	id, err := app.readIDParam(c)
+	if err != nil {
+		return app.notFoundResponse(c)
+	}
+
+	err = app.models.Webhooks.Delete(id)
+	if err != nil {
+		switch err {
+		case data.ErrRecordNotFound:
+			return app.notFoundResponse(c)
+		default:
+			return app.serverErrorResponse(c, err)
+		}
+	}
+
+	app.logger.PrintInfo("webhook deleted", map[string]any{
+		"webhook_id": id,
+		"user_id":    user.ID,
+	})
+
+	return c.JSON(http.StatusOK, envelope{"success": true})
+}
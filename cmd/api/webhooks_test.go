@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/data"
+)
+
+func TestNotifyWebhooks(t *testing.T) {
+	webhookInitialDelay = 10 * time.Millisecond
+
+	// Deliveries run in background goroutines on their own connections, so a file is used rather than an in-memory database
+	appDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "app.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer appDB.Close()
+
+	err = createWebhookTables(appDB)
+	if err != nil {
+		t.Fatalf("Failed to create webhook tables in database: %v", err)
+	}
+
+	// The receiver fails the first attempt, so the delivery must be retried before it succeeds
+	var attempts atomic.Int32
+	var gotBody []byte
+	var gotSignature, gotTimestamp string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		gotBody, _ = io.ReadAll(r.Body)
+		gotSignature = r.Header.Get("X-Listener-Signature")
+		gotTimestamp = r.Header.Get("X-Listener-Timestamp")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	app := newTestApplication(t, appDB, nil)
+
+	hook := &data.Webhook{URL: receiver.URL, Secret: "test-secret", Enabled: true}
+	assert.NilError(t, app.models.Webhooks.Insert(hook))
+
+	app.notifyWebhooks(syncWebhookPayload{
+		Event:    "sync.completed",
+		SyncType: "results",
+		Counts:   map[string]int{"results": 12},
+		Success:  true,
+	})
+	app.wg.Wait()
+
+	assert.Equal(t, attempts.Load(), int32(2))
+	assert.Equal(t, gotSignature, signWebhookPayload("test-secret", gotTimestamp, gotBody))
+	assert.StringContains(t, string(gotBody), `"sync_type":"results"`)
+
+	deliveries, err := app.models.Webhooks.GetRecentDeliveries(10)
+	assert.NilError(t, err)
+	assert.Equal(t, len(deliveries), 1)
+	assert.Equal(t, deliveries[0].Status, data.DeliveryDelivered)
+	assert.Equal(t, deliveries[0].Attempts, 2)
+	assert.Equal(t, deliveries[0].ResponseCode, http.StatusNoContent)
+}
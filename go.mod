@@ -7,7 +7,9 @@ toolchain go1.23.6
 require (
 	github.com/a-h/templ v0.3.833
 	github.com/labstack/echo/v4 v4.13.3
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.24
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/tidwall/gjson v1.18.0
 	golang.org/x/crypto v0.33.0
 	golang.org/x/time v0.8.0
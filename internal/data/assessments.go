@@ -29,7 +29,7 @@ type Assessment struct {
 }
 
 type AssessmentModel struct {
-	DB *sql.DB
+	DB *ListenerDB
 }
 
 func (a *Assessment) CreateTNV() {
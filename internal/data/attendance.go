@@ -1,7 +1,5 @@
 package data
 
-import "database/sql"
-
 type Attendance struct {
 	ID                *int    `json:"id,omitempty"`
 	Nsn               *string `json:"nsn,omitempty"`
@@ -18,7 +16,7 @@ type Attendance struct {
 }
 
 type AttendanceModel struct {
-	DB *sql.DB
+	DB *ListenerDB
 }
 
 func (m *AttendanceModel) InsertManyAttendance(attendance []Attendance) error {
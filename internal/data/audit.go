@@ -0,0 +1,291 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions recorded in the audit trail
+const (
+	AuditUserRegister       = "user.register"
+	AuditUserInvite         = "user.invite"
+	AuditUserActivate       = "user.activate"
+	AuditUserSignIn         = "user.sign_in"
+	AuditUserSignOut        = "user.sign_out"
+	AuditUserPasswordUpdate = "user.password_update"
+	AuditUserDelete         = "user.delete"
+	AuditUserRoleUpdate     = "user.role_update"
+	AuditSessionRevoke      = "user.session_revoke"
+	AuditUser2FAEnable      = "user.2fa_enable"
+	AuditUser2FADisable     = "user.2fa_disable"
+	AuditUser2FAReset       = "user.2fa_reset"
+	AuditConfigUpdate       = "config.update"
+	AuditConfigKAMARAuth    = "config.kamar_auth"
+	AuditConfigPIIPolicy    = "config.pii_policy"
+	AuditJSONSwitch         = "config.json_switch"
+	AuditTLSCertUpload      = "config.tls_upload"
+	AuditTLSCertReset       = "config.tls_reset"
+	AuditLockoutClear       = "lockout.clear"
+	AuditLogsDelete         = "logs.delete"
+	AuditDataExport         = "data.export"
+	AuditConsentOverride    = "data.consent_override"
+	AuditDataFolderOpen     = "data.folder_open"
+	AuditStudentView        = "student.view"
+	AuditStudentErase       = "student.erase"
+	AuditBackupCreate       = "backup.create"
+	AuditBackupRestore      = "backup.restore"
+	AuditSinkCreate         = "replication.sink_create"
+	AuditSinkDelete         = "replication.sink_delete"
+)
+
+var AuditActions = []string{
+	AuditUserRegister, AuditUserInvite, AuditUserActivate, AuditUserSignIn, AuditUserSignOut, AuditUserPasswordUpdate, AuditUserDelete, AuditUserRoleUpdate, AuditSessionRevoke,
+	AuditUser2FAEnable, AuditUser2FADisable, AuditUser2FAReset,
+	AuditConfigUpdate, AuditConfigKAMARAuth, AuditConfigPIIPolicy, AuditJSONSwitch, AuditTLSCertUpload, AuditTLSCertReset, AuditLockoutClear,
+	AuditLogsDelete, AuditDataExport, AuditConsentOverride, AuditDataFolderOpen, AuditStudentView, AuditStudentErase,
+	AuditBackupCreate, AuditBackupRestore, AuditSinkCreate, AuditSinkDelete,
+}
+
+// The hash of the event before the first one
+const auditGenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+type AuditEvent struct {
+	ID       int64  `json:"id"`
+	Time     string `json:"time"`
+	UserID   int64  `json:"user_id"`
+	Action   string `json:"action"`
+	Target   string `json:"target"`
+	IP       string `json:"ip"`
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// Each event's hash covers its own fields and the hash of the event before it, so editing, deleting or reordering any event breaks the chain from that point on
+func (e *AuditEvent) computeHash() string {
+	h := sha256.New()
+	for _, field := range []string{strconv.FormatInt(e.ID, 10), e.Time, strconv.FormatInt(e.UserID, 10), e.Action, e.Target, e.IP, e.PrevHash} {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type AuditModel struct {
+	DB *sql.DB
+}
+
+// Insert appends an event to the audit trail, setting its id, time and hashes. Events must be chained in the order they are inserted, so the previous hash is read and the event written inside one BEGIN IMMEDIATE transaction - SQLite then serialises inserts itself, including any made by another process using app.db.
+func (m *AuditModel) Insert(e *AuditEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// database/sql can't begin an IMMEDIATE transaction, so it is run by hand on a connection of its own
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE;`); err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			conn.ExecContext(context.Background(), `ROLLBACK;`)
+		}
+	}()
+
+	e.PrevHash = auditGenesisHash
+	e.ID = 1
+	err = conn.QueryRowContext(ctx, `SELECT id + 1, hash FROM audit_events ORDER BY id DESC LIMIT 1;`).Scan(&e.ID, &e.PrevHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	e.Time = time.Now().UTC().Format("2006-01-02 15:04:05")
+	e.Hash = e.computeHash()
+
+	query := `
+		INSERT INTO audit_events (id, time, user_id, action, target, ip, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+
+	_, err = conn.ExecContext(ctx, query, e.ID, e.Time, e.UserID, e.Action, e.Target, e.IP, e.PrevHash, e.Hash)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.ExecContext(ctx, `COMMIT;`); err != nil {
+		return err
+	}
+	committed = true
+
+	return nil
+}
+
+// Since returns every event after the one with the given id, oldest first
+func (m *AuditModel) Since(id int64) ([]*AuditEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT id, time, user_id, action, target, ip, prev_hash, hash FROM audit_events WHERE id > $1 ORDER BY id ASC;`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		if err := rows.Scan(&e.ID, &e.Time, &e.UserID, &e.Action, &e.Target, &e.IP, &e.PrevHash, &e.Hash); err != nil {
+			return nil, err
+		}
+		events = append(events, &e)
+	}
+
+	return events, rows.Err()
+}
+
+// Carry writes the events in trail that are newer than the last one in the audit trail, keeping their ids and hashes, and returns how many were written. Restoring a backup replaces app.db, so the trail read from it beforehand is carried into the restored one - every app.db holds an earlier part of the same chain, so the carried events link on to the restored ones and Verify still checks the whole trail.
+func (m *AuditModel) Carry(trail []*AuditEvent) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var last int64
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM audit_events;`).Scan(&last)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+		INSERT INTO audit_events (id, time, user_id, action, target, ip, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+
+	carried := 0
+	for _, e := range trail {
+		if e.ID <= last {
+			continue
+		}
+		_, err := tx.ExecContext(ctx, query, e.ID, e.Time, e.UserID, e.Action, e.Target, e.IP, e.PrevHash, e.Hash)
+		if err != nil {
+			return 0, err
+		}
+		carried++
+	}
+
+	return carried, tx.Commit()
+}
+
+func (m *AuditModel) GetAll(filters Filters) ([]*AuditEvent, Metadata, error) {
+	var where strings.Builder
+	args := []any{}
+
+	where.WriteString(" WHERE 1=1")
+	if len(filters.AuditFilters.UserID) > 0 {
+		where.WriteString(fmt.Sprintf(" AND user_id IN (%s)", placeholders(len(filters.AuditFilters.UserID))))
+		for _, val := range filters.AuditFilters.UserID {
+			args = append(args, val)
+		}
+	}
+	if len(filters.AuditFilters.Action) > 0 {
+		where.WriteString(fmt.Sprintf(" AND action IN (%s)", placeholders(len(filters.AuditFilters.Action))))
+		for _, val := range filters.AuditFilters.Action {
+			args = append(args, val)
+		}
+	}
+	if filters.AuditFilters.Target != "" {
+		where.WriteString(" AND target LIKE ?")
+		args = append(args, "%"+filters.AuditFilters.Target+"%")
+	}
+
+	query := fmt.Sprintf(`
+		SELECT COUNT(*) OVER(), id, time, user_id, action, target, ip, prev_hash, hash
+		FROM audit_events%s
+		ORDER BY %s %s, id DESC
+		LIMIT ? OFFSET ?
+	`, where.String(), filters.sortColumn(), filters.sortDirection())
+	args = append(args, filters.limit(), filters.offset())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	events := []*AuditEvent{}
+
+	for rows.Next() {
+		var e AuditEvent
+		err := rows.Scan(&totalRecords, &e.ID, &e.Time, &e.UserID, &e.Action, &e.Target, &e.IP, &e.PrevHash, &e.Hash)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		events = append(events, &e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return events, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// AuditVerification is the result of checking the audit trail's hash chain
+type AuditVerification struct {
+	Checked  int
+	BrokenAt int64
+}
+
+func (v AuditVerification) Intact() bool {
+	return v.BrokenAt == 0
+}
+
+// Verify walks the whole audit trail, recomputing each event's hash, and reports the first event whose hash or link to the previous event doesn't match
+func (m *AuditModel) Verify() (AuditVerification, error) {
+	var result AuditVerification
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT id, time, user_id, action, target, ip, prev_hash, hash FROM audit_events ORDER BY id ASC;`)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	prev := auditGenesisHash
+	var prevID int64
+	for rows.Next() {
+		var e AuditEvent
+		if err := rows.Scan(&e.ID, &e.Time, &e.UserID, &e.Action, &e.Target, &e.IP, &e.PrevHash, &e.Hash); err != nil {
+			return result, err
+		}
+		result.Checked++
+		if e.ID != prevID+1 || e.PrevHash != prev || e.computeHash() != e.Hash {
+			result.BrokenAt = e.ID
+			return result, nil
+		}
+		prev, prevID = e.Hash, e.ID
+	}
+
+	return result, rows.Err()
+}
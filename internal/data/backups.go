@@ -0,0 +1,18 @@
+package data
+
+import (
+	"slices"
+	"time"
+)
+
+// Backup is a folder in the backups directory holding consistent copies of app.db, and of listener.db when the listener database is stored in SQLite
+type Backup struct {
+	Name    string    `json:"name"`
+	TakenAt time.Time `json:"taken_at"`
+	Files   []string  `json:"files"`
+	Size    int64     `json:"size"`
+}
+
+func (b Backup) HasFile(name string) bool {
+	return slices.Contains(b.Files, name)
+}
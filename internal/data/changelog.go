@@ -0,0 +1,73 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const (
+	ChangeInsert = "insert"
+	ChangeUpdate = "update"
+	ChangeRetire = "retire"
+)
+
+// Change is a single row of change_log, written by triggers on the SMS tables whenever a row is inserted, has any of its values changed, or is deleted
+type Change struct {
+	Seq            int64     `json:"seq"`
+	Entity         string    `json:"entity"`
+	Key            string    `json:"key"`
+	Operation      string    `json:"operation"`
+	ChangedColumns []string  `json:"changed_columns"`
+	ChangedAt      time.Time `json:"changed_at"`
+}
+
+type ChangeLogModel struct {
+	DB *ListenerDB
+}
+
+// GetAfter returns up to limit changes with a seq greater than after, oldest first. Consumers should store the seq of the last change they processed and pass it back in as after.
+func (m *ChangeLogModel) GetAfter(after int64, limit int) ([]Change, error) {
+	query := `
+		SELECT seq, entity, entity_key, operation, changed_columns, changed_at
+		FROM change_log
+		WHERE seq > $1
+		ORDER BY seq
+		LIMIT $2;
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []Change{}
+	for rows.Next() {
+		var c Change
+		var columns, changedAt string
+		if err := rows.Scan(&c.Seq, &c.Entity, &c.Key, &c.Operation, &columns, &changedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(columns), &c.ChangedColumns); err != nil {
+			return nil, err
+		}
+		c.ChangedAt, _ = time.Parse(time.DateTime, changedAt)
+		changes = append(changes, c)
+	}
+
+	return changes, rows.Err()
+}
+
+// LatestSeq returns the seq of the most recent change, or 0 if nothing has been recorded yet
+func (m *ChangeLogModel) LatestSeq() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var seq int64
+	err := m.DB.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) FROM change_log;`).Scan(&seq)
+	return seq, err
+}
@@ -1,7 +1,6 @@
 package data
 
 import (
-	"database/sql"
 	"strconv"
 	"strings"
 )
@@ -21,7 +20,7 @@ type ClassEffort struct {
 }
 
 type ClassEffortsModel struct {
-	DB *sql.DB
+	DB *ListenerDB
 }
 
 func (m *ClassEffortsModel) InsertManyClassEfforts(efforts []ClassEffort) error {
@@ -33,7 +32,7 @@ func (m *ClassEffortsModel) InsertManyClassEfforts(efforts []ClassEffort) error
 	defer tx.Rollback() // Rollback transaction if there's an error
 
 	stmt, err := tx.Prepare(`
-	INSERT INTO class_efforts (count, id, nsn, date, slot, term, week, subject, user, efforts)
+	INSERT INTO class_efforts (count, id, nsn, date, slot, term, week, subject, "user", efforts)
 	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 	ON CONFLICT(id, date, slot) DO UPDATE SET
 		count = excluded.count,
@@ -41,7 +40,7 @@ func (m *ClassEffortsModel) InsertManyClassEfforts(efforts []ClassEffort) error
 		term = excluded.term,
 		week = excluded.week,
 		subject = excluded.subject,
-		user = excluded.user,
+		"user" = excluded."user",
 		efforts = excluded.efforts,
 		listener_updated_at = (datetime('now'))
 	;`)
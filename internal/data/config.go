@@ -4,7 +4,11 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"net"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/michaelcjefferson/kamar-listener/internal/validator"
@@ -35,7 +39,7 @@ import (
 // TODO: Add port
 // "calendar" is an option from KAMAR, but it isn't particularly useful and its data structure is messy - to allow calendars to be received from KAMAR, a new data structure needs to be built and implemented before adding "calendar" to this list
 // UPDATE: calendars should be fine - it's just a long string - add later
-var ConfigKeySafeList = []string{"service_name", "info_url", "privacy_statement", "listener_username", "listener_password", "details", "passwords", "photos", "groups", "awards", "timetables", "attendance", "assessments", "pastoral", "learningsupport", "recognitions", "classefforts", "subjects", "notices", "bookings", "calendar"}
+var ConfigKeySafeList = []string{"service_name", "info_url", "privacy_statement", "listener_username", "listener_password", "details", "passwords", "photos", "groups", "awards", "timetables", "attendance", "assessments", "pastoral", "learningsupport", "recognitions", "classefforts", "subjects", "notices", "bookings", "calendar", "export_enabled", "export_format", "export_incremental", "export_dir", "export_interval_minutes", "backup_enabled", "backup_keep_daily", "backup_keep_weekly", "backup_keep_monthly", "encrypted_columns", "lockout_exempt_ips", "kamar_allowed_cidrs", "kamar_allowlist_learn"}
 
 type ConfigEntry struct {
 	Key         string `json:"key"`
@@ -55,6 +59,13 @@ type ListenerConfig map[string]any
 
 type ConfigModel struct {
 	DB *sql.DB
+	// Incremented by every Set, so anything caching the config can tell it has changed - a pointer, so copies of Models share it
+	version *atomic.Uint64
+}
+
+// Version changes whenever the config is changed by Set
+func (m *ConfigModel) Version() uint64 {
+	return m.version.Load()
 }
 
 func ValidateConfigKey(v *validator.Validator, key string) {
@@ -74,6 +85,52 @@ func ValidateConfigValue(v *validator.Validator, key, value, valueType string) {
 func ValidateConfigUpdate(v *validator.Validator, config ConfigEntry) {
 	ValidateConfigKey(v, config.Key)
 	ValidateConfigValue(v, config.Key, config.Value, config.Type)
+
+	if config.Key == "export_format" {
+		v.Check(validator.In(config.Value, ExportFormats...), config.Key, "must be one of csv or parquet")
+	}
+	if config.Key == "encrypted_columns" {
+		ValidateEncryptedColumns(v, config.Value)
+	}
+	if config.Key == "kamar_allowed_cidrs" {
+		_, err := ParseCIDRList(config.Value)
+		v.Check(err == nil, config.Key, "must be a comma separated list of IP addresses or CIDR ranges, eg. 10.0.0.5, 10.1.0.0/24")
+	}
+	if config.Key == "lockout_exempt_ips" {
+		for _, ip := range strings.Split(config.Value, ",") {
+			ip = strings.TrimSpace(ip)
+			v.Check(ip == "" || net.ParseIP(ip) != nil, config.Key, "must be a comma separated list of IP addresses")
+		}
+	}
+}
+
+// ParseCIDRList parses a comma separated list of CIDR ranges, where a bare IP address is a range holding just that address
+func ParseCIDRList(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
 }
 
 // NewConfig creates a Config from ConfigEntries
@@ -245,5 +302,7 @@ func (m *ConfigModel) Set(entry ConfigEntry) error {
 		return err
 	}
 
+	m.version.Add(1)
+
 	return nil
 }
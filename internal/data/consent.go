@@ -0,0 +1,135 @@
+package data
+
+import (
+	"context"
+	"strings"
+)
+
+// Columns holding contact details, which are withheld from a student's rows when they haven't consented to their details being shared
+var consentDetailsColumns = map[string][]string{
+	"students":           {"email", "mobile"},
+	"student_caregivers": {"email", "mobile"},
+	"student_emergency":  {"mobile"},
+	"student_residences": {"title", "salutation", "email", "numflatunit", "numstreet", "ruraldelivery", "suburb", "town", "postcode"},
+}
+
+// ConsentPurpose is what data is being shared for, which decides which of a student's datasharing flags apply
+type ConsentPurpose int
+
+const (
+	// Exports for the school's own reporting honour the details and photo flags
+	ConsentExport ConsentPurpose = iota
+	// Research exports are shared outside the school, so students who haven't consented to other uses of their data are left out altogether
+	ConsentResearch
+)
+
+type consentFlags struct {
+	details, photo, other bool
+}
+
+// Consent holds the students who have withheld consent for any kind of datasharing, keyed by their id. A nil Consent withholds nothing, which is how an admin override is applied.
+type Consent struct {
+	withheld map[string]consentFlags
+}
+
+type ConsentModel struct {
+	DB *ListenerDB
+}
+
+// Load reads the datasharing flags KAMAR sent for each student. Only a flag set to 0 withholds anything - students KAMAR hasn't sent flags for are shared as before.
+func (m *ConsentModel) Load() (*Consent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT student_id, details, photo, other FROM student_datasharing;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	c := &Consent{withheld: make(map[string]consentFlags)}
+	values := make([]any, 4)
+	pointers := []any{&values[0], &values[1], &values[2], &values[3]}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		if err := m.DB.Cipher.OpenValues(values); err != nil {
+			return nil, err
+		}
+		flags := consentFlags{
+			details: exportValueToString(values[1]) == "0",
+			photo:   exportValueToString(values[2]) == "0",
+			other:   exportValueToString(values[3]) == "0",
+		}
+		if flags != (consentFlags{}) {
+			c.withheld[exportValueToString(values[0])] = flags
+		}
+	}
+
+	return c, rows.Err()
+}
+
+// Withheld returns the number of students withholding consent for any kind of datasharing
+func (c *Consent) Withheld() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.withheld)
+}
+
+// PhotoWithheld reports whether the student with the given id hasn't consented to their photo being shared
+func (c *Consent) PhotoWithheld(studentID string) bool {
+	return c != nil && c.withheld[studentID].photo
+}
+
+// Filter returns a function that removes from a row of table, read with the given columns, anything the student the row is about hasn't consented to share for purpose. The function returns false if the whole row should be left out. Rows of tables that aren't about a student are returned unchanged.
+func (c *Consent) Filter(table string, columns []string, purpose ConsentPurpose) func(values []any) bool {
+	keep := func([]any) bool { return true }
+	if c == nil || len(c.withheld) == 0 {
+		return keep
+	}
+
+	studentColumn := -1
+	for _, st := range subjectTables {
+		if st.table != table {
+			continue
+		}
+		for i, col := range columns {
+			if strings.EqualFold(col, st.column) {
+				studentColumn = i
+			}
+		}
+	}
+	if studentColumn < 0 {
+		return keep
+	}
+
+	var detailsColumns []int
+	for _, name := range consentDetailsColumns[table] {
+		for i, col := range columns {
+			if strings.EqualFold(col, name) {
+				detailsColumns = append(detailsColumns, i)
+			}
+		}
+	}
+
+	return func(values []any) bool {
+		flags, ok := c.withheld[exportValueToString(values[studentColumn])]
+		if !ok {
+			return true
+		}
+		if purpose == ConsentResearch && flags.other {
+			return false
+		}
+		if table == "photos" && flags.photo {
+			return false
+		}
+		if flags.details {
+			for _, i := range detailsColumns {
+				values[i] = nil
+			}
+		}
+		return true
+	}
+}
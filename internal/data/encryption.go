@@ -0,0 +1,408 @@
+package data
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+	"golang.org/x/crypto/scrypt"
+)
+
+// EncryptedPrefix marks a value as having been encrypted by a FieldCipher, so it can be recognised and decrypted wherever it is read, including from views and from columns that have since been removed from the encrypted list
+const EncryptedPrefix = "enc:v1:"
+
+// DefaultEncryptedColumns are the columns holding contact details, identifiers and health information, which are encrypted unless the encrypted_columns config value says otherwise
+var DefaultEncryptedColumns = []string{
+	"students.nsn", "students.email", "students.mobile",
+	"student_caregivers.name", "student_caregivers.email", "student_caregivers.mobile",
+	"student_emergency.name", "student_emergency.mobile",
+	"student_flags.general", "student_flags.notes", "student_flags.alert", "student_flags.conditions", "student_flags.dietary", "student_flags.medical", "student_flags.pastoral", "student_flags.reactions", "student_flags.specialneeds", "student_flags.vaccinations",
+	"student_residences.email", "student_residences.numflatunit", "student_residences.numstreet", "student_residences.ruraldelivery", "student_residences.suburb", "student_residences.town", "student_residences.postcode",
+}
+
+var (
+	ErrWrongEncryptionKey = errors.New("encryption key doesn't match the key listener data was encrypted with")
+
+	encryptedColumnRX = regexp.MustCompile(`^[a-z_]+\.[a-z_]+$`)
+)
+
+// FieldCipher encrypts the values of a configurable set of listener columns before they are written, and decrypts them again when they are exported. Encryption is deterministic - the same value in the same column always encrypts to the same text - so upserts, UNIQUE constraints and change_log's comparison of old and new values keep working on encrypted columns, at the cost of revealing which rows share a value.
+type FieldCipher struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+	checkKey []byte
+
+	mu      sync.RWMutex
+	columns map[string]bool
+}
+
+// NewFieldCipher creates a FieldCipher from a 32 byte key, from which separate keys for encryption, nonces and the key check are derived
+func NewFieldCipher(key []byte) (*FieldCipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(deriveSubkey(key, "field encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FieldCipher{
+		aead:     aead,
+		nonceKey: deriveSubkey(key, "field nonce"),
+		checkKey: deriveSubkey(key, "key check"),
+		columns:  make(map[string]bool),
+	}, nil
+}
+
+func deriveSubkey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("kamar-listener " + purpose))
+	return mac.Sum(nil)
+}
+
+// DeriveFieldKey stretches a passphrase into a 32 byte key
+func DeriveFieldKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+// KeyCheck returns a value that identifies the key without revealing it, which is stored alongside the data so that starting the listener with the wrong key can be detected before anything is written
+func (c *FieldCipher) KeyCheck() string {
+	return base64.StdEncoding.EncodeToString(c.checkKey[:16])
+}
+
+// ParseEncryptedColumns splits a comma separated list of table.column names, lower casing them, as Postgres folds unquoted names to lower case
+func ParseEncryptedColumns(list string) []string {
+	var columns []string
+	for _, col := range strings.Split(list, ",") {
+		col = strings.ToLower(strings.TrimSpace(col))
+		if col != "" {
+			columns = append(columns, col)
+		}
+	}
+	return columns
+}
+
+func ValidateEncryptedColumns(v *validator.Validator, list string) {
+	for _, col := range ParseEncryptedColumns(list) {
+		v.Check(encryptedColumnRX.MatchString(col), "encrypted_columns", "must be a comma separated list of table.column names, eg. students.nsn, student_flags.medical")
+	}
+}
+
+// SetColumns replaces the set of table.column names that are encrypted when written
+func (c *FieldCipher) SetColumns(columns []string) {
+	set := make(map[string]bool, len(columns))
+	for _, col := range columns {
+		set[strings.ToLower(col)] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.columns = set
+}
+
+// Encrypts reports whether values written to table.column are encrypted. It is safe to call on a nil FieldCipher, which encrypts nothing.
+func (c *FieldCipher) Encrypts(table, column string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.columns[strings.ToLower(table+"."+column)]
+}
+
+// Seal encrypts v, which may be any value accepted as a query argument (including pointers, as used by the KAMAR data types). NULLs, and values that are already encrypted, are returned unchanged.
+func (c *FieldCipher) Seal(table, column string, v any) (any, error) {
+	value, err := driver.DefaultParameterConverter.ConvertValue(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var plaintext string
+	switch val := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		plaintext = val
+	case []byte:
+		plaintext = string(val)
+	default:
+		plaintext = exportValueToString(val)
+	}
+	if strings.HasPrefix(plaintext, EncryptedPrefix) {
+		return plaintext, nil
+	}
+
+	// Deriving the nonce from the value makes encryption deterministic. Including the column means equal values in different columns still encrypt differently.
+	mac := hmac.New(sha256.New, c.nonceKey)
+	mac.Write([]byte(strings.ToLower(table + "." + column)))
+	mac.Write([]byte{0})
+	mac.Write([]byte(plaintext))
+	nonce := mac.Sum(nil)[:c.aead.NonceSize()]
+
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return EncryptedPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts v if it is an encrypted value, and returns it unchanged otherwise. It is safe to call on a nil FieldCipher, in which case encrypted values are an error.
+func (c *FieldCipher) Open(v any) (any, error) {
+	var s string
+	switch val := v.(type) {
+	case string:
+		s = val
+	case []byte:
+		s = string(val)
+	default:
+		return v, nil
+	}
+	if !strings.HasPrefix(s, EncryptedPrefix) {
+		return v, nil
+	}
+
+	if c == nil {
+		return nil, errors.New("found encrypted data, but the listener was started without an encryption key")
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(s, EncryptedPrefix))
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return nil, errors.New("malformed encrypted value")
+	}
+
+	plaintext, err := c.aead.Open(nil, sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrWrongEncryptionKey
+	}
+
+	return string(plaintext), nil
+}
+
+// OpenValues decrypts every encrypted value in values in place, eg. a row scanned for export
+func (c *FieldCipher) OpenValues(values []any) error {
+	for i, v := range values {
+		opened, err := c.Open(v)
+		if err != nil {
+			return err
+		}
+		values[i] = opened
+	}
+	return nil
+}
+
+var (
+	insertColumnsRX = regexp.MustCompile(`(?is)^\s*INSERT\s+(?:OR\s+\w+\s+)?INTO\s+"?(\w+)"?\s*\(([^)]*)\)\s*VALUES\s*\(([^)]*)\)`)
+	updateTableRX   = regexp.MustCompile(`(?is)^\s*UPDATE\s+"?(\w+)"?\s+SET\s`)
+	assignmentRX    = regexp.MustCompile(`"?(\w+)"?\s*=\s*(\$\d+|\?)`)
+)
+
+// sealedArgs works out which arguments of an INSERT or UPDATE statement are written to encrypted columns, returning a map of argument index to column name. Placeholders may be written as $n or ?, but not both.
+func (c *FieldCipher) sealedArgs(query string) (string, map[int]string) {
+	if c == nil {
+		return "", nil
+	}
+
+	args := make(map[int]string)
+
+	if m := insertColumnsRX.FindStringSubmatch(query); m != nil {
+		table := m[1]
+		columns := strings.Split(m[2], ",")
+		values := strings.Split(m[3], ",")
+		question := 0
+		for i, value := range values {
+			value = strings.TrimSpace(value)
+			index := -1
+			switch {
+			case value == "?":
+				index = question
+				question++
+			case strings.HasPrefix(value, "$"):
+				n, err := strconv.Atoi(value[1:])
+				if err != nil {
+					continue
+				}
+				index = n - 1
+			}
+			if index < 0 || i >= len(columns) {
+				continue
+			}
+			column := strings.Trim(strings.TrimSpace(columns[i]), `"`)
+			if c.Encrypts(table, column) {
+				args[index] = column
+			}
+		}
+		return table, args
+	}
+
+	if m := updateTableRX.FindStringSubmatch(query); m != nil {
+		table := m[1]
+		for _, loc := range assignmentRX.FindAllStringSubmatchIndex(query, -1) {
+			column := query[loc[2]:loc[3]]
+			placeholder := query[loc[4]:loc[5]]
+			index := -1
+			if placeholder == "?" {
+				index = strings.Count(query[:loc[4]], "?")
+			} else if n, err := strconv.Atoi(placeholder[1:]); err == nil {
+				index = n - 1
+			}
+			if index >= 0 && c.Encrypts(table, column) {
+				args[index] = column
+			}
+		}
+		return table, args
+	}
+
+	return "", nil
+}
+
+// ListenerStmt is a prepared statement on the listener database, which encrypts any arguments written to encrypted columns
+type ListenerStmt struct {
+	*sql.Stmt
+	cipher *FieldCipher
+	table  string
+	sealed map[int]string
+}
+
+func (s *ListenerStmt) sealArgs(args []any) ([]any, error) {
+	if len(s.sealed) == 0 {
+		return args, nil
+	}
+
+	out := make([]any, len(args))
+	copy(out, args)
+	for i, column := range s.sealed {
+		if i >= len(out) {
+			continue
+		}
+		sealed, err := s.cipher.Seal(s.table, column, out[i])
+		if err != nil {
+			return nil, fmt.Errorf("couldn't encrypt %s.%s: %w", s.table, column, err)
+		}
+		out[i] = sealed
+	}
+	return out, nil
+}
+
+func (s *ListenerStmt) Exec(args ...any) (sql.Result, error) {
+	return s.ExecContext(context.Background(), args...)
+}
+
+func (s *ListenerStmt) ExecContext(ctx context.Context, args ...any) (sql.Result, error) {
+	args, err := s.sealArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.ExecContext(ctx, args...)
+}
+
+// EncryptColumn encrypts any values of table.column that were written before it was added to the encrypted columns, returning the number of distinct values encrypted. table and column must be checked against the database's columns first, as they are interpolated into queries.
+func (db *ListenerDB) EncryptColumn(table, column string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT DISTINCT "%s" FROM "%s" WHERE "%s" IS NOT NULL AND "%s" NOT LIKE $1;`, column, table, column, column), EncryptedPrefix+"%")
+	if err != nil {
+		return 0, err
+	}
+
+	var plaintexts []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		plaintexts = append(plaintexts, value)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, plaintext := range plaintexts {
+		sealed, err := db.Cipher.Seal(table, column, plaintext)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`UPDATE "%s" SET "%s" = $1 WHERE "%s" = $2;`, table, column, column), sealed, plaintext)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(plaintexts), tx.Commit()
+}
+
+// FieldEncryption records how the listener data key is derived, and a check value for it, so that the same key is required every time the listener starts
+type FieldEncryption struct {
+	// KDF is "passphrase" or "keyfile"
+	KDF      string
+	Salt     []byte
+	KeyCheck string
+}
+
+type FieldEncryptionModel struct {
+	DB *sql.DB
+}
+
+func (m *FieldEncryptionModel) Get() (*FieldEncryption, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var fe FieldEncryption
+	var salt string
+	err := m.DB.QueryRowContext(ctx, `SELECT kdf, salt, key_check FROM field_encryption WHERE id = 1;`).Scan(&fe.KDF, &salt, &fe.KeyCheck)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	fe.Salt, err = base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fe, nil
+}
+
+func (m *FieldEncryptionModel) Insert(fe *FieldEncryption) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `INSERT INTO field_encryption (id, kdf, salt, key_check) VALUES (1, $1, $2, $3);`, fe.KDF, base64.StdEncoding.EncodeToString(fe.Salt), fe.KeyCheck)
+	return err
+}
+
+// NewSalt returns a random salt for DeriveFieldKey
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	return salt, err
+}
@@ -0,0 +1,88 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+)
+
+func TestFieldCipherSealedArgs(t *testing.T) {
+	fc, err := NewFieldCipher(make([]byte, 32))
+	assert.NilError(t, err)
+	fc.SetColumns([]string{"students.nsn", "student_residences.numstreet"})
+
+	tests := []struct {
+		name  string
+		query string
+		table string
+		want  map[int]string
+	}{
+		{
+			name:  "Numbered placeholders",
+			query: `INSERT INTO students (id, uuid, nsn) VALUES ($1, $2, $3) ON CONFLICT(uuid) DO UPDATE SET nsn = excluded.nsn;`,
+			table: "students",
+			want:  map[int]string{2: "nsn"},
+		},
+		{
+			name:  "Question mark placeholders and quoted names",
+			query: `INSERT OR IGNORE INTO "student_residences" ("student_uuid", "numStreet") VALUES (?, ?);`,
+			table: "student_residences",
+			want:  map[int]string{1: "numStreet"},
+		},
+		{
+			name:  "Update",
+			query: `UPDATE students SET username = ?, nsn = ? WHERE uuid = ?;`,
+			table: "students",
+			want:  map[int]string{1: "nsn"},
+		},
+		{
+			name:  "Table without encrypted columns",
+			query: `INSERT INTO subjects (id, name) VALUES ($1, $2);`,
+			table: "subjects",
+			want:  map[int]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table, args := fc.sealedArgs(tt.query)
+			assert.Equal(t, table, tt.table)
+			assert.Equal(t, len(args), len(tt.want))
+			for i, col := range tt.want {
+				assert.Equal(t, args[i], col)
+			}
+		})
+	}
+}
+
+func TestFieldCipherSealAndOpen(t *testing.T) {
+	fc, err := NewFieldCipher(make([]byte, 32))
+	assert.NilError(t, err)
+
+	nsn := "123456789"
+	sealed, err := fc.Seal("students", "nsn", &nsn)
+	assert.NilError(t, err)
+
+	again, err := fc.Seal("students", "nsn", nsn)
+	assert.NilError(t, err)
+	assert.Equal(t, again, sealed)
+
+	// Already encrypted values aren't encrypted twice, eg. when copying a table to a sink
+	twice, err := fc.Seal("students", "nsn", sealed)
+	assert.NilError(t, err)
+	assert.Equal(t, twice, sealed)
+
+	opened, err := fc.Open(sealed)
+	assert.NilError(t, err)
+	assert.Equal(t, opened, any(nsn))
+
+	other, err := NewFieldCipher(append(make([]byte, 31), 1))
+	assert.NilError(t, err)
+	_, err = other.Open(sealed)
+	assert.Equal(t, err, ErrWrongEncryptionKey)
+
+	var nilCipher *FieldCipher
+	plain, err := nilCipher.Open("plain")
+	assert.NilError(t, err)
+	assert.Equal(t, plain, any("plain"))
+}
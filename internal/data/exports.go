@@ -0,0 +1,344 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/parquet"
+)
+
+// Exports read whole tables, so they are given a far longer deadline than the 3 second one used for regular queries
+const exportTimeout = 5 * time.Minute
+
+var ExportFormats = []string{"csv", "parquet"}
+
+type ExportModel struct {
+	DB *ListenerDB
+}
+
+// ExportWatermarkModel records, per table and export format, how far exports have got, so incremental exports only include rows changed since the previous run
+type ExportWatermarkModel struct {
+	DB *sql.DB
+}
+
+// ExportWatermark is the latest listener_updated_at value that has been exported, and the rows exported with exactly that value. listener_updated_at only has second resolution, so rows written later in the same second could still arrive - the next incremental export selects that second again, and uses Exported to skip the rows it already has.
+type ExportWatermark struct {
+	UpdatedAt string
+	// Hashes of the rows, from exportRowHash
+	Exported []string
+}
+
+// Get the table's watermark, or the zero ExportWatermark if it has never been exported
+func (m *ExportWatermarkModel) Get(table, format string) (ExportWatermark, error) {
+	var watermark ExportWatermark
+	var exported string
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, `SELECT watermark, exported FROM export_watermarks WHERE table_name = $1 AND format = $2;`, table, format).Scan(&watermark.UpdatedAt, &exported)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ExportWatermark{}, nil
+	}
+	if err != nil {
+		return ExportWatermark{}, err
+	}
+
+	return watermark, json.Unmarshal([]byte(exported), &watermark.Exported)
+}
+
+func (m *ExportWatermarkModel) Set(table, format string, watermark ExportWatermark) error {
+	exported, err := json.Marshal(watermark.Exported)
+	if err != nil {
+		return err
+	}
+	if watermark.Exported == nil {
+		exported = []byte("[]")
+	}
+
+	query := `
+		INSERT INTO export_watermarks (table_name, format, watermark, exported) VALUES ($1, $2, $3, $4)
+		ON CONFLICT(table_name, format) DO UPDATE SET watermark = excluded.watermark, exported = excluded.exported, updated_at = (datetime('now'));
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, table, format, watermark.UpdatedAt, string(exported))
+	return err
+}
+
+// GetExportableTables returns the names of every table and view in the listener database, excluding the database's internal tables and change_log
+func (m *ExportModel) GetExportableTables() ([]string, error) {
+	query := `
+		SELECT name FROM sqlite_master
+		WHERE type IN ('table', 'view') AND name NOT LIKE 'sqlite_%' AND name != 'change_log'
+		ORDER BY name;
+	`
+	if m.DB.Dialect == DialectPostgres {
+		query = `
+			SELECT table_name FROM information_schema.tables
+			WHERE table_schema = current_schema() AND table_name != 'change_log'
+			ORDER BY table_name;
+		`
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+
+	return tables, rows.Err()
+}
+
+// WriteCSV writes every row of the provided table to w as UTF-8 CSV, with a header row of column names, and returns the number of rows written. Anything a student hasn't consented to share is withheld, unless consent is nil. table must come from GetExportableTables, as it is interpolated into the query.
+func (m *ExportModel) WriteCSV(table string, consent *Consent, w io.Writer) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, fmt.Sprintf(`SELECT * FROM "%s";`, table))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	// Excel only detects UTF-8 (and therefore displays macrons correctly) if the file starts with a byte order mark
+	if _, err := w.Write([]byte("\ufeff")); err != nil {
+		return 0, err
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return 0, err
+	}
+
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	record := make([]string, len(columns))
+	shared := consent.Filter(table, columns, ConsentExport)
+
+	count := 0
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return count, err
+		}
+		if err := m.DB.Cipher.OpenValues(values); err != nil {
+			return count, fmt.Errorf("couldn't decrypt %s: %w", table, err)
+		}
+		if !shared(values) {
+			continue
+		}
+		for i, v := range values {
+			record[i] = exportValueToString(v)
+		}
+		if err := cw.Write(record); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+
+	cw.Flush()
+	return count, cw.Error()
+}
+
+// GetParquetColumns derives a Parquet schema for the provided table from the column types declared in the listener database, following SQLite's type affinity rules: INTEGER affinity becomes INT64, REAL affinity becomes DOUBLE, BLOB (or Postgres' BYTEA) columns stay as raw bytes, and everything else (including DATETIME) is written as a UTF-8 string.
+func (m *ExportModel) GetParquetColumns(table string) ([]parquet.Column, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tableColumns, err := m.DB.Columns(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []parquet.Column
+	for _, tc := range tableColumns {
+		col := parquet.Column{Name: tc.Name, Type: parquet.String}
+		declared := strings.ToUpper(tc.Type)
+		switch {
+		case strings.Contains(declared, "INT"):
+			col.Type = parquet.Int64
+		case strings.Contains(declared, "REAL"), strings.Contains(declared, "FLOA"), strings.Contains(declared, "DOUB"):
+			col.Type = parquet.Double
+		case strings.Contains(declared, "BLOB"), strings.Contains(declared, "BYTEA"):
+			col.Type = parquet.Bytes
+		}
+		columns = append(columns, col)
+	}
+
+	return columns, nil
+}
+
+// TracksUpdates reports whether the table has a listener_updated_at column, so can be exported incrementally
+func (m *ExportModel) TracksUpdates(table string) (bool, error) {
+	columns, err := m.GetParquetColumns(table)
+	if err != nil {
+		return false, err
+	}
+
+	for _, col := range columns {
+		if col.Name == "listener_updated_at" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// WriteParquet writes the provided table to w as a Parquet file, withholding what students haven't consented to share as WriteCSV does. If since is not the zero ExportWatermark and the table has a listener_updated_at column, only rows that weren't exported up to since are written. It returns the number of rows written and the watermark to pass as since to the next incremental export.
+func (m *ExportModel) WriteParquet(table string, since ExportWatermark, consent *Consent, w io.Writer) (int, ExportWatermark, error) {
+	columns, err := m.GetParquetColumns(table)
+	if err != nil {
+		return 0, ExportWatermark{}, err
+	}
+
+	updatedAtIndex := -1
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		if col.Name == "listener_updated_at" {
+			updatedAtIndex = i
+		}
+		names[i] = col.Name
+	}
+	shared := consent.Filter(table, names, ConsentExport)
+
+	query := fmt.Sprintf(`SELECT * FROM "%s"`, table)
+	var args []any
+	// The watermark's own second is included, as rows may have been written in it after the last export
+	if since.UpdatedAt != "" && updatedAtIndex >= 0 {
+		query += ` WHERE listener_updated_at >= $1`
+		args = append(args, since.UpdatedAt)
+	}
+	exported := make(map[string]bool, len(since.Exported))
+	for _, hash := range since.Exported {
+		exported[hash] = true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, ExportWatermark{}, err
+	}
+	defer rows.Close()
+
+	pw, err := parquet.NewWriter(w, columns)
+	if err != nil {
+		return 0, ExportWatermark{}, err
+	}
+
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	watermark := ExportWatermark{UpdatedAt: since.UpdatedAt, Exported: slices.Clone(since.Exported)}
+	count := 0
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return count, ExportWatermark{}, err
+		}
+		if err := m.DB.Cipher.OpenValues(values); err != nil {
+			return count, ExportWatermark{}, fmt.Errorf("couldn't decrypt %s: %w", table, err)
+		}
+		// Withheld rows still move the watermark on, so they aren't picked up by the next incremental export either
+		if updatedAtIndex >= 0 {
+			updatedAt := exportValueToString(values[updatedAtIndex])
+			hash := exportRowHash(values)
+			if updatedAt == since.UpdatedAt && exported[hash] {
+				continue
+			}
+			switch {
+			case updatedAt > watermark.UpdatedAt:
+				watermark = ExportWatermark{UpdatedAt: updatedAt, Exported: []string{hash}}
+			case updatedAt == watermark.UpdatedAt:
+				watermark.Exported = append(watermark.Exported, hash)
+			}
+		}
+		if !shared(values) {
+			continue
+		}
+		if err := pw.Write(values); err != nil {
+			return count, ExportWatermark{}, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, ExportWatermark{}, err
+	}
+
+	return count, watermark, pw.Close()
+}
+
+// Identifies a version of a row by its values, so a row updated again in the watermark's second is exported again, but one that is unchanged isn't
+func exportRowHash(values []any) string {
+	h := sha256.New()
+	for _, v := range values {
+		// NULL is told apart from an empty string
+		if v == nil {
+			h.Write([]byte{1})
+		} else {
+			h.Write([]byte(exportValueToString(v)))
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// Converts a value scanned from the database into its CSV representation - NULL becomes an empty cell
+func exportValueToString(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(val)
+	case string:
+		return val
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(val)
+	case time.Time:
+		return val.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(val)
+	}
+}
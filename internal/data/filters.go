@@ -9,6 +9,7 @@ import (
 
 type Filters struct {
 	LogFilters   LogFilters
+	AuditFilters AuditFilters
 	Page         int
 	PageSize     int
 	Sort         string
@@ -21,6 +22,12 @@ type LogFilters struct {
 	UserID  []int
 }
 
+type AuditFilters struct {
+	UserID []int
+	Action []string
+	Target string
+}
+
 type Metadata struct {
 	CurrentPage  int `json:"current_page,omitempty"`
 	PageSize     int `json:"page_size,omitempty"`
@@ -2,7 +2,6 @@ package data
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
 	"reflect"
@@ -61,7 +60,7 @@ func (p *Password) Hash() []byte {
 
 // }
 
-func QueryForRecordCounts(tableName string, db *sql.DB) (int, int, error) {
+func QueryForRecordCounts(tableName string, db *ListenerDB) (int, int, error) {
 	var today, total int
 	query := fmt.Sprintf(`
 		SELECT
@@ -3,6 +3,7 @@ package data
 import (
 	"database/sql"
 	"errors"
+	"sync/atomic"
 )
 
 var (
@@ -10,43 +11,69 @@ var (
 )
 
 type Models struct {
-	Assessments    AssessmentModel
-	Attendance     AttendanceModel
-	ClassEfforts   ClassEffortsModel
-	Config         ConfigModel
-	ListenerEvents ListenerEventsModel
-	Logs           LogModel
-	Notices        NoticesModel
-	Pastoral       PastoralModel
-	Recognitions   RecognitionsModel
-	Results        ResultModel
-	Staff          StaffModel
-	Students       StudentModel
-	Subjects       SubjectModel
-	Timetables     TimetableModel
-	Tokens         TokenModel
-	Users          UserModel
-	Widgets        WidgetModel
+	Assessments     AssessmentModel
+	Audit           AuditModel
+	Attendance      AttendanceModel
+	ChangeLog       ChangeLogModel
+	ClassEfforts    ClassEffortsModel
+	Config          ConfigModel
+	Consent         ConsentModel
+	Erasures        ErasureModel
+	Exports         ExportModel
+	ExportMarks     ExportWatermarkModel
+	FieldEncryption FieldEncryptionModel
+	ListenerEvents  ListenerEventsModel
+	Logs            LogModel
+	Notices         NoticesModel
+	Pastoral        PastoralModel
+	PIIPolicy       PIIPolicyModel
+	Recognitions    RecognitionsModel
+	Replication     ReplicationSinkModel
+	ResearchKey     ResearchKeyModel
+	Results         ResultModel
+	Staff           StaffModel
+	Students        StudentModel
+	SubjectAccess   SubjectAccessModel
+	Subjects        SubjectModel
+	Timetables      TimetableModel
+	Tokens          TokenModel
+	TwoFactor       TwoFactorModel
+	Users           UserModel
+	Webhooks        WebhookModel
+	Widgets         WidgetModel
 }
 
-func NewModels(appdb, kamardb *sql.DB, background func(fn func())) Models {
+func NewModels(appdb *sql.DB, kamardb *ListenerDB, background func(fn func())) Models {
 	return Models{
-		Assessments:    AssessmentModel{DB: kamardb},
-		Attendance:     AttendanceModel{DB: kamardb},
-		ClassEfforts:   ClassEffortsModel{DB: kamardb},
-		Config:         ConfigModel{DB: appdb},
-		ListenerEvents: ListenerEventsModel{DB: appdb},
-		Logs:           LogModel{DB: appdb, background: background},
-		Notices:        NoticesModel{DB: kamardb},
-		Pastoral:       PastoralModel{DB: kamardb},
-		Recognitions:   RecognitionsModel{DB: kamardb},
-		Results:        ResultModel{DB: kamardb},
-		Staff:          StaffModel{DB: kamardb},
-		Students:       StudentModel{DB: kamardb},
-		Subjects:       SubjectModel{DB: kamardb},
-		Timetables:     TimetableModel{DB: kamardb},
-		Tokens:         TokenModel{DB: appdb},
-		Users:          UserModel{DB: appdb},
-		Widgets:        WidgetModel{DB: appdb},
+		Assessments:     AssessmentModel{DB: kamardb},
+		Audit:           AuditModel{DB: appdb},
+		Attendance:      AttendanceModel{DB: kamardb},
+		ChangeLog:       ChangeLogModel{DB: kamardb},
+		ClassEfforts:    ClassEffortsModel{DB: kamardb},
+		Config:          ConfigModel{DB: appdb, version: new(atomic.Uint64)},
+		Consent:         ConsentModel{DB: kamardb},
+		Erasures:        ErasureModel{DB: appdb},
+		Exports:         ExportModel{DB: kamardb},
+		ExportMarks:     ExportWatermarkModel{DB: appdb},
+		FieldEncryption: FieldEncryptionModel{DB: appdb},
+		ListenerEvents:  ListenerEventsModel{DB: appdb},
+		Logs:            LogModel{DB: appdb, background: background},
+		Notices:         NoticesModel{DB: kamardb},
+		Pastoral:        PastoralModel{DB: kamardb},
+		PIIPolicy:       PIIPolicyModel{DB: appdb},
+		Recognitions:    RecognitionsModel{DB: kamardb},
+		Replication:     ReplicationSinkModel{DB: appdb},
+		ResearchKey:     ResearchKeyModel{DB: appdb},
+		Results:         ResultModel{DB: kamardb},
+		Staff:           StaffModel{DB: kamardb, PII: PIIPolicyModel{DB: appdb}},
+		Students:        StudentModel{DB: kamardb, PII: PIIPolicyModel{DB: appdb}},
+		SubjectAccess:   SubjectAccessModel{DB: kamardb},
+		Subjects:        SubjectModel{DB: kamardb},
+		Timetables:      TimetableModel{DB: kamardb},
+		Tokens:          TokenModel{DB: appdb},
+		TwoFactor:       TwoFactorModel{DB: appdb},
+		Users:           UserModel{DB: appdb},
+		Webhooks:        WebhookModel{DB: appdb},
+		Widgets:         WidgetModel{DB: appdb},
 	}
 }
@@ -1,9 +1,5 @@
 package data
 
-import (
-	"database/sql"
-)
-
 type Notice struct {
 	UUID              *string `json:"uuid"`
 	DateStart         *string `json:"DateStart,omitempty"`
@@ -20,7 +16,7 @@ type Notice struct {
 }
 
 type NoticesModel struct {
-	DB *sql.DB
+	DB *ListenerDB
 }
 
 func (m *NoticesModel) InsertManyNotices(notices []Notice) error {
@@ -1,7 +1,5 @@
 package data
 
-import "database/sql"
-
 type Pastoral struct {
 	ID                *int    `json:"id,omitempty"`
 	Nsn               *string `json:"nsn,omitempty"`
@@ -31,7 +29,7 @@ type Pastoral struct {
 }
 
 type PastoralModel struct {
-	DB *sql.DB
+	DB *ListenerDB
 }
 
 func (m *PastoralModel) InsertManyPastoral(pastoral []Pastoral) error {
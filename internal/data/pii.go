@@ -0,0 +1,567 @@
+package data
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+)
+
+const (
+	PIIStore    = "store"
+	PIIHash     = "hash"
+	PIITruncate = "truncate"
+	PIIDrop     = "drop"
+
+	// Hashed values are prefixed so they can't be mistaken for (or hashed again like) values KAMAR sent
+	PIIHashPrefix = "hmac:"
+)
+
+var PIIActions = []string{PIIStore, PIIHash, PIITruncate, PIIDrop}
+
+// Fields KAMAR always sends, and fields it only sends when they are listed in the check response
+var (
+	StudentRequiredFields = []string{"firstname", "lastname", "gender", "gendercode", "nsn", "uniqueid"}
+	StudentOptionalFields = []string{"schoolindex", "firstnamelegal", "lastnamelegal", "forenames", "forenameslegal", "genderpreferred", "username", "mobile", "email", "house", "whanau", "boarder", "byodinfo", "ece", "esol", "ors", "languagespoken", "datebirth", "startingdate", "startschooldate", "created", "leavingdate", "leavingreason", "leavingschool", "leavingactivity", "res", "resa", "resb", "res.title", "res.salutation", "res.email", "res.numFlatUnit", "res.numStreet", "res.ruralDelivery", "res.suburb", "res.town", "res.postcode", "caregivers", "caregivers1", "caregivers2", "caregivers3", "caregivers4", "caregiver.name", "caregiver.relationship", "caregiver.status", "caregiver.address", "caregiver.mobile", "caregiver.email", "emergency", "emergency1", "emergency2", "emergency.name", "emergency.relationship", "emergency.mobile", "moetype", "ethnicityL1", "ethnicityL2", "ethnicity", "iwi", "yearlevel", "fundinglevel", "tutor", "timetablebottom1", "timetablebottom2", "timetablebottom3", "timetablebottom4", "timetabletop1", "timetabletop2", "timetabletop3", "timetabletop4", "maorilevel", "pacificlanguage", "pacificlevel", "flags", "flag.alert", "flag.conditions", "flag.dietary", "flag.general", "flag.ibuprofen", "flag.medical", "flag.notes", "flag.paracetamol", "flag.pastoral", "flag.reactions", "flag.specialneeds", "flag.vaccinations", "flag.eotcconsent", "flag.eotcform", "custom", "custom.custom1", "custom.custom2", "custom.custom3", "custom.custom4", "custom.custom5", "siblinglink", "photocopierid", "signedagreement", "accountdisabled", "networkaccess", "altdescription", "althomedrive"}
+	StaffRequiredFields   = []string{"uniqueid", "firstname", "lastname", "username", "gender", "email"}
+	StaffOptionalFields   = []string{"schoolindex", "title", "mobile", "extension", "classification", "position", "house", "tutor", "groups", "groups.departments", "datebirth", "created", "leavingdate", "startingdate", "eslguid", "moenumber", "photocopierid", "registrationnumber", "custom", "custom.custom1", "custom.custom2", "custom.custom3", "custom.custom4", "custom.custom5"}
+)
+
+// Fields that switch on a group of related fields, with the prefix of the fields in the group (eg. caregiver.mobile, caregivers1), the struct field the group is decoded into, and the listener table its members are stored in
+var piiGroups = map[string]struct{ prefix, field, table string }{
+	"res":        {"res", "residences", "student_residences"},
+	"caregivers": {"caregiver", "caregivers", "student_caregivers"},
+	"emergency":  {"emergency", "emergency", "student_emergency"},
+	"flags":      {"flag", "flags", "student_flags"},
+	"custom":     {"custom", "custom", ""},
+	"groups":     {"groups", "groups", ""},
+}
+
+// What truncating a field keeps, keyed by the last part of the field's name
+var piiTruncations = map[string]string{
+	"res":            "postcode only",
+	"email":          "domain only",
+	"mobile":         "first 3 digits",
+	"datebirth":      "year only",
+	"numstreet":      "street name only",
+	"name":           "initial only",
+	"firstname":      "initial only",
+	"firstnamelegal": "initial only",
+	"lastname":       "initial only",
+	"lastnamelegal":  "initial only",
+	"forenames":      "initial only",
+	"forenameslegal": "initial only",
+}
+
+type PIIRule struct {
+	Entity    string `json:"entity"`
+	Field     string `json:"field"`
+	Action    string `json:"action"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// PIIField describes a field on the PII policy editor
+type PIIField struct {
+	Entity     string
+	Field      string
+	Action     string
+	Required   bool
+	Hashable   bool
+	Truncation string
+	UpdatedAt  string
+	// Number of values held in the listener database, counted for dropped fields only, or -1 if they can't be counted
+	Stored int
+}
+
+type PIIPolicyModel struct {
+	DB *sql.DB
+}
+
+func ValidatePIIRule(v *validator.Validator, r *PIIRule) {
+	v.Check(validator.In(r.Entity, "students", "staff"), "entity", "must be students or staff")
+	v.Check(validator.In(r.Field, PIIFieldNames(r.Entity)...), "field", "must be a field KAMAR can send")
+	v.Check(validator.In(r.Action, PIIActions...), "action", "must be store, hash, truncate or drop")
+
+	switch r.Action {
+	case PIIHash:
+		v.Check(piiHashable(r.Entity, r.Field), "action", "only text fields can be hashed")
+	case PIITruncate:
+		_, ok := piiFieldType(r.Entity, r.Field)
+		v.Check(ok && PIITruncation(r.Field) != "", "action", "this field can't be truncated")
+	}
+}
+
+// NewHashKey generates a random key for keyed hashes, such as those of PII policy fields and research pseudonyms, so a hashed value (eg. a phone number) can't be recovered by hashing every possible value
+func NewHashKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// PIIFieldNames returns every field KAMAR can send for students or staff
+func PIIFieldNames(entity string) []string {
+	switch entity {
+	case "students":
+		return append(append([]string{}, StudentRequiredFields...), StudentOptionalFields...)
+	case "staff":
+		return append(append([]string{}, StaffRequiredFields...), StaffOptionalFields...)
+	}
+	return nil
+}
+
+// PIITruncation describes what truncating a field keeps, or returns "" if the field can't be truncated
+func PIITruncation(field string) string {
+	name := field
+	if i := strings.LastIndex(field, "."); i >= 0 {
+		name = field[i+1:]
+	}
+	return piiTruncations[strings.ToLower(name)]
+}
+
+// PIIColumn returns the listener table a field is stored in, and its column. The column is empty for fields that switch on a whole group of fields, which are stored as rows of their own table. ok is false for fields that aren't stored in a column of their own, such as custom fields, which are stored together as JSON.
+func PIIColumn(entity, field string) (table, column string, ok bool) {
+	if g, isGroup := piiGroups[field]; isGroup {
+		return g.table, "", entity == "students" && g.table != ""
+	}
+
+	prefix, sub, nested := strings.Cut(field, ".")
+	if !nested {
+		return entity, field, entity == "students" || entity == "staff"
+	}
+	for _, g := range piiGroups {
+		if g.prefix == prefix && g.table != "" && entity == "students" {
+			return g.table, sub, true
+		}
+	}
+	return "", "", false
+}
+
+// PIIPolicyFields lists every field KAMAR can send, along with the rule set for it
+func PIIPolicyFields(rules []PIIRule) []PIIField {
+	set := make(map[string]PIIRule, len(rules))
+	for _, r := range rules {
+		set[r.Entity+":"+r.Field] = r
+	}
+
+	var fields []PIIField
+	for _, entity := range []string{"students", "staff"} {
+		required := StudentRequiredFields
+		if entity == "staff" {
+			required = StaffRequiredFields
+		}
+		for _, name := range PIIFieldNames(entity) {
+			f := PIIField{
+				Entity:   entity,
+				Field:    name,
+				Action:   PIIStore,
+				Required: validator.In(name, required...),
+				Hashable: piiHashable(entity, name),
+				Stored:   -1,
+			}
+			if _, ok := piiFieldType(entity, name); ok {
+				f.Truncation = PIITruncation(name)
+			}
+			if r, ok := set[entity+":"+name]; ok {
+				f.Action = r.Action
+				f.UpdatedAt = r.UpdatedAt
+			}
+			fields = append(fields, f)
+		}
+	}
+
+	return fields
+}
+
+func (m *PIIPolicyModel) GetAll() ([]PIIRule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT entity, field, action, updated_at FROM pii_policy ORDER BY entity, field;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []PIIRule
+	for rows.Next() {
+		var r PIIRule
+		if err := rows.Scan(&r.Entity, &r.Field, &r.Action, &r.UpdatedAt); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+
+	return rules, rows.Err()
+}
+
+func (m *PIIPolicyModel) Set(r *PIIRule) error {
+	query := `
+		INSERT INTO pii_policy (entity, field, action)
+		VALUES ($1, $2, $3)
+		ON CONFLICT(entity, field) DO UPDATE SET
+			action = excluded.action,
+			updated_at = datetime('now')
+		RETURNING updated_at
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, r.Entity, r.Field, r.Action).Scan(&r.UpdatedAt)
+}
+
+// Load reads the policy to apply to data from KAMAR. Models without an app database (eg. those writing to replication sinks, which are sent data the policy has already been applied to) have no policy, and store data as it is.
+func (m *PIIPolicyModel) Load() (*PIIPolicy, error) {
+	if m.DB == nil {
+		return nil, nil
+	}
+
+	rules, err := m.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var key string
+	err = m.DB.QueryRowContext(ctx, `SELECT key FROM pii_hash_key WHERE id = 1;`).Scan(&key)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PIIPolicy{key: []byte(key), rules: make(map[string]string, len(rules))}
+	for _, r := range rules {
+		p.rules[r.Entity+":"+r.Field] = r.Action
+		if r.Action != PIIStore {
+			p.applied = append(p.applied, r)
+		}
+	}
+
+	return p, nil
+}
+
+// PIIPolicy says what to do with each field of the student and staff records sent by KAMAR. Fields without a rule are stored as they are. A nil policy stores everything.
+type PIIPolicy struct {
+	key   []byte
+	rules map[string]string
+	// Rules that change data, in field order so they are always applied the same way
+	applied []PIIRule
+}
+
+func (p *PIIPolicy) Action(entity, field string) string {
+	if p == nil {
+		return PIIStore
+	}
+	if action, ok := p.rules[entity+":"+field]; ok {
+		return action
+	}
+	return PIIStore
+}
+
+// Hash returns the value a hashed field is stored as. Values that are already hashed are returned unchanged, as is every value when there is no policy.
+func (p *PIIPolicy) Hash(value string) string {
+	if p == nil || strings.HasPrefix(value, PIIHashPrefix) {
+		return value
+	}
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(value))
+	return PIIHashPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Advertised returns the fields KAMAR should be asked to send, leaving out dropped fields and the fields of dropped groups so they are never sent at all
+func (p *PIIPolicy) Advertised(entity string, fields []string) []string {
+	var advertised []string
+	for _, f := range fields {
+		if p.Action(entity, f) == PIIDrop {
+			continue
+		}
+		if g, ok := piiGroupOf(f); ok && p.Action(entity, g) == PIIDrop {
+			continue
+		}
+		advertised = append(advertised, f)
+	}
+	return advertised
+}
+
+func (p *PIIPolicy) ApplyToStudents(students []Student) {
+	if p == nil || len(p.applied) == 0 {
+		return
+	}
+	for i := range students {
+		p.apply("students", reflect.ValueOf(&students[i]).Elem())
+	}
+}
+
+func (p *PIIPolicy) ApplyToStaff(staff []Staff) {
+	if p == nil || len(p.applied) == 0 {
+		return
+	}
+	for i := range staff {
+		p.apply("staff", reflect.ValueOf(&staff[i]).Elem())
+	}
+}
+
+func (p *PIIPolicy) apply(entity string, record reflect.Value) {
+	for _, r := range p.applied {
+		if r.Entity != entity {
+			continue
+		}
+		for _, v := range piiValues(record, r.Field) {
+			switch r.Action {
+			case PIIDrop:
+				v.Set(reflect.Zero(v.Type()))
+			case PIIHash:
+				if s, ok := piiString(v); ok {
+					setPIIString(v, p.Hash(s))
+				}
+			case PIITruncate:
+				truncatePII(r.Field, v)
+			}
+		}
+	}
+}
+
+// Each truncation keeps its own output unchanged, so data truncated by the primary database's policy is safe to pass through it again
+func truncatePII(field string, v reflect.Value) {
+	if field == "res" {
+		// Keep only the postcode, and the ref that identifies the residence
+		for i := 0; i < v.Len(); i++ {
+			r := v.Index(i)
+			for j := 0; j < r.NumField(); j++ {
+				f := r.Field(j)
+				if name := r.Type().Field(j).Name; name != "Ref" && name != "Postcode" && f.Kind() == reflect.Pointer {
+					f.Set(reflect.Zero(f.Type()))
+				}
+			}
+		}
+		return
+	}
+
+	if PIITruncation(field) == "year only" {
+		if v.Kind() == reflect.Pointer && !v.IsNil() && v.Elem().Kind() == reflect.Int && v.Elem().Int() >= 10000 {
+			year := int(v.Elem().Int() / 10000)
+			v.Set(reflect.ValueOf(&year))
+		}
+		return
+	}
+
+	s, ok := piiString(v)
+	if !ok {
+		return
+	}
+	switch PIITruncation(field) {
+	case "domain only":
+		if i := strings.LastIndex(s, "@"); i >= 0 {
+			s = s[i:]
+		}
+	case "first 3 digits":
+		digits := strings.Map(func(r rune) rune {
+			if unicode.IsDigit(r) {
+				return r
+			}
+			return -1
+		}, s)
+		if len(digits) > 3 {
+			digits = digits[:3]
+		}
+		s = digits
+	case "street name only":
+		// Leave out the leading words that hold a number, eg. "12A" or "3/45"
+		words := strings.Fields(s)
+		for len(words) > 1 && strings.IndexFunc(words[0], unicode.IsDigit) >= 0 {
+			words = words[1:]
+		}
+		s = strings.Join(words, " ")
+	case "initial only":
+		for _, r := range s {
+			s = string(r) + "."
+			break
+		}
+	}
+	setPIIString(v, s)
+}
+
+// CountStored counts the rows of a listener table that hold a value in column, or all of its rows if column is empty. table and column must come from PIIColumn, never from a request.
+func (db *ListenerDB) CountStored(table, column string) (int, error) {
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM %s`, table)
+	if column != "" {
+		query += fmt.Sprintf(` WHERE %s IS NOT NULL`, column)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var n int
+	err := db.QueryRowContext(ctx, query).Scan(&n)
+	return n, err
+}
+
+// ClearStored removes the values already stored for a field that has been dropped - setting its column to NULL, or deleting every row if column is empty. table and column must come from PIIColumn, never from a request.
+func (db *ListenerDB) ClearStored(table, column string) (int64, error) {
+	query := fmt.Sprintf(`DELETE FROM %s`, table)
+	if column != "" {
+		query = fmt.Sprintf(`UPDATE %s SET %s = NULL WHERE %s IS NOT NULL`, table, column, column)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// The group a field belongs to, eg. caregivers for caregiver.mobile and caregivers1
+func piiGroupOf(field string) (string, bool) {
+	for name, g := range piiGroups {
+		if field != name && strings.HasPrefix(field, g.prefix) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func piiRecordType(entity string) reflect.Type {
+	if entity == "staff" {
+		return reflect.TypeOf(Staff{})
+	}
+	return reflect.TypeOf(Student{})
+}
+
+// Find a struct field by the name KAMAR uses for it, which is usually its json tag
+func piiFieldIndex(t reflect.Type, name string) (int, bool) {
+	if name == "" {
+		return 0, false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if strings.EqualFold(tag, name) || strings.EqualFold(f.Name, name) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Split a field into the struct field of its record, and for fields within a group, the struct field of each member of the group
+func piiFieldPath(field string) (outer, inner string) {
+	if g, ok := piiGroups[field]; ok {
+		return g.field, ""
+	}
+	prefix, sub, nested := strings.Cut(field, ".")
+	if !nested {
+		return field, ""
+	}
+	for _, g := range piiGroups {
+		if g.prefix == prefix {
+			return g.field, sub
+		}
+	}
+	return "", ""
+}
+
+func piiFieldType(entity, field string) (reflect.Type, bool) {
+	t := piiRecordType(entity)
+	outer, inner := piiFieldPath(field)
+
+	i, ok := piiFieldIndex(t, outer)
+	if !ok {
+		return nil, false
+	}
+	t = t.Field(i).Type
+	if inner == "" {
+		return t, true
+	}
+
+	if t.Kind() == reflect.Slice || t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, false
+	}
+	i, ok = piiFieldIndex(t, inner)
+	if !ok {
+		return nil, false
+	}
+	return t.Field(i).Type, true
+}
+
+func piiHashable(entity, field string) bool {
+	t, ok := piiFieldType(entity, field)
+	if !ok {
+		return false
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.String
+}
+
+// The settable values a field refers to within a record - one for each member of a group, eg. the mobile of every caregiver
+func piiValues(record reflect.Value, field string) []reflect.Value {
+	outer, inner := piiFieldPath(field)
+
+	i, ok := piiFieldIndex(record.Type(), outer)
+	if !ok {
+		return nil
+	}
+	v := record.Field(i)
+	if inner == "" {
+		return []reflect.Value{v}
+	}
+
+	var members []reflect.Value
+	switch v.Kind() {
+	case reflect.Slice:
+		for j := 0; j < v.Len(); j++ {
+			members = append(members, v.Index(j))
+		}
+	case reflect.Pointer:
+		if !v.IsNil() {
+			members = append(members, v.Elem())
+		}
+	}
+
+	var values []reflect.Value
+	for _, m := range members {
+		if m.Kind() != reflect.Struct {
+			continue
+		}
+		if j, ok := piiFieldIndex(m.Type(), inner); ok {
+			values = append(values, m.Field(j))
+		}
+	}
+	return values
+}
+
+func piiString(v reflect.Value) (string, bool) {
+	switch {
+	case v.Kind() == reflect.String:
+		return v.String(), v.String() != ""
+	case v.Kind() == reflect.Pointer && !v.IsNil() && v.Elem().Kind() == reflect.String:
+		return v.Elem().String(), true
+	}
+	return "", false
+}
+
+func setPIIString(v reflect.Value, s string) {
+	if v.Kind() == reflect.String {
+		v.SetString(s)
+		return
+	}
+	v.Set(reflect.ValueOf(&s))
+}
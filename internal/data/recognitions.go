@@ -1,7 +1,6 @@
 package data
 
 import (
-	"database/sql"
 	"strconv"
 	"strings"
 )
@@ -24,7 +23,7 @@ type Recognition struct {
 }
 
 type RecognitionsModel struct {
-	DB *sql.DB
+	DB *ListenerDB
 }
 
 func (m *RecognitionsModel) InsertManyRecognitions(recognitions []Recognition) error {
@@ -36,7 +35,7 @@ func (m *RecognitionsModel) InsertManyRecognitions(recognitions []Recognition) e
 	defer tx.Rollback() // Rollback transaction if there's an error
 
 	stmt, err := tx.Prepare(`
-	INSERT INTO recognitions (count, id, nsn, uuid, date, slot, term, week, subject, user, points, comment, values)
+	INSERT INTO recognitions (count, id, nsn, uuid, date, slot, term, week, subject, "user", points, comment, "values")
 	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
 	ON CONFLICT(id, date, slot) DO UPDATE SET
 		count = excluded.count,
@@ -45,10 +44,10 @@ func (m *RecognitionsModel) InsertManyRecognitions(recognitions []Recognition) e
 		term = excluded.term,
 		week = excluded.week,
 		subject = excluded.subject,
-		user = excluded.user,
+		"user" = excluded."user",
 		points = excluded.points,
 		comment = excluded.comment,
-		values = excluded.values,
+		"values" = excluded."values",
 		listener_updated_at = (datetime('now'))
 	;`)
 	if err != nil {
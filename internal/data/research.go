@@ -0,0 +1,324 @@
+package data
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ResearchFormats = []string{"csv", "sqlite"}
+
+// Tables included in a research export. Tables holding little but direct identifiers or contact details (caregivers, emergency contacts, residences, staff, photos) are left out entirely.
+var ResearchTables = []string{"students", "student_groups", "student_awards", "attendance", "attendance_values", "results", "assessments", "subjects", "pastoral", "recognitions", "class_efforts", "timetables"}
+
+// Columns holding an identifier for a student or staff member, which are replaced by a pseudonym in every table they appear in, so rows can still be joined across tables
+var researchPseudonymColumns = map[string]bool{
+	"nsn": true, "uuid": true, "username": true, "uniqueid": true, "siblinglink": true,
+	"student_id": true, "student_uuid": true, "att_student_id": true, "student": true,
+	"teacher": true, "tutor": true, "user": true,
+}
+
+// Tables where the id column identifies a student, rather than eg. a subject
+var researchPseudonymIDTables = map[string]bool{"students": true, "results": true}
+
+// Columns holding direct identifiers, or free text that may name someone, which are left out
+var researchDroppedColumns = map[string]bool{
+	"firstname": true, "firstnamelegal": true, "lastname": true, "lastnamelegal": true, "forenames": true, "forenameslegal": true,
+	"email": true, "mobile": true, "photocopierid": true, "byodinfo": true, "altdescription": true, "althomedrive": true, "custom": true,
+	"comment": true, "notes": true, "reason": true, "motivation": true, "others_involved": true, "action1": true, "action2": true, "action3": true,
+}
+
+// ResearchAggregate is a summary included in a research export. The last column of its query must be a count, so that small counts can be suppressed.
+type ResearchAggregate struct {
+	Name  string
+	Query string
+}
+
+var ResearchAggregates = []ResearchAggregate{
+	{"students_by_yearlevel", `SELECT yearlevel, gender, ethnicityL1, COUNT(*) AS students FROM students GROUP BY yearlevel, gender, ethnicityL1 ORDER BY yearlevel, gender, ethnicityL1`},
+	{"results_by_standard", `SELECT year, number, result, COUNT(DISTINCT nsn) AS students FROM results GROUP BY year, number, result ORDER BY year, number, result`},
+	{"pastoral_by_type", `SELECT type, COUNT(DISTINCT student_id) AS students FROM pastoral GROUP BY type ORDER BY type`},
+}
+
+// ResearchKeyModel holds the key research pseudonyms are made with. It is kept in app.db, separate from the listener data, so pseudonyms stay the same across exports but can't be reversed by anyone holding only an export.
+type ResearchKeyModel struct {
+	DB *sql.DB
+}
+
+func (m *ResearchKeyModel) Get() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var key string
+	err := m.DB.QueryRowContext(ctx, `SELECT key FROM research_key WHERE id = 1;`).Scan(&key)
+	if err != nil {
+		return nil, err
+	}
+
+	return hex.DecodeString(key)
+}
+
+// ResearchPseudonym returns the pseudonym for an identifier. Values are compared as text, so a student id stored as an integer in one table and as text in another gets the same pseudonym.
+func ResearchPseudonym(key []byte, value any) any {
+	if value == nil {
+		return nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(exportValueToString(value)))
+	return hex.EncodeToString(mac.Sum(nil))[:20]
+}
+
+// WriteResearchCSV writes a table as CSV with identifiers pseudonymised, direct identifiers left out, and students who haven't consented to other uses of their data left out. table must be one of ResearchTables.
+func (m *ExportModel) WriteResearchCSV(table string, key []byte, consent *Consent, w io.Writer) (int, error) {
+	cw := csv.NewWriter(w)
+	count, err := m.readResearchTable(table, key, consent, csvRows(cw))
+	if err != nil {
+		return count, err
+	}
+	cw.Flush()
+	return count, cw.Error()
+}
+
+// WriteResearchSQLite copies a table to dst with identifiers pseudonymised and direct identifiers and students who haven't consented left out, as WriteResearchCSV does. table must be one of ResearchTables.
+func (m *ExportModel) WriteResearchSQLite(table string, key []byte, consent *Consent, dst *sql.DB) (int, error) {
+	tx, err := dst.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	count, err := m.readResearchTable(table, key, consent, sqliteRows(tx, table))
+	if err != nil {
+		return count, err
+	}
+	return count, tx.Commit()
+}
+
+// WriteResearchAggregateCSV writes a summary as CSV, replacing any count below minCell with "<minCell" so that small groups of students can't be singled out
+func (m *ExportModel) WriteResearchAggregateCSV(a ResearchAggregate, minCell int, w io.Writer) (int, error) {
+	cw := csv.NewWriter(w)
+	count, err := m.readResearchAggregate(a, minCell, csvRows(cw))
+	if err != nil {
+		return count, err
+	}
+	cw.Flush()
+	return count, cw.Error()
+}
+
+// WriteResearchAggregateSQLite writes a summary to a table of dst, suppressing counts below minCell as WriteResearchAggregateCSV does
+func (m *ExportModel) WriteResearchAggregateSQLite(a ResearchAggregate, minCell int, dst *sql.DB) (int, error) {
+	tx, err := dst.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	count, err := m.readResearchAggregate(a, minCell, sqliteRows(tx, a.Name))
+	if err != nil {
+		return count, err
+	}
+	return count, tx.Commit()
+}
+
+// Receives the columns, then each row, of a table or summary being exported
+type researchRowWriter func(columns []string, values []any) error
+
+func csvRows(cw *csv.Writer) researchRowWriter {
+	return func(columns []string, values []any) error {
+		if values == nil {
+			return cw.Write(columns)
+		}
+		record := make([]string, len(values))
+		for i, v := range values {
+			record[i] = exportValueToString(v)
+		}
+		return cw.Write(record)
+	}
+}
+
+// Columns are created without a type, so each value keeps the type it had in the listener database
+func sqliteRows(tx *sql.Tx, table string) researchRowWriter {
+	var stmt *sql.Stmt
+	return func(columns []string, values []any) error {
+		if values == nil {
+			quoted := make([]string, len(columns))
+			placeholders := make([]string, len(columns))
+			for i, c := range columns {
+				quoted[i] = `"` + c + `"`
+				placeholders[i] = "?"
+			}
+			if _, err := tx.Exec(fmt.Sprintf(`CREATE TABLE "%s" (%s);`, table, strings.Join(quoted, ", "))); err != nil {
+				return err
+			}
+			var err error
+			stmt, err = tx.Prepare(fmt.Sprintf(`INSERT INTO "%s" VALUES (%s);`, table, strings.Join(placeholders, ", ")))
+			return err
+		}
+		_, err := stmt.Exec(values...)
+		return err
+	}
+}
+
+func (m *ExportModel) readResearchTable(table string, key []byte, consent *Consent, write researchRowWriter) (int, error) {
+	if !researchTable(table) {
+		return 0, fmt.Errorf("%s can't be included in a research export", table)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, fmt.Sprintf(`SELECT * FROM "%s";`, table))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	// The position of each column that is written, and whether it is pseudonymised
+	var kept []int
+	var keptNames []string
+	pseudonymise := make(map[int]bool)
+	for i, c := range columns {
+		name := strings.ToLower(c)
+		if researchDroppedColumns[name] || name == "listener_updated_at" {
+			continue
+		}
+		if researchPseudonymColumns[name] || name == "id" && researchPseudonymIDTables[table] {
+			pseudonymise[i] = true
+		}
+		kept = append(kept, i)
+		keptNames = append(keptNames, c)
+	}
+	if err := write(keptNames, nil); err != nil {
+		return 0, err
+	}
+
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	record := make([]any, len(kept))
+	shared := consent.Filter(table, columns, ConsentResearch)
+
+	count := 0
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return count, err
+		}
+		if err := m.DB.Cipher.OpenValues(values); err != nil {
+			return count, fmt.Errorf("couldn't decrypt %s: %w", table, err)
+		}
+		if !shared(values) {
+			continue
+		}
+		for j, i := range kept {
+			v := values[i]
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			switch {
+			case pseudonymise[i]:
+				v = ResearchPseudonym(key, v)
+			case strings.EqualFold(columns[i], "datebirth"):
+				v = researchBirthYear(v)
+			}
+			record[j] = v
+		}
+		if err := write(nil, record); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, rows.Err()
+}
+
+func (m *ExportModel) readResearchAggregate(a ResearchAggregate, minCell int, write researchRowWriter) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, a.Query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if len(columns) == 0 {
+		return 0, errors.New("research summary has no columns")
+	}
+	if err := write(columns, nil); err != nil {
+		return 0, err
+	}
+
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	count := 0
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return count, err
+		}
+		// Grouped columns may be encrypted - as encryption is deterministic, the groups are still correct once decrypted
+		if err := m.DB.Cipher.OpenValues(values); err != nil {
+			return count, fmt.Errorf("couldn't decrypt %s: %w", a.Name, err)
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		last := len(values) - 1
+		if n, err := strconv.Atoi(exportValueToString(values[last])); err == nil && n < minCell {
+			values[last] = "<" + strconv.Itoa(minCell)
+		}
+		if err := write(nil, values); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, rows.Err()
+}
+
+func researchTable(table string) bool {
+	for _, t := range ResearchTables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// Dates of birth are reduced to the year, which is enough to work out age cohorts
+func researchBirthYear(v any) any {
+	s := exportValueToString(v)
+	if len(s) < 4 {
+		return nil
+	}
+	year, err := strconv.Atoi(s[:4])
+	if err != nil {
+		return nil
+	}
+	return int64(year)
+}
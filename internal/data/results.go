@@ -32,7 +32,7 @@ type Result struct {
 }
 
 type ResultModel struct {
-	DB *sql.DB
+	DB *ListenerDB
 }
 
 func (r *Result) CreateTNV() {
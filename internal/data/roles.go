@@ -0,0 +1,49 @@
+package data
+
+import (
+	"slices"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+)
+
+// Roles a user can be given, from most to least able
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleViewer   = "viewer"
+)
+
+var Roles = []string{RoleAdmin, RoleOperator, RoleViewer}
+
+// Permission is something a route requires the user's role to allow
+type Permission string
+
+const (
+	// See the dashboard, logs, help and the changes feed
+	PermissionView Permission = "view"
+	// Run exports, prune logs and manage webhooks, replication sinks and backups - everything that keeps data flowing without changing how it is received
+	PermissionOperate Permission = "operate"
+	// Change KAMAR credentials, the listener's config and PII policy, switch JSON mode and restore backups
+	PermissionConfigure Permission = "configure"
+	// Register users and assign their roles
+	PermissionManageUsers Permission = "manage_users"
+	// Look up and erase students for Privacy Act requests, and override students' datasharing consent
+	PermissionPrivacy Permission = "privacy"
+	// Read the audit trail
+	PermissionAudit Permission = "audit"
+)
+
+var rolePermissions = map[string][]Permission{
+	RoleAdmin:    {PermissionView, PermissionOperate, PermissionConfigure, PermissionManageUsers, PermissionPrivacy, PermissionAudit},
+	RoleOperator: {PermissionView, PermissionOperate},
+	RoleViewer:   {PermissionView},
+}
+
+// Can reports whether the user's role grants permission. Anonymous users have no role, so can't do anything.
+func (u *User) Can(permission Permission) bool {
+	return slices.Contains(rolePermissions[u.Role], permission)
+}
+
+func ValidateRole(v *validator.Validator, role string) {
+	v.Check(validator.In(role, Roles...), "role", "must be one of admin, operator or viewer")
+}
@@ -0,0 +1,147 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"time"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+)
+
+// ReplicationSink is a secondary database that every batch written to the listener database is copied to, eg. another SQLite file on a second disk or network share, or a Postgres server
+type ReplicationSink struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Driver string `json:"driver"`
+	// DSN is a file path for SQLite sinks, and a connection string (which may hold a password) for Postgres sinks
+	DSN     string `json:"-"`
+	Enabled bool   `json:"enabled"`
+	// NeedsResync is set when the sink has missed batches, eg. because it was unreachable, and is cleared once the whole listener database has been copied to it again
+	NeedsResync bool      `json:"needs_resync"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Target describes where the sink writes to without revealing any password in its DSN
+func (s ReplicationSink) Target() string {
+	if Dialect(s.Driver) == DialectSQLite {
+		return s.DSN
+	}
+	if u, err := url.Parse(s.DSN); err == nil && u.Host != "" {
+		return u.Redacted()
+	}
+	return "postgres connection string"
+}
+
+// SinkStatus is a point in time view of a sink's replication, for display on the dashboard
+type SinkStatus struct {
+	ID          int
+	Name        string
+	Target      string
+	Pending     int
+	Lag         time.Duration
+	LastApplied time.Time
+	LastError   string
+	LastErrorAt time.Time
+	NeedsResync bool
+	Resyncing   bool
+}
+
+type ReplicationSinkModel struct {
+	DB *sql.DB
+}
+
+func ValidateReplicationSink(v *validator.Validator, s *ReplicationSink) {
+	v.Check(s.Name != "", "name", "must be provided")
+	v.Check(len(s.Name) <= 100, "name", "must not be more than 100 characters long")
+	v.Check(validator.In(s.Driver, Dialects...), "driver", "must be sqlite or postgres")
+	v.Check(s.DSN != "", "dsn", "must be provided")
+}
+
+func (m *ReplicationSinkModel) Insert(s *ReplicationSink) error {
+	query := `
+		INSERT INTO replication_sinks (name, driver, dsn, enabled, needs_resync)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var createdAt string
+	err := m.DB.QueryRowContext(ctx, query, s.Name, s.Driver, s.DSN, s.Enabled, s.NeedsResync).Scan(&s.ID, &createdAt)
+	if err != nil {
+		return err
+	}
+	s.CreatedAt, _ = time.Parse(time.DateTime, createdAt)
+
+	return nil
+}
+
+func (m *ReplicationSinkModel) GetAll() ([]ReplicationSink, error) {
+	query := `SELECT id, name, driver, dsn, enabled, needs_resync, created_at FROM replication_sinks ORDER BY id;`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sinks []ReplicationSink
+	for rows.Next() {
+		var s ReplicationSink
+		var createdAt string
+		if err := rows.Scan(&s.ID, &s.Name, &s.Driver, &s.DSN, &s.Enabled, &s.NeedsResync, &createdAt); err != nil {
+			return nil, err
+		}
+		s.CreatedAt, _ = time.Parse(time.DateTime, createdAt)
+		sinks = append(sinks, s)
+	}
+
+	return sinks, rows.Err()
+}
+
+func (m *ReplicationSinkModel) SetNeedsResync(id int, needsResync bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `UPDATE replication_sinks SET needs_resync = $1 WHERE id = $2;`, needsResync, id)
+	return err
+}
+
+func (m *ReplicationSinkModel) Delete(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM replication_sinks WHERE id = $1;`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// State summarises the sink's replication in a word or two, for display
+func (s SinkStatus) State() string {
+	switch {
+	case s.Resyncing:
+		return "resyncing"
+	case s.NeedsResync:
+		return "needs resync"
+	case s.Pending > 0:
+		return "behind"
+	default:
+		return "up to date"
+	}
+}
@@ -40,10 +40,18 @@ type Staff struct {
 type SchoolIndex int
 
 type StaffModel struct {
-	DB *sql.DB
+	DB  *ListenerDB
+	PII PIIPolicyModel
 }
 
 func (m *StaffModel) InsertManyStaff(staff []Staff) error {
+	// Minimise personal information according to the PII policy before anything is written
+	policy, err := m.PII.Load()
+	if err != nil {
+		return err
+	}
+	policy.ApplyToStaff(staff)
+
 	// Start a transaction (tx)
 	tx, err := m.DB.Begin()
 	if err != nil {
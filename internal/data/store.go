@@ -0,0 +1,296 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Dialect identifies the database engine holding the data received from KAMAR. app.db is always SQLite, but the listener tables can be stored in PostgreSQL for schools that want KAMAR data alongside their other systems.
+type Dialect string
+
+const (
+	DialectSQLite   Dialect = "sqlite"
+	DialectPostgres Dialect = "postgres"
+)
+
+var Dialects = []string{string(DialectSQLite), string(DialectPostgres)}
+
+// ListenerDB is the connection to the listener database. Model queries are written once in SQLite's syntax, and ListenerDB rewrites them for the configured dialect before they are run, so both backends share the same ingestion code.
+type ListenerDB struct {
+	*sql.DB
+	Dialect Dialect
+	// Cipher, if set, encrypts values written to sensitive columns through prepared statements
+	Cipher *FieldCipher
+}
+
+func NewListenerDB(db *sql.DB, dialect Dialect) *ListenerDB {
+	return &ListenerDB{DB: db, Dialect: dialect}
+}
+
+// ListenerTx is a transaction on a ListenerDB, rewriting queries in the same way. Every method of sql.Tx that takes a query is wrapped, as the embedded ones would run it unchanged.
+type ListenerTx struct {
+	*sql.Tx
+	dialect Dialect
+	cipher  *FieldCipher
+}
+
+var (
+	datetimeNow         = regexp.MustCompile(`datetime\('now'\)`)
+	datetimeNowModifier = regexp.MustCompile(`datetime\('now',\s*'([+-]?\d+) (\w+)'\)`)
+	insertOrIgnore      = regexp.MustCompile(`(?is)INSERT\s+OR\s+IGNORE\s+INTO(.*?);?\s*$`)
+)
+
+// PostgresNow is Postgres' equivalent of datetime('now') - listener_updated_at is stored as TEXT in the same format in both dialects, so values can be compared as strings (eg. by incremental exports)
+const PostgresNow = `to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')`
+
+// Rebind rewrites a query written for SQLite so it can be run against d. Only the SQLite-specific syntax used by the listener models is handled: datetime('now'[, modifier]), INSERT OR IGNORE, and ? placeholders.
+func (d Dialect) Rebind(query string) string {
+	if d != DialectPostgres {
+		return query
+	}
+
+	query = datetimeNowModifier.ReplaceAllString(query, `to_char(now() AT TIME ZONE 'UTC' + interval '$1 $2', 'YYYY-MM-DD HH24:MI:SS')`)
+	query = datetimeNow.ReplaceAllString(query, PostgresNow)
+	query = insertOrIgnore.ReplaceAllString(query, `INSERT INTO$1 ON CONFLICT DO NOTHING;`)
+
+	return rebindPlaceholders(query)
+}
+
+// Replace ? placeholders with $1, $2 etc., skipping any inside quoted strings or identifiers
+func rebindPlaceholders(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+func (db *ListenerDB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(db.Dialect.Rebind(query), args...)
+}
+
+func (db *ListenerDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return db.DB.ExecContext(ctx, db.Dialect.Rebind(query), args...)
+}
+
+func (db *ListenerDB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.DB.Query(db.Dialect.Rebind(query), args...)
+}
+
+func (db *ListenerDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return db.DB.QueryContext(ctx, db.Dialect.Rebind(query), args...)
+}
+
+func (db *ListenerDB) QueryRow(query string, args ...any) *sql.Row {
+	return db.DB.QueryRow(db.Dialect.Rebind(query), args...)
+}
+
+func (db *ListenerDB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return db.DB.QueryRowContext(ctx, db.Dialect.Rebind(query), args...)
+}
+
+func (db *ListenerDB) Prepare(query string) (*ListenerStmt, error) {
+	stmt, err := db.DB.Prepare(db.Dialect.Rebind(query))
+	if err != nil {
+		return nil, err
+	}
+	table, sealed := db.Cipher.sealedArgs(query)
+	return &ListenerStmt{Stmt: stmt, cipher: db.Cipher, table: table, sealed: sealed}, nil
+}
+
+func (db *ListenerDB) PrepareContext(ctx context.Context, query string) (*ListenerStmt, error) {
+	stmt, err := db.DB.PrepareContext(ctx, db.Dialect.Rebind(query))
+	if err != nil {
+		return nil, err
+	}
+	table, sealed := db.Cipher.sealedArgs(query)
+	return &ListenerStmt{Stmt: stmt, cipher: db.Cipher, table: table, sealed: sealed}, nil
+}
+
+func (db *ListenerDB) Begin() (*ListenerTx, error) {
+	return db.BeginTx(context.Background(), nil)
+}
+
+func (db *ListenerDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*ListenerTx, error) {
+	tx, err := db.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &ListenerTx{Tx: tx, dialect: db.Dialect, cipher: db.Cipher}, nil
+}
+
+func (tx *ListenerTx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.Rebind(query), args...)
+}
+
+func (tx *ListenerTx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return tx.Tx.ExecContext(ctx, tx.dialect.Rebind(query), args...)
+}
+
+func (tx *ListenerTx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.dialect.Rebind(query), args...)
+}
+
+func (tx *ListenerTx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.QueryContext(ctx, tx.dialect.Rebind(query), args...)
+}
+
+func (tx *ListenerTx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.Rebind(query), args...)
+}
+
+func (tx *ListenerTx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRowContext(ctx, tx.dialect.Rebind(query), args...)
+}
+
+func (tx *ListenerTx) Prepare(query string) (*ListenerStmt, error) {
+	return tx.PrepareContext(context.Background(), query)
+}
+
+func (tx *ListenerTx) PrepareContext(ctx context.Context, query string) (*ListenerStmt, error) {
+	stmt, err := tx.Tx.PrepareContext(ctx, tx.dialect.Rebind(query))
+	if err != nil {
+		return nil, err
+	}
+	table, sealed := tx.cipher.sealedArgs(query)
+	return &ListenerStmt{Stmt: stmt, cipher: tx.cipher, table: table, sealed: sealed}, nil
+}
+
+// Column is a column of a listener table, with its declared type
+type Column struct {
+	Name string
+	Type string
+}
+
+// Columns returns the columns of table in the order they were declared, or none if the table doesn't exist
+func (db *ListenerDB) Columns(ctx context.Context, table string) ([]Column, error) {
+	query := `SELECT name, type FROM pragma_table_info($1);`
+	if db.Dialect == DialectPostgres {
+		query = `
+			SELECT column_name, data_type FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = $1
+			ORDER BY ordinal_position;
+		`
+	}
+
+	rows, err := db.QueryContext(ctx, query, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []Column
+	for rows.Next() {
+		var col Column
+		if err := rows.Scan(&col.Name, &col.Type); err != nil {
+			return nil, err
+		}
+		columns = append(columns, col)
+	}
+
+	return columns, rows.Err()
+}
+
+// CopyTable replaces every row of table in dst with the rows of table in src, returning the number of rows copied. Only columns that exist in both are copied - column names are matched case insensitively, as Postgres folds unquoted names to lower case. table must come from a trusted list (eg. ExportModel.GetExportableTables), as it is interpolated into queries.
+func CopyTable(src, dst *ListenerDB, table string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	dstColumns, err := dst.Columns(ctx, table)
+	if err != nil {
+		return 0, err
+	}
+	if len(dstColumns) == 0 {
+		return 0, fmt.Errorf("table %s doesn't exist in destination", table)
+	}
+	dstNames := make(map[string]string, len(dstColumns))
+	for _, col := range dstColumns {
+		dstNames[strings.ToLower(col.Name)] = col.Name
+	}
+
+	rows, err := src.QueryContext(ctx, fmt.Sprintf(`SELECT * FROM "%s";`, table))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	srcColumns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	// Index of each source column to copy, and the name it has in dst
+	var copyIndexes []int
+	var names []string
+	for i, col := range srcColumns {
+		if name, ok := dstNames[strings.ToLower(col)]; ok {
+			copyIndexes = append(copyIndexes, i)
+			names = append(names, `"`+name+`"`)
+		}
+	}
+
+	tx, err := dst.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM "%s";`, table)); err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare(fmt.Sprintf(`INSERT INTO "%s" (%s) VALUES (%s);`, table, strings.Join(names, ", "), placeholders(len(names))))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	values := make([]any, len(srcColumns))
+	pointers := make([]any, len(srcColumns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	args := make([]any, len(copyIndexes))
+
+	count := 0
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return count, err
+		}
+		for i, idx := range copyIndexes {
+			args[i] = values[idx]
+		}
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+
+	return count, tx.Commit()
+}
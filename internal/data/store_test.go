@@ -0,0 +1,82 @@
+package data
+
+import (
+	"context"
+	"testing"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+)
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect Dialect
+		query   string
+		want    string
+	}{
+		{
+			name:    "SQLite queries are unchanged",
+			dialect: DialectSQLite,
+			query:   `SELECT 1 FROM results WHERE id = ? AND listener_updated_at >= datetime('now', '-1 day');`,
+			want:    `SELECT 1 FROM results WHERE id = ? AND listener_updated_at >= datetime('now', '-1 day');`,
+		},
+		{
+			name:    "Placeholders",
+			dialect: DialectPostgres,
+			query:   `SELECT 1 FROM staff_groups WHERE staff_uuid = ? AND name = ? AND ref != '?' LIMIT 1;`,
+			want:    `SELECT 1 FROM staff_groups WHERE staff_uuid = $1 AND name = $2 AND ref != '?' LIMIT 1;`,
+		},
+		{
+			name:    "Timestamps",
+			dialect: DialectPostgres,
+			query:   `UPDATE subjects SET listener_updated_at = (datetime('now')) WHERE listener_updated_at < datetime('now', '-1 day');`,
+			want:    `UPDATE subjects SET listener_updated_at = (` + PostgresNow + `) WHERE listener_updated_at < to_char(now() AT TIME ZONE 'UTC' + interval '-1 day', 'YYYY-MM-DD HH24:MI:SS');`,
+		},
+		{
+			name:    "Insert or ignore",
+			dialect: DialectPostgres,
+			query: `
+	INSERT OR IGNORE INTO attendance (student_id, nsn) VALUES ($1, $2);`,
+			want: `
+	INSERT INTO attendance (student_id, nsn) VALUES ($1, $2) ON CONFLICT DO NOTHING;`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.dialect.Rebind(tt.query), tt.want)
+		})
+	}
+}
+
+func TestListenerTxRebinds(t *testing.T) {
+	// A SQLite connection posing as Postgres - SQLite can't run Postgres' timestamp syntax, so a query only fails if it was rewritten
+	db := NewListenerDB(newTestDBInMemory(t), DialectPostgres)
+	defer db.Close()
+
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	assert.NilError(t, err)
+	defer tx.Rollback()
+
+	query := `SELECT datetime('now');`
+	var now string
+	assert.NilError(t, tx.Tx.QueryRowContext(ctx, query).Scan(&now))
+
+	rewritten := func(err error) {
+		t.Helper()
+		if err == nil {
+			t.Errorf("got: nil; expected the query to have been rewritten for Postgres")
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, query)
+	rewritten(err)
+	_, err = tx.QueryContext(ctx, query)
+	rewritten(err)
+	rewritten(tx.QueryRowContext(ctx, query).Scan(&now))
+	_, err = tx.PrepareContext(ctx, query)
+	rewritten(err)
+	_, err = db.PrepareContext(ctx, query)
+	rewritten(err)
+}
@@ -176,10 +176,18 @@ type Residence struct {
 }
 
 type StudentModel struct {
-	DB *sql.DB
+	DB  *ListenerDB
+	PII PIIPolicyModel
 }
 
 func (m *StudentModel) InsertManyStudents(students []Student) error {
+	// Minimise personal information according to the PII policy before anything is written
+	policy, err := m.PII.Load()
+	if err != nil {
+		return err
+	}
+	policy.ApplyToStudents(students)
+
 	// Start a transaction (tx)
 	tx, err := m.DB.Begin()
 	if err != nil {
@@ -0,0 +1,462 @@
+package data
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+)
+
+// Every listener table holding records about a student, and the column holding the student's id, in the order they are erased - child tables before students
+var subjectTables = []struct{ table, column string }{
+	{"student_awards", "student_id"},
+	{"student_caregivers", "student_id"},
+	{"student_datasharing", "student_id"},
+	{"student_emergency", "student_id"},
+	{"student_flags", "student_id"},
+	{"student_groups", "student_id"},
+	{"student_residences", "student_id"},
+	{"attendance_values", "att_student_id"},
+	{"attendance", "student_id"},
+	{"results", "id"},
+	{"pastoral", "student_id"},
+	{"recognitions", "student_id"},
+	{"class_efforts", "student_id"},
+	{"timetables", "student"},
+	{"photos", "id"},
+	{"students", "id"},
+}
+
+type SubjectMatch struct {
+	ID        int
+	UUID      string
+	NSN       string
+	Firstname string
+	Lastname  string
+	YearLevel string
+}
+
+type SubjectTable struct {
+	Name    string
+	Columns []string
+	Rows    [][]string
+}
+
+// SubjectRecord is everything the listener holds about one student, as provided in response to a Privacy Act request
+type SubjectRecord struct {
+	StudentID   int
+	GeneratedAt time.Time
+	Tables      []SubjectTable
+}
+
+// JSON returns the record with each row as an object of column names to values, which is easier to read than columns and rows kept apart
+func (r *SubjectRecord) JSON() map[string]any {
+	tables := make(map[string][]map[string]string, len(r.Tables))
+	for _, t := range r.Tables {
+		rows := make([]map[string]string, 0, len(t.Rows))
+		for _, row := range t.Rows {
+			obj := make(map[string]string, len(t.Columns))
+			for i, c := range t.Columns {
+				obj[c] = row[i]
+			}
+			rows = append(rows, obj)
+		}
+		tables[t.Name] = rows
+	}
+
+	return map[string]any{
+		"student_id":   r.StudentID,
+		"generated_at": r.GeneratedAt,
+		"tables":       tables,
+	}
+}
+
+type SubjectAccessModel struct {
+	DB *ListenerDB
+}
+
+// FindStudents looks a student up by id, NSN or name. NSNs are compared as stored, whether they are encrypted or hashed by the PII policy. Names can't be searched if they are encrypted or hashed.
+func (m *SubjectAccessModel) FindStudents(query string, policy *PIIPolicy) ([]SubjectMatch, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, nil
+	}
+
+	var conditions []string
+	var args []any
+	if id, err := strconv.Atoi(query); err == nil {
+		args = append(args, id)
+		conditions = append(conditions, fmt.Sprintf("id = $%d", len(args)))
+
+		for _, nsn := range []string{query, policy.Hash(query)} {
+			var stored any = nsn
+			if m.DB.Cipher.Encrypts("students", "nsn") {
+				sealed, err := m.DB.Cipher.Seal("students", "nsn", nsn)
+				if err != nil {
+					return nil, err
+				}
+				stored = sealed
+			}
+			args = append(args, stored)
+			conditions = append(conditions, fmt.Sprintf("nsn = $%d", len(args)))
+		}
+	} else {
+		args = append(args, "%"+strings.ToLower(query)+"%")
+		conditions = append(conditions, fmt.Sprintf("LOWER(COALESCE(firstname, '') || ' ' || COALESCE(lastname, '')) LIKE $%d", len(args)))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT id, uuid, nsn, firstname, lastname, yearlevel FROM students WHERE `+strings.Join(conditions, " OR ")+` ORDER BY lastname, firstname LIMIT 50;`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matches []SubjectMatch
+	for rows.Next() {
+		var id sql.NullInt64
+		values := make([]any, 5)
+		if err := rows.Scan(&id, &values[0], &values[1], &values[2], &values[3], &values[4]); err != nil {
+			return nil, err
+		}
+		if err := m.DB.Cipher.OpenValues(values); err != nil {
+			return nil, err
+		}
+		matches = append(matches, SubjectMatch{
+			ID:        int(id.Int64),
+			UUID:      exportValueToString(values[0]),
+			NSN:       exportValueToString(values[1]),
+			Firstname: exportValueToString(values[2]),
+			Lastname:  exportValueToString(values[3]),
+			YearLevel: exportValueToString(values[4]),
+		})
+	}
+
+	return matches, rows.Err()
+}
+
+// Collect gathers every row held about a student from each of the tables in tables that holds student records, decrypting any encrypted values
+func (m *SubjectAccessModel) Collect(studentID int, tables []string) (*SubjectRecord, error) {
+	record := &SubjectRecord{StudentID: studentID, GeneratedAt: time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	// Show the student first, then the tables their records are held in
+	for i := len(subjectTables) - 1; i >= 0; i-- {
+		st := subjectTables[i]
+		if !validator.In(st.table, tables...) {
+			continue
+		}
+
+		// Comparing as text means the id matches whether the column holds it as an integer or as text
+		rows, err := m.DB.QueryContext(ctx, fmt.Sprintf(`SELECT * FROM "%s" WHERE CAST(%s AS TEXT) = $1;`, st.table, st.column), strconv.Itoa(studentID))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", st.table, err)
+		}
+
+		t, err := m.readSubjectRows(st.table, rows)
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", st.table, err)
+		}
+		if len(t.Rows) > 0 {
+			record.Tables = append(record.Tables, t)
+		}
+	}
+
+	return record, nil
+}
+
+func (m *SubjectAccessModel) readSubjectRows(table string, rows *sql.Rows) (SubjectTable, error) {
+	t := SubjectTable{Name: table}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return t, err
+	}
+	t.Columns = columns
+
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return t, err
+		}
+		if err := m.DB.Cipher.OpenValues(values); err != nil {
+			return t, err
+		}
+		row := make([]string, len(values))
+		for i, v := range values {
+			row[i] = exportValueToString(v)
+		}
+		t.Rows = append(t.Rows, row)
+	}
+
+	return t, rows.Err()
+}
+
+// Erase deletes every row held about a student from each of the tables in tables that holds student records, in a single transaction, and returns the number of rows deleted
+func (m *SubjectAccessModel) Erase(studentID int, tables []string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var deleted int64
+	for _, st := range subjectTables {
+		if !validator.In(st.table, tables...) {
+			continue
+		}
+		result, err := tx.ExecContext(ctx, fmt.Sprintf(`DELETE FROM "%s" WHERE CAST(%s AS TEXT) = $1;`, st.table, st.column), strconv.Itoa(studentID))
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", st.table, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		deleted += n
+	}
+
+	return deleted, tx.Commit()
+}
+
+// StudentIDs returns the id of every student that any of the tables in tables holds records about
+func (m *SubjectAccessModel) StudentIDs(tables []string) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	seen := make(map[int]bool)
+	var ids []int
+	for _, st := range subjectTables {
+		if !validator.In(st.table, tables...) {
+			continue
+		}
+
+		rows, err := m.DB.QueryContext(ctx, fmt.Sprintf(`SELECT DISTINCT CAST(%s AS TEXT) FROM "%s" WHERE %s IS NOT NULL;`, st.column, st.table, st.column))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", st.table, err)
+		}
+
+		for rows.Next() {
+			var val string
+			if err := rows.Scan(&val); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			// Only ids KAMAR sent as numbers can belong to an erased student
+			id, err := strconv.Atoi(val)
+			if err != nil || seen[id] {
+				continue
+			}
+			seen[id] = true
+			ids = append(ids, id)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", st.table, err)
+		}
+	}
+
+	return ids, nil
+}
+
+// Erasure records that a student's data was erased. The student isn't identified by their id, but by a keyed hash of it, so the tombstone can stop their data being stored again without itself holding an identifier.
+type Erasure struct {
+	ID          int    `json:"id"`
+	ErasedBy    int64  `json:"erased_by"`
+	Reference   string `json:"reference"`
+	RowsDeleted int64  `json:"rows_deleted"`
+	ErasedAt    string `json:"erased_at"`
+}
+
+type ErasureModel struct {
+	DB *sql.DB
+}
+
+func ValidateErasure(v *validator.Validator, e *Erasure) {
+	v.Check(strings.TrimSpace(e.Reference) != "", "reference", "must be provided, eg. the reference of the Privacy Act request")
+	v.Check(len(e.Reference) <= 200, "reference", "must not be more than 200 characters long")
+}
+
+func (m *ErasureModel) hashKey(ctx context.Context) ([]byte, error) {
+	var key string
+	err := m.DB.QueryRowContext(ctx, `SELECT key FROM pii_hash_key WHERE id = 1;`).Scan(&key)
+	return []byte(key), err
+}
+
+func erasedStudentKey(key []byte, studentID int) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("student:" + strconv.Itoa(studentID)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Insert records the tombstone for a student. Erasing a student that was already erased (eg. because their data was sent again before the tombstone existed) updates the existing tombstone.
+func (m *ErasureModel) Insert(studentID int, e *Erasure) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	key, err := m.hashKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO erasures (student_key, erased_by, reference, rows_deleted)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT(student_key) DO UPDATE SET
+			erased_by = excluded.erased_by,
+			reference = excluded.reference,
+			rows_deleted = erasures.rows_deleted + excluded.rows_deleted,
+			erased_at = datetime('now')
+		RETURNING id, erased_at
+	`
+
+	return m.DB.QueryRowContext(ctx, query, erasedStudentKey(key, studentID), e.ErasedBy, e.Reference, e.RowsDeleted).Scan(&e.ID, &e.ErasedAt)
+}
+
+func (m *ErasureModel) GetAll() ([]Erasure, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT id, erased_by, reference, rows_deleted, erased_at FROM erasures ORDER BY id DESC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var erasures []Erasure
+	for rows.Next() {
+		var e Erasure
+		if err := rows.Scan(&e.ID, &e.ErasedBy, &e.Reference, &e.RowsDeleted, &e.ErasedAt); err != nil {
+			return nil, err
+		}
+		erasures = append(erasures, e)
+	}
+
+	return erasures, rows.Err()
+}
+
+// Tombstone is an erasure as it is stored, including the keyed hash of the student's id
+type Tombstone struct {
+	Erasure
+	studentKey string
+}
+
+// Tombstones returns every tombstone, oldest first
+func (m *ErasureModel) Tombstones() ([]Tombstone, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT id, student_key, erased_by, reference, rows_deleted, erased_at FROM erasures ORDER BY id ASC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tombstones []Tombstone
+	for rows.Next() {
+		var t Tombstone
+		if err := rows.Scan(&t.ID, &t.studentKey, &t.ErasedBy, &t.Reference, &t.RowsDeleted, &t.ErasedAt); err != nil {
+			return nil, err
+		}
+		tombstones = append(tombstones, t)
+	}
+
+	return tombstones, rows.Err()
+}
+
+// Merge writes tombstones read from another copy of app.db into this one, replacing any this one holds for the same student. Restoring a backup replaces app.db, so the tombstones read from it beforehand are merged into the restored one - otherwise an erasure made after the backup was taken would be undone. Both copies hash student ids with the same pii_hash_key, as it never changes once created.
+func (m *ErasureModel) Merge(tombstones []Tombstone) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO erasures (student_key, erased_by, reference, rows_deleted, erased_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT(student_key) DO UPDATE SET
+			erased_by = excluded.erased_by,
+			reference = excluded.reference,
+			rows_deleted = excluded.rows_deleted,
+			erased_at = excluded.erased_at
+	`
+
+	for _, t := range tombstones {
+		_, err := tx.ExecContext(ctx, query, t.studentKey, t.ErasedBy, t.Reference, t.RowsDeleted, t.ErasedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Load reads the tombstones, to check data sent by KAMAR against
+func (m *ErasureModel) Load() (*ErasedStudents, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	key, err := m.hashKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT student_key FROM erasures;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	e := &ErasedStudents{key: key, keys: make(map[string]bool)}
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		e.keys[k] = true
+	}
+
+	return e, rows.Err()
+}
+
+// ErasedStudents reports whether a student's data has been erased
+type ErasedStudents struct {
+	key  []byte
+	keys map[string]bool
+}
+
+func (e *ErasedStudents) Empty() bool {
+	return e == nil || len(e.keys) == 0
+}
+
+func (e *ErasedStudents) Has(studentID *int) bool {
+	if e.Empty() || studentID == nil {
+		return false
+	}
+	return e.keys[erasedStudentKey(e.key, *studentID)]
+}
@@ -1,7 +1,5 @@
 package data
 
-import "database/sql"
-
 type Subject struct {
 	ID                *string `json:"id,omitempty"`
 	Created           *int64  `json:"created,omitempty"`
@@ -14,7 +12,7 @@ type Subject struct {
 }
 
 type SubjectModel struct {
-	DB *sql.DB
+	DB *ListenerDB
 }
 
 // TODO: Possibly check if ID already exists, and update instead of insert in those cases - change query to ON CONFLICT? It shouldn't happen often
@@ -3,7 +3,8 @@ CREATE TABLE IF NOT EXISTS users (
   created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
   last_authenticated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
   username TEXT NOT NULL UNIQUE,
-  password_hash TEXT NOT NULL
+  password_hash TEXT NOT NULL,
+  role TEXT NOT NULL DEFAULT 'viewer'
 );
 
 -- test_user_1 pass: password
@@ -15,5 +16,7 @@ INSERT INTO users (username, password_hash) VALUES
 CREATE TABLE IF NOT EXISTS tokens (
   hash BLOB PRIMARY KEY, 
   user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE, 
-  expiry TEXT NOT NULL
+  expiry TEXT NOT NULL,
+  scope TEXT NOT NULL DEFAULT 'authentication',
+  role TEXT NOT NULL DEFAULT ''
 );
\ No newline at end of file
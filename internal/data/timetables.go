@@ -1,7 +1,5 @@
 package data
 
-import "database/sql"
-
 // TODO: Find out whether or not teacher timetables might be sent with a similar format - if so, define StudentTimetable and TeacherTimetable structs
 type Timetable struct {
 	Student           *int    `json:"student,omitempty"`
@@ -12,7 +10,7 @@ type Timetable struct {
 }
 
 type TimetableModel struct {
-	DB *sql.DB
+	DB *ListenerDB
 }
 
 func (m *TimetableModel) InsertManyTimetables(timetables []Timetable) error {
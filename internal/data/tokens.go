@@ -6,26 +6,60 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"github.com/michaelcjefferson/kamar-listener/internal/validator"
 )
 
+// Tokens are scoped to what they can be used for - signing a user in, or activating an invited user's account
+const (
+	ScopeAuthentication = "authentication"
+	ScopeActivation     = "activation"
+)
+
 // JSON tags dictate which fields will be encoded into JSON for the client, and the names  of their corresponding keys ("token" is more meaningful for the client than "plaintext")
 type Token struct {
 	Plaintext string `json:"token"`
 	Hash      []byte `json:"-"`
 	UserID    int64  `json:"-"`
 	Expiry    string `json:"expiry"`
+	Scope     string `json:"-"`
+	// The role an activation token gives the user who activates it
+	Role string `json:"-"`
+	// Where an authentication token was created from, shown on the sessions page
+	IP        string `json:"-"`
+	UserAgent string `json:"-"`
 }
 
+// A signed in user's authentication token, as listed on the sessions page. The token itself is never shown - sessions are referred to by ID.
+type Session struct {
+	ID         int64
+	UserID     int64
+	Username   string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	Expiry     time.Time
+	IP         string
+	UserAgent  string
+	// Whether this is the session the list was requested with
+	Current bool
+}
+
+// How often a session's last used time is written, so that not every request writes to the database
+const sessionTouchInterval = time.Minute
+
+// User agents are cut short before they are stored, as the client can make them any length
+const maxUserAgentLength = 256
+
 // ttl (time-to-live) is added to time.Now to create a token expiry
-func generateToken(userID int64, ttl time.Duration) (*Token, error) {
+func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
 	t := time.Now().Add(ttl).UTC().Format(time.RFC3339)
 
 	token := &Token{
 		UserID: userID,
 		Expiry: t,
+		Scope:  scope,
 	}
 
 	// crypto/rand.Read fills a byte slice with random bytes from CSPRNG. This token will have an entropy (randomness) of 16 bytes. Base32 encoding means the plaintext token itself will be 26 bytes long.
@@ -57,10 +91,42 @@ type TokenModel struct {
 
 // Whenever a token is created, the next step will be for it to be stored in the tokens table on the database. So, call m.Insert() as part of the token creation process.
 func (m *TokenModel) New(userID int64, ttl time.Duration) (*Token, error) {
-	token, err := generateToken(userID, ttl)
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// Create an authentication token for a user signing in from ip with userAgent
+func (m *TokenModel) NewSession(userID int64, ttl time.Duration, ip, userAgent string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+	token.IP = ip
+	token.UserAgent = truncateUserAgent(userAgent)
+
+	err = m.Insert(token)
+	return token, err
+}
+
+func truncateUserAgent(userAgent string) string {
+	if len(userAgent) > maxUserAgentLength {
+		return userAgent[:maxUserAgentLength]
+	}
+	return userAgent
+}
+
+// Create a token an invited user can activate their account with. There is no user for it to belong to yet, so it belongs to the user who sent the invitation, and is removed along with them.
+func (m *TokenModel) NewActivation(invitedBy int64, role string, ttl time.Duration) (*Token, error) {
+	token, err := generateToken(invitedBy, ttl, ScopeActivation)
 	if err != nil {
 		return nil, err
 	}
+	token.Role = role
 
 	err = m.Insert(token)
 	return token, err
@@ -68,12 +134,12 @@ func (m *TokenModel) New(userID int64, ttl time.Duration) (*Token, error) {
 
 func (m *TokenModel) Insert(token *Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry)
-		VALUES ($1, $2, $3);
+		INSERT INTO tokens (hash, user_id, expiry, scope, role, ip, user_agent, created_at, last_used_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, strftime('%Y-%m-%dT%H:%M:%SZ', 'now'), strftime('%Y-%m-%dT%H:%M:%SZ', 'now'));
 		
-		UPDATE users SET last_authenticated_at = datetime('now') WHERE id = $4;`
+		UPDATE users SET last_authenticated_at = datetime('now') WHERE id = $8 AND $9 = 'authentication';`
 
-	args := []any{token.Hash, token.UserID, token.Expiry, token.UserID}
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.Role, token.IP, token.UserAgent, token.UserID, token.Scope}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -82,16 +148,72 @@ func (m *TokenModel) Insert(token *Token) error {
 	return err
 }
 
-func (m *TokenModel) DeleteAllForUser(userID int64) (int64, error) {
+// Get the unexpired activation token matching tokenPlaintext
+func (m *TokenModel) GetActivation(tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		SELECT hash, user_id, expiry, scope, role
+		FROM tokens
+		WHERE hash = $1
+		AND scope = 'activation'
+		AND expiry > strftime('%Y-%m-%dT%H:%M:%SZ', 'now')
+	`
+
+	token := Token{Plaintext: tokenPlaintext}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:]).Scan(&token.Hash, &token.UserID, &token.Expiry, &token.Scope, &token.Role)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// Remove a single token, eg. an activation token once it has been used. Returns ErrRecordNotFound if it has already been removed.
+func (m *TokenModel) Delete(token *Token) error {
 	query := `
 		DELETE FROM tokens
-		WHERE user_id = $1
+		WHERE hash = $1
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	result, err := m.DB.ExecContext(ctx, query, userID)
+	result, err := m.DB.ExecContext(ctx, query, token.Hash)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m *TokenModel) DeleteAllForUser(scope string, userID int64) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, scope, userID)
 	r, _ := result.RowsAffected()
 	return r, err
 }
@@ -109,3 +231,187 @@ func (m *TokenModel) DeleteExpiredTokens() (int64, error) {
 	r, _ := result.RowsAffected()
 	return r, err
 }
+
+// Push back the expiry of the authentication token tokenPlaintext, so a signed in user's session carries on rather than being replaced by a new one
+func (m *TokenModel) Extend(tokenPlaintext string, ttl time.Duration) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		UPDATE tokens
+		SET expiry = $1
+		WHERE hash = $2 AND scope = 'authentication'
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, time.Now().Add(ttl).UTC().Format(time.RFC3339), tokenHash[:])
+	return err
+}
+
+// Record that the authentication token tokenPlaintext has been used from ip with userAgent. Only written if it hasn't been in the last sessionTouchInterval.
+func (m *TokenModel) Touch(tokenPlaintext, ip, userAgent string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		UPDATE tokens
+		SET last_used_at = strftime('%Y-%m-%dT%H:%M:%SZ', 'now'), ip = $1, user_agent = $2
+		WHERE hash = $3 AND scope = 'authentication'
+		AND (last_used_at < $4 OR ip != $1 OR user_agent != $2)
+	`
+
+	threshold := time.Now().Add(-sessionTouchInterval).UTC().Format(time.RFC3339)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, ip, truncateUserAgent(userAgent), tokenHash[:], threshold)
+	return err
+}
+
+const sessionColumns = `
+	tokens.rowid, tokens.user_id, users.username, tokens.created_at, tokens.last_used_at, tokens.expiry, tokens.ip, tokens.user_agent, tokens.hash = $1
+	FROM tokens
+	INNER JOIN users ON users.id = tokens.user_id
+	WHERE tokens.scope = 'authentication'
+	AND tokens.expiry > strftime('%Y-%m-%dT%H:%M:%SZ', 'now')`
+
+// Get the unexpired sessions of the user with userID, most recently used first. currentToken is the token the request was made with, so its session can be marked as the current one.
+func (m *TokenModel) GetSessionsForUser(userID int64, currentToken string) ([]Session, error) {
+	return m.getSessions(`AND tokens.user_id = $2`, currentToken, userID)
+}
+
+// Get the unexpired sessions of every user, most recently used first
+func (m *TokenModel) GetAllSessions(currentToken string) ([]Session, error) {
+	return m.getSessions(``, currentToken)
+}
+
+func (m *TokenModel) getSessions(where, currentToken string, args ...any) ([]Session, error) {
+	currentHash := sha256.Sum256([]byte(currentToken))
+
+	query := `SELECT ` + sessionColumns + `
+		` + where + `
+		ORDER BY tokens.last_used_at DESC, tokens.rowid DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, append([]any{currentHash[:]}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// Get the unexpired session with id
+func (m *TokenModel) GetSession(id int64) (*Session, error) {
+	query := `SELECT ` + sessionColumns + `
+		AND tokens.rowid = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	session, err := scanSession(m.DB.QueryRowContext(ctx, query, []byte{}, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return session, nil
+}
+
+func scanSession(row interface{ Scan(...any) error }) (*Session, error) {
+	var session Session
+	var createdAt, lastUsedAt, expiry string
+
+	err := row.Scan(&session.ID, &session.UserID, &session.Username, &createdAt, &lastUsedAt, &expiry, &session.IP, &session.UserAgent, &session.Current)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sessions from before these were recorded have empty values, and are left as the zero time
+	session.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	session.LastUsedAt, _ = time.Parse(time.RFC3339, lastUsedAt)
+	session.Expiry, _ = time.Parse(time.RFC3339, expiry)
+
+	return &session, nil
+}
+
+// Sign out the session with id. Returns ErrRecordNotFound if there isn't one.
+func (m *TokenModel) DeleteSession(id int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE rowid = $1 AND scope = 'authentication'
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Sign out the session for tokenPlaintext, eg. when its user logs out
+func (m *TokenModel) DeleteForToken(tokenPlaintext string) (int64, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = 'authentication'
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, tokenHash[:])
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Sign out every session of the user with userID apart from the one for keepToken, eg. after they change their password
+func (m *TokenModel) DeleteOtherSessions(userID int64, keepToken string) (int64, error) {
+	keepHash := sha256.Sum256([]byte(keepToken))
+
+	query := `
+		DELETE FROM tokens
+		WHERE scope = 'authentication' AND user_id = $1 AND hash != $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, keepHash[:])
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
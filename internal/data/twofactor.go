@@ -0,0 +1,191 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/totp"
+)
+
+// How many recovery codes a user is given when they turn on 2FA
+const recoveryCodeCount = 10
+
+// A user's TOTP secret and whether they have finished enrolling with it. The secret is set when they first visit the 2FA page, and only takes effect once they have confirmed a code from it.
+type TwoFactor struct {
+	UserID  int64
+	Secret  string
+	Enabled bool
+	// The step of the last code accepted, so the same code can't be used twice
+	LastStep          int64
+	RecoveryCodesLeft int
+}
+
+type TwoFactorModel struct {
+	DB *sql.DB
+}
+
+// Get the user's 2FA settings. Users who have never set up 2FA get a TwoFactor with no secret, which isn't enabled.
+func (m *TwoFactorModel) Get(userID int64) (*TwoFactor, error) {
+	query := `
+		SELECT secret, enabled, last_step,
+			(SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = $1 AND used_at IS NULL)
+		FROM user_two_factor
+		WHERE user_id = $1
+	`
+
+	tf := &TwoFactor{UserID: userID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&tf.Secret, &tf.Enabled, &tf.LastStep, &tf.RecoveryCodesLeft)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	return tf, nil
+}
+
+// Get the ids of every user with 2FA turned on
+func (m *TwoFactorModel) GetEnabledUserIDs() (map[int64]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT user_id FROM user_two_factor WHERE enabled = 1;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+
+	return ids, rows.Err()
+}
+
+// Store a new secret for a user who hasn't turned 2FA on yet
+func (m *TwoFactorModel) SetSecret(userID int64, secret string) error {
+	query := `
+		INSERT INTO user_two_factor (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, enabled = 0, last_step = 0
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, secret)
+	return err
+}
+
+// Turn 2FA on once the user has confirmed a code from their secret, which was from the given step, and return their recovery codes. Only hashes of the codes are stored, so this is the only time they can be shown.
+func (m *TwoFactorModel) Enable(userID, step int64) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE user_two_factor SET enabled = 1, last_step = $1 WHERE user_id = $2;`, step, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_recovery_codes WHERE user_id = $1;`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range codes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2);`, userID, hashRecoveryCode(code))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit()
+}
+
+// Verify checks code, either from the user's authenticator app or one of their recovery codes, and uses it up so it can't be used again. recovery is true if a recovery code was used.
+func (m *TwoFactorModel) Verify(tf *TwoFactor, code string, now time.Time) (recovery, ok bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if step, valid := totp.Validate(tf.Secret, code, now); valid {
+		// Only accept codes from later steps than the last one used, so a code seen over someone's shoulder can't be replayed
+		result, err := m.DB.ExecContext(ctx, `UPDATE user_two_factor SET last_step = $1 WHERE user_id = $2 AND last_step < $1;`, step, tf.UserID)
+		if err != nil {
+			return false, false, err
+		}
+		n, err := result.RowsAffected()
+		return false, n == 1, err
+	}
+
+	result, err := m.DB.ExecContext(ctx, `UPDATE user_recovery_codes SET used_at = datetime('now') WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL;`, tf.UserID, hashRecoveryCode(code))
+	if err != nil {
+		return false, false, err
+	}
+	n, err := result.RowsAffected()
+	return true, n == 1, err
+}
+
+// Turn off 2FA for a user, removing their secret and recovery codes, so they can sign in with just their password and set it up again
+func (m *TwoFactorModel) Reset(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_two_factor WHERE user_id = $1;`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_recovery_codes WHERE user_id = $1;`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Recovery codes look like "abcde-fghij", and are matched regardless of case or the dash
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+func hashRecoveryCode(code string) []byte {
+	normalised := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(normalised))
+	return hash[:]
+}
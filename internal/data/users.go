@@ -25,6 +25,7 @@ type User struct {
 	CreatedAt           string   `json:"created_at"`
 	LastAuthenticatedAt string   `json:"last_authenticated_at"`
 	Username            string   `json:"username"`
+	Role                string   `json:"role"`
 	Password            Password `json:"-"`
 }
 
@@ -70,12 +71,12 @@ func (m *UserModel) Insert(user *User) error {
 	}
 
 	query := `
-		INSERT INTO users (username, password_hash)
-		VALUES ($1, $2)
+		INSERT INTO users (username, password_hash, role)
+		VALUES ($1, $2, $3)
 		RETURNING id
 	`
 
-	args := []any{user.Username, user.Password.hash}
+	args := []any{user.Username, user.Password.hash, user.Role}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -95,7 +96,7 @@ func (m *UserModel) Insert(user *User) error {
 
 func (m *UserModel) GetAll() ([]*User, error) {
 	query := `
-		SELECT id, created_at, last_authenticated_at, username FROM users;
+		SELECT id, created_at, last_authenticated_at, username, role FROM users;
 	`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -119,6 +120,7 @@ func (m *UserModel) GetAll() ([]*User, error) {
 			&user.CreatedAt,
 			&user.LastAuthenticatedAt,
 			&user.Username,
+			&user.Role,
 		)
 		if err != nil {
 			return nil, err
@@ -136,7 +138,7 @@ func (m *UserModel) GetAll() ([]*User, error) {
 
 func (m *UserModel) GetByID(id int64) (*User, error) {
 	query := `
-		SELECT id, created_at, username, password_hash
+		SELECT id, created_at, username, role, password_hash
 		FROM users
 		WHERE id = $1
 	`
@@ -150,6 +152,7 @@ func (m *UserModel) GetByID(id int64) (*User, error) {
 		&user.ID,
 		&user.CreatedAt,
 		&user.Username,
+		&user.Role,
 		&user.Password.hash,
 	)
 
@@ -167,7 +170,7 @@ func (m *UserModel) GetByID(id int64) (*User, error) {
 
 func (m *UserModel) GetByUsername(username string) (*User, error) {
 	query := `
-		SELECT id, created_at, username, password_hash
+		SELECT id, created_at, username, role, password_hash
 		FROM users
 		WHERE username = $1
 	`
@@ -181,6 +184,7 @@ func (m *UserModel) GetByUsername(username string) (*User, error) {
 		&user.ID,
 		&user.CreatedAt,
 		&user.Username,
+		&user.Role,
 		&user.Password.hash,
 	)
 
@@ -202,11 +206,12 @@ func (m *UserModel) GetForToken(tokenPlaintext string) (*User, string, error) {
 
 	// INNER JOIN returns only the rows in the inner (overlapping) section of the Venn diagram created when users and tokens are joined on id. i.e., only rows with a matching id/user_id in both tables will exist in the join table.
 	query := `
-		SELECT users.id, users.created_at, users.username, users.password_hash, tokens.expiry
+		SELECT users.id, users.created_at, users.username, users.role, users.password_hash, tokens.expiry
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
 		WHERE tokens.hash = $1
+		AND tokens.scope = 'authentication'
 		AND tokens.expiry > datetime('now')`
 
 	// Use [:] to convert the tokenHash [32]byte to a []byte. This is to match with SQLite's blob type, which tokens are stored as.
@@ -222,6 +227,7 @@ func (m *UserModel) GetForToken(tokenPlaintext string) (*User, string, error) {
 		&user.ID,
 		&user.CreatedAt,
 		&user.Username,
+		&user.Role,
 		&user.Password.hash,
 		&tokenExpiry,
 	)
@@ -283,6 +289,30 @@ func (m *UserModel) Update(user User) error {
 	return nil
 }
 
+func (m *UserModel) UpdateRole(userID int64, role string) error {
+	query := `
+		UPDATE users SET role = $1 WHERE id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, role, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
 func (m *UserModel) Delete(userID int64) error {
 	query := `
 		DELETE FROM users WHERE id = $1
@@ -0,0 +1,195 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/url"
+	"time"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/validator"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+type Webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID           int       `json:"id"`
+	WebhookID    int       `json:"webhook_id"`
+	URL          string    `json:"url"`
+	Event        string    `json:"event"`
+	Payload      string    `json:"payload"`
+	Status       string    `json:"status"`
+	Attempts     int       `json:"attempts"`
+	ResponseCode int       `json:"response_code"`
+	Error        string    `json:"error,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+type WebhookModel struct {
+	DB *sql.DB
+}
+
+func ValidateWebhook(v *validator.Validator, w *Webhook) {
+	v.Check(w.URL != "", "url", "must be provided")
+
+	u, err := url.Parse(w.URL)
+	v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "url", "must be a valid http or https URL")
+}
+
+// NewWebhookSecret generates a random secret, used to sign the payloads sent to a webhook target so the receiver can verify they came from this listener
+func NewWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (m *WebhookModel) Insert(w *Webhook) error {
+	query := `
+		INSERT INTO webhooks (url, secret, enabled)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var createdAt string
+	err := m.DB.QueryRowContext(ctx, query, w.URL, w.Secret, w.Enabled).Scan(&w.ID, &createdAt)
+	if err != nil {
+		return err
+	}
+	w.CreatedAt, _ = time.Parse(time.DateTime, createdAt)
+
+	return nil
+}
+
+func (m *WebhookModel) GetAll() ([]Webhook, error) {
+	return m.query(`SELECT id, url, secret, enabled, created_at FROM webhooks ORDER BY id;`)
+}
+
+func (m *WebhookModel) GetEnabled() ([]Webhook, error) {
+	return m.query(`SELECT id, url, secret, enabled, created_at FROM webhooks WHERE enabled = 1 ORDER BY id;`)
+}
+
+func (m *WebhookModel) query(query string) ([]Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		var w Webhook
+		var createdAt string
+		if err := rows.Scan(&w.ID, &w.URL, &w.Secret, &w.Enabled, &createdAt); err != nil {
+			return nil, err
+		}
+		w.CreatedAt, _ = time.Parse(time.DateTime, createdAt)
+		webhooks = append(webhooks, w)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// Delete removes a webhook target - its past deliveries are kept so they can still be viewed
+func (m *WebhookModel) Delete(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1;`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m *WebhookModel) InsertDelivery(d *WebhookDelivery) error {
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, url, event, payload, status)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, d.WebhookID, d.URL, d.Event, d.Payload, d.Status).Scan(&d.ID)
+}
+
+// UpdateDelivery records the outcome of the latest attempt to deliver d
+func (m *WebhookModel) UpdateDelivery(d *WebhookDelivery) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = $2, response_code = $3, error = $4, updated_at = (datetime('now'))
+		WHERE id = $5
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, d.Status, d.Attempts, d.ResponseCode, d.Error, d.ID)
+	return err
+}
+
+// GetRecentDeliveries returns the most recent deliveries across all webhook targets, newest first
+func (m *WebhookModel) GetRecentDeliveries(limit int) ([]WebhookDelivery, error) {
+	query := `
+		SELECT id, webhook_id, url, event, payload, status, attempts, response_code, error, created_at, updated_at
+		FROM webhook_deliveries
+		ORDER BY id DESC
+		LIMIT $1;
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		var createdAt, updatedAt string
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.URL, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.ResponseCode, &d.Error, &createdAt, &updatedAt)
+		if err != nil {
+			return nil, err
+		}
+		d.CreatedAt, _ = time.Parse(time.DateTime, createdAt)
+		d.UpdatedAt, _ = time.Parse(time.DateTime, updatedAt)
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
@@ -6,19 +6,42 @@ import (
 )
 
 type WidgetData struct {
+	// SHA-256 fingerprint of the built-in CA's certificate, when the listener's certificate was made with it
+	CAFingerprint      string
+	CanOverrideConsent bool
+	CanUnlock          bool
+	// When the certificate being served expires, if that is soon enough to warn about
+	CertExpiry      time.Time
+	ConsentWithheld int
 	CountByType     map[string]int
 	DBSize          float64
 	Events          []ListenerEvent
+	ExportEnabled   bool
 	IP              string
 	JSONEnabled     bool
-	LastCheckTime   time.Time
-	LastInsertTime  time.Time
-	RecentErrorLogs []*Log
-	RecentLogs      []*Log
-	RecordsToday    int
-	TotalErrors     int
-	TotalLogs       int
-	TotalRecords    int
+	// When KAMAR last used the previous listener password, if it has since the password changed and the password still works
+	KAMARSecondaryUsed   time.Time
+	KAMARSecondaryExpiry time.Time
+	LastCheckTime        time.Time
+	LastExportError      string
+	LastExportTime       time.Time
+	LastInsertTime       time.Time
+	Lockouts             []Lockout
+	RecentErrorLogs      []*Log
+	RecentLogs           []*Log
+	RecordsToday         int
+	Sinks                []SinkStatus
+	TotalErrors          int
+	TotalLogs            int
+	TotalRecords         int
+}
+
+// A source IP or username that is temporarily locked out after too many failed sign in or KAMAR auth attempts
+type Lockout struct {
+	Kind        string
+	Value       string
+	Failures    int
+	LockedUntil time.Time
 }
 
 type WidgetModel struct {
@@ -53,6 +53,13 @@ func New(out io.Writer, minLevel Level, logModel *data.LogModel) *Logger {
 	}
 }
 
+// SetLogModel points the logger at a different log table, eg. after the database has been reopened
+func (l *Logger) SetLogModel(logModel *data.LogModel) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logModel = logModel
+}
+
 func (l *Logger) PrintInfo(message string, properties map[string]any) {
 	l.print(LevelInfo, message, properties)
 }
@@ -90,9 +97,13 @@ func (l *Logger) print(level Level, message string, properties map[string]any) (
 		aux.Trace = string(debug.Stack())
 	}
 
+	l.mu.Lock()
+	logModel := l.logModel
+	l.mu.Unlock()
+
 	// Write log to database in secondary thread, if logModel exists
-	if l.logModel != nil {
-		l.logModel.Insert(&aux)
+	if logModel != nil {
+		logModel.Insert(&aux)
 	}
 	// if l.logModel != nil {
 	// 	go func() {
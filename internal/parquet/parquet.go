@@ -0,0 +1,428 @@
+// Package parquet implements a minimal Apache Parquet file writer - just enough to write flat tables of optional INT64, DOUBLE and BYTE_ARRAY columns. Pages are PLAIN encoded and uncompressed, which every Parquet reader supports, so exports don't need any third party compression or Thrift libraries.
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+var magic = []byte("PAR1")
+
+// DefaultRowGroupSize is the number of rows buffered in memory before they are written out as a row group
+const DefaultRowGroupSize = 50_000
+
+type ColumnType int
+
+const (
+	String ColumnType = iota
+	Int64
+	Double
+	Bytes
+)
+
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+// Parquet physical types, encodings etc. as defined in parquet.thrift
+const (
+	typeInt64     = 2
+	typeDouble    = 5
+	typeByteArray = 6
+
+	repetitionOptional = 1
+
+	convertedUTF8 = 0
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	pageTypeData = 0
+
+	codecUncompressed = 0
+)
+
+func (t ColumnType) physicalType() int32 {
+	switch t {
+	case Int64:
+		return typeInt64
+	case Double:
+		return typeDouble
+	default:
+		return typeByteArray
+	}
+}
+
+type columnBuffer struct {
+	values    bytes.Buffer
+	defLevels []bool
+}
+
+type columnChunkMeta struct {
+	dataPageOffset int64
+	size           int64
+	numValues      int64
+}
+
+type rowGroupMeta struct {
+	columns  []columnChunkMeta
+	numRows  int64
+	byteSize int64
+}
+
+// Writer writes rows to a Parquet file. Rows are buffered in memory and written out in row groups of RowGroupSize rows - Close must be called to write the final row group and the file footer.
+type Writer struct {
+	RowGroupSize int
+
+	w         io.Writer
+	offset    int64
+	columns   []Column
+	buffers   []columnBuffer
+	bufRows   int
+	rowGroups []rowGroupMeta
+	numRows   int64
+	closed    bool
+}
+
+func NewWriter(w io.Writer, columns []Column) (*Writer, error) {
+	if len(columns) == 0 {
+		return nil, errors.New("parquet: at least one column is required")
+	}
+
+	pw := &Writer{
+		RowGroupSize: DefaultRowGroupSize,
+		w:            w,
+		columns:      columns,
+		buffers:      make([]columnBuffer, len(columns)),
+	}
+
+	if err := pw.write(magic); err != nil {
+		return nil, err
+	}
+
+	return pw, nil
+}
+
+func (pw *Writer) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.offset += int64(n)
+	return err
+}
+
+// Write appends a row. row must have one value per column - nil is written as NULL, and other values are converted to the column's type where possible.
+func (pw *Writer) Write(row []any) error {
+	if pw.closed {
+		return errors.New("parquet: write to closed writer")
+	}
+	if len(row) != len(pw.columns) {
+		return fmt.Errorf("parquet: row has %d values, expected %d", len(row), len(pw.columns))
+	}
+
+	for i, v := range row {
+		if err := pw.buffers[i].append(pw.columns[i].Type, v); err != nil {
+			return fmt.Errorf("parquet: column %s: %w", pw.columns[i].Name, err)
+		}
+	}
+
+	pw.bufRows++
+	if pw.bufRows >= pw.RowGroupSize {
+		return pw.flushRowGroup()
+	}
+
+	return nil
+}
+
+func (b *columnBuffer) append(t ColumnType, v any) error {
+	if v == nil {
+		b.defLevels = append(b.defLevels, false)
+		return nil
+	}
+
+	var scratch [8]byte
+
+	switch t {
+	case Int64:
+		i, ok, err := toInt64(v)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			b.defLevels = append(b.defLevels, false)
+			return nil
+		}
+		binary.LittleEndian.PutUint64(scratch[:], uint64(i))
+		b.values.Write(scratch[:])
+	case Double:
+		f, ok, err := toFloat64(v)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			b.defLevels = append(b.defLevels, false)
+			return nil
+		}
+		binary.LittleEndian.PutUint64(scratch[:], math.Float64bits(f))
+		b.values.Write(scratch[:])
+	default:
+		s := toBytes(v)
+		binary.LittleEndian.PutUint32(scratch[:4], uint32(len(s)))
+		b.values.Write(scratch[:4])
+		b.values.Write(s)
+	}
+
+	b.defLevels = append(b.defLevels, true)
+	return nil
+}
+
+// Empty strings are common in KAMAR data for missing numbers, so they are written as NULL rather than treated as an error
+func toInt64(v any) (int64, bool, error) {
+	switch val := v.(type) {
+	case int64:
+		return val, true, nil
+	case int:
+		return int64(val), true, nil
+	case float64:
+		return int64(val), true, nil
+	case bool:
+		if val {
+			return 1, true, nil
+		}
+		return 0, true, nil
+	case []byte:
+		return parseInt64(string(val))
+	case string:
+		return parseInt64(val)
+	}
+	return 0, false, fmt.Errorf("can't convert %T to int64", v)
+}
+
+func parseInt64(s string) (int64, bool, error) {
+	if s == "" {
+		return 0, false, nil
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("can't convert %q to int64", s)
+	}
+	return i, true, nil
+}
+
+func toFloat64(v any) (float64, bool, error) {
+	switch val := v.(type) {
+	case float64:
+		return val, true, nil
+	case int64:
+		return float64(val), true, nil
+	case int:
+		return float64(val), true, nil
+	case []byte:
+		return parseFloat64(string(val))
+	case string:
+		return parseFloat64(val)
+	}
+	return 0, false, fmt.Errorf("can't convert %T to double", v)
+}
+
+func parseFloat64(s string) (float64, bool, error) {
+	if s == "" {
+		return 0, false, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("can't convert %q to double", s)
+	}
+	return f, true, nil
+}
+
+func toBytes(v any) []byte {
+	switch val := v.(type) {
+	case []byte:
+		return val
+	case string:
+		return []byte(val)
+	case int64:
+		return strconv.AppendInt(nil, val, 10)
+	case float64:
+		return strconv.AppendFloat(nil, val, 'f', -1, 64)
+	case bool:
+		return strconv.AppendBool(nil, val)
+	case time.Time:
+		return []byte(val.Format(time.RFC3339))
+	}
+	return []byte(fmt.Sprint(v))
+}
+
+// Write every buffered column out as a single data page, forming one row group
+func (pw *Writer) flushRowGroup() error {
+	if pw.bufRows == 0 {
+		return nil
+	}
+
+	rg := rowGroupMeta{numRows: int64(pw.bufRows)}
+
+	for i := range pw.buffers {
+		buf := &pw.buffers[i]
+
+		levels := encodeDefinitionLevels(buf.defLevels)
+		pageSize := len(levels) + buf.values.Len()
+
+		header := newEncoder()
+		header.structBegin()
+		header.i32Field(1, pageTypeData)
+		header.i32Field(2, int32(pageSize))
+		header.i32Field(3, int32(pageSize))
+		header.fieldHeader(5, compactStruct)
+		header.structBegin()
+		header.i32Field(1, int32(len(buf.defLevels)))
+		header.i32Field(2, encodingPlain)
+		header.i32Field(3, encodingRLE)
+		header.i32Field(4, encodingRLE)
+		header.structEnd()
+		header.structEnd()
+
+		chunk := columnChunkMeta{
+			dataPageOffset: pw.offset,
+			size:           int64(header.buf.Len() + pageSize),
+			numValues:      int64(len(buf.defLevels)),
+		}
+
+		if err := pw.write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := pw.write(levels); err != nil {
+			return err
+		}
+		if err := pw.write(buf.values.Bytes()); err != nil {
+			return err
+		}
+
+		rg.columns = append(rg.columns, chunk)
+		rg.byteSize += chunk.size
+
+		buf.values.Reset()
+		buf.defLevels = buf.defLevels[:0]
+	}
+
+	pw.rowGroups = append(pw.rowGroups, rg)
+	pw.numRows += int64(pw.bufRows)
+	pw.bufRows = 0
+
+	return nil
+}
+
+// Encode definition levels (1 for a value, 0 for NULL) as a single bit-packed run of the RLE/bit-packing hybrid encoding, prefixed by its length as required for v1 data pages
+func encodeDefinitionLevels(levels []bool) []byte {
+	groups := (len(levels) + 7) / 8
+
+	var run bytes.Buffer
+	run.Write(binary.AppendUvarint(nil, uint64(groups)<<1|1))
+
+	packed := make([]byte, groups)
+	for i, defined := range levels {
+		if defined {
+			packed[i/8] |= 1 << (i % 8)
+		}
+	}
+	run.Write(packed)
+
+	out := make([]byte, 4, 4+run.Len())
+	binary.LittleEndian.PutUint32(out, uint32(run.Len()))
+	return append(out, run.Bytes()...)
+}
+
+// Close writes any buffered rows and the file footer. It does not close the underlying io.Writer.
+func (pw *Writer) Close() error {
+	if pw.closed {
+		return nil
+	}
+	pw.closed = true
+
+	if err := pw.flushRowGroup(); err != nil {
+		return err
+	}
+
+	footer := pw.fileMetaData()
+	if err := pw.write(footer); err != nil {
+		return err
+	}
+
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(footer)))
+	if err := pw.write(length[:]); err != nil {
+		return err
+	}
+
+	return pw.write(magic)
+}
+
+// Rows returns the number of rows written so far
+func (pw *Writer) Rows() int64 {
+	return pw.numRows + int64(pw.bufRows)
+}
+
+func (pw *Writer) fileMetaData() []byte {
+	e := newEncoder()
+	e.structBegin()
+
+	e.i32Field(1, 1)
+
+	// Schema: a root element followed by one leaf per column
+	e.listField(2, compactStruct, len(pw.columns)+1)
+	e.structBegin()
+	e.binaryField(4, []byte("schema"))
+	e.i32Field(5, int32(len(pw.columns)))
+	e.structEnd()
+	for _, col := range pw.columns {
+		e.structBegin()
+		e.i32Field(1, col.Type.physicalType())
+		e.i32Field(3, repetitionOptional)
+		e.binaryField(4, []byte(col.Name))
+		if col.Type == String {
+			e.i32Field(6, convertedUTF8)
+		}
+		e.structEnd()
+	}
+
+	e.i64Field(3, pw.numRows)
+
+	e.listField(4, compactStruct, len(pw.rowGroups))
+	for _, rg := range pw.rowGroups {
+		e.structBegin()
+		e.listField(1, compactStruct, len(rg.columns))
+		for i, chunk := range rg.columns {
+			col := pw.columns[i]
+			e.structBegin()
+			e.i64Field(2, chunk.dataPageOffset)
+			e.fieldHeader(3, compactStruct)
+			e.structBegin()
+			e.i32Field(1, col.Type.physicalType())
+			e.listField(2, compactI32, 2)
+			e.varint(encodingPlain)
+			e.varint(encodingRLE)
+			e.listField(3, compactBinary, 1)
+			e.binary([]byte(col.Name))
+			e.i32Field(4, codecUncompressed)
+			e.i64Field(5, chunk.numValues)
+			e.i64Field(6, chunk.size)
+			e.i64Field(7, chunk.size)
+			e.i64Field(9, chunk.dataPageOffset)
+			e.structEnd()
+			e.structEnd()
+		}
+		e.i64Field(2, rg.byteSize)
+		e.i64Field(3, rg.numRows)
+		e.structEnd()
+	}
+
+	e.binaryField(6, []byte("kamar-listener"))
+
+	e.structEnd()
+	return e.buf.Bytes()
+}
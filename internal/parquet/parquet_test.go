@@ -0,0 +1,267 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+)
+
+// decoder reads back the subset of the Thrift compact protocol written by encoder, turning each struct into a map of field id to value
+type decoder struct {
+	r *bytes.Reader
+}
+
+func (d *decoder) uvarint(t *testing.T) uint64 {
+	v, err := binary.ReadUvarint(d.r)
+	assert.NilError(t, err)
+	return v
+}
+
+func (d *decoder) varint(t *testing.T) int64 {
+	u := d.uvarint(t)
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+func (d *decoder) value(t *testing.T, fieldType byte) any {
+	switch fieldType {
+	case compactI32, compactI64:
+		return d.varint(t)
+	case compactBinary:
+		b := make([]byte, d.uvarint(t))
+		d.r.Read(b)
+		return string(b)
+	case compactList:
+		h, _ := d.r.ReadByte()
+		size := int(h >> 4)
+		if size == 15 {
+			size = int(d.uvarint(t))
+		}
+		list := make([]any, size)
+		for i := range list {
+			list[i] = d.value(t, h&0x0F)
+		}
+		return list
+	case compactStruct:
+		return d.readStruct(t)
+	}
+	t.Fatalf("unexpected field type %d", fieldType)
+	return nil
+}
+
+func (d *decoder) readStruct(t *testing.T) map[int16]any {
+	fields := map[int16]any{}
+	var last int16
+	for {
+		h, err := d.r.ReadByte()
+		assert.NilError(t, err)
+		if h == 0 {
+			return fields
+		}
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			id = int16(d.varint(t))
+		}
+		fields[id] = d.value(t, h&0x0F)
+		last = id
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+
+	pw, err := NewWriter(&buf, []Column{
+		{Name: "name", Type: String},
+		{Name: "yearlevel", Type: Int64},
+		{Name: "score", Type: Double},
+	})
+	assert.NilError(t, err)
+	// Force more than one row group
+	pw.RowGroupSize = 2
+
+	rows := [][]any{
+		{"Aroha", int64(9), 71.5},
+		{nil, "10", nil},
+		{[]byte("Mere"), "", "88"},
+	}
+	for _, row := range rows {
+		assert.NilError(t, pw.Write(row))
+	}
+	assert.NilError(t, pw.Close())
+
+	file := buf.Bytes()
+	assert.Equal(t, string(file[:4]), "PAR1")
+	assert.Equal(t, string(file[len(file)-4:]), "PAR1")
+
+	footerLen := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	footer := file[len(file)-8-footerLen : len(file)-8]
+	meta := (&decoder{r: bytes.NewReader(footer)}).readStruct(t)
+
+	assert.Equal(t, meta[3].(int64), int64(3))
+	assert.Equal(t, len(meta[2].([]any)), 4)
+
+	rowGroups := meta[4].([]any)
+	assert.Equal(t, len(rowGroups), 2)
+
+	// Read back the yearlevel column of the first row group: the definition levels should mark the second row as present, and both values should be decoded
+	chunk := rowGroups[0].(map[int16]any)[1].([]any)[1].(map[int16]any)
+	offset := chunk[2].(int64)
+	r := bytes.NewReader(file[offset:])
+	header := (&decoder{r: r}).readStruct(t)
+	assert.Equal(t, header[1].(int64), int64(pageTypeData))
+	assert.Equal(t, header[5].(map[int16]any)[1].(int64), int64(2))
+
+	page := make([]byte, header[3].(int64))
+	r.Read(page)
+	levelsLen := binary.LittleEndian.Uint32(page)
+	levels := page[4 : 4+levelsLen]
+	assert.Equal(t, levels[1], byte(0b11))
+	values := page[4+levelsLen:]
+	assert.Equal(t, int64(binary.LittleEndian.Uint64(values)), int64(9))
+	assert.Equal(t, int64(binary.LittleEndian.Uint64(values[8:])), int64(10))
+
+	// The score column of the second row group holds a single value parsed from a string
+	chunk = rowGroups[1].(map[int16]any)[1].([]any)[2].(map[int16]any)
+	r = bytes.NewReader(file[chunk[2].(int64):])
+	header = (&decoder{r: r}).readStruct(t)
+	page = make([]byte, header[3].(int64))
+	r.Read(page)
+	levelsLen = binary.LittleEndian.Uint32(page)
+	assert.Equal(t, math.Float64frombits(binary.LittleEndian.Uint64(page[4+levelsLen:])), 88.0)
+}
+
+func TestWriterRejectsBadValues(t *testing.T) {
+	pw, err := NewWriter(&bytes.Buffer{}, []Column{{Name: "id", Type: Int64}})
+	assert.NilError(t, err)
+
+	err = pw.Write([]any{"not a number"})
+	if err == nil {
+		t.Errorf("got: nil; expected an error converting a non-numeric string")
+	}
+}
+
+// The bytes a spec conforming writer produces for a single optional INT64 column "id" holding 1 and NULL, assembled by hand from parquet.thrift and the Thrift compact protocol spec rather than with encoder, so a mistake in encoder can't hide itself. In the compact protocol a field header is (id delta << 4 | type), where i32 = 5, i64 = 6, binary = 8, list = 9 and struct = 12, a list header is (size << 4 | element type), and integers are zigzag varints.
+func TestWriterMatchesSpec(t *testing.T) {
+	var buf bytes.Buffer
+
+	pw, err := NewWriter(&buf, []Column{{Name: "id", Type: Int64}})
+	assert.NilError(t, err)
+	assert.NilError(t, pw.Write([]any{int64(1)}))
+	assert.NilError(t, pw.Write([]any{nil}))
+	assert.NilError(t, pw.Close())
+
+	var want []byte
+	add := func(b ...byte) { want = append(want, b...) }
+
+	add('P', 'A', 'R', '1')
+
+	// PageHeader, at offset 4
+	add(0x15, 0x00) // 1: type = DATA_PAGE
+	add(0x15, 0x1c) // 2: uncompressed_page_size = 14
+	add(0x15, 0x1c) // 3: compressed_page_size = 14
+	add(0x2c)       // 5: data_page_header
+	add(0x15, 0x04) //   1: num_values = 2
+	add(0x15, 0x00) //   2: encoding = PLAIN
+	add(0x15, 0x06) //   3: definition_level_encoding = RLE
+	add(0x15, 0x06) //   4: repetition_level_encoding = RLE
+	add(0x00, 0x00)
+	// Definition levels: their length, then one bit-packed run of one group of 8 levels, holding 1 then 0
+	add(0x02, 0x00, 0x00, 0x00, 0x03, 0b01)
+	// The one non-NULL value, PLAIN encoded
+	add(0x01, 0, 0, 0, 0, 0, 0, 0)
+
+	// FileMetaData, after the 17 byte page header and 14 byte page
+	footerStart := len(want)
+	add(0x15, 0x02)                            // 1: version = 1
+	add(0x19, 0x2c)                            // 2: schema, a list of 2 SchemaElements
+	add(0x48, 6, 's', 'c', 'h', 'e', 'm', 'a') //   4: name = "schema"
+	add(0x15, 0x02)                            //   5: num_children = 1
+	add(0x00)
+	add(0x15, 0x04)        //   1: type = INT64
+	add(0x25, 0x02)        //   3: repetition_type = OPTIONAL
+	add(0x18, 2, 'i', 'd') //   4: name = "id"
+	add(0x00)
+	add(0x16, 0x04)              // 3: num_rows = 2
+	add(0x19, 0x1c)              // 4: row_groups, a list of 1 RowGroup
+	add(0x19, 0x1c)              //   1: columns, a list of 1 ColumnChunk
+	add(0x26, 0x08)              //     2: file_offset = 4
+	add(0x1c)                    //     3: meta_data
+	add(0x15, 0x04)              //       1: type = INT64
+	add(0x19, 0x25, 0x00, 0x06)  //       2: encodings = [PLAIN, RLE]
+	add(0x19, 0x18, 2, 'i', 'd') //       3: path_in_schema = ["id"]
+	add(0x15, 0x00)              //       4: codec = UNCOMPRESSED
+	add(0x16, 0x04)              //       5: num_values = 2
+	add(0x16, 0x3e)              //       6: total_uncompressed_size = 31
+	add(0x16, 0x3e)              //       7: total_compressed_size = 31
+	add(0x26, 0x08)              //       9: data_page_offset = 4
+	add(0x00, 0x00)
+	add(0x16, 0x3e) //   2: total_byte_size = 31
+	add(0x16, 0x04) //   3: num_rows = 2
+	add(0x00)
+	add(0x28, 14) // 6: created_by
+	add([]byte("kamar-listener")...)
+	add(0x00)
+
+	footerLen := len(want) - footerStart
+	add(byte(footerLen), 0, 0, 0)
+	add('P', 'A', 'R', '1')
+
+	assert.Equal(t, footerStart, 4+17+14)
+	assert.Equal(t, bytes.Equal(buf.Bytes(), want), true)
+	if t.Failed() {
+		t.Logf("got:  % x", buf.Bytes())
+		t.Logf("want: % x", want)
+	}
+}
+
+// Readers find pages through the offsets and sizes in the footer, so they must agree with where the writer actually put them
+func TestWriterLayout(t *testing.T) {
+	var buf bytes.Buffer
+
+	pw, err := NewWriter(&buf, []Column{
+		{Name: "name", Type: String},
+		{Name: "yearlevel", Type: Int64},
+	})
+	assert.NilError(t, err)
+	pw.RowGroupSize = 3
+	for i := range 7 {
+		assert.NilError(t, pw.Write([]any{"Aroha", int64(i)}))
+	}
+	assert.NilError(t, pw.Close())
+
+	file := buf.Bytes()
+	footerLen := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	footerStart := len(file) - 8 - footerLen
+	meta := (&decoder{r: bytes.NewReader(file[footerStart : len(file)-8])}).readStruct(t)
+
+	// Column chunks follow one another from just after the leading magic number to the footer
+	offset := int64(len(magic))
+	var rows int64
+	for _, rg := range meta[4].([]any) {
+		rowGroup := rg.(map[int16]any)
+		var byteSize int64
+		for _, c := range rowGroup[1].([]any) {
+			chunk := c.(map[int16]any)[3].(map[int16]any)
+			assert.Equal(t, chunk[9].(int64), offset)
+			assert.Equal(t, chunk[5].(int64), rowGroup[3].(int64))
+
+			r := bytes.NewReader(file[offset:])
+			header := (&decoder{r: r}).readStruct(t)
+			headerLen := int64(len(file[offset:]) - r.Len())
+			assert.Equal(t, header[3].(int64), header[2].(int64))
+			assert.Equal(t, header[5].(map[int16]any)[1].(int64), chunk[5].(int64))
+			assert.Equal(t, chunk[7].(int64), headerLen+header[3].(int64))
+			assert.Equal(t, chunk[6].(int64), chunk[7].(int64))
+
+			offset += chunk[7].(int64)
+			byteSize += chunk[7].(int64)
+		}
+		assert.Equal(t, rowGroup[2].(int64), byteSize)
+		rows += rowGroup[3].(int64)
+	}
+	assert.Equal(t, offset, int64(footerStart))
+	assert.Equal(t, rows, meta[3].(int64))
+	assert.Equal(t, rows, int64(7))
+}
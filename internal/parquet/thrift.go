@@ -0,0 +1,83 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Parquet's page headers and file footer are Thrift structs serialised with the compact protocol. Only the parts of the protocol needed to write them are implemented here.
+// https://github.com/apache/thrift/blob/master/doc/specs/thrift-compact-protocol.md
+const (
+	compactI32    = 5
+	compactI64    = 6
+	compactBinary = 8
+	compactList   = 9
+	compactStruct = 12
+)
+
+type encoder struct {
+	buf bytes.Buffer
+	// Field ids are written as a delta from the previous field in the same struct, so the last id written is tracked for each level of nesting
+	lastField []int16
+}
+
+func newEncoder() *encoder {
+	return &encoder{}
+}
+
+func (e *encoder) structBegin() {
+	e.lastField = append(e.lastField, 0)
+}
+
+func (e *encoder) structEnd() {
+	e.buf.WriteByte(0)
+	e.lastField = e.lastField[:len(e.lastField)-1]
+}
+
+func (e *encoder) fieldHeader(id int16, fieldType byte) {
+	last := &e.lastField[len(e.lastField)-1]
+	delta := id - *last
+	if delta > 0 && delta <= 15 {
+		e.buf.WriteByte(byte(delta)<<4 | fieldType)
+	} else {
+		e.buf.WriteByte(fieldType)
+		e.varint(int64(id))
+	}
+	*last = id
+}
+
+// Integers are zigzag encoded so that small negative numbers stay small
+func (e *encoder) varint(v int64) {
+	e.buf.Write(binary.AppendUvarint(nil, uint64((v<<1)^(v>>63))))
+}
+
+func (e *encoder) binary(b []byte) {
+	e.buf.Write(binary.AppendUvarint(nil, uint64(len(b))))
+	e.buf.Write(b)
+}
+
+func (e *encoder) i32Field(id int16, v int32) {
+	e.fieldHeader(id, compactI32)
+	e.varint(int64(v))
+}
+
+func (e *encoder) i64Field(id int16, v int64) {
+	e.fieldHeader(id, compactI64)
+	e.varint(v)
+}
+
+func (e *encoder) binaryField(id int16, b []byte) {
+	e.fieldHeader(id, compactBinary)
+	e.binary(b)
+}
+
+// Write a list field header - the caller must then write size elements of elemType
+func (e *encoder) listField(id int16, elemType byte, size int) {
+	e.fieldHeader(id, compactList)
+	if size < 15 {
+		e.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		e.buf.WriteByte(0xF0 | elemType)
+		e.buf.Write(binary.AppendUvarint(nil, uint64(size)))
+	}
+}
@@ -0,0 +1,226 @@
+package tlscerts
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/jsonlog"
+)
+
+// Files in the TLS directory holding the built-in certificate authority, which is used when mkcert can't be
+const (
+	CAFile    = "ca.pem"
+	caKeyFile = "ca-key.pem"
+)
+
+const (
+	caValidFor = 10 * 365 * 24 * time.Hour
+	// Apple devices refuse certificates from private CAs that are valid for longer than 825 days
+	leafValidFor = 825 * 24 * time.Hour
+)
+
+// GenerateSelfSignedCert creates a certificate for localhost and ip in the TLS directory, signed by the listener's own certificate authority, without needing mkcert or a network connection. The CA is created the first time, and reused after that so it only needs to be trusted once. Nothing is done if a certificate already exists.
+func GenerateSelfSignedCert(tlsDirPath, ip string, logger *jsonlog.Logger) error {
+	if err := os.MkdirAll(tlsDirPath, 0755); err != nil {
+		return fmt.Errorf("failed to create TLS directory: %w", err)
+	}
+
+	certPath := filepath.Join(tlsDirPath, "cert.pem")
+	keyPath := filepath.Join(tlsDirPath, "key.pem")
+
+	if _, err := os.Stat(certPath); err == nil {
+		logger.PrintInfo("TLS certificate already exists, skipping generation.", nil)
+		return nil
+	}
+
+	ca, caKey, err := loadOrCreateCA(tlsDirPath, logger)
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"KAMAR Listener"},
+			CommonName:   "localhost",
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(leafValidFor),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if parsed := net.ParseIP(ip); parsed != nil && !parsed.IsLoopback() {
+		template.IPAddresses = append(template.IPAddresses, parsed)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	// The CA follows the leaf, so clients that haven't been given the CA can still see what signed it
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+
+	if err := writeKey(keyPath, key); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certPath, chain, 0644); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+
+	logger.PrintInfo("TLS certificate generated with built-in certificate authority: key.pem & cert.pem", map[string]any{
+		"ip": ip,
+	})
+	return nil
+}
+
+// CAFingerprint returns the SHA-256 fingerprint of the built-in CA's certificate, formatted the way Windows and browsers show it, so IT can check the CA they are trusting is the listener's. ok is false if the built-in CA hasn't been created.
+func CAFingerprint(tlsDirPath string) (fingerprint string, ok bool, err error) {
+	ca, err := readCert(filepath.Join(tlsDirPath, CAFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+
+	sum := sha256.Sum256(ca.Raw)
+	hexes := make([]string, len(sum))
+	for i, b := range sum {
+		hexes[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hexes, ":"), true, nil
+}
+
+func loadOrCreateCA(tlsDirPath string, logger *jsonlog.Logger) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	caPath := filepath.Join(tlsDirPath, CAFile)
+	caKeyPath := filepath.Join(tlsDirPath, caKeyFile)
+
+	ca, err := readCert(caPath)
+	if err == nil {
+		key, err := readKey(caKeyPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read certificate authority key: %w", err)
+		}
+		return ca, key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("failed to read certificate authority: %w", err)
+	}
+
+	logger.PrintInfo("creating built-in certificate authority...", nil)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	host, _ := os.Hostname()
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"KAMAR Listener"},
+			// Includes the host, so CAs from listeners on different machines can be told apart in the trust store
+			CommonName: strings.TrimSpace("KAMAR Listener CA " + host),
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidFor),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		// The CA can only sign the listener's own certificates, not other CAs
+		MaxPathLenZero: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate authority: %w", err)
+	}
+
+	ca, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := writeKey(caKeyPath, key); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return nil, nil, fmt.Errorf("failed to write certificate authority: %w", err)
+	}
+
+	return ca, key, nil
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func readCert(path string) (*x509.Certificate, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s doesn't hold a PEM certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func readKey(path string) (*ecdsa.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s doesn't hold a PEM key", path)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// Keys are only readable by the user running the listener
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return fmt.Errorf("failed to write key: %w", err)
+	}
+	return nil
+}
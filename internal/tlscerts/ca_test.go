@@ -0,0 +1,58 @@
+package tlscerts
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+	"github.com/michaelcjefferson/kamar-listener/internal/jsonlog"
+)
+
+func TestGenerateSelfSignedCert(t *testing.T) {
+	dir := t.TempDir()
+	logger := jsonlog.New(io.Discard, jsonlog.LevelInfo, nil)
+
+	_, ok, err := CAFingerprint(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, ok, false)
+
+	assert.NilError(t, GenerateSelfSignedCert(dir, "10.0.0.5", logger))
+
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	assert.NilError(t, err)
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	assert.NilError(t, err)
+
+	ca, err := readCert(filepath.Join(dir, CAFile))
+	assert.NilError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	// The certificate is trusted for localhost and the machine's IP by anything that trusts the CA
+	for _, name := range []string{"localhost", "127.0.0.1", "10.0.0.5"} {
+		_, err = leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots})
+		assert.NilError(t, err)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: "10.0.0.6", Roots: roots})
+	assert.Equal(t, err != nil, true)
+
+	info, err := os.Stat(filepath.Join(dir, caKeyFile))
+	assert.NilError(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0600))
+
+	fingerprint, ok, err := CAFingerprint(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, len(fingerprint), 32*3-1)
+
+	// A new certificate, eg. for a new IP, is signed by the same CA, so it doesn't need to be trusted again
+	assert.NilError(t, os.Remove(filepath.Join(dir, "cert.pem")))
+	assert.NilError(t, GenerateSelfSignedCert(dir, "10.0.0.6", logger))
+	again, _, err := CAFingerprint(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, again, fingerprint)
+}
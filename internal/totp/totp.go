@@ -0,0 +1,90 @@
+// Package totp implements time-based one-time passwords (RFC 6238), as used by authenticator apps such as Google Authenticator and Microsoft Authenticator.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Authenticator apps assume these, so they are left out of the otpauth URI
+	period = 30 * time.Second
+	digits = 6
+	// Codes from one step either side of now are accepted, to allow for clock drift between the server and the user's phone
+	skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Generate a new random secret, base32 encoded as authenticator apps expect
+func NewSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// Step returns the number of periods since the Unix epoch at t
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(period/time.Second)
+}
+
+// Code returns the code for secret at the given step
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.ReplaceAll(secret, " ", "")))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", digits, value%1_000_000), nil
+}
+
+// Validate checks code against secret at t, returning the step it matched so the caller can refuse it if it has been used before. ok is false if the code doesn't match.
+func Validate(secret, code string, t time.Time) (step int64, ok bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != digits {
+		return 0, false
+	}
+
+	now := Step(t)
+	for s := now - skew; s <= now+skew; s++ {
+		expected, err := Code(secret, s)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+
+	return 0, false
+}
+
+// URI returns the otpauth:// URI authenticator apps use to add an account, either by scanning it as a QR code or by opening it directly
+func URI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+
+	return fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(issuer), url.PathEscape(account), v.Encode())
+}
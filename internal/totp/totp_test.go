@@ -0,0 +1,51 @@
+package totp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/michaelcjefferson/kamar-listener/internal/assert"
+)
+
+// The SHA-1 test vectors from RFC 6238 appendix B, truncated to 6 digits
+func TestCode(t *testing.T) {
+	secret := encoding.EncodeToString([]byte("12345678901234567890"))
+
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		code, err := Code(secret, Step(time.Unix(tt.unix, 0)))
+		assert.NilError(t, err)
+		assert.Equal(t, code, tt.want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := NewSecret()
+	assert.NilError(t, err)
+
+	now := time.Unix(1700000000, 0)
+	code, err := Code(secret, Step(now))
+	assert.NilError(t, err)
+
+	step, ok := Validate(secret, code, now)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, step, Step(now))
+
+	// A code from the previous period is still accepted, but not one from two periods ago
+	_, ok = Validate(secret, code, now.Add(period))
+	assert.Equal(t, ok, true)
+	_, ok = Validate(secret, code, now.Add(2*period))
+	assert.Equal(t, ok, false)
+
+	_, ok = Validate(secret, "12345", now)
+	assert.Equal(t, ok, false)
+}